@@ -0,0 +1,82 @@
+package api
+
+import (
+	"cisco.com/comm/audit"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Records every call that may change something, that is anything but GET and
+// HEAD, in the audit log once it's been answered
+func audited(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		res := &auditedWriter{ResponseWriter: w}
+
+		h.ServeHTTP(res, r)
+
+		if res.status == 0 {
+			res.status = http.StatusOK
+		}
+
+		audit.Record(audit.Entry{
+			Type:     audit.API,
+			Client:   r.RemoteAddr,
+			Method:   r.Method,
+			Host:     r.Host,
+			Path:     r.URL.RequestURI(),
+			Status:   res.status,
+			BytesIn:  body.n,
+			BytesOut: res.n,
+			Duration: float64(time.Since(start)) / float64(time.Millisecond),
+		})
+	})
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+type auditedWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *auditedWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditedWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Broadcasts stream their results
+func (w *auditedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
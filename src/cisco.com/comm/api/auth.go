@@ -0,0 +1,44 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Lets requests through only with "Authorization: Bearer token", if token is
+// set. The health checks are always let through, so probes need no token, and
+// /debug/ needs debugToken instead; without one it's refused.
+func guarded(token, debugToken string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/healthz" || r.URL.Path == "/readyz":
+		case strings.HasPrefix(r.URL.Path, "/debug/"):
+			if debugToken == "" {
+				w.WriteHeader(http.StatusNotFound)
+				jsonResponse(w, ErrorResponse{Error: "ERR_DEBUG_DISABLED", Message: "Set api.debug_token to turn on /debug/"})
+				return
+			}
+			if !authorized(r, debugToken) {
+				unauthorized(w)
+				return
+			}
+		case token != "" && !authorized(r, token):
+			unauthorized(w)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func authorized(r *http.Request, token string) bool {
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.WriteHeader(http.StatusUnauthorized)
+	jsonResponse(w, ErrorResponse{Error: "ERR_UNAUTHORIZED"})
+}
@@ -0,0 +1,189 @@
+package api
+
+import (
+	"bytes"
+	"cisco.com/comm/common"
+	"cisco.com/comm/log"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Responses to a broadcast are passed back up to this many bytes
+const broadcastMaxResponse = 64 << 10
+
+// How a broadcast went for one connection. One of these is streamed back per
+// matching connection as soon as it's known.
+type BroadcastResult struct {
+	Connection int    `json:"connection"`
+	Peer       string `json:"peer,omitempty"`
+
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+
+	// The response (base64 in JSON), cut short if it's bigger than
+	// broadcastMaxResponse
+	Response     []byte `json:"response,omitempty"`
+	ResponseSize int64  `json:"response_size"`
+	Truncated    bool   `json:"truncated,omitempty"`
+
+	Duration string `json:"duration"`
+}
+
+// Sent last, once every connection answered or gave up
+type BroadcastSummary struct {
+	Selector  string `json:"selector"`
+	Matched   int    `json:"matched"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+	Duration  string `json:"duration"`
+}
+
+//
+// POST	/broadcast?selector=site=paris,version!=2	Send the body to every connection
+//							whose labels match the selector (all of them if it's empty)
+//							and stream back one JSON line per connection as it responds,
+//							then {"summary": {...}}. ?timeout= applies to each connection.
+//
+func (c *Controller) Broadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+		return
+	}
+
+	selector, err := common.ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		jsonResponse(w, ErrorResponse{
+			Error:   err.Error(),
+			Message: "selector must be a comma separated list of key=value, key!=value, key or !key"})
+		return
+	}
+
+	timeout, err := c.requestTimeout(r)
+	if err != nil {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		jsonResponse(w, ErrorResponse{
+			Error:   "ERR_BAD_TIMEOUT",
+			Message: "timeout must be a duration such as 30s"})
+		return
+	}
+
+	sz, err := strconv.ParseInt(r.Header.Get("content-length"), 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		jsonResponse(w, ErrorResponse{
+			Error:   err.Error(),
+			Message: "Failed to parse content-length header. Please make sure it's set."})
+		return
+	}
+
+	// Every connection gets its own copy of the body
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, sz))
+	if err == nil && int64(len(body)) < sz {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		jsonResponse(w, ErrorResponse{Error: err.Error(), Message: "Failed to read the request body"})
+		return
+	}
+
+	var targets []common.Connection
+	for _, conn := range c.Server.GetConnections() {
+		if selector.Matches(conn.Labels()) {
+			targets = append(targets, conn)
+		}
+	}
+
+	log.I("Broadcasting %d bytes to %d connections matching %q", sz, len(targets), r.URL.Query().Get("selector"))
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	start := time.Now()
+	results := make(chan BroadcastResult, len(targets))
+	for _, conn := range targets {
+		go func(conn common.Connection) {
+			begin := time.Now()
+			res := broadcastTo(ctx, conn, body, timeout)
+			res.Duration = time.Since(begin).String()
+			results <- res
+		}(conn)
+	}
+
+	w.Header().Set("content-type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+
+	summary := BroadcastSummary{Selector: r.URL.Query().Get("selector"), Matched: len(targets)}
+	for range targets {
+		res := <-results
+		if res.OK {
+			summary.Succeeded++
+		} else {
+			summary.Failed++
+		}
+
+		enc.Encode(res)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	summary.Duration = time.Since(start).String()
+	enc.Encode(struct {
+		Summary BroadcastSummary `json:"summary"`
+	}{summary})
+}
+
+func broadcastTo(ctx context.Context, conn common.Connection, body []byte, timeout time.Duration) BroadcastResult {
+	res := BroadcastResult{Connection: conn.Id, Peer: conn.Peer}
+
+	if err := conn.CheckOutbound(int64(len(body))); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	in := make(chan common.IngressMessage, 1)
+	err := conn.Send(common.EgressMessage{
+		N:            int64(len(body)),
+		R:            bytes.NewReader(body),
+		Binary:       true,
+		ResponseChan: in,
+		Ctx:          ctx})
+
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	msg := <-in
+	if err := responseError(msg); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	var buf bytes.Buffer
+	io.CopyN(&buf, msg.R, broadcastMaxResponse)
+	rest, _ := io.Copy(ioutil.Discard, msg.R)
+
+	res.OK = true
+	res.Response = buf.Bytes()
+	res.ResponseSize = int64(buf.Len()) + rest
+	res.Truncated = rest > 0
+	return res
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"testing"
+)
+
+// The results of a broadcast by connection, and its summary
+func broadcast(t *testing.T, c *Controller, query, body string) (map[int]BroadcastResult, BroadcastSummary) {
+	t.Helper()
+	w := call(c.Broadcast, "POST", "/broadcast?"+query, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: got %d %s", query, w.Code, w.Body)
+	}
+
+	results := make(map[int]BroadcastResult)
+	var summary BroadcastSummary
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		var line struct {
+			BroadcastResult
+			Summary *BroadcastSummary `json:"summary"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("%s: bad line %q: %v", query, sc.Text(), err)
+		}
+
+		if line.Summary != nil {
+			summary = *line.Summary
+			continue
+		}
+		if _, dup := results[line.Connection]; dup {
+			t.Errorf("%s: connection %d reported twice", query, line.Connection)
+		}
+		results[line.Connection] = line.BroadcastResult
+	}
+	return results, summary
+}
+
+func TestBroadcastSelector(t *testing.T) {
+	server := newTestServer(t, "paris-1", "paris-2", "berlin", "silent")
+	labels := []map[string]string{
+		{"site": "paris", "tier": "gold"},
+		{"site": "paris"},
+		{"site": "berlin", "tier": "gold"},
+		{"site": "paris", "tier": "silver"},
+	}
+	for i, conn := range server.GetConnections() {
+		conn.SetLabels(labels[i])
+	}
+	c := &Controller{Server: server}
+
+	tests := []struct {
+		selector string
+		want     []int
+	}{
+		{"", []int{1, 2, 3, 4}},
+		{"site=paris,tier", []int{1, 4}},
+		{"site!=paris", []int{3}},
+		{"!tier", []int{2}},
+		{"site=paris,tier!=silver", []int{1, 2}},
+		{"site=rome", nil},
+	}
+
+	for _, test := range tests {
+		results, summary := broadcast(t, c, "timeout=20ms&selector="+url.QueryEscape(test.selector), "ping")
+
+		var got []int
+		for id := range results {
+			got = append(got, id)
+		}
+		sort.Ints(got)
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%q: reached %v, want %v", test.selector, got, test.want)
+		}
+
+		failed := 0
+		for id, res := range results {
+			peer := server.GetConnection(id).Peer
+			switch {
+			case peer == "silent":
+				failed++
+				if res.OK || res.Error != "ERR_TIMEOUT" {
+					t.Errorf("%q: got %+v from a peer that never answers", test.selector, res)
+				}
+			case !res.OK || string(res.Response) != peer+":ping" || res.Peer != peer:
+				t.Errorf("%q: got %+v from %s", test.selector, res, peer)
+			}
+		}
+
+		want := BroadcastSummary{Selector: test.selector, Matched: len(test.want), Succeeded: len(test.want) - failed, Failed: failed}
+		summary.Duration = ""
+		if summary != want {
+			t.Errorf("%q: got summary %+v, want %+v", test.selector, summary, want)
+		}
+	}
+
+	for _, selector := range []string{"=paris", "!", "bad key=x"} {
+		if w := call(c.Broadcast, "POST", "/broadcast?selector="+url.QueryEscape(selector), "ping"); w.Code != http.StatusPreconditionFailed {
+			t.Errorf("%q: got %d, want %d", selector, w.Code, http.StatusPreconditionFailed)
+		}
+	}
+}
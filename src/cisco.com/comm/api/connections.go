@@ -0,0 +1,100 @@
+package api
+
+import (
+	"cisco.com/comm/common"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrBadQuery = errors.New("ERR_BAD_QUERY")
+
+// Orders connections by one of their fields
+var connectionOrders = map[string]func(a, b common.Connection) bool{
+	"id":   func(a, b common.Connection) bool { return a.Id < b.Id },
+	"peer": func(a, b common.Connection) bool { return a.Peer < b.Peer },
+	"connected": func(a, b common.Connection) bool {
+		return a.Stats().Connected.Before(b.Stats().Connected)
+	},
+	"last_activity": func(a, b common.Connection) bool {
+		return a.Stats().LastActivity.Before(b.Stats().LastActivity)
+	},
+	"messages_in":  func(a, b common.Connection) bool { return a.Stats().MessagesIn < b.Stats().MessagesIn },
+	"messages_out": func(a, b common.Connection) bool { return a.Stats().MessagesOut < b.Stats().MessagesOut },
+	"bytes_in":     func(a, b common.Connection) bool { return a.Stats().BytesIn < b.Stats().BytesIn },
+	"bytes_out":    func(a, b common.Connection) bool { return a.Stats().BytesOut < b.Stats().BytesOut },
+}
+
+// Apply the filters, order and limit of a GET /connections query
+func queryConnections(q url.Values, conns []common.Connection) ([]common.Connection, error) {
+	selector, err := common.ParseSelector(q.Get("selector"))
+	if err != nil {
+		return nil, err
+	}
+
+	var idle time.Duration
+	if s := q.Get("idle"); s != "" {
+		if idle, err = time.ParseDuration(s); err != nil {
+			return nil, ErrBadQuery
+		}
+	}
+
+	match := func(field, value string) bool {
+		want, ok := q[field]
+		return !ok || want[0] == value
+	}
+
+	res := []common.Connection{}
+	for _, c := range conns {
+		ok := selector.Matches(c.Labels()) &&
+			match("peer", c.Peer) &&
+			match("hostname", c.Info.Hostname) &&
+			match("version", c.Info.Version) &&
+			time.Since(c.Stats().LastActivity) >= idle
+
+		if capability := q.Get("capability"); capability != "" {
+			has := false
+			for _, have := range c.Info.Capabilities {
+				has = has || have == capability
+			}
+			ok = ok && has
+		}
+
+		if ok {
+			res = append(res, c)
+		}
+	}
+
+	order := q.Get("sort")
+	if order == "" {
+		order = "id"
+	}
+
+	desc := strings.HasPrefix(order, "-")
+	less, ok := connectionOrders[strings.TrimPrefix(order, "-")]
+	if !ok {
+		return nil, ErrBadQuery
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if desc {
+			return less(res[j], res[i])
+		}
+		return less(res[i], res[j])
+	})
+
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, ErrBadQuery
+		}
+		if n < len(res) {
+			res = res[:n]
+		}
+	}
+
+	return res, nil
+}
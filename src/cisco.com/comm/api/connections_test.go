@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// The ids GET /connections?query returns, in order
+func listConnections(t *testing.T, c *Controller, query string) []int {
+	t.Helper()
+	w := call(c.Connections, "GET", "/connections?"+query, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: got %d %s", query, w.Code, w.Body)
+	}
+
+	var res struct {
+		Connections []struct {
+			Id int `json:"id"`
+		} `json:"connections"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%s: bad response %q: %v", query, w.Body, err)
+	}
+
+	ids := []int{}
+	for _, conn := range res.Connections {
+		ids = append(ids, conn.Id)
+	}
+	return ids
+}
+
+func TestConnectionsQuery(t *testing.T) {
+	server := newTestServer(t, "alpha", "beta", "gamma", "alpha")
+	infos := []struct {
+		hostname, version string
+		capabilities      []string
+		labels            map[string]string
+		messagesIn        int
+	}{
+		{"a.example", "1.2", []string{"checksums", "transfers"}, map[string]string{"site": "paris"}, 1},
+		{"b.example", "1.3", []string{"checksums"}, map[string]string{"site": "berlin"}, 3},
+		{"c.example", "1.3", nil, map[string]string{"site": "paris", "tier": "gold"}, 2},
+		{"a.example", "1.2", []string{"compression:gzip"}, nil, 0},
+	}
+	for i := range server.conns {
+		conn := &server.conns[i]
+		conn.Info.Hostname = infos[i].hostname
+		conn.Info.Version = infos[i].version
+		conn.Info.Capabilities = infos[i].capabilities
+		conn.SetLabels(infos[i].labels)
+		for n := 0; n < infos[i].messagesIn; n++ {
+			conn.CountIn(10)
+		}
+	}
+	c := &Controller{Server: server}
+
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"", []int{1, 2, 3, 4}},
+		{"peer=alpha", []int{1, 4}},
+		{"peer=delta", []int{}},
+		{"hostname=a.example", []int{1, 4}},
+		{"version=1.3", []int{2, 3}},
+		{"capability=checksums", []int{1, 2}},
+		{"capability=compression:gzip", []int{4}},
+		{"selector=" + url.QueryEscape("site=paris"), []int{1, 3}},
+		{"selector=" + url.QueryEscape("!site"), []int{4}},
+		{"peer=alpha&version=1.2&capability=transfers", []int{1}},
+		{"idle=1h", []int{}},
+		{"sort=peer", []int{1, 4, 2, 3}},
+		{"sort=-peer", []int{3, 2, 1, 4}},
+		{"sort=messages_in", []int{4, 1, 3, 2}},
+		{"sort=-messages_in", []int{2, 3, 1, 4}},
+		{"sort=-id", []int{4, 3, 2, 1}},
+		{"sort=-messages_in&limit=2", []int{2, 3}},
+		{"limit=0", []int{}},
+		{"limit=10", []int{1, 2, 3, 4}},
+		{"site=paris", []int{1, 2, 3, 4}},
+	}
+	for _, test := range tests {
+		if got := listConnections(t, c, test.query); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: got %v, want %v", test.query, got, test.want)
+		}
+	}
+
+	// Only traffic counts as activity, not heartbeats
+	time.Sleep(100 * time.Millisecond)
+	server.conns[1].Heard()
+	server.conns[2].CountOut(10)
+	if got := listConnections(t, c, "idle=50ms"); fmt.Sprint(got) != "[1 2 4]" {
+		t.Errorf("idle=50ms: got %v, want [1 2 4]", got)
+	}
+
+	for _, query := range []string{"idle=soon", "idle=-", "sort=size", "sort=--id", "limit=-1", "limit=all", "selector=" + url.QueryEscape("=paris")} {
+		if w := call(c.Connections, "GET", "/connections?"+query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d %s, want 400", query, w.Code, w.Body)
+		}
+	}
+
+	if w := call(c.Connections, "POST", "/connections", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: got %d, want 405", w.Code)
+	}
+}
@@ -3,13 +3,18 @@ package api
 import (
 	"cisco.com/comm/common"
 	"cisco.com/comm/log"
+	"cisco.com/comm/metrics"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type ConnectionsIndexResponse struct {
@@ -22,7 +27,37 @@ type ErrorResponse struct {
 }
 
 type Controller struct {
-	Server SocketServer
+	Server    SocketServer
+	Reload    Reloader
+	Transfers Transfers
+	Queue     Queue
+	Limiter   RateLimiter
+	Router    Router
+
+	// Messages sent with POST /transceiver/{id}
+	Messages *MessageStore
+
+	// Default for how long Transmit waits for the remote end to respond
+	RequestTimeout time.Duration
+
+	// For /readyz and /debug/state, nil if there's nothing to tell
+	Ready Readiness
+	State StateDump
+
+	// For /debug/connections/{id}/frames, nil if unsupported
+	Frames FrameTap
+}
+
+// Re-reads the configuration and applies whatever can be changed at runtime.
+type Reloader func() (*ReloadResult, error)
+
+type ReloadResult struct {
+
+	// Connections dropped because their credentials were revoked
+	Revoked []int `json:"revoked"`
+
+	// Settings that changed but only take effect after a restart
+	RestartRequired []string `json:"restart_required,omitempty"`
 }
 
 func jsonResponse(w http.ResponseWriter, payload interface{}) error {
@@ -34,6 +69,11 @@ func jsonResponse(w http.ResponseWriter, payload interface{}) error {
 
 //
 // GET	/connections		Return a list of clients connected to this server.
+//							Filter with ?selector= (labels, see /broadcast), ?peer=, ?hostname=,
+//							?version=, ?capability= and ?idle=5m (no traffic for at least
+//							that long). ?sort= id (default), peer, connected, last_activity,
+//							messages_in, messages_out, bytes_in or bytes_out, with a leading
+//							- for descending order. ?limit= caps the number returned.
 //
 func (c *Controller) Connections(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
@@ -43,21 +83,153 @@ func (c *Controller) Connections(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cons := ConnectionsIndexResponse{c.Server.GetConnections()}
+	conns, err := queryConnections(r.URL.Query(), c.Server.GetConnections())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		jsonResponse(w, ErrorResponse{
+			Error:   err.Error(),
+			Message: "Check the selector, idle, sort and limit parameters"})
+		return
+	}
+
+	cons := ConnectionsIndexResponse{conns}
 	res, _ := json.Marshal(cons)
 	w.Write(res)
 }
 
 //
-// PUT	/{id}		Send arbitrary data to a connected client given by {id}.
-// GET /{id}		Synchronously receives data from connected client given by {id}
+// GET	/connections/{id}			A single connection.
+// DELETE	/connections/{id}			Drop it.
+// GET	/connections/{id}/labels	Its labels.
+// PUT	/connections/{id}/labels	Replace its labels with a JSON object of strings.
+// PATCH	/connections/{id}/labels	Merge a JSON object into its labels. null removes a label.
+//
+// Labels set here last until the connection drops; the peer's own come back
+// with the next handshake.
+//
+func (c *Controller) Connection(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/connections/"), "/")
+
+	id, err := strconv.Atoi(parts[0])
+	var conn common.Connection
+	if err == nil {
+		conn = c.Server.GetConnection(id)
+	}
+
+	if err != nil || conn.Out == nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "labels") {
+		w.WriteHeader(http.StatusNotFound)
+		jsonResponse(w, ErrorResponse{Error: "ERR_CONNECTION_UNKNOWN"})
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		jsonResponse(w, conn)
+	case len(parts) == 1 && r.Method == "DELETE":
+		if !c.Server.CloseConnection(id) {
+			w.WriteHeader(http.StatusNotFound)
+			jsonResponse(w, ErrorResponse{Error: "ERR_CONNECTION_UNKNOWN"})
+			return
+		}
+		log.I("Connection %d dropped through the API", id)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && r.Method == "GET":
+		jsonResponse(w, conn.Labels())
+	case len(parts) == 2 && (r.Method == "PUT" || r.Method == "PATCH"):
+		var changes map[string]*string
+		if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			jsonResponse(w, ErrorResponse{Error: "ERR_BAD_LABELS", Message: err.Error()})
+			return
+		}
+
+		labels := conn.Labels()
+		if r.Method == "PUT" {
+			labels = make(map[string]string)
+		}
+
+		for k, v := range changes {
+			if v == nil {
+				delete(labels, k)
+				continue
+			}
+
+			if err := common.CheckLabel(k, *v); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				jsonResponse(w, ErrorResponse{Error: "ERR_BAD_LABELS", Message: err.Error()})
+				return
+			}
+			labels[k] = *v
+		}
+
+		conn.SetLabels(labels)
+		log.I("Labels of connection %d are now %v", id, labels)
+		jsonResponse(w, labels)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+	}
+}
+
+//
+// POST	/reload		Re-read the configuration file and swap in new routes and keys.
+//
+func (c *Controller) ReloadConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+		return
+	}
+
+	if c.Reload == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		jsonResponse(w, ErrorResponse{Error: "ERR_RELOAD_UNSUPPORTED"})
+		return
+	}
+
+	res, err := c.Reload()
+
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		jsonResponse(w, ErrorResponse{
+			Error:   "ERR_RELOAD",
+			Message: err.Error()})
+		return
+	}
+
+	jsonResponse(w, res)
+}
+
+//
+// GET	/metrics		Counters in the Prometheus text format.
+//
+func (c *Controller) Metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+		return
+	}
+
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	metrics.WriteText(w)
+}
+
+//
+// PUT	/transceiver/{id}	Send arbitrary data to a connected client given by {id} and wait
+//							for its response (504 after ?timeout=, default limits.request_timeout).
+//							With ?transfer=1 the data is sent as a resumable fragmented transfer
+//							instead and the call returns right away (see /transfers).
+// POST	/transceiver/{id}	Send data like PUT but return a message ID right away. The response
+//							is kept for GET /messages/{msgid}, and POSTed to ?callback= if given.
+// GET	/transceiver/{id}	Synchronously receives data from connected client given by {id}
 //							NOTE if client is not connected, both of these will fail fast.
+//							To have data delivered once it connects, see /queue.
 //
-// Ex: File upload via cURL: curl -XPUT localhost:3500/1 -F file=@test.bin
-// Ex: Shell binary: curl -XPUT localhost:3500/1 -d 'asdf'
+// Ex: File upload via cURL: curl -XPUT localhost:3500/transceiver/1 -F file=@test.bin
+// Ex: Shell binary: curl -XPUT localhost:3500/transceiver/1 -d 'asdf'
 //
 func (c *Controller) Transceiver(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path[13:]
+	path := strings.TrimPrefix(r.URL.Path, "/transceiver/")
 	rx, _ := regexp.Compile("^([0-9]{1,20})$")
 	id := rx.FindString(path)
 
@@ -80,7 +252,7 @@ func (c *Controller) Transceiver(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		c.Receive(w, r, int(connid))
-	case "PUT":
+	case "PUT", "POST":
 		c.Transmit(w, r, int(connid))
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -104,19 +276,71 @@ func (c *Controller) Transmit(
 		return
 	}
 
-	X := common.EgressMessage{N: sz, R: r.Body, Binary: true}
-	conn := c.Server.GetConnection(int(connid)).Out
+	connection := c.Server.GetConnection(int(connid))
+
+	if r.URL.Query().Get("transfer") != "" {
+		c.StartTransfer(w, r, connection, sz)
+		return
+	}
 
+	if err := connection.CheckOutbound(sz); err != nil {
+		_, max := connection.Limits()
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		jsonResponse(w, ErrorResponse{
+			Error:   err.Error(),
+			Message: fmt.Sprintf("Messages to connection %d may be at most %d bytes", connid, max)})
+		return
+	}
+
+	timeout, err := c.requestTimeout(r)
+	if err != nil {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		jsonResponse(w, ErrorResponse{
+			Error:   "ERR_BAD_TIMEOUT",
+			Message: "timeout must be a duration such as 30s"})
+		return
+	}
+
+	if r.Method == "POST" {
+		c.TransmitAsync(w, r, connection, sz, timeout)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(r.Context(), timeout)
+	}
+	defer cancel()
+
+	res := make(chan common.IngressMessage, 1)
+	X := common.EgressMessage{N: sz, R: r.Body, Binary: true, ResponseChan: res, Ctx: ctx}
 	select {
-	case conn <- X:
-		log.D(" Sent data to connection %d. Waiting for replay", connid)
-		c.Receive(w, r, connid)
+	case connection.Out <- X:
+		log.D(" Sent data to connection %d. Waiting for reply", connid)
+		c.HandleResponse(w, r, <-res, 0)
 	default:
 		log.D("ERROR: Tried to send data to socket server but server is not ready")
-		jsonResponse(w, errors.New("ERR_SOCKET_NOT_READY"))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		jsonResponse(w, ErrorResponse{
+			Error:   "ERR_SOCKET_NOT_READY",
+			Message: "To deliver data once the peer connects, PUT it to /queue/{peer}"})
 	}
 }
 
+// ?timeout=30s overrides the default request timeout
+func (c *Controller) requestTimeout(r *http.Request) (time.Duration, error) {
+	t := r.URL.Query().Get("timeout")
+	if t == "" {
+		return c.RequestTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(t)
+	if err == nil && timeout < 0 {
+		err = errors.New("ERR_BAD_TIMEOUT")
+	}
+	return timeout, err
+}
+
 func (c *Controller) Receive(
 	w http.ResponseWriter,
 	r *http.Request,
@@ -132,6 +356,12 @@ func (c *Controller) Receive(
 
 	con := c.Server.GetConnection(connid).In
 
+	if con == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		jsonResponse(w, ErrorResponse{Error: "ERR_SOCKET_NOT_READY"})
+		return
+	}
+
 	select {
 	case msg := <-con:
 		log.D("RECV ingress msg from socket server")
@@ -149,7 +379,15 @@ func (c *Controller) HandleResponse(
 	resr common.IngressMessage,
 	sz int64) {
 
-	if resr.Err != nil {
+	if resr.Err == context.DeadlineExceeded {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		jsonResponse(w, ErrorResponse{
+			Error:   "ERR_TIMEOUT",
+			Message: "No response from the remote end before the deadline.",
+		})
+	} else if resr.Err == context.Canceled {
+		log.D("API client went away before the response arrived")
+	} else if resr.Err != nil {
 		w.WriteHeader(http.StatusNotAcceptable)
 		jsonResponse(w, ErrorResponse{
 			Error:   resr.Err.Error(),
@@ -163,5 +401,8 @@ func (c *Controller) HandleResponse(
 		})
 	} else {
 		io.Copy(w, resr.R)
+
+		// Whatever the caller didn't take still has to be read off the WAN
+		io.Copy(ioutil.Discard, resr.R)
 	}
 }
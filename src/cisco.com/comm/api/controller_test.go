@@ -0,0 +1,128 @@
+package api
+
+import (
+	"bytes"
+	"cisco.com/comm/common"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A SocketServer whose connections stand in for peers: each answers a request
+// with its peer's name and the payload, except that peers named "silent"
+// never answer.
+type testServer struct {
+	m     sync.Mutex
+	conns []common.Connection
+}
+
+func newTestServer(t *testing.T, peers ...string) *testServer {
+	s := &testServer{}
+	for i, peer := range peers {
+		conn := common.NewConnection(i+1, nil)
+		conn.Peer = peer
+		s.conns = append(s.conns, conn)
+		go answer(conn)
+	}
+
+	t.Cleanup(func() {
+		for _, conn := range s.conns {
+			s.CloseConnection(conn.Id)
+		}
+	})
+	return s
+}
+
+func answer(conn common.Connection) {
+	for {
+		var m common.EgressMessage
+		select {
+		case m = <-conn.Out:
+		case <-conn.Done():
+			return
+		}
+
+		body, _ := ioutil.ReadAll(m.R)
+		go func(m common.EgressMessage) {
+			if conn.Peer == "silent" {
+				ctx := m.Ctx
+				if ctx == nil {
+					ctx = context.Background()
+				}
+				<-ctx.Done()
+				m.ResponseChan <- common.IngressMessage{Err: ctx.Err()}
+				return
+			}
+
+			res := []byte(conn.Peer + ":" + string(body))
+			m.ResponseChan <- common.IngressMessage{N: int64(len(res)), R: bytes.NewReader(res)}
+		}(m)
+	}
+}
+
+func (s *testServer) GetConnection(id int) common.Connection {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, conn := range s.conns {
+		if conn.Id == id {
+			return conn
+		}
+	}
+	return common.Connection{}
+}
+
+func (s *testServer) GetConnections() []common.Connection {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]common.Connection(nil), s.conns...)
+}
+
+func (s *testServer) CloseConnection(id int) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for i, conn := range s.conns {
+		if conn.Id == id {
+			conn.Close()
+			s.conns = append(s.conns[:i], s.conns[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// A clock tests move by hand
+type testClock struct {
+	m   sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Unix(1000, 0)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.m.Lock()
+	c.now = c.now.Add(d)
+	c.m.Unlock()
+}
+
+// Call handler with a request like curl would send it
+func call(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("content-length", strconv.Itoa(len(body)))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
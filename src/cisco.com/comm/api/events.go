@@ -0,0 +1,72 @@
+package api
+
+import (
+	"cisco.com/comm/events"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+type EventsResponse struct {
+	Events []events.Event `json:"events"`
+}
+
+//
+// GET	/events		Recent events: tunnels connecting, disconnecting and being rejected,
+//					oldest first. ?since={id} skips those up to and including id. With
+//					?follow=1 the response doesn't end: events are written one JSON
+//					object per line as they happen, after those already kept.
+//
+func (c *Controller) Events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+		return
+	}
+
+	var since uint64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			jsonResponse(w, ErrorResponse{Error: "ERR_BAD_SINCE", Message: "since must be an event ID"})
+			return
+		}
+	}
+
+	if r.URL.Query().Get("follow") == "" {
+		jsonResponse(w, EventsResponse{Events: events.Since(since)})
+		return
+	}
+
+	// Subscribe first so nothing published in between is missed
+	live, cancel := events.Subscribe()
+	defer cancel()
+
+	w.Header().Set("content-type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	for _, e := range events.Since(since) {
+		enc.Encode(e)
+		since = e.ID
+	}
+
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case e := <-live:
+			if e.ID > since {
+				if err := enc.Encode(e); err != nil {
+					return
+				}
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"cisco.com/comm/common"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Largest payload POST /debug/connections/{id}/frames takes
+const maxFramePayload = 1 << 20
+
+// Raw frames of a connection, for the debug console. Implemented by
+// tunnel.Tunnel.
+type FrameTap interface {
+	Tap(id int, fn func(common.Frame)) (func(), error)
+	SendFrame(id int, f common.Frame) (uint64, error)
+}
+
+type SendFrameResponse struct {
+	Seq uint64 `json:"seq"`
+}
+
+//
+// GET	/debug/connections/{id}/frames	Every frame sent or received on the connection from
+//										now on, one JSON object per line, with the first 4
+//										KiB of its payload. Ends when the connection does.
+// POST	/debug/connections/{id}/frames	Send the body to the peer as a single frame, as it
+//										is: ?type= (a number), ?seq=, ?response=1 and
+//										?timeout= (ms) set its header. A request without
+//										a seq gets a fresh one. Returns the seq sent. The
+//										frame bypasses the middleware and the response to
+//										it is only seen by GET.
+//
+// Both need the debug token, as everything under /debug/ does.
+//
+func (c *Controller) DebugFrames(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/debug/connections/"), "/")
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) != 2 || parts[1] != "frames" || c.Server.GetConnection(id).Out == nil {
+		w.WriteHeader(http.StatusNotFound)
+		jsonResponse(w, ErrorResponse{Error: "ERR_CONNECTION_UNKNOWN"})
+		return
+	}
+
+	if c.Frames == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		jsonResponse(w, ErrorResponse{Error: "ERR_FRAMES_UNSUPPORTED"})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		c.tapFrames(w, r, id)
+	case "POST":
+		c.sendFrame(w, r, id)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+	}
+}
+
+func (c *Controller) tapFrames(w http.ResponseWriter, r *http.Request, id int) {
+
+	// A slow reader misses frames rather than holding up the connection
+	frames := make(chan common.Frame, 1024)
+	untap, err := c.Frames.Tap(id, func(f common.Frame) {
+		select {
+		case frames <- f:
+		default:
+		}
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		jsonResponse(w, ErrorResponse{Error: "ERR_CONNECTION_UNKNOWN"})
+		return
+	}
+	defer untap()
+
+	w.Header().Set("content-type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	done := c.Server.GetConnection(id).Done()
+
+	for {
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		select {
+		case f := <-frames:
+			if err := enc.Encode(f); err != nil {
+				return
+			}
+		case <-done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (c *Controller) sendFrame(w http.ResponseWriter, r *http.Request, id int) {
+	var f common.Frame
+	q := r.URL.Query()
+
+	t, err := strconv.ParseUint(q.Get("type"), 10, 8)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		jsonResponse(w, ErrorResponse{Error: "ERR_BAD_FRAME", Message: "type must be a number from 0 to 255"})
+		return
+	}
+	f.Type = byte(t)
+
+	if s := q.Get("seq"); s != "" {
+		if f.Seq, err = strconv.ParseUint(s, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			jsonResponse(w, ErrorResponse{Error: "ERR_BAD_FRAME", Message: "seq must be a number"})
+			return
+		}
+	}
+
+	if s := q.Get("timeout"); s != "" {
+		ms, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			jsonResponse(w, ErrorResponse{Error: "ERR_BAD_FRAME", Message: "timeout must be a number of milliseconds"})
+			return
+		}
+		f.Timeout = uint32(ms)
+	}
+
+	if q.Get("response") != "" {
+		f.Flags = common.FrameResponse
+	}
+
+	f.Payload, err = ioutil.ReadAll(io.LimitReader(r.Body, maxFramePayload+1))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		jsonResponse(w, ErrorResponse{Error: "ERR_BAD_FRAME", Message: err.Error()})
+		return
+	}
+	if len(f.Payload) > maxFramePayload {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		jsonResponse(w, ErrorResponse{Error: "ERR_BAD_FRAME", Message: fmt.Sprintf("Frames sent here may be at most %d bytes", maxFramePayload)})
+		return
+	}
+
+	seq, err := c.Frames.SendFrame(id, f)
+	switch {
+	case err == common.ErrMessageTooLarge:
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		jsonResponse(w, ErrorResponse{Error: err.Error()})
+	case err != nil:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		jsonResponse(w, ErrorResponse{Error: err.Error()})
+	default:
+		jsonResponse(w, SendFrameResponse{Seq: seq})
+	}
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	_ "net/http/pprof" // Registers /debug/pprof/ on the default mux
+	"runtime"
+)
+
+// Whether the tunnel can carry traffic. Nil if it can, or else why not.
+type Readiness func() error
+
+// What the connections' goroutines hold, as JSON. Implemented by socket.State.
+type StateDump func() interface{}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+type StateResponse struct {
+	Goroutines int         `json:"goroutines"`
+	Sessions   interface{} `json:"sessions"`
+}
+
+//
+// GET	/healthz	200 as long as the process serves the API.
+//
+func (c *Controller) Healthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+		return
+	}
+
+	jsonResponse(w, HealthResponse{Status: "ok"})
+}
+
+//
+// GET	/readyz		200 once the tunnel is up: in server mode the WAN listener is bound,
+//					in client mode the connection to the server is established and the
+//					server was heard from lately. 503 and the reason otherwise.
+//
+func (c *Controller) Readyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+		return
+	}
+
+	if c.Ready != nil {
+		if err := c.Ready(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			jsonResponse(w, ErrorResponse{Error: "ERR_NOT_READY", Message: err.Error()})
+			return
+		}
+	}
+
+	jsonResponse(w, HealthResponse{Status: "ready"})
+}
+
+//
+// GET	/debug/state	Requests in flight and being served, control queue depths and
+//						streams of every connection. Needs the debug token, like
+//						/debug/pprof/.
+//
+func (c *Controller) DebugState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+		return
+	}
+
+	res := StateResponse{Goroutines: runtime.NumGoroutine(), Sessions: []interface{}{}}
+	if c.State != nil {
+		res.Sessions = c.State()
+	}
+	jsonResponse(w, res)
+}
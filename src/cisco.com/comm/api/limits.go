@@ -0,0 +1,55 @@
+package api
+
+import (
+	"cisco.com/comm/common"
+	"cisco.com/comm/log"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Request and byte rate limits. Implemented by socket.Limiter.
+type RateLimiter interface {
+	Limits() common.RateLimits
+	SetLimits(common.RateLimits) error
+}
+
+//
+// GET	/limits		The rate limits in force.
+// PUT	/limits		Replace them with a JSON object shaped like rate_limits in the config
+//					file. Lasts until the next reload, which applies the file's again.
+//
+func (c *Controller) Limits(w http.ResponseWriter, r *http.Request) {
+	if c.Limiter == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		jsonResponse(w, ErrorResponse{Error: "ERR_LIMITS_UNSUPPORTED"})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		jsonResponse(w, c.Limiter.Limits())
+	case "PUT":
+		var limits common.RateLimits
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+
+		if err := dec.Decode(&limits); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			jsonResponse(w, ErrorResponse{Error: "ERR_BAD_LIMITS", Message: err.Error()})
+			return
+		}
+
+		if err := c.Limiter.SetLimits(limits); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			jsonResponse(w, ErrorResponse{Error: "ERR_BAD_LIMITS", Message: err.Error()})
+			return
+		}
+
+		log.I("Rate limits changed through the API")
+		jsonResponse(w, c.Limiter.Limits())
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+	}
+}
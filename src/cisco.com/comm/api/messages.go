@@ -0,0 +1,397 @@
+package api
+
+import (
+	"bytes"
+	"cisco.com/comm/common"
+	"cisco.com/comm/log"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a message sent with POST /transceiver/{id}
+const (
+	MessagePending = "pending"
+	MessageSent    = "sent"
+	MessageDone    = "done"
+	MessageFailed  = "failed"
+)
+
+// How long a callback may take
+const callbackTimeout = 30 * time.Second
+
+var callbackClient = &http.Client{Timeout: callbackTimeout}
+
+// Delivery receipt of an asynchronous message
+type MessageStatus struct {
+	ID string `json:"id"`
+
+	// Connection the message went out on and its peer's name
+	Connection int    `json:"connection"`
+	Peer       string `json:"peer,omitempty"`
+
+	Size int64 `json:"size"`
+
+	// pending (waiting to be written to the WAN), sent (waiting for the
+	// response), done or failed
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+
+	ResponseSize int64 `json:"response_size"`
+
+	// Where the outcome is POSTed, the HTTP status that got and why it
+	// failed, if it did
+	Callback       string `json:"callback,omitempty"`
+	CallbackStatus int    `json:"callback_status,omitempty"`
+	CallbackError  string `json:"callback_error,omitempty"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+type MessagesIndexResponse struct {
+	Messages []MessageStatus `json:"messages"`
+}
+
+// Keeps asynchronous messages and their responses in memory until they are
+// collected or expire.
+type MessageStore struct {
+
+	// How long a finished message is kept
+	ttl time.Duration
+
+	m    sync.Mutex
+	msgs map[string]*asyncMessage
+
+	// The clock, time.Now but for tests
+	now func() time.Time
+}
+
+type asyncMessage struct {
+	status   MessageStatus
+	response []byte
+	cancel   context.CancelFunc
+}
+
+func NewMessageStore(ttl time.Duration) *MessageStore {
+	return &MessageStore{ttl: ttl, msgs: make(map[string]*asyncMessage), now: time.Now}
+}
+
+func newMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Forget finished messages nobody collected in time. Call with s.m held.
+func (s *MessageStore) expire() {
+	for id, am := range s.msgs {
+		finished := am.status.State == MessageDone || am.status.State == MessageFailed
+		if finished && s.now().Sub(am.status.Updated) > s.ttl {
+			delete(s.msgs, id)
+		}
+	}
+}
+
+func (s *MessageStore) update(id string, f func(*asyncMessage)) {
+	s.m.Lock()
+	if am, ok := s.msgs[id]; ok {
+		f(am)
+		am.status.Updated = s.now()
+	}
+	s.m.Unlock()
+}
+
+func (s *MessageStore) get(id string) (MessageStatus, []byte, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.expire()
+	am, ok := s.msgs[id]
+	if !ok {
+		return MessageStatus{}, nil, false
+	}
+
+	return am.status, am.response, true
+}
+
+func (s *MessageStore) list() []MessageStatus {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.expire()
+	res := make([]MessageStatus, 0, len(s.msgs))
+	for _, am := range s.msgs {
+		res = append(res, am.status)
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Created.Before(res[j].Created) })
+	return res
+}
+
+// Forget a message, abandoning it if it's still underway
+func (s *MessageStore) remove(id string) bool {
+	s.m.Lock()
+	am, ok := s.msgs[id]
+	delete(s.msgs, id)
+	s.m.Unlock()
+
+	if ok {
+		am.cancel()
+	}
+	return ok
+}
+
+// Send body to conn as a request and keep the outcome. Returns the message's
+// status right away.
+func (s *MessageStore) send(conn common.Connection, body []byte, timeout time.Duration, callback string) MessageStatus {
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+
+	now := s.now()
+	am := &asyncMessage{
+		status: MessageStatus{
+			ID:         newMessageID(),
+			Connection: conn.Id,
+			Peer:       conn.Peer,
+			Size:       int64(len(body)),
+			State:      MessagePending,
+			Callback:   callback,
+			Created:    now,
+			Updated:    now,
+		},
+		cancel: cancel,
+	}
+
+	// run updates the status from here on
+	status := am.status
+
+	s.m.Lock()
+	s.expire()
+	s.msgs[status.ID] = am
+	s.m.Unlock()
+
+	go s.run(ctx, conn, status.ID, body)
+	return status
+}
+
+func (s *MessageStore) run(ctx context.Context, conn common.Connection, id string, body []byte) {
+	defer s.update(id, func(am *asyncMessage) { am.cancel() })
+
+	res := make(chan common.IngressMessage, 1)
+	err := conn.Send(common.EgressMessage{
+		N:            int64(len(body)),
+		R:            bytes.NewReader(body),
+		Binary:       true,
+		ResponseChan: res,
+		Ctx:          ctx})
+
+	var response []byte
+	if err == nil {
+		s.update(id, func(am *asyncMessage) { am.status.State = MessageSent })
+		response, err = receive(<-res)
+	}
+
+	s.update(id, func(am *asyncMessage) {
+		if err != nil {
+			am.status.State = MessageFailed
+			am.status.Error = err.Error()
+			return
+		}
+
+		am.status.State = MessageDone
+		am.status.ResponseSize = int64(len(response))
+		am.response = response
+	})
+
+	if err != nil {
+		log.W("Asynchronous message %s to connection %d failed: %v", id, conn.Id, err)
+	} else {
+		log.D("Asynchronous message %s to connection %d got a %d byte response", id, conn.Id, len(response))
+	}
+
+	if status, _, ok := s.get(id); ok && status.Callback != "" {
+		s.notify(status, response)
+	}
+}
+
+// Why a request got no response, named the way HandleResponse names it, or
+// nil if it got one
+func responseError(in common.IngressMessage) error {
+	switch {
+	case in.Err == context.DeadlineExceeded:
+		return errors.New("ERR_TIMEOUT")
+	case in.Err == context.Canceled:
+		return errors.New("ERR_CANCELLED")
+	case in.Err != nil:
+		return in.Err
+	case in.R == nil:
+		return errors.New("ERR_REMOTE_NA")
+	}
+
+	return nil
+}
+
+// Read a response off the WAN
+func receive(in common.IngressMessage) ([]byte, error) {
+	if err := responseError(in); err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(in.R)
+}
+
+// POST the outcome of a message to its callback: the response if there is
+// one, the message's status otherwise.
+func (s *MessageStore) notify(status MessageStatus, response []byte) {
+	body, ctype := io.Reader(bytes.NewReader(response)), "application/octet-stream"
+	if status.State != MessageDone {
+		b, _ := json.Marshal(status)
+		body, ctype = bytes.NewReader(b), "application/json"
+	}
+
+	req, err := http.NewRequest("POST", status.Callback, body)
+	if err != nil {
+		s.update(status.ID, func(am *asyncMessage) { am.status.CallbackError = err.Error() })
+		return
+	}
+
+	req.Header.Set("content-type", ctype)
+	req.Header.Set("x-comm-message-id", status.ID)
+	req.Header.Set("x-comm-message-state", status.State)
+
+	res, err := callbackClient.Do(req)
+	if err != nil {
+		log.W("Callback for message %s to %s failed: %v", status.ID, status.Callback, err)
+		s.update(status.ID, func(am *asyncMessage) { am.status.CallbackError = err.Error() })
+		return
+	}
+
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	s.update(status.ID, func(am *asyncMessage) {
+		am.status.CallbackStatus = res.StatusCode
+		if res.StatusCode/100 != 2 {
+			am.status.CallbackError = res.Status
+		}
+	})
+}
+
+// POST /transceiver/{id}. The body is read up front since it has to outlive
+// the API request; the size limit keeps that bounded.
+func (c *Controller) TransmitAsync(w http.ResponseWriter, r *http.Request, conn common.Connection, sz int64, timeout time.Duration) {
+	callback := r.URL.Query().Get("callback")
+	if callback != "" {
+		u, err := url.Parse(callback)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			jsonResponse(w, ErrorResponse{
+				Error:   "ERR_BAD_CALLBACK",
+				Message: "callback must be an http or https URL"})
+			return
+		}
+	}
+
+	if conn.Out == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		jsonResponse(w, ErrorResponse{
+			Error:   "ERR_SOCKET_NOT_READY",
+			Message: "To deliver data once the peer connects, PUT it to /queue/{peer}"})
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, sz))
+	if err == nil && int64(len(body)) < sz {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		jsonResponse(w, ErrorResponse{Error: err.Error(), Message: "Failed to read the request body"})
+		return
+	}
+
+	status := c.Messages.send(conn, body, timeout, callback)
+
+	w.Header().Set("location", "/messages/"+status.ID)
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	jsonResponse(w, status)
+}
+
+//
+// GET	/messages		List the asynchronous messages we know of, oldest first.
+//
+func (c *Controller) MessagesIndex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+		return
+	}
+
+	jsonResponse(w, MessagesIndexResponse{Messages: c.Messages.list()})
+}
+
+//
+// GET	/messages/{msgid}		The response once it arrived (200). Otherwise the
+//								message's status: 202 while it's underway, 502 or
+//								504 if it failed.
+// GET	/messages/{msgid}/status	The message's status, whatever its state.
+// DELETE	/messages/{msgid}		Forget the message, abandoning it if it's underway.
+//
+// Finished messages are forgotten after api.message_ttl.
+//
+func (c *Controller) Message(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/messages/"), "/")
+	id := parts[0]
+
+	status, response, ok := c.Messages.get(id)
+	if !ok || len(parts) > 2 {
+		w.WriteHeader(http.StatusNotFound)
+		jsonResponse(w, ErrorResponse{Error: "ERR_MESSAGE_UNKNOWN"})
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && parts[1] == "status" && r.Method == "GET":
+		jsonResponse(w, status)
+	case len(parts) == 1 && r.Method == "GET":
+		w.Header().Set("x-comm-message-state", status.State)
+
+		switch status.State {
+		case MessageDone:
+			w.Write(response)
+		case MessageFailed:
+			if status.Error == "ERR_TIMEOUT" {
+				w.WriteHeader(http.StatusGatewayTimeout)
+			} else {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+			jsonResponse(w, status)
+		default:
+			w.Header().Set("content-type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			jsonResponse(w, status)
+		}
+	case len(parts) == 1 && r.Method == "DELETE":
+		c.Messages.remove(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+	}
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Send body to connection id asynchronously. Returns the message's ID.
+func sendAsync(t *testing.T, c *Controller, target, body string) string {
+	t.Helper()
+	w := call(c.Transceiver, "POST", target, body)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("POST %s: got %d %s", target, w.Code, w.Body)
+	}
+
+	var status MessageStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if loc := w.Header().Get("location"); loc != "/messages/"+status.ID {
+		t.Errorf("POST %s: got location %q for message %s", target, loc, status.ID)
+	}
+	return status.ID
+}
+
+// Wait for message id to be done or failed
+func waitMessage(t *testing.T, c *Controller, id string) MessageStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var status MessageStatus
+		w := call(c.Message, "GET", "/messages/"+id+"/status", "")
+		json.Unmarshal(w.Body.Bytes(), &status)
+		if status.State == MessageDone || status.State == MessageFailed {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Message %s still %s", id, status.State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAsyncMessage(t *testing.T) {
+	clock := newTestClock()
+	c := &Controller{Server: newTestServer(t, "edge", "silent"), Messages: NewMessageStore(time.Minute)}
+	c.Messages.now = clock.Now
+
+	id := sendAsync(t, c, "/transceiver/1", "hi")
+	if status := waitMessage(t, c, id); status.State != MessageDone || status.ResponseSize != 7 || status.Peer != "edge" {
+		t.Errorf("Got status %+v", status)
+	}
+
+	w := call(c.Message, "GET", "/messages/"+id, "")
+	if w.Code != http.StatusOK || w.Body.String() != "edge:hi" || w.Header().Get("x-comm-message-state") != MessageDone {
+		t.Errorf("Got response %d %q", w.Code, w.Body)
+	}
+
+	// A peer that doesn't answer in time
+	clock.Add(time.Second)
+	late := sendAsync(t, c, "/transceiver/2?timeout=20ms", "hi")
+	if status := waitMessage(t, c, late); status.State != MessageFailed || status.Error != "ERR_TIMEOUT" {
+		t.Errorf("Got status %+v for an unanswered message", status)
+	}
+	if w := call(c.Message, "GET", "/messages/"+late, ""); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Got %d for an unanswered message, want %d", w.Code, http.StatusGatewayTimeout)
+	}
+
+	var index MessagesIndexResponse
+	json.Unmarshal(call(c.MessagesIndex, "GET", "/messages", "").Body.Bytes(), &index)
+	if len(index.Messages) != 2 || index.Messages[0].ID != id || index.Messages[1].ID != late {
+		t.Errorf("Got index %+v, want %s then %s", index.Messages, id, late)
+	}
+
+	// Finished messages are kept for the TTL after they finished, then
+	// forgotten
+	clock.Add(59 * time.Second)
+	if w := call(c.Message, "GET", "/messages/"+id, ""); w.Code != http.StatusOK {
+		t.Errorf("Got %d for a message within its TTL", w.Code)
+	}
+
+	clock.Add(time.Second)
+	if w := call(c.Message, "GET", "/messages/"+id, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Got %d for a message past its TTL, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := call(c.Message, "GET", "/messages/"+late, ""); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Got %d for a later message within its TTL", w.Code)
+	}
+
+	clock.Add(time.Second)
+	if w := call(c.Message, "GET", "/messages/"+late, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Got %d for a message past its TTL, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAsyncMessageUnderway(t *testing.T) {
+	c := &Controller{Server: newTestServer(t, "silent"), Messages: NewMessageStore(time.Minute)}
+
+	// Underway messages don't expire, and deleting one abandons it
+	id := sendAsync(t, c, "/transceiver/1", "hi")
+	if w := call(c.Message, "GET", "/messages/"+id, ""); w.Code != http.StatusAccepted {
+		t.Errorf("Got %d for a message underway, want %d", w.Code, http.StatusAccepted)
+	}
+
+	if w := call(c.Message, "DELETE", "/messages/"+id, ""); w.Code != http.StatusNoContent {
+		t.Errorf("Got %d deleting a message, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := call(c.Message, "GET", "/messages/"+id, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Got %d for a deleted message, want %d", w.Code, http.StatusNotFound)
+	}
+
+	if w := call(c.Transceiver, "POST", "/transceiver/1?callback=ftp://x", "hi"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Got %d for a bad callback, want %d", w.Code, http.StatusPreconditionFailed)
+	}
+}
+
+func TestAsyncMessageCallback(t *testing.T) {
+	got := make(chan string, 1)
+	cb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got <- r.Header.Get("x-comm-message-state") + " " + string(body)
+	}))
+	defer cb.Close()
+
+	c := &Controller{Server: newTestServer(t, "edge"), Messages: NewMessageStore(time.Minute)}
+	id := sendAsync(t, c, "/transceiver/1?callback="+cb.URL, "hi")
+
+	select {
+	case res := <-got:
+		if res != "done edge:hi" {
+			t.Errorf("Callback got %q", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No callback")
+	}
+
+	// The callback's outcome is recorded right after it returns
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, _, _ := c.Messages.get(id)
+		if status.CallbackStatus == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Got status %+v after the callback", status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
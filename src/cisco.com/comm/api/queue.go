@@ -0,0 +1,153 @@
+package api
+
+import (
+	"cisco.com/comm/common"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The store-and-forward queue. Implemented by socket.Queue.
+type Queue interface {
+
+	// Store size bytes from r until they can be delivered to the named peer,
+	// for at most ttl (zero for the default)
+	Enqueue(peer string, size int64, r io.Reader, ttl time.Duration) (common.QueuedMessage, error)
+
+	Peers() []common.QueueSummary
+	List(peer string) []common.QueuedMessage
+
+	Delete(peer string, id uint64) error
+	Purge(peer string) int
+}
+
+type QueueIndexResponse struct {
+	Peers []common.QueueSummary `json:"peers"`
+}
+
+type QueueListResponse struct {
+	Messages []common.QueuedMessage `json:"messages"`
+}
+
+type QueuePurgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+//
+// GET	/queue		What the store-and-forward queue holds, by peer.
+//
+func (c *Controller) QueueIndex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+		return
+	}
+
+	res := QueueIndexResponse{Peers: []common.QueueSummary{}}
+	if c.Queue != nil {
+		res.Peers = c.Queue.Peers()
+	}
+
+	jsonResponse(w, res)
+}
+
+//
+// PUT	/queue/{peer}		Queue data for the peer of that name (see GET /connections),
+//							delivered in order whenever it's connected. ?ttl=1h overrides
+//							queue.ttl. Replies 202 once the data is on disk.
+// GET	/queue/{peer}		List the messages queued for a peer, oldest first.
+// DELETE	/queue/{peer}		Purge everything queued for a peer.
+// DELETE	/queue/{peer}/{msgid}	Remove a single message.
+//
+func (c *Controller) QueuePeer(w http.ResponseWriter, r *http.Request) {
+	if c.Queue == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		jsonResponse(w, ErrorResponse{
+			Error:   "ERR_QUEUE_DISABLED",
+			Message: "Set queue.dir to enable the store-and-forward queue"})
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/queue/"), "/")
+	peer, err := url.PathUnescape(parts[0])
+
+	if err != nil || peer == "" || len(parts) > 2 {
+		w.WriteHeader(http.StatusNotFound)
+		jsonResponse(w, ErrorResponse{Error: "ERR_QUEUE_BAD_PEER"})
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "PUT":
+		c.enqueue(w, r, peer)
+	case len(parts) == 1 && r.Method == "GET":
+		jsonResponse(w, QueueListResponse{Messages: c.Queue.List(peer)})
+	case len(parts) == 1 && r.Method == "DELETE":
+		jsonResponse(w, QueuePurgeResponse{Purged: c.Queue.Purge(peer)})
+	case len(parts) == 2 && r.Method == "DELETE":
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if err == nil {
+			err = c.Queue.Delete(peer, id)
+		}
+
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			jsonResponse(w, ErrorResponse{Error: "ERR_QUEUE_MESSAGE_UNKNOWN"})
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+	}
+}
+
+func (c *Controller) enqueue(w http.ResponseWriter, r *http.Request, peer string) {
+	sz, err := strconv.ParseInt(r.Header.Get("content-length"), 10, 64)
+
+	if err != nil {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		jsonResponse(w, ErrorResponse{
+			Error:   err.Error(),
+			Message: "Failed to parse content-length header. Please make sure it's set."})
+		return
+	}
+
+	var ttl time.Duration
+	if t := r.URL.Query().Get("ttl"); t != "" {
+		if ttl, err = time.ParseDuration(t); err != nil || ttl <= 0 {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			jsonResponse(w, ErrorResponse{
+				Error:   "ERR_BAD_TTL",
+				Message: "ttl must be a positive duration such as 1h"})
+			return
+		}
+	}
+
+	msg, err := c.Queue.Enqueue(peer, sz, r.Body, ttl)
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err.Error() {
+		case "ERR_QUEUE_FULL":
+			status = http.StatusInsufficientStorage
+		case "ERR_QUEUE_BAD_PEER":
+			status = http.StatusNotFound
+		}
+
+		w.WriteHeader(status)
+		jsonResponse(w, ErrorResponse{
+			Error:   err.Error(),
+			Message: fmt.Sprintf("Can't queue a message for %s", peer)})
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	jsonResponse(w, msg)
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"cisco.com/comm/common"
+	"fmt"
+	"net/http"
+)
+
+// Where proxied requests go. Implemented by socket.Router.
+type Router interface {
+	Table() common.RouteTable
+}
+
+//
+// GET	/routes		The routes proxied requests take by their Host header, and the
+//					default origin for the rest. Change them in the config file and
+//					reload.
+//
+func (c *Controller) Routes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+		return
+	}
+
+	if c.Router == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		jsonResponse(w, ErrorResponse{Error: "ERR_ROUTES_UNSUPPORTED"})
+		return
+	}
+
+	jsonResponse(w, c.Router.Table())
+}
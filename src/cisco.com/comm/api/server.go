@@ -4,16 +4,65 @@ import (
 	"cisco.com/comm/log"
 	"fmt"
 	"net/http"
+	"time"
 )
 
 type APIServer struct {
-	Port         int
-	SocketServer SocketServer
+	Port           int
+	SocketServer   SocketServer
+	Reload         Reloader
+	Transfers      Transfers
+	Queue          Queue
+	Limiter        RateLimiter
+	Router         Router
+	RequestTimeout time.Duration
+
+	// How long responses to asynchronous messages are kept
+	MessageTTL time.Duration
+
+	Ready  Readiness
+	State  StateDump
+	Frames FrameTap
+
+	// Required for every call but the health checks, if set
+	Token string
+
+	// Required for /debug/. Empty turns it off.
+	DebugToken string
 }
 
 func (a *APIServer) Listen() error {
-	root := Controller{Server: a.SocketServer}
+	root := Controller{
+		Server:         a.SocketServer,
+		Reload:         a.Reload,
+		Transfers:      a.Transfers,
+		Queue:          a.Queue,
+		Limiter:        a.Limiter,
+		Router:         a.Router,
+		Messages:       NewMessageStore(a.MessageTTL),
+		RequestTimeout: a.RequestTimeout,
+		Ready:          a.Ready,
+		State:          a.State,
+		Frames:         a.Frames}
 	log.I("Starting. Bind to TCP %d", a.Port)
 	http.HandleFunc("/connections", root.Connections)
-	return http.ListenAndServe(fmt.Sprintf(":%d", a.Port), nil)
+	http.HandleFunc("/connections/", root.Connection)
+	http.HandleFunc("/broadcast", root.Broadcast)
+	http.HandleFunc("/reload", root.ReloadConfig)
+	http.HandleFunc("/metrics", root.Metrics)
+	http.HandleFunc("/limits", root.Limits)
+	http.HandleFunc("/routes", root.Routes)
+	http.HandleFunc("/events", root.Events)
+	http.HandleFunc("/transceiver/", root.Transceiver)
+	http.HandleFunc("/transfers", root.TransfersIndex)
+	http.HandleFunc("/transfers/", root.Transfer)
+	http.HandleFunc("/queue", root.QueueIndex)
+	http.HandleFunc("/queue/", root.QueuePeer)
+	http.HandleFunc("/messages", root.MessagesIndex)
+	http.HandleFunc("/messages/", root.Message)
+	http.HandleFunc("/healthz", root.Healthz)
+	http.HandleFunc("/readyz", root.Readyz)
+	http.HandleFunc("/debug/state", root.DebugState)
+	http.HandleFunc("/debug/connections/", root.DebugFrames)
+	return http.ListenAndServe(fmt.Sprintf(":%d", a.Port), audited(guarded(a.Token, a.DebugToken, http.DefaultServeMux)))
 }
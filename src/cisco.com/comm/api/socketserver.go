@@ -14,4 +14,7 @@ import (
 type SocketServer interface {
 	GetConnection(int) common.Connection
 	GetConnections() []common.Connection
+
+	// Drop a connection. False if there's no such connection.
+	CloseConnection(int) bool
 }
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"cisco.com/comm/common"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Resumable fragmented transfers. Implemented by socket.Transfers.
+type Transfers interface {
+
+	// Spool size bytes from r and send them to the named peer in the
+	// background
+	Start(peer string, size int64, r io.Reader) (common.TransferStatus, error)
+
+	List() []common.TransferStatus
+	Get(id string) (common.TransferStatus, bool)
+
+	// The peer's response, once the transfer is done
+	Response(id string) (io.ReadCloser, error)
+
+	// Stop the transfer (or forget a finished one) and delete its files
+	Cancel(id string) error
+}
+
+type TransfersIndexResponse struct {
+	Transfers []common.TransferStatus `json:"transfers"`
+}
+
+// PUT /transceiver/{id}?transfer=1. Replies 202 with the new transfer once the
+// payload is spooled.
+func (c *Controller) StartTransfer(w http.ResponseWriter, r *http.Request, conn common.Connection, sz int64) {
+	if c.Transfers == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		jsonResponse(w, ErrorResponse{
+			Error:   "ERR_TRANSFERS_DISABLED",
+			Message: "Set transfers.dir to enable fragmented transfers"})
+		return
+	}
+
+	if conn.Out == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		jsonResponse(w, ErrorResponse{Error: "ERR_SOCKET_NOT_READY"})
+		return
+	}
+
+	status, err := c.Transfers.Start(conn.Peer, sz, r.Body)
+
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		jsonResponse(w, ErrorResponse{
+			Error:   err.Error(),
+			Message: fmt.Sprintf("Can't start a transfer to connection %d", conn.Id)})
+		return
+	}
+
+	w.Header().Set("location", "/transfers/"+status.ID)
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	jsonResponse(w, status)
+}
+
+//
+// GET	/transfers		List the transfers we are sending.
+//
+func (c *Controller) TransfersIndex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+		return
+	}
+
+	res := TransfersIndexResponse{Transfers: []common.TransferStatus{}}
+	if c.Transfers != nil {
+		res.Transfers = c.Transfers.List()
+	}
+
+	jsonResponse(w, res)
+}
+
+//
+// GET	/transfers/{tid}			Progress of a transfer.
+// GET	/transfers/{tid}/response	The peer's response, once the transfer is done.
+// DELETE	/transfers/{tid}		Cancel a transfer, or forget a finished one.
+//
+func (c *Controller) Transfer(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/transfers/"), "/")
+	id := parts[0]
+
+	if c.Transfers == nil {
+		w.WriteHeader(http.StatusNotFound)
+		jsonResponse(w, ErrorResponse{Error: "ERR_TRANSFERS_DISABLED"})
+		return
+	}
+
+	status, ok := c.Transfers.Get(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		jsonResponse(w, ErrorResponse{Error: "ERR_TRANSFER_UNKNOWN"})
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		jsonResponse(w, status)
+	case len(parts) == 1 && r.Method == "DELETE":
+		c.Transfers.Cancel(id)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "response" && r.Method == "GET":
+		res, err := c.Transfers.Response(id)
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			jsonResponse(w, ErrorResponse{
+				Error:   err.Error(),
+				Message: fmt.Sprintf("Transfer is %s", status.State)})
+			return
+		}
+		defer res.Close()
+		io.Copy(w, res)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		jsonResponse(w, ErrorResponse{Message: fmt.Sprintf("%s not allowed here", r.Method)})
+	}
+}
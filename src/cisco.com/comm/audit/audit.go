@@ -0,0 +1,341 @@
+// Append-only record of the requests proxied through the tunnel and the
+// actions taken through the management API, written as one JSON object per
+// line. With a hash chain, every record carries the hash of the one before, so
+// records changed, removed or reordered after the fact no longer verify.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"cisco.com/comm/log"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record types
+const (
+	Request = "request"
+	API     = "api"
+)
+
+// Which way a proxied request went
+const (
+	// The peer's request, served on this side
+	Inbound = "inbound"
+
+	// A LAN client's request, sent to the peer
+	Outbound = "outbound"
+)
+
+type Entry struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+
+	// The tunnel the request went through and who is on the other end
+	Connection int    `json:"connection,omitempty"`
+	Peer       string `json:"peer,omitempty"`
+	Direction  string `json:"direction,omitempty"`
+
+	// Address of the LAN client or API caller
+	Client string `json:"client,omitempty"`
+
+	Method string `json:"method,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Status int    `json:"status,omitempty"`
+
+	// Request and response sizes, headers included
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+
+	Duration float64 `json:"duration_ms"`
+	Error    string  `json:"error,omitempty"`
+
+	// The hash of the previous record and of this one, hex encoded, if the
+	// log is chained
+	Prev string `json:"prev,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+type Options struct {
+
+	// The file written to. Rotated files get the time of rotation appended to
+	// their name.
+	Path string
+
+	// Rotate once the file reaches this size. Zero means never.
+	MaxBytes int64
+
+	// Rotate once the file is this old. Zero means never.
+	MaxAge time.Duration
+
+	// Chain the records together by their hashes. The chain carries on
+	// across rotation and restarts.
+	HashChain bool
+}
+
+// A record doesn't fit the chain
+var ErrBrokenChain = errors.New("ERR_BROKEN_CHAIN")
+
+type logFile struct {
+	m    sync.Mutex
+	opts Options
+
+	f       *os.File
+	size    int64
+	opened  time.Time
+	last    string
+	failing bool
+}
+
+// Nil until Open is called, in which case Record does nothing
+var current *logFile
+var mcurrent sync.Mutex
+
+// Start writing records to opts.Path, appending to the file if it exists
+func Open(opts Options) error {
+	l := &logFile{opts: opts}
+
+	if opts.HashChain {
+		last, err := lastHash(opts.Path)
+		if err != nil {
+			return err
+		}
+		l.last = last
+	}
+
+	if err := l.open(); err != nil {
+		return err
+	}
+
+	mcurrent.Lock()
+	prev := current
+	current = l
+	mcurrent.Unlock()
+
+	if prev != nil {
+		prev.close()
+	}
+	return nil
+}
+
+// Stop writing records
+func Close() {
+	mcurrent.Lock()
+	l := current
+	current = nil
+	mcurrent.Unlock()
+
+	if l != nil {
+		l.close()
+	}
+}
+
+// Write e to the audit log, if there is one. Its Time is set here unless
+// given, and its hashes if the log is chained.
+func Record(e Entry) {
+	mcurrent.Lock()
+	l := current
+	mcurrent.Unlock()
+
+	if l == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	l.write(e)
+}
+
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.opts.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.f = f
+	l.size = fi.Size()
+	l.opened = time.Now()
+	if l.size > 0 {
+		l.opened = fi.ModTime()
+	}
+	return nil
+}
+
+func (l *logFile) close() {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.f != nil {
+		l.f.Sync()
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+func (l *logFile) write(e Entry) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.f == nil {
+		return
+	}
+
+	if l.opts.HashChain {
+		e.Prev = l.last
+		e.Hash = hash(e)
+	}
+
+	line, _ := json.Marshal(e)
+	line = append(line, '\n')
+
+	if l.due(int64(len(line))) {
+		if err := l.rotate(); err != nil {
+			l.fail("Can't rotate the audit log %s: %v", l.opts.Path, err)
+		}
+	}
+
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		l.fail("Can't write to the audit log %s: %v", l.opts.Path, err)
+		return
+	}
+
+	l.failing = false
+	l.last = e.Hash
+}
+
+// Whether the file is due for rotation before writing n more bytes
+func (l *logFile) due(n int64) bool {
+	if l.size == 0 {
+		return false
+	}
+	if l.opts.MaxBytes > 0 && l.size+n > l.opts.MaxBytes {
+		return true
+	}
+	return l.opts.MaxAge > 0 && time.Since(l.opened) >= l.opts.MaxAge
+}
+
+func (l *logFile) rotate() error {
+	l.f.Sync()
+	l.f.Close()
+
+	name := l.opts.Path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	rerr := os.Rename(l.opts.Path, name)
+
+	// Keep writing, even if it's to the same file
+	if err := l.open(); err != nil {
+		return err
+	}
+	return rerr
+}
+
+// Report a failure to write once, rather than for every record
+func (l *logFile) fail(format string, x ...interface{}) {
+	if !l.failing {
+		log.E(format, x...)
+	}
+	l.failing = true
+}
+
+// The hash of e chained to e.Prev, with e.Hash left out
+func hash(e Entry) string {
+	e.Hash = ""
+	b, _ := json.Marshal(e)
+
+	h := sha256.New()
+	io.WriteString(h, e.Prev)
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// The hash of the last record in the file at path, if it exists. A last
+// record that doesn't parse, which is what a crash in the middle of a write
+// leaves behind, is cut off.
+func lastHash(path string) (string, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	last := ""
+	rd := bufio.NewReader(f)
+	var off int64
+
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+
+		var e Entry
+		if b := bytes.TrimSpace(line); len(b) > 0 {
+			if jerr := json.Unmarshal(b, &e); jerr != nil {
+				if _, perr := rd.Peek(1); perr != io.EOF {
+					return "", fmt.Errorf("%s: %v", path, jerr)
+				}
+
+				log.W("Cutting off the partial record at %d in %s", off, path)
+				return last, f.Truncate(off)
+			}
+			last = e.Hash
+
+			// Complete, but for the end of the line
+			if err == io.EOF {
+				_, err = f.WriteAt([]byte("\n"), off+int64(len(line)))
+				return last, err
+			}
+		}
+
+		off += int64(len(line))
+		if err == io.EOF {
+			return last, nil
+		}
+	}
+}
+
+// Check the chain in r, which must start with the record following the one
+// hashed prev ("" for the very first). Returns the hash of the last record, to
+// carry on with the next file, and the number of records checked.
+func Verify(r io.Reader, prev string) (string, int, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+
+	n := 0
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		n++
+
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return prev, n, fmt.Errorf("record %d: %v", n, err)
+		}
+
+		if e.Prev != prev || e.Hash != hash(e) {
+			return prev, n, fmt.Errorf("record %d: %v", n, ErrBrokenChain)
+		}
+		prev = e.Hash
+	}
+	return prev, n, sc.Err()
+}
@@ -0,0 +1,137 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Write n API records to the chained log at path, one status apart
+func writeRecords(t *testing.T, opts Options, from, n int) {
+	opts.HashChain = true
+	if err := Open(opts); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+
+	for i := from; i < from+n; i++ {
+		Record(Entry{Type: API, Method: "PUT", Path: "/limits", Status: 200 + i})
+	}
+}
+
+func verifyFile(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	_, n, err := Verify(bytes.NewReader(b), "")
+	return n, err
+}
+
+func TestVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeRecords(t, Options{Path: path}, 0, 4)
+
+	if n, err := verifyFile(path); err != nil || n != 4 {
+		t.Fatalf("Verifying the log: %d records, %v", n, err)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	lines := strings.SplitAfter(string(b), "\n")
+
+	tests := []struct {
+		name  string
+		lines []string
+
+		// The record the chain breaks at
+		at int
+	}{
+		{"edited", []string{lines[0], strings.Replace(lines[1], `"status":201`, `"status":200`, 1), lines[2], lines[3]}, 2},
+		{"deleted", []string{lines[0], lines[2], lines[3]}, 2},
+		{"reordered", []string{lines[0], lines[2], lines[1], lines[3]}, 2},
+		{"missing its start", []string{lines[1], lines[2], lines[3]}, 1},
+	}
+
+	for _, test := range tests {
+		_, n, err := Verify(strings.NewReader(strings.Join(test.lines, "")), "")
+		if err == nil || !strings.Contains(err.Error(), ErrBrokenChain.Error()) {
+			t.Errorf("%s: got %v, want %v", test.name, err, ErrBrokenChain)
+		} else if n != test.at {
+			t.Errorf("%s: broke at record %d, want %d", test.name, n, test.at)
+		}
+	}
+}
+
+func TestChainAcrossRestartsAndRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// Restarts carry on from the last record in the file
+	writeRecords(t, Options{Path: path}, 0, 2)
+	writeRecords(t, Options{Path: path}, 2, 2)
+	if n, err := verifyFile(path); err != nil || n != 4 {
+		t.Fatalf("After a restart: %d records, %v", n, err)
+	}
+
+	// Rotation carries on from the last record in the file before
+	writeRecords(t, Options{Path: path, MaxBytes: 600}, 4, 8)
+
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) == 0 {
+		t.Fatal("The log wasn't rotated")
+	}
+	sort.Strings(rotated)
+
+	prev, total := "", 0
+	for _, name := range append(rotated, path) {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var n int
+		if prev, n, err = Verify(bytes.NewReader(b), prev); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		total += n
+	}
+
+	if total != 12 {
+		t.Errorf("Verified %d records, want 12", total)
+	}
+}
+
+func TestPartialLastRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeRecords(t, Options{Path: path}, 0, 2)
+
+	// What a crash in the middle of a write leaves behind
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"time":"2026-10-19T10:00:00Z","type":"ap`)
+	f.Close()
+
+	writeRecords(t, Options{Path: path}, 2, 2)
+	if n, err := verifyFile(path); err != nil || n != 4 {
+		t.Fatalf("After cutting off a partial record: %d records, %v", n, err)
+	}
+
+	// A complete record that only lacks its newline is kept
+	b, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, bytes.TrimSuffix(b, []byte("\n")), 0600)
+
+	writeRecords(t, Options{Path: path}, 4, 1)
+	if n, err := verifyFile(path); err != nil || n != 5 {
+		t.Fatalf("After a record without a newline: %d records, %v", n, err)
+	}
+
+	// Damage anywhere else is left for Verify to find
+	b, _ = ioutil.ReadFile(path)
+	ioutil.WriteFile(path, append([]byte("{garbage\n"), b...), 0600)
+	if err := Open(Options{Path: path, HashChain: true}); err == nil {
+		Close()
+		t.Error("Opened a log with a damaged record in the middle")
+	}
+}
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Parse a CIDR block such as 10.0.0.0/8, or a single address, which is taken
+// as a block of one
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, block, err := net.ParseCIDR(s)
+		return block, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address or CIDR block %q", s)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	res := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		block, err := ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, block)
+	}
+	return res, nil
+}
@@ -1,17 +1,279 @@
 package common
 
 import (
+	"cisco.com/comm/metrics"
+	"encoding/json"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var ErrClosed = errors.New("ERR_CONNECTION_CLOSED")
+
+var ErrMessageTooLarge = errors.New("ERR_MESSAGE_TOO_LARGE")
+
 type Connection struct {
 	Id     int                   `json:"id"`
 	Remote net.Addr              `json:"remote"`
 	Out    chan (EgressMessage)  `json:"-"`
 	In     chan (IngressMessage) `json:"-"`
+
+	// Name the peer gave in the handshake. Survives reconnects, unlike Id.
+	Peer string `json:"peer,omitempty"`
+
+	// What the peer told us about itself in the handshake
+	Info PeerInfo `json:"info"`
+
+	// Mutable state, shared by every copy of this Connection
+	state *connectionState
+}
+
+// Declared by a peer in the handshake
+type PeerInfo struct {
+	Hostname string `json:"hostname,omitempty"`
+
+	// Version of comm the peer runs
+	Version string `json:"version,omitempty"`
+
+	// Optional features the peer has turned on, e.g. "checksums",
+	// "compression:gzip" or "transfers"
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Whatever else the peer was configured to tell, e.g. its customer
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Traffic on a connection. Messages are frames of any type, bytes their
+// payloads.
+type ConnectionStats struct {
+	Connected    time.Time `json:"connected"`
+	LastActivity time.Time `json:"last_activity"`
+
+	// Last time anything, heartbeats included, arrived from the peer
+	LastHeard time.Time `json:"last_heard"`
+
+	MessagesIn  int64 `json:"messages_in"`
+	MessagesOut int64 `json:"messages_out"`
+	BytesIn     int64 `json:"bytes_in"`
+	BytesOut    int64 `json:"bytes_out"`
+}
+
+type connectionState struct {
+
+	// Accessed atomically, and first to keep them 64-bit aligned.
+	// lastActivity and lastHeard are in Unix nanoseconds.
+	lastActivity int64
+	lastHeard    int64
+	messagesIn   int64
+	messagesOut  int64
+	bytesIn      int64
+	bytesOut     int64
+
+	m    sync.Mutex
+	lan  net.Addr
+	done chan struct{}
+
+	// Largest message we accept from and may send to the peer, in bytes.
+	// Zero means no limit.
+	maxIn  int64
+	maxOut int64
+
+	// Given by the peer in the handshake or set through the API
+	labels map[string]string
+
+	// Who the peer authenticated as, see SetIdentity
+	identity string
+
+	connected time.Time
 }
 
+func NewConnection(id int, remote net.Addr) Connection {
+	now := time.Now()
+	return Connection{
+		Id:     id,
+		Remote: remote,
+		Out:    make(chan EgressMessage),
+		In:     make(chan IngressMessage),
+		state: &connectionState{
+			done:         make(chan struct{}),
+			connected:    now,
+			lastActivity: now.UnixNano(),
+			lastHeard:    now.UnixNano()}}
+}
+
+// Close the connection. Out is left open since any number of goroutines may
+// be sending on it; they should give up once Done is closed (see Send).
 func (c *Connection) Close() {
-	close(c.Out)
+	close(c.state.done)
 	close(c.In)
 }
+
+// Closed once the connection is closed
+func (c Connection) Done() <-chan struct{} {
+	return c.state.done
+}
+
+// Queue a message on Out. Blocks until it is picked up or the connection
+// closes, in which case ErrClosed is returned.
+func (c Connection) Send(m EgressMessage) error {
+	select {
+	case c.Out <- m:
+		return nil
+	case <-c.state.done:
+		return ErrClosed
+	}
+}
+
+// The address LAN clients use to send requests through this connection, or
+// nil if there is no LAN listener.
+func (c Connection) LAN() net.Addr {
+	if c.state == nil {
+		return nil
+	}
+
+	c.state.m.Lock()
+	defer c.state.m.Unlock()
+	return c.state.lan
+}
+
+func (c Connection) SetLAN(addr net.Addr) {
+	c.state.m.Lock()
+	c.state.lan = addr
+	c.state.m.Unlock()
+}
+
+// The message size limits agreed on for this connection, see SetLimits
+func (c Connection) Limits() (in, out int64) {
+	if c.state == nil {
+		return 0, 0
+	}
+
+	c.state.m.Lock()
+	defer c.state.m.Unlock()
+	return c.state.maxIn, c.state.maxOut
+}
+
+func (c Connection) SetLimits(in, out int64) {
+	c.state.m.Lock()
+	c.state.maxIn, c.state.maxOut = in, out
+	c.state.m.Unlock()
+}
+
+// Check that an n byte message may be sent to the peer. Returns
+// ErrMessageTooLarge (and counts it) if not.
+func (c Connection) CheckOutbound(n int64) error {
+	if _, out := c.Limits(); out > 0 && n > out {
+		metrics.OversizedMessages.With("outbound").Inc()
+		return ErrMessageTooLarge
+	}
+
+	return nil
+}
+
+// A copy of the connection's labels
+func (c Connection) Labels() map[string]string {
+	res := make(map[string]string)
+	if c.state == nil {
+		return res
+	}
+
+	c.state.m.Lock()
+	defer c.state.m.Unlock()
+	for k, v := range c.state.labels {
+		res[k] = v
+	}
+	return res
+}
+
+// Replace the connection's labels with a copy of labels
+func (c Connection) SetLabels(labels map[string]string) {
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+
+	c.state.m.Lock()
+	c.state.labels = copied
+	c.state.m.Unlock()
+}
+
+// Who the peer authenticated as in the handshake. Unlike Peer it can't be
+// made up, so it tells apart peers that claim the same name. Empty if the
+// peer didn't authenticate.
+func (c Connection) Identity() string {
+	if c.state == nil {
+		return ""
+	}
+
+	c.state.m.Lock()
+	defer c.state.m.Unlock()
+	return c.state.identity
+}
+
+func (c Connection) SetIdentity(identity string) {
+	c.state.m.Lock()
+	c.state.identity = identity
+	c.state.m.Unlock()
+}
+
+// Count a message of n bytes received from the peer
+func (c Connection) CountIn(n int64) {
+	atomic.AddInt64(&c.state.messagesIn, 1)
+	atomic.AddInt64(&c.state.bytesIn, n)
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&c.state.lastActivity, now)
+	atomic.StoreInt64(&c.state.lastHeard, now)
+}
+
+// Note that the peer sent a heartbeat. Unlike a message it doesn't count as
+// activity.
+func (c Connection) Heard() {
+	atomic.StoreInt64(&c.state.lastHeard, time.Now().UnixNano())
+}
+
+// Count a message of n bytes sent to the peer
+func (c Connection) CountOut(n int64) {
+	atomic.AddInt64(&c.state.messagesOut, 1)
+	atomic.AddInt64(&c.state.bytesOut, n)
+	atomic.StoreInt64(&c.state.lastActivity, time.Now().UnixNano())
+}
+
+func (c Connection) Stats() ConnectionStats {
+	if c.state == nil {
+		return ConnectionStats{}
+	}
+
+	return ConnectionStats{
+		Connected:    c.state.connected,
+		LastActivity: time.Unix(0, atomic.LoadInt64(&c.state.lastActivity)),
+		LastHeard:    time.Unix(0, atomic.LoadInt64(&c.state.lastHeard)),
+		MessagesIn:   atomic.LoadInt64(&c.state.messagesIn),
+		MessagesOut:  atomic.LoadInt64(&c.state.messagesOut),
+		BytesIn:      atomic.LoadInt64(&c.state.bytesIn),
+		BytesOut:     atomic.LoadInt64(&c.state.bytesOut),
+	}
+}
+
+func (c Connection) MarshalJSON() ([]byte, error) {
+	type plain Connection
+
+	var lan string
+	if addr := c.LAN(); addr != nil {
+		lan = addr.Network() + "://" + addr.String()
+	}
+
+	in, out := c.Limits()
+
+	return json.Marshal(struct {
+		plain
+		LAN         string `json:"lan,omitempty"`
+		MaxInbound  int64  `json:"max_inbound_size,omitempty"`
+		MaxOutbound int64  `json:"max_outbound_size,omitempty"`
+
+		Labels map[string]string `json:"labels"`
+
+		ConnectionStats
+	}{plain(c), lan, in, out, c.Labels(), c.Stats()})
+}
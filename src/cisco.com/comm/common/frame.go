@@ -0,0 +1,31 @@
+package common
+
+import "time"
+
+// Frame directions
+const (
+	FrameIn  = "in"
+	FrameOut = "out"
+)
+
+// The flag of a Frame that makes it a response, socket.FLAG_RESPONSE on the
+// wire
+const FrameResponse byte = 4
+
+// A frame on a connection as the debug console sees it
+type Frame struct {
+	Time time.Time `json:"time"`
+
+	// FrameIn if it came from the peer, FrameOut if it went to it
+	Direction string `json:"direction"`
+
+	Type    byte   `json:"type"`
+	Flags   byte   `json:"flags"`
+	Seq     uint64 `json:"seq"`
+	Length  uint64 `json:"length"`
+	Timeout uint32 `json:"timeout,omitempty"`
+
+	// The payload, uncompressed. Cut off after the first few KiB of a frame
+	// that was tapped; Length tells how long it really was.
+	Payload []byte `json:"payload,omitempty"`
+}
@@ -0,0 +1,134 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrBadSelector = errors.New("ERR_BAD_SELECTOR")
+
+// Label keys and values may not contain these, so they can be written as
+// key=value lists and selectors
+const labelReserved = "=!,() \t\r\n"
+
+func CheckLabel(key, value string) error {
+	if key == "" || strings.ContainsAny(key, labelReserved) {
+		return fmt.Errorf("invalid label key %q", key)
+	}
+
+	if strings.ContainsAny(value, labelReserved) {
+		return fmt.Errorf("invalid value %q for label %s", value, key)
+	}
+
+	return nil
+}
+
+// Parse key=value pairs, as found in the config, into a label set
+func ParseLabels(pairs []string) (map[string]string, error) {
+	res := make(map[string]string, len(pairs))
+	for _, kv := range pairs {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("label %q must be key=value", kv)
+		}
+
+		if err := CheckLabel(kv[:i], kv[i+1:]); err != nil {
+			return nil, err
+		}
+
+		res[kv[:i]] = kv[i+1:]
+	}
+
+	return res, nil
+}
+
+// Parse key=value pairs into a map. Unlike labels, values may be anything.
+func ParseMetadata(pairs []string) (map[string]string, error) {
+	res := make(map[string]string, len(pairs))
+	for _, kv := range pairs {
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%q must be key=value", kv)
+		}
+
+		res[kv[:i]] = kv[i+1:]
+	}
+
+	return res, nil
+}
+
+// Picks connections by their labels. A selector is a comma separated list of
+// requirements, all of which must hold:
+//
+//	site=paris		label site is paris (== works too)
+//	site!=paris		label site isn't paris, or isn't set
+//	site			label site is set
+//	!site			label site isn't set
+//
+// The empty selector matches everything.
+type Selector []requirement
+
+type requirement struct {
+	key   string
+	op    string
+	value string
+}
+
+func ParseSelector(s string) (Selector, error) {
+	var res Selector
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var r requirement
+		switch {
+		case strings.Contains(part, "!="):
+			i := strings.Index(part, "!=")
+			r = requirement{key: part[:i], op: "!=", value: part[i+2:]}
+		case strings.Contains(part, "=="):
+			i := strings.Index(part, "==")
+			r = requirement{key: part[:i], op: "=", value: part[i+2:]}
+		case strings.Contains(part, "="):
+			i := strings.Index(part, "=")
+			r = requirement{key: part[:i], op: "=", value: part[i+1:]}
+		case strings.HasPrefix(part, "!"):
+			r = requirement{key: part[1:], op: "!"}
+		default:
+			r = requirement{key: part, op: ""}
+		}
+
+		r.key, r.value = strings.TrimSpace(r.key), strings.TrimSpace(r.value)
+		if CheckLabel(r.key, r.value) != nil {
+			return nil, ErrBadSelector
+		}
+
+		res = append(res, r)
+	}
+
+	return res, nil
+}
+
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		v, ok := labels[r.key]
+
+		switch r.op {
+		case "=":
+			ok = ok && v == r.value
+		case "!=":
+			ok = !ok || v != r.value
+		case "!":
+			ok = !ok
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
@@ -1,11 +1,16 @@
 package common
 
-import "io"
+import (
+	"context"
+	"io"
+)
 
 // An outbound message over the TCP channel
 type EgressMessage struct {
 
-	// Sequence identifier for the message
+	// Sequence identifier for the message. Requests (messages with a
+	// ResponseChan) are assigned a fresh one when sent; a response must carry
+	// the Seq of the request it answers.
 	Seq uint64
 
 	// Length of this message payload
@@ -17,8 +22,18 @@ type EgressMessage struct {
 	// Whether or not the message payload should be interpreted as binary
 	Binary bool
 
+	// A message type registered with socket.Chain.Handle, or 0 for a CONTROL
+	// or DATA message as picked by Binary
+	Type byte
+
 	// Channel to receive the corresponding response message
 	ResponseChan chan IngressMessage
+
+	// Bounds a request that expects a response (optional). Its deadline is
+	// sent along so the remote end can give up too. Once it is done the
+	// remote end is told to abandon the request and ResponseChan receives an
+	// IngressMessage whose Err is Ctx.Err().
+	Ctx context.Context
 }
 
 // An inbound message over the TCP channel
@@ -38,4 +53,11 @@ type IngressMessage struct {
 
 	// Whether or not the message payload should be interpreted as binary
 	Binary bool
+
+	// The message's type if it isn't CONTROL or DATA, 0 otherwise
+	Type byte
+
+	// For new requests: done once the sender's deadline passes or it
+	// cancels the request. Whoever serves the request should stop then.
+	Ctx context.Context
 }
@@ -0,0 +1,33 @@
+package common
+
+import (
+	"time"
+)
+
+// A message waiting in the store-and-forward queue for its peer
+type QueuedMessage struct {
+
+	// Increases in the order messages were queued, across all peers
+	ID uint64 `json:"id"`
+
+	Peer string `json:"peer"`
+	Size int64  `json:"size"`
+
+	Enqueued time.Time `json:"enqueued"`
+
+	// The message is dropped if it can't be delivered by then
+	Expires time.Time `json:"expires"`
+
+	// Failed delivery attempts so far. Not kept across restarts.
+	Attempts int `json:"attempts"`
+}
+
+// What the store-and-forward queue holds for a peer
+type QueueSummary struct {
+	Peer     string `json:"peer"`
+	Messages int    `json:"messages"`
+	Bytes    int64  `json:"bytes"`
+
+	// Whether the peer is connected and its messages are being delivered
+	Connected bool `json:"connected"`
+}
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"fmt"
+)
+
+// How fast something may go. Zero means no limit. Each allows a burst of up
+// to one second's worth.
+type Rate struct {
+
+	// Requests per second
+	Requests int64 `json:"requests"`
+
+	// Bytes per second
+	Bytes int64 `json:"bytes"`
+}
+
+func (r Rate) Unlimited() bool {
+	return r.Requests == 0 && r.Bytes == 0
+}
+
+// Overrides the per-connection rate for one connection
+type ConnectionRate struct {
+	Connection int `json:"connection"`
+	Rate
+}
+
+// The rate for requests routed by Host, matched like routes: exactly, or by
+// subdomain if it starts with "*."
+type RouteRate struct {
+	Host string `json:"host"`
+	Rate
+}
+
+// Token bucket limits on the traffic of a tunnel end. Requests over a limit
+// are refused with a 429; bytes over a limit are delayed.
+type RateLimits struct {
+
+	// Shared by every connection
+	Global Rate `json:"global"`
+
+	// For each connection on its own, unless overridden in Connections
+	Connection  Rate             `json:"connection"`
+	Connections []ConnectionRate `json:"connections"`
+
+	Routes []RouteRate `json:"routes"`
+}
+
+// Check the limits for values that can't work. Returns every problem found.
+func (l RateLimits) Check() []string {
+	var errs []string
+	check := func(name string, r Rate) {
+		if r.Requests < 0 {
+			errs = append(errs, fmt.Sprintf("%s.requests: must not be negative", name))
+		}
+		if r.Bytes < 0 {
+			errs = append(errs, fmt.Sprintf("%s.bytes: must not be negative", name))
+		}
+	}
+
+	check("global", l.Global)
+	check("connection", l.Connection)
+
+	ids := make(map[int]bool)
+	for i, c := range l.Connections {
+		name := fmt.Sprintf("connections[%d]", i)
+		if ids[c.Connection] {
+			errs = append(errs, fmt.Sprintf("%s.connection: duplicate limit for connection %d", name, c.Connection))
+		}
+		ids[c.Connection] = true
+		check(name, c.Rate)
+	}
+
+	hosts := make(map[string]bool)
+	for i, r := range l.Routes {
+		name := fmt.Sprintf("routes[%d]", i)
+		if r.Host == "" {
+			errs = append(errs, name+".host: required")
+		} else if hosts[r.Host] {
+			errs = append(errs, fmt.Sprintf("%s.host: duplicate limit for %q", name, r.Host))
+		}
+		hosts[r.Host] = true
+		check(name, r.Rate)
+	}
+
+	return errs
+}
@@ -0,0 +1,15 @@
+package common
+
+// Proxied requests whose Host header matches Host go to Origin
+type Route struct {
+	Host   string `json:"host"`
+	Origin string `json:"origin"`
+}
+
+// The routes in force, as shown by GET /routes
+type RouteTable struct {
+
+	// Where requests that match no route go
+	Default string  `json:"default"`
+	Routes  []Route `json:"routes"`
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"time"
+)
+
+// States of a fragmented transfer
+const (
+	TransferSending    = "sending"
+	TransferWaiting    = "waiting"
+	TransferCommitting = "committing"
+	TransferDone       = "done"
+	TransferFailed     = "failed"
+	TransferCancelled  = "cancelled"
+)
+
+// Progress of a fragmented transfer we are sending
+type TransferStatus struct {
+	ID string `json:"id"`
+
+	// Name of the peer the transfer goes to. The transfer carries on over
+	// whatever connection that peer has at the moment.
+	Peer string `json:"peer"`
+
+	// Total payload size and how much of it the peer acknowledged
+	Size  int64 `json:"size"`
+	Acked int64 `json:"acked"`
+
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+}
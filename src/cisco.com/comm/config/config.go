@@ -0,0 +1,401 @@
+// Configuration for the comm daemon. A Config is assembled in layers: built-in
+// defaults, then an optional JSON config file, then COMM_* environment
+// variables and finally any command-line flags the user explicitly set.
+package config
+
+import (
+	"bytes"
+	"cisco.com/comm/common"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+type Config struct {
+	Mode    string     `json:"mode"`
+	Handler string     `json:"handler"`
+	API     APIConfig  `json:"api"`
+	WAN     WANConfig  `json:"wan"`
+	LAN     LANConfig  `json:"lan"`
+	TLS     TLSConfig  `json:"tls"`
+	Routes  []Route    `json:"routes"`
+	Auth    AuthConfig `json:"auth"`
+	Limits  Limits     `json:"limits"`
+	Log     LogConfig  `json:"log"`
+
+	Compression CompressionConfig `json:"compression"`
+	Transfers   TransfersConfig   `json:"transfers"`
+	Queue       QueueConfig       `json:"queue"`
+
+	// Request and byte rates per connection, per route and overall.
+	// Editable at runtime through the API.
+	RateLimits common.RateLimits `json:"rate_limits"`
+
+	Admission AdmissionConfig `json:"admission"`
+
+	// Which origins requests from the peer may reach
+	ACL ACLConfig `json:"acl"`
+
+	Audit AuditConfig `json:"audit"`
+
+	Tracing TracingConfig `json:"tracing"`
+}
+
+// The management API listener
+type APIConfig struct {
+	Port int `json:"port"`
+
+	// How long the outcome of an asynchronous message is kept after it
+	// finished
+	MessageTTL Duration `json:"message_ttl"`
+
+	// Bearer token required for every call but /healthz and /readyz. Empty
+	// leaves the API open.
+	Token string `json:"token"`
+
+	// Bearer token required for /debug/pprof and /debug/state. Empty turns
+	// them off.
+	DebugToken string `json:"debug_token"`
+}
+
+// The tunnel socket. In server mode this is the port to bind to, in client
+// mode the server and port to connect to.
+type WANConfig struct {
+	Server string `json:"server"`
+	Port   int    `json:"port"`
+
+	// Protect every message with CRC32C checksums. Turned on for a
+	// connection if either end asks for it.
+	Checksums bool `json:"checksums"`
+
+	// How often to send the peer a heartbeat if it does them too. The
+	// shorter interval of the two ends is used. Zero turns them off.
+	Heartbeat Duration `json:"heartbeat"`
+
+	// Name sent to the peer in the handshake. Identifies a client across
+	// reconnects. Defaults to the host name.
+	Name string `json:"name"`
+
+	// key=value pairs sent to the peer in the handshake, e.g. site=paris.
+	// The server picks connections for a broadcast by their labels.
+	Labels []string `json:"labels"`
+
+	// key=value pairs sent to the peer in the handshake for its records,
+	// e.g. customer=pepsi. Shown under info in GET /connections.
+	Metadata []string `json:"metadata"`
+}
+
+type LANConfig struct {
+
+	// Address LAN clients send requests to: host:port or unix:/path. In
+	// server mode every tunnel needs a listener of its own, so the port
+	// must be zero (random) there unless the peer has one in Ports, and
+	// "{peer}" or "{id}" in a socket path is replaced by the peer's name or
+	// the connection ID. Empty picks a random port.
+	Listen string `json:"listen"`
+
+	// Fixed LAN port for each peer, by the name it sends in the handshake,
+	// in server mode. It stays the same however often the peer reconnects.
+	Ports map[string]int `json:"ports"`
+
+	// Default destination (host:port) for proxied requests that don't match
+	// any route.
+	Origin string `json:"origin"`
+}
+
+type TLSConfig struct {
+	Enabled bool `json:"enabled"`
+
+	// PEM encoded certificate and key. Required in server mode, optional in
+	// client mode (client certificates).
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+
+	// PEM encoded CA bundle used to verify the peer. Uses the system pool if
+	// empty.
+	CA string `json:"ca"`
+
+	// Overrides the name used to verify the server certificate (client only)
+	ServerName string `json:"server_name"`
+
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+}
+
+// Send requests carrying the Host header Host to Origin instead of the
+// default LAN origin. Host may start with "*." to match any subdomain.
+type Route struct {
+	Host   string `json:"host"`
+	Origin string `json:"origin"`
+}
+
+type AuthConfig struct {
+
+	// Key presented to the server during the handshake (client mode)
+	Key string `json:"key"`
+
+	// Keys the server accepts from clients. An empty list disables
+	// authentication (server mode).
+	Keys []string `json:"keys"`
+}
+
+type Limits struct {
+
+	// Timeout for dialing the WAN server and LAN origins
+	DialTimeout Duration `json:"dial_timeout"`
+
+	// How long a proxied request may take end to end before the caller gets
+	// a 504. Zero means no limit.
+	RequestTimeout Duration `json:"request_timeout"`
+
+	// Largest message, in bytes, accepted from the peer. Announced in the
+	// handshake so the peer doesn't send anything bigger. Zero means no limit.
+	MaxInboundSize int64 `json:"max_inbound_size"`
+
+	// Largest message, in bytes, we send to the peer. The peer's
+	// max_inbound_size lowers it further per connection. Zero means no limit.
+	MaxOutboundSize int64 `json:"max_outbound_size"`
+}
+
+type CompressionConfig struct {
+
+	// Codecs to offer (client) or accept (server) in order of preference:
+	// "gzip", "flate" and/or "lz". Empty disables compression.
+	Codecs []string `json:"codecs"`
+
+	// Payloads smaller than this many bytes are sent uncompressed
+	MinSize int64 `json:"min_size"`
+}
+
+type TransfersConfig struct {
+
+	// Where fragmented transfers are spooled (sender) and assembled
+	// (receiver). Empty disables them.
+	Dir string `json:"dir"`
+
+	// Payload bytes per chunk
+	ChunkSize int64 `json:"chunk_size"`
+
+	// Largest transfer accepted from the peer, in bytes. Zero means no
+	// limit.
+	MaxSize int64 `json:"max_size"`
+}
+
+type QueueConfig struct {
+
+	// Where the store-and-forward queue keeps messages for peers until they
+	// can be delivered. Empty disables it.
+	Dir string `json:"dir"`
+
+	// How long a message is kept if it can't be delivered, unless whoever
+	// queued it says otherwise
+	TTL Duration `json:"ttl"`
+
+	// Most payload bytes queued per peer. Zero means no limit.
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// Which clients the server lets connect. Zero values mean no limit.
+type AdmissionConfig struct {
+
+	// Tunnels open at once, counting those still shaking hands
+	MaxTunnels int `json:"max_tunnels"`
+
+	// Tunnels open at once from a single address
+	MaxPerIP int `json:"max_per_ip"`
+
+	// Tunnels open at once from all addresses in a CIDR block together
+	CIDRLimits []CIDRLimit `json:"cidr_limits"`
+
+	// New connections accepted per second
+	AcceptRate int64 `json:"accept_rate"`
+
+	// Time a client has to complete the handshake after connecting
+	HandshakeTimeout Duration `json:"handshake_timeout"`
+
+	// Addresses or CIDR blocks. If allow is set, only clients from there
+	// are accepted; clients from deny never are.
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+type CIDRLimit struct {
+	CIDR string `json:"cidr"`
+	Max  int    `json:"max"`
+}
+
+// Requests from the peer must match an allow rule, if there are any, and no
+// deny rule. Denied requests get a 403.
+type ACLConfig struct {
+	Allow []ACLRule `json:"allow"`
+	Deny  []ACLRule `json:"deny"`
+}
+
+// Empty fields match anything
+type ACLRule struct {
+
+	// A host name, "*.example.com", an address or a CIDR block
+	Host string `json:"host"`
+
+	Ports   []int    `json:"ports"`
+	Methods []string `json:"methods"`
+
+	// Path prefixes
+	Paths []string `json:"paths"`
+}
+
+// Append-only log of proxied requests and API calls, one JSON object per line
+type AuditConfig struct {
+
+	// The file. Empty disables the audit log.
+	Path string `json:"path"`
+
+	// Rotate the file once it reaches this size or age. Zero means never.
+	MaxBytes int64    `json:"max_bytes"`
+	MaxAge   Duration `json:"max_age"`
+
+	// Chain every record to the one before by its hash, so that tampering
+	// shows
+	HashChain bool `json:"hash_chain"`
+}
+
+// Spans for requests passing through, following W3C traceparent headers
+type TracingConfig struct {
+
+	// "stdout" or "otlp". Empty disables tracing.
+	Exporter string `json:"exporter"`
+
+	// The OTLP/HTTP collector's traces URL
+	Endpoint string `json:"endpoint"`
+
+	ServiceName string `json:"service_name"`
+
+	// The share of new traces recorded, from 0 to 1
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+type LogConfig struct {
+
+	// One of debug, info, warn, error
+	Level string `json:"level"`
+}
+
+// A time.Duration that is written as a string ("1m30s") in config files.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("duration must be a string such as \"10s\"")
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+// Built-in defaults, for whatever the config file and environment don't set.
+// Message sizes are left unlimited, as they were before limits existed.
+func Default() *Config {
+	hostname, _ := os.Hostname()
+
+	return &Config{
+		Mode:    "server",
+		Handler: "api",
+		API:     APIConfig{MessageTTL: Duration(time.Hour)},
+		WAN:     WANConfig{Server: "localhost", Name: hostname, Heartbeat: Duration(15 * time.Second)},
+		LAN:     LANConfig{Origin: "localhost:8080"},
+		Limits: Limits{
+			DialTimeout: Duration(10 * time.Second),
+		},
+		Log:         LogConfig{Level: "info"},
+		Tracing:     TracingConfig{ServiceName: "comm", SampleRatio: 1},
+		Compression: CompressionConfig{MinSize: 1024},
+		Transfers:   TransfersConfig{ChunkSize: 1 << 20, MaxSize: 1 << 32},
+		Queue:       QueueConfig{TTL: Duration(24 * time.Hour), MaxBytes: 1 << 30},
+		Admission:   AdmissionConfig{HandshakeTimeout: Duration(10 * time.Second)},
+	}
+}
+
+// Load the defaults, overlay the file at path (if any) and then the
+// environment. The result is not validated.
+func Load(path string) (*Config, error) {
+	c := Default()
+
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.ApplyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Unknown keys are almost always typos, so refuse them rather than
+	// silently running with a default.
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(c); err != nil {
+		return &FileError{Path: path, Err: err}
+	}
+
+	return nil
+}
+
+// Returns a copy of the config with secrets masked, suitable for printing.
+func (c *Config) Redacted() *Config {
+	r := *c
+
+	if r.Auth.Key != "" {
+		r.Auth.Key = redacted
+	}
+
+	if r.API.Token != "" {
+		r.API.Token = redacted
+	}
+
+	if r.API.DebugToken != "" {
+		r.API.DebugToken = redacted
+	}
+
+	if len(c.Auth.Keys) > 0 {
+		r.Auth.Keys = make([]string, len(c.Auth.Keys))
+		for i := range r.Auth.Keys {
+			r.Auth.Keys[i] = redacted
+		}
+	}
+
+	return &r
+}
+
+const redacted = "********"
+
+// Reports a config file that couldn't be parsed.
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
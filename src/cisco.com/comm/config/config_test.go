@@ -0,0 +1,130 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		env   string
+		check func(c *Config) interface{}
+		want  interface{}
+	}{
+		{"COMM_MODE=client", func(c *Config) interface{} { return c.Mode }, "client"},
+		{"COMM_WAN_PORT=3501", func(c *Config) interface{} { return c.WAN.Port }, 3501},
+		{"COMM_WAN_CHECKSUMS=true", func(c *Config) interface{} { return c.WAN.Checksums }, true},
+		{"COMM_WAN_HEARTBEAT=2s", func(c *Config) interface{} { return c.WAN.Heartbeat }, Duration(2 * time.Second)},
+		{"COMM_TRACING_SAMPLE_RATIO=0.25", func(c *Config) interface{} { return c.Tracing.SampleRatio }, 0.25},
+		{"COMM_LIMITS_MAX_INBOUND_SIZE=1024", func(c *Config) interface{} { return c.Limits.MaxInboundSize }, int64(1024)},
+		{"COMM_AUTH_KEYS=a, b,,c", func(c *Config) interface{} { return c.Auth.Keys }, []string{"a", "b", "c"}},
+		{"COMM_LAN_PORTS=site-a=7001, site-b=7002", func(c *Config) interface{} { return c.LAN.Ports }, map[string]int{"site-a": 7001, "site-b": 7002}},
+
+		// The value may contain =, only the first one splits
+		{"COMM_API_TOKEN=a=b", func(c *Config) interface{} { return c.API.Token }, "a=b"},
+
+		// Not ours
+		{"MODE=client", func(c *Config) interface{} { return c.Mode }, "server"},
+	}
+
+	for _, test := range tests {
+		c := Default()
+		if err := c.ApplyEnv([]string{test.env}); err != nil {
+			t.Errorf("%s: %v", test.env, err)
+			continue
+		}
+
+		if got := test.check(c); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.env, got, test.want)
+		}
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string
+	}{
+		{"COMM_WAN_PORT=eighty", "COMM_WAN_PORT: "},
+		{"COMM_WAN_CHECKSUMS=maybe", "COMM_WAN_CHECKSUMS: "},
+		{"COMM_WAN_HEARTBEAT=15", "COMM_WAN_HEARTBEAT: "},
+		{"COMM_TRACING_SAMPLE_RATIO=half", "COMM_TRACING_SAMPLE_RATIO: "},
+		{"COMM_LAN_PORTS=site-a", "COMM_LAN_PORTS: "},
+	}
+
+	for _, test := range tests {
+		err := Default().ApplyEnv([]string{test.env})
+		if err == nil || !strings.HasPrefix(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want one starting with %q", test.env, err, test.want)
+		}
+	}
+}
+
+func TestEnvNames(t *testing.T) {
+	names := make(map[string]bool)
+	for _, name := range EnvNames() {
+		names[name] = true
+	}
+
+	for _, want := range []string{"COMM_MODE", "COMM_WAN_PORT", "COMM_API_DEBUG_TOKEN", "COMM_AUTH_KEYS"} {
+		if !names[want] {
+			t.Errorf("EnvNames lacks %s", want)
+		}
+	}
+
+	// Lists of structs can't be set from the environment
+	if names["COMM_ROUTES"] {
+		t.Error("EnvNames has COMM_ROUTES")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("The defaults don't validate: %v", err)
+	}
+
+	tests := []struct {
+		change func(c *Config)
+		want   string
+	}{
+		{func(c *Config) { c.Mode = "proxy" }, `mode: must be 'client' or 'server', got "proxy"`},
+		{func(c *Config) { c.Handler = "repl" }, `handler: must be 'api' or 'console' (or 'echo', its old name), got "repl"`},
+		{func(c *Config) { c.API.Port = 70000 }, "api.port: 70000 is not a valid TCP port"},
+		{func(c *Config) { c.WAN.Heartbeat = Duration(time.Millisecond) }, "wan.heartbeat: must be at least 1s"},
+		{func(c *Config) { c.Mode, c.WAN.Server = "client", "" }, "wan.server: required in client mode"},
+		{func(c *Config) { c.LAN.Origin = "localhost" }, "lan.origin: address localhost: missing port in address"},
+		{func(c *Config) { c.LAN.Listen = "unix:/tmp/comm.sock" }, "lan.listen: socket path must contain {peer} or {id} in server mode"},
+		{func(c *Config) { c.LAN.Listen = ":7000" }, "lan.listen: port must be 0 in server mode"},
+		{func(c *Config) { c.LAN.Ports = map[string]int{"a": 70000} }, "lan.ports.a: 70000 is not a valid TCP port"},
+		{func(c *Config) { c.LAN.Ports = map[string]int{"a": 7000, "b": 7000} }, "lan.ports.b: port 7000 is taken by a already"},
+		{func(c *Config) { c.Routes = []Route{{Host: "a", Origin: "b:1"}, {Host: "a", Origin: "b:2"}} }, `routes[1].host: duplicate route for "a"`},
+		{func(c *Config) { c.Compression.Codecs = []string{"zip"} }, `compression.codecs[0]: unknown codec "zip"`},
+		{func(c *Config) { c.ACL.Deny = []ACLRule{{Paths: []string{"admin"}}} }, `acl.deny[0].paths: "admin" must start with /`},
+		{func(c *Config) { c.Tracing.Exporter = "otlp" }, "tracing.endpoint: must be the collector's URL"},
+		{func(c *Config) { c.Log.Level = "trace" }, `log.level: must be one of debug, info, warn, error, got "trace"`},
+	}
+
+	for _, test := range tests {
+		c := Default()
+		test.change(c)
+
+		err := c.Validate()
+		if err == nil || !strings.Contains(err.Error(), "\n  - "+test.want) {
+			t.Errorf("Got %v, want an error with %q", err, test.want)
+		}
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	c := Default()
+	c.Mode = "proxy"
+	c.API.Port = -1
+	c.Log.Level = ""
+
+	err, ok := c.Validate().(ValidationError)
+	if !ok || len(err) != 3 {
+		t.Fatalf("Got %#v, want 3 problems", err)
+	}
+}
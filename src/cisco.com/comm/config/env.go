@@ -0,0 +1,159 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix for environment variables that override config values
+const EnvPrefix = "COMM_"
+
+// Override config values from environment variables given as KEY=VALUE
+// pairs (see os.Environ). Variable names are derived from the JSON keys of
+// the config file, e.g. {"wan": {"port": 1}} becomes COMM_WAN_PORT. Lists are
+// comma separated, and so are the key=value pairs of maps. Routes can't be
+// overridden from the environment.
+func (c *Config) ApplyEnv(environ []string) error {
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if i := strings.Index(kv, "="); i > 0 && strings.HasPrefix(kv, EnvPrefix) {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	return applyEnv(reflect.ValueOf(c).Elem(), strings.TrimSuffix(EnvPrefix, "_"), env)
+}
+
+// Names of every environment variable ApplyEnv understands
+func EnvNames() []string {
+	var names []string
+	collectEnvNames(reflect.TypeOf(Config{}), strings.TrimSuffix(EnvPrefix, "_"), &names)
+	return names
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+func envName(prefix string, f reflect.StructField) string {
+	tag := strings.Split(f.Tag.Get("json"), ",")[0]
+	return prefix + "_" + strings.ToUpper(tag)
+}
+
+func collectEnvNames(t reflect.Type, prefix string, names *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := envName(prefix, f)
+
+		switch {
+		case f.Type.Kind() == reflect.Struct:
+			collectEnvNames(f.Type, name, names)
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() != reflect.String:
+			// Not settable from the environment
+		default:
+			*names = append(*names, name)
+		}
+	}
+}
+
+func applyEnv(v reflect.Value, prefix string, env map[string]string) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := envName(prefix, f)
+		field := v.Field(i)
+
+		if f.Type.Kind() == reflect.Struct {
+			if err := applyEnv(field, name, env); err != nil {
+				return err
+			}
+			continue
+		}
+
+		raw, ok := env[name]
+		if !ok {
+			continue
+		}
+
+		if err := setField(field, raw); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+func setField(field reflect.Value, raw string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("can't be set from the environment")
+		}
+
+		var items []string
+		for _, s := range strings.Split(raw, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				items = append(items, s)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	case reflect.Map:
+		if field.Type().Key().Kind() != reflect.String || field.Type().Elem().Kind() != reflect.Int {
+			return fmt.Errorf("can't be set from the environment")
+		}
+
+		m := make(map[string]int)
+		for _, s := range strings.Split(raw, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+
+			i := strings.Index(s, "=")
+			if i <= 0 {
+				return fmt.Errorf("%q is not key=value", s)
+			}
+
+			n, err := strconv.Atoi(strings.TrimSpace(s[i+1:]))
+			if err != nil {
+				return err
+			}
+			m[strings.TrimSpace(s[:i])] = n
+		}
+		field.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// Build the tls.Config for the WAN listener. Returns nil if TLS is disabled.
+func (t TLSConfig) ServerConfig() (*tls.Config, error) {
+	if !t.Enabled {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	// With a CA configured, clients must present a certificate signed by it.
+	if t.CA != "" {
+		pool, err := loadPool(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return conf, nil
+}
+
+// Build the tls.Config used to dial server. Returns nil if TLS is disabled.
+func (t TLSConfig) ClientConfig(server string) (*tls.Config, error) {
+	if !t.Enabled {
+		return nil, nil
+	}
+
+	conf := &tls.Config{ServerName: server, InsecureSkipVerify: t.InsecureSkipVerify}
+
+	if t.ServerName != "" {
+		conf.ServerName = t.ServerName
+	}
+
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	if t.CA != "" {
+		pool, err := loadPool(t.CA)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+
+	return conf, nil
+}
+
+func loadPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New(path + ": no certificates found")
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,354 @@
+package config
+
+import (
+	"cisco.com/comm/common"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every problem found by Validate. Reporting all of them at once saves the
+// operator a round trip per typo.
+type ValidationError []string
+
+func (v ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(v, "\n  - ")
+}
+
+// Check the config for values that can't work. Returns nil or a
+// ValidationError.
+func (c *Config) Validate() error {
+	var errs ValidationError
+	fail := func(ft string, x ...interface{}) {
+		errs = append(errs, fmt.Sprintf(ft, x...))
+	}
+
+	switch c.Mode {
+	case "client", "server":
+	default:
+		fail("mode: must be 'client' or 'server', got %q", c.Mode)
+	}
+
+	switch c.Handler {
+	case "api", "console", "echo":
+	default:
+		fail("handler: must be 'api' or 'console' (or 'echo', its old name), got %q", c.Handler)
+	}
+
+	checkPort := func(name string, port int) {
+		if port < 0 || port > 65535 {
+			fail("%s: %d is not a valid TCP port", name, port)
+		}
+	}
+
+	checkPort("api.port", c.API.Port)
+
+	if c.API.MessageTTL <= 0 {
+		fail("api.message_ttl: must be positive")
+	}
+
+	checkPort("wan.port", c.WAN.Port)
+
+	if c.WAN.Heartbeat < 0 {
+		fail("wan.heartbeat: must not be negative")
+	} else if c.WAN.Heartbeat > 0 && c.WAN.Heartbeat < Duration(time.Second) {
+		fail("wan.heartbeat: must be at least 1s")
+	}
+
+	if c.Mode == "client" {
+		if c.WAN.Server == "" {
+			fail("wan.server: required in client mode")
+		}
+		if c.WAN.Port == 0 {
+			fail("wan.port: required in client mode")
+		}
+	}
+
+	if err := checkListen(c.LAN.Listen, c.Mode); err != nil {
+		fail("lan.listen: %v", err)
+	}
+
+	if len(c.LAN.Ports) > 0 && c.Mode != "server" {
+		fail("lan.ports: only used in server mode, set the port in lan.listen instead")
+	}
+
+	byPort := make(map[int]string)
+	for _, peer := range sortedKeys(c.LAN.Ports) {
+		port := c.LAN.Ports[peer]
+		switch {
+		case peer == "":
+			fail("lan.ports: empty peer name")
+		case port <= 0 || port > 65535:
+			fail("lan.ports.%s: %d is not a valid TCP port", peer, port)
+		case byPort[port] != "":
+			fail("lan.ports.%s: port %d is taken by %s already", peer, port, byPort[port])
+		default:
+			byPort[port] = peer
+		}
+	}
+
+	if err := checkHostPort(c.LAN.Origin); err != nil {
+		fail("lan.origin: %v", err)
+	}
+
+	if c.TLS.Enabled {
+		if c.Mode == "server" && (c.TLS.Cert == "" || c.TLS.Key == "") {
+			fail("tls: cert and key are required in server mode")
+		}
+		if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+			fail("tls: cert and key must be given together")
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, r := range c.Routes {
+		if r.Host == "" {
+			fail("routes[%d].host: required", i)
+		} else if seen[r.Host] {
+			fail("routes[%d].host: duplicate route for %q", i, r.Host)
+		}
+		seen[r.Host] = true
+
+		if err := checkHostPort(r.Origin); err != nil {
+			fail("routes[%d].origin: %v", i, err)
+		}
+	}
+
+	for i, k := range c.Auth.Keys {
+		if k == "" {
+			fail("auth.keys[%d]: empty key", i)
+		}
+	}
+
+	if c.Limits.DialTimeout < 0 {
+		fail("limits.dial_timeout: must not be negative")
+	}
+
+	if c.Limits.RequestTimeout < 0 {
+		fail("limits.request_timeout: must not be negative")
+	}
+
+	if _, err := common.ParseLabels(c.WAN.Labels); err != nil {
+		fail("wan.labels: %v", err)
+	}
+
+	if _, err := common.ParseMetadata(c.WAN.Metadata); err != nil {
+		fail("wan.metadata: %v", err)
+	}
+
+	if c.Limits.MaxInboundSize < 0 {
+		fail("limits.max_inbound_size: must not be negative")
+	}
+
+	if c.Limits.MaxOutboundSize < 0 {
+		fail("limits.max_outbound_size: must not be negative")
+	}
+
+	for i, name := range c.Compression.Codecs {
+		if name != "gzip" && name != "flate" && name != "lz" {
+			fail("compression.codecs[%d]: unknown codec %q, must be gzip, flate or lz", i, name)
+		}
+	}
+
+	if c.Compression.MinSize < 0 {
+		fail("compression.min_size: must not be negative")
+	}
+
+	if c.Transfers.ChunkSize <= 0 {
+		fail("transfers.chunk_size: must be positive")
+	}
+
+	if c.Transfers.MaxSize < 0 {
+		fail("transfers.max_size: must not be negative")
+	}
+
+	if c.Queue.TTL <= 0 {
+		fail("queue.ttl: must be positive")
+	}
+
+	if c.Queue.MaxBytes < 0 {
+		fail("queue.max_bytes: must not be negative")
+	}
+
+	for _, err := range c.RateLimits.Check() {
+		fail("rate_limits.%s", err)
+	}
+
+	if c.Admission.MaxTunnels < 0 {
+		fail("admission.max_tunnels: must not be negative")
+	}
+
+	if c.Admission.MaxPerIP < 0 {
+		fail("admission.max_per_ip: must not be negative")
+	}
+
+	for i, l := range c.Admission.CIDRLimits {
+		if _, err := common.ParseCIDR(l.CIDR); err != nil {
+			fail("admission.cidr_limits[%d].cidr: %v", i, err)
+		}
+		if l.Max <= 0 {
+			fail("admission.cidr_limits[%d].max: must be positive", i)
+		}
+	}
+
+	if c.Admission.AcceptRate < 0 {
+		fail("admission.accept_rate: must not be negative")
+	}
+
+	if c.Admission.HandshakeTimeout < 0 {
+		fail("admission.handshake_timeout: must not be negative")
+	}
+
+	for i, s := range c.Admission.Allow {
+		if _, err := common.ParseCIDR(s); err != nil {
+			fail("admission.allow[%d]: %v", i, err)
+		}
+	}
+
+	for i, s := range c.Admission.Deny {
+		if _, err := common.ParseCIDR(s); err != nil {
+			fail("admission.deny[%d]: %v", i, err)
+		}
+	}
+
+	for i, r := range c.ACL.Allow {
+		if err := checkACLRule(r); err != nil {
+			fail("acl.allow[%d].%v", i, err)
+		}
+	}
+
+	for i, r := range c.ACL.Deny {
+		if err := checkACLRule(r); err != nil {
+			fail("acl.deny[%d].%v", i, err)
+		}
+	}
+
+	if c.Audit.MaxBytes < 0 {
+		fail("audit.max_bytes: must not be negative")
+	}
+
+	if c.Audit.MaxAge < 0 {
+		fail("audit.max_age: must not be negative")
+	}
+
+	switch c.Tracing.Exporter {
+	case "", "stdout":
+	case "otlp":
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			fail("tracing.endpoint: must be the collector's URL for the otlp exporter, got %q", c.Tracing.Endpoint)
+		}
+	default:
+		fail("tracing.exporter: must be stdout or otlp, got %q", c.Tracing.Exporter)
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		fail("tracing.sample_ratio: must be between 0 and 1")
+	}
+
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		fail("log.level: must be one of debug, info, warn, error, got %q", c.Log.Level)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func checkHostPort(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("required")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	if host == "" {
+		return fmt.Errorf("missing host in %q", addr)
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("invalid port in %q", addr)
+	}
+
+	return nil
+}
+
+func checkListen(addr, mode string) error {
+	if addr == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(addr, "unix:") {
+		path := addr[len("unix:"):]
+		if path == "" {
+			return fmt.Errorf("missing socket path")
+		}
+		if mode == "server" && !strings.Contains(path, "{peer}") && !strings.Contains(path, "{id}") {
+			return fmt.Errorf("socket path must contain {peer} or {id} in server mode, every connection needs its own socket")
+		}
+		return nil
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port in %q", addr)
+	}
+
+	if mode == "server" && n != 0 {
+		return fmt.Errorf("port must be 0 in server mode, every connection needs its own listener; give peers fixed ports with lan.ports")
+	}
+
+	return nil
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func checkACLRule(r ACLRule) error {
+	if strings.Contains(r.Host, "/") {
+		if _, err := common.ParseCIDR(r.Host); err != nil {
+			return fmt.Errorf("host: %v", err)
+		}
+	}
+
+	for _, p := range r.Ports {
+		if p <= 0 || p > 65535 {
+			return fmt.Errorf("ports: %d is not a valid TCP port", p)
+		}
+	}
+
+	for _, m := range r.Methods {
+		if m == "" || strings.ContainsAny(m, " \t\r\n") {
+			return fmt.Errorf("methods: invalid method %q", m)
+		}
+	}
+
+	for _, p := range r.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("paths: %q must start with /", p)
+		}
+	}
+
+	return nil
+}
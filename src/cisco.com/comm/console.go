@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"cisco.com/comm/api"
+	"cisco.com/comm/common"
+	"cisco.com/comm/socket"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const consoleUsageText = `usage: comm console [-api URL] [-token TOKEN] [-script FILE] [-timeout D] ID
+
+Attach the debug console to connection ID of a running comm, through
+/debug/connections/ID/frames. Commands are read from FILE, or stdin:
+
+  send TYPE [seq=N] [response] [timeout=MS] [PAYLOAD]
+  expect [TYPE] [seq=N|seq=last] [response|request] [within=D] [PAYLOAD]
+  sleep D
+  quit
+
+The API URL defaults as for comm ctl, the token to $COMM_API_DEBUG_TOKEN. A
+script stops at the first step that fails. Exit status is as for comm ctl.`
+
+// comm console [flags] ID	Debug a connection of a running comm frame by frame
+func runConsole(args []string) int {
+	port := os.Getenv("COMM_API_PORT")
+	if port == "" {
+		port = "3500"
+	}
+	base := os.Getenv("COMM_CTL_API")
+	if base == "" {
+		base = "http://" + net.JoinHostPort("localhost", port)
+	}
+
+	fs := flag.NewFlagSet("console", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintln(os.Stderr, consoleUsageText) }
+	apiURL := fs.String("api", base, "URL of the API")
+	token := fs.String("token", os.Getenv("COMM_API_DEBUG_TOKEN"), "Debug token of the API")
+	script := fs.String("script", "", "Run the commands in this file")
+	timeout := fs.Duration("timeout", 5*time.Second, "How long expect waits by default")
+
+	if err := fs.Parse(args); err != nil {
+		return ctlUsage
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, consoleUsageText)
+		return ctlUsage
+	}
+	id, err := strconv.Atoi(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad connection ID %q\n", fs.Arg(0))
+		return ctlUsage
+	}
+
+	opts := socket.ConsoleOptions{In: os.Stdin, Out: os.Stdout, Timeout: *timeout}
+	if *script != "" {
+		f, err := os.Open(*script)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return ctlUsage
+		}
+		defer f.Close()
+		opts.In, opts.Script = f, true
+	} else if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice == 0 {
+		opts.Script = true
+	}
+
+	c := &ctlClient{
+		base:  strings.TrimSuffix(*apiURL, "/"),
+		token: *token,
+		out:   os.Stdout,
+		http:  &http.Client{},
+	}
+
+	l, err := attach(c, id)
+	if err == nil {
+		defer l.Close()
+		err = socket.RunConsole(l, opts)
+	}
+	if err == nil {
+		return ctlOK
+	}
+
+	fmt.Fprintln(os.Stderr, err)
+	if e, ok := err.(*ctlError); ok {
+		return e.code
+	}
+	return ctlFailed
+}
+
+// The frames of a connection of another process, through its API
+type httpLink struct {
+	c      *ctlClient
+	path   string
+	body   io.Closer
+	frames chan common.Frame
+}
+
+// Start following the frames of connection id, so that nothing sent after
+// this returns is missed
+func attach(c *ctlClient, id int) (*httpLink, error) {
+	path := fmt.Sprintf("/debug/connections/%d/frames", id)
+
+	res, err := c.do("GET", path, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &httpLink{c: c, path: path, body: res.Body, frames: make(chan common.Frame, 1024)}
+	go func() {
+		defer close(l.frames)
+
+		dec := json.NewDecoder(res.Body)
+		for {
+			var f common.Frame
+			if err := dec.Decode(&f); err != nil {
+				return
+			}
+			l.frames <- f
+		}
+	}()
+	return l, nil
+}
+
+func (l *httpLink) Send(f common.Frame) (uint64, error) {
+	q := url.Values{"type": {strconv.Itoa(int(f.Type))}}
+	if f.Seq != 0 {
+		q.Set("seq", strconv.FormatUint(f.Seq, 10))
+	}
+	if f.Flags&common.FrameResponse != 0 {
+		q.Set("response", "1")
+	}
+	if f.Timeout != 0 {
+		q.Set("timeout", strconv.FormatUint(uint64(f.Timeout), 10))
+	}
+
+	res, err := l.c.do("POST", l.path+"?"+q.Encode(), bytes.NewReader(f.Payload), int64(len(f.Payload)))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	var sent api.SendFrameResponse
+	if err := json.NewDecoder(res.Body).Decode(&sent); err != nil {
+		return 0, err
+	}
+	return sent.Seq, nil
+}
+
+func (l *httpLink) Frames() <-chan common.Frame {
+	return l.frames
+}
+
+func (l *httpLink) Close() error {
+	return l.body.Close()
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cisco.com/comm/api"
+	"cisco.com/comm/common"
+	"cisco.com/comm/events"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes of comm ctl
+const (
+	ctlOK          = 0
+	ctlFailed      = 1 // The API refused the call or the request failed
+	ctlUsage       = 2
+	ctlUnreachable = 3 // The API didn't answer
+)
+
+const ctlUsageText = `usage: comm ctl [-api URL] [-token TOKEN] [-json] COMMAND
+
+  connections ls [-selector S] [-peer P] [-idle D] [-sort K] [-limit N]
+  connections show ID
+  connections kill ID
+  send [-timeout D] [-async] ID [FILE]   send FILE (or stdin) to a connection
+  tail events [-since ID]                follow the event stream
+  metrics
+  routes
+  reload
+
+The API URL defaults to $COMM_CTL_API or http://localhost:$COMM_API_PORT
+(3500 if unset), the token to $COMM_API_TOKEN. Exit status is 0 on success,
+1 if the call failed, 2 for bad usage and 3 if the API can't be reached.`
+
+// A call to the API failed: it answered with an error, or not at all
+type ctlError struct {
+	code int
+	msg  string
+}
+
+func (e *ctlError) Error() string {
+	return e.msg
+}
+
+type ctlClient struct {
+	base  string
+	token string
+	json  bool
+	out   io.Writer
+	http  *http.Client
+}
+
+// comm ctl [flags] COMMAND	Drive a running comm through its API
+func runCtl(args []string) int {
+	port := os.Getenv("COMM_API_PORT")
+	if port == "" {
+		port = "3500"
+	}
+	base := os.Getenv("COMM_CTL_API")
+	if base == "" {
+		base = "http://" + net.JoinHostPort("localhost", port)
+	}
+
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintln(os.Stderr, ctlUsageText) }
+	apiURL := fs.String("api", base, "URL of the API")
+	token := fs.String("token", os.Getenv("COMM_API_TOKEN"), "Bearer token for the API")
+	asJSON := fs.Bool("json", false, "Print the API's JSON instead of tables")
+
+	if err := fs.Parse(args); err != nil {
+		return ctlUsage
+	}
+
+	c := &ctlClient{
+		base:  strings.TrimSuffix(*apiURL, "/"),
+		token: *token,
+		json:  *asJSON,
+		out:   os.Stdout,
+		http:  &http.Client{},
+	}
+
+	err := c.run(fs.Args())
+	if err == nil {
+		return ctlOK
+	}
+
+	fmt.Fprintln(os.Stderr, err)
+	if e, ok := err.(*ctlError); ok {
+		return e.code
+	}
+	return ctlFailed
+}
+
+func usageError(format string, a ...interface{}) error {
+	return &ctlError{code: ctlUsage, msg: fmt.Sprintf(format, a...) + "\n\n" + ctlUsageText}
+}
+
+func (c *ctlClient) run(args []string) error {
+	if len(args) == 0 {
+		return usageError("no command given")
+	}
+
+	switch args[0] {
+	case "connections":
+		if len(args) < 2 {
+			return usageError("connections needs ls, show or kill")
+		}
+		switch args[1] {
+		case "ls":
+			return c.connections(args[2:])
+		case "show":
+			return c.connection(args[2:])
+		case "kill":
+			return c.kill(args[2:])
+		}
+		return usageError("unknown connections command %q", args[1])
+	case "send":
+		return c.send(args[1:])
+	case "tail":
+		if len(args) < 2 || args[1] != "events" {
+			return usageError("tail needs events")
+		}
+		return c.tail(args[2:])
+	case "metrics":
+		return c.metrics()
+	case "routes":
+		return c.routes()
+	case "reload":
+		return c.reload()
+	}
+	return usageError("unknown command %q", args[0])
+}
+
+// Call the API. A response other than 2xx is turned into an error, with what
+// the API said about it.
+func (c *ctlClient) do(method, path string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return nil, &ctlError{code: ctlUsage, msg: err.Error()}
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("content-length", strconv.FormatInt(size, 10))
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, &ctlError{code: ctlUnreachable, msg: err.Error()}
+	}
+
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		data, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+
+		msg := strings.TrimSpace(string(data))
+		var e api.ErrorResponse
+		if json.Unmarshal(data, &e) == nil {
+			switch {
+			case e.Error != "" && e.Message != "":
+				msg = e.Error + ": " + e.Message
+			case e.Error != "":
+				msg = e.Error
+			case e.Message != "":
+				msg = e.Message
+			}
+		}
+		return nil, &ctlError{code: ctlFailed, msg: fmt.Sprintf("%s %s: %s: %s", method, path, res.Status, msg)}
+	}
+	return res, nil
+}
+
+// Call the API and decode its JSON answer into v, or with -json print it as is
+func (c *ctlClient) get(method, path string, v interface{}) (printed bool, err error) {
+	res, err := c.do(method, path, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return false, err
+	}
+
+	if c.json {
+		var out bytes.Buffer
+		if json.Indent(&out, data, "", "  ") != nil {
+			out.Reset()
+			out.Write(data)
+		}
+		fmt.Fprintln(c.out, out.String())
+		return true, nil
+	}
+	return false, json.Unmarshal(data, v)
+}
+
+// A connection as listed by the API
+type ctlConnection struct {
+	ID     int `json:"id"`
+	Remote struct {
+		IP   string
+		Port int
+	} `json:"remote"`
+	Peer string          `json:"peer"`
+	Info common.PeerInfo `json:"info"`
+	LAN  string          `json:"lan"`
+	common.ConnectionStats
+}
+
+func (c *ctlClient) connections(args []string) error {
+	fs := flag.NewFlagSet("connections ls", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	q := url.Values{}
+	for _, name := range []string{"selector", "peer", "idle", "sort", "limit"} {
+		fs.String(name, "", "")
+	}
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return usageError("bad arguments to connections ls")
+	}
+	fs.Visit(func(f *flag.Flag) { q.Set(f.Name, f.Value.String()) })
+
+	path := "/connections"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+
+	var res struct {
+		Connections []ctlConnection `json:"connections"`
+	}
+	if printed, err := c.get("GET", path, &res); printed || err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPEER\tREMOTE\tVERSION\tLAN\tCONNECTED\tIDLE\tIN\tOUT")
+	for _, conn := range res.Connections {
+		remote := ""
+		if conn.Remote.IP != "" {
+			remote = net.JoinHostPort(conn.Remote.IP, strconv.Itoa(conn.Remote.Port))
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			conn.ID, orDash(conn.Peer), orDash(remote), orDash(conn.Info.Version), orDash(conn.LAN),
+			conn.Connected.Local().Format("2006-01-02 15:04:05"),
+			time.Since(conn.LastActivity).Round(time.Second),
+			traffic(conn.MessagesIn, conn.BytesIn), traffic(conn.MessagesOut, conn.BytesOut))
+	}
+	return w.Flush()
+}
+
+func (c *ctlClient) connection(args []string) error {
+	id, err := connectionID(args)
+	if err != nil {
+		return err
+	}
+
+	// There's no better table than the JSON itself
+	c.json = true
+	_, err = c.get("GET", "/connections/"+strconv.Itoa(id), nil)
+	return err
+}
+
+func (c *ctlClient) kill(args []string) error {
+	id, err := connectionID(args)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.do("DELETE", "/connections/"+strconv.Itoa(id), nil, 0)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	fmt.Fprintf(c.out, "connection %d dropped\n", id)
+	return nil
+}
+
+func (c *ctlClient) send(args []string) error {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	timeout := fs.Duration("timeout", 0, "")
+	async := fs.Bool("async", false, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() < 1 || fs.NArg() > 2 {
+		return usageError("bad arguments to send")
+	}
+
+	id, err := connectionID(fs.Args()[:1])
+	if err != nil {
+		return err
+	}
+
+	// The API wants the length up front
+	var body io.Reader
+	var size int64
+	if fs.NArg() == 2 && fs.Arg(1) != "-" {
+		f, err := os.Open(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		body, size = f, st.Size()
+	} else {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		body, size = bytes.NewReader(data), int64(len(data))
+	}
+
+	method := "PUT"
+	if *async {
+		method = "POST"
+	}
+	path := "/transceiver/" + strconv.Itoa(id)
+	if *timeout > 0 {
+		path += "?timeout=" + timeout.String()
+	}
+
+	res, err := c.do(method, path, body, size)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	_, err = io.Copy(c.out, res.Body)
+	return err
+}
+
+func (c *ctlClient) tail(args []string) error {
+	fs := flag.NewFlagSet("tail events", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	since := fs.Uint64("since", 0, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return usageError("bad arguments to tail events")
+	}
+
+	res, err := c.do("GET", fmt.Sprintf("/events?follow=1&since=%d", *since), nil, 0)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if c.json {
+			fmt.Fprintln(c.out, scanner.Text())
+			continue
+		}
+
+		var e events.Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return err
+		}
+
+		line := fmt.Sprintf("%s  %-12s  #%d", e.Time.Local().Format("2006-01-02 15:04:05"), e.Type, e.ID)
+		if e.Connection != 0 {
+			line += fmt.Sprintf("  connection=%d", e.Connection)
+		}
+		if e.Peer != "" {
+			line += "  peer=" + e.Peer
+		}
+		if e.Remote != "" {
+			line += "  remote=" + e.Remote
+		}
+		if e.Reason != "" {
+			line += "  reason=" + e.Reason
+		}
+		fmt.Fprintln(c.out, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return &ctlError{code: ctlUnreachable, msg: "the API closed the event stream"}
+}
+
+func (c *ctlClient) metrics() error {
+	res, err := c.do("GET", "/metrics", nil, 0)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	_, err = io.Copy(c.out, res.Body)
+	return err
+}
+
+func (c *ctlClient) routes() error {
+	var t common.RouteTable
+	if printed, err := c.get("GET", "/routes", &t); printed || err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tORIGIN")
+	for _, r := range t.Routes {
+		fmt.Fprintf(w, "%s\t%s\n", r.Host, r.Origin)
+	}
+	fmt.Fprintf(w, "*\t%s\n", orDash(t.Default))
+	return w.Flush()
+}
+
+func (c *ctlClient) reload() error {
+	var res api.ReloadResult
+	if printed, err := c.get("POST", "/reload", &res); printed || err != nil {
+		return err
+	}
+
+	fmt.Fprintln(c.out, "configuration reloaded")
+	if len(res.Revoked) > 0 {
+		fmt.Fprintf(c.out, "dropped connections with revoked keys: %v\n", res.Revoked)
+	}
+	if len(res.RestartRequired) > 0 {
+		fmt.Fprintf(c.out, "changed but need a restart: %s\n", strings.Join(res.RestartRequired, ", "))
+	}
+	return nil
+}
+
+func connectionID(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, usageError("expected a connection ID")
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil || id < 0 {
+		return 0, usageError("%q is not a connection ID", args[0])
+	}
+	return id, nil
+}
+
+// Messages and bytes, e.g. "12 / 3.4 KiB"
+func traffic(messages, n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%d / %d B", messages, n)
+	}
+	return fmt.Sprintf("%d / %.1f %s", messages, f, units[i])
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A request the fake API got
+type ctlRequest struct {
+	method, uri, token, body string
+}
+
+// An API that records what it's asked and answers every call with status and
+// body
+func newTestAPI(t *testing.T, status int, body string) (*httptest.Server, func() []ctlRequest) {
+	var m sync.Mutex
+	var requests []ctlRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		m.Lock()
+		requests = append(requests, ctlRequest{r.Method, r.URL.RequestURI(), r.Header.Get("Authorization"), string(data)})
+		m.Unlock()
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []ctlRequest {
+		m.Lock()
+		defer m.Unlock()
+		return append([]ctlRequest(nil), requests...)
+	}
+}
+
+func newTestCtl(base string) (*ctlClient, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	return &ctlClient{base: base, token: "secret", out: out, http: &http.Client{}}, out
+}
+
+func TestCtlArguments(t *testing.T) {
+	tests := []struct {
+		args   []string
+		method string
+		uri    string
+	}{
+		{[]string{"connections", "ls"}, "GET", "/connections"},
+		{[]string{"connections", "ls", "-selector", "site=paris", "-sort", "-messages_in", "-limit", "5"},
+			"GET", "/connections?limit=5&selector=site%3Dparis&sort=-messages_in"},
+		{[]string{"connections", "ls", "-peer", "alpha", "-idle", "5m"}, "GET", "/connections?idle=5m&peer=alpha"},
+		{[]string{"connections", "show", "7"}, "GET", "/connections/7"},
+		{[]string{"connections", "kill", "7"}, "DELETE", "/connections/7"},
+		{[]string{"send", "7", "ctl_test.go"}, "PUT", "/transceiver/7"},
+		{[]string{"send", "-async", "-timeout", "2s", "7", "ctl_test.go"}, "POST", "/transceiver/7?timeout=2s"},
+		{[]string{"metrics"}, "GET", "/metrics"},
+		{[]string{"routes"}, "GET", "/routes"},
+		{[]string{"reload"}, "POST", "/reload"},
+	}
+
+	for _, test := range tests {
+		server, requests := newTestAPI(t, http.StatusOK, "{}")
+		c, _ := newTestCtl(server.URL)
+		if err := c.run(test.args); err != nil {
+			t.Errorf("%v: %v", test.args, err)
+			continue
+		}
+
+		got := requests()
+		if len(got) != 1 || got[0].method != test.method || got[0].uri != test.uri {
+			t.Errorf("%v: got %+v, want %s %s", test.args, got, test.method, test.uri)
+			continue
+		}
+		if got[0].token != "Bearer secret" {
+			t.Errorf("%v: got authorization %q", test.args, got[0].token)
+		}
+	}
+
+	// send passes the file on as it is
+	server, requests := newTestAPI(t, http.StatusOK, "answer")
+	c, out := newTestCtl(server.URL)
+	if err := c.run([]string{"send", "7", "ctl.go"}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile("ctl.go")
+	if got := requests(); len(got) != 1 || got[0].body != string(data) {
+		t.Errorf("send: the API got a different body")
+	}
+	if out.String() != "answer" {
+		t.Errorf("send: printed %q, want the answer", out)
+	}
+}
+
+func TestCtlUsage(t *testing.T) {
+	server, requests := newTestAPI(t, http.StatusOK, "{}")
+	for _, args := range [][]string{
+		{},
+		{"bogus"},
+		{"connections"},
+		{"connections", "rm", "7"},
+		{"connections", "ls", "extra"},
+		{"connections", "ls", "-color", "red"},
+		{"connections", "show"},
+		{"connections", "show", "seven"},
+		{"connections", "kill", "-1"},
+		{"connections", "kill", "7", "8"},
+		{"send"},
+		{"send", "7", "a", "b"},
+		{"send", "-timeout", "soon", "7"},
+		{"tail"},
+		{"tail", "logs"},
+		{"tail", "events", "-since", "last"},
+	} {
+		c, _ := newTestCtl(server.URL)
+		err := c.run(args)
+		e, ok := err.(*ctlError)
+		if !ok || e.code != ctlUsage {
+			t.Errorf("%v: got %v, want a usage error", args, err)
+			continue
+		}
+		if !strings.HasSuffix(e.msg, ctlUsageText) {
+			t.Errorf("%v: the usage isn't shown: %q", args, e.msg)
+		}
+	}
+
+	if got := requests(); len(got) > 0 {
+		t.Errorf("bad usage called the API: %+v", got)
+	}
+}
+
+func TestCtlErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+		want   string
+	}{
+		{http.StatusNotFound, `{"error": "ERR_NOT_FOUND", "message": "No such connection"}`,
+			"DELETE /connections/7: 404 Not Found: ERR_NOT_FOUND: No such connection"},
+		{http.StatusBadRequest, `{"error": "ERR_BAD_QUERY"}`,
+			"DELETE /connections/7: 400 Bad Request: ERR_BAD_QUERY"},
+		{http.StatusMethodNotAllowed, `{"message": "DELETE not allowed here"}`,
+			"DELETE /connections/7: 405 Method Not Allowed: DELETE not allowed here"},
+		{http.StatusBadGateway, "upstream is down\n",
+			"DELETE /connections/7: 502 Bad Gateway: upstream is down"},
+	}
+
+	for _, test := range tests {
+		server, _ := newTestAPI(t, test.status, test.body)
+		c, out := newTestCtl(server.URL)
+		err := c.run([]string{"connections", "kill", "7"})
+		e, ok := err.(*ctlError)
+		if !ok || e.code != ctlFailed || e.msg != test.want {
+			t.Errorf("%d: got %#v, want %q", test.status, err, test.want)
+		}
+		if out.Len() > 0 {
+			t.Errorf("%d: printed %q on failure", test.status, out)
+		}
+	}
+
+	// Nothing listening
+	server, _ := newTestAPI(t, http.StatusOK, "{}")
+	server.Close()
+	c, _ := newTestCtl(server.URL)
+	if e, ok := c.run([]string{"metrics"}).(*ctlError); !ok || e.code != ctlUnreachable {
+		t.Errorf("got %v, want the API unreachable", e)
+	}
+}
+
+func TestCtlExitStatus(t *testing.T) {
+	ok, _ := newTestAPI(t, http.StatusOK, "{}")
+	failing, _ := newTestAPI(t, http.StatusNotFound, `{"error": "ERR_NOT_FOUND"}`)
+	gone, _ := newTestAPI(t, http.StatusOK, "{}")
+	gone.Close()
+
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{"-api", ok.URL + "/", "connections", "kill", "7"}, ctlOK},
+		{[]string{"-api", failing.URL, "connections", "kill", "7"}, ctlFailed},
+		{[]string{"-api", gone.URL, "connections", "kill", "7"}, ctlUnreachable},
+		{[]string{"-api", ok.URL, "connections", "kill"}, ctlUsage},
+		{[]string{"-nope", "connections", "ls"}, ctlUsage},
+		{[]string{"-api", "http://[::1", "metrics"}, ctlUsage},
+	}
+	for _, test := range tests {
+		if got := runCtl(test.args); got != test.want {
+			t.Errorf("%v: got %d, want %d", test.args, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+// Process-wide stream of things that happened to tunnels, such as peers
+// connecting or being turned away, served by the API's GET /events.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Kept for GET /events. Older events are dropped.
+const backlog = 1024
+
+// Events buffered for a subscriber that falls behind. Beyond that it misses
+// some.
+const subscriberBuffer = 64
+
+// Event types
+const (
+	Connected    = "connected"
+	Disconnected = "disconnected"
+	Rejected     = "rejected"
+)
+
+type Event struct {
+
+	// Increases by one with every event published
+	ID   uint64    `json:"id"`
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+
+	Connection int    `json:"connection,omitempty"`
+	Peer       string `json:"peer,omitempty"`
+	Remote     string `json:"remote,omitempty"`
+
+	// Why, for events that need explaining, e.g. why a peer was rejected
+	Reason string `json:"reason,omitempty"`
+}
+
+var (
+	m           sync.Mutex
+	lastID      uint64
+	recent      []Event
+	subscribers = make(map[chan Event]bool)
+)
+
+// Record e and pass it on to every subscriber. Its ID and Time are set here.
+func Publish(e Event) {
+	m.Lock()
+	defer m.Unlock()
+
+	lastID++
+	e.ID = lastID
+	e.Time = time.Now()
+
+	recent = append(recent, e)
+	if len(recent) > backlog {
+		recent = append([]Event(nil), recent[len(recent)-backlog:]...)
+	}
+
+	for c := range subscribers {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// The events kept with an ID above since, oldest first
+func Since(since uint64) []Event {
+	m.Lock()
+	defer m.Unlock()
+
+	res := []Event{}
+	for _, e := range recent {
+		if e.ID > since {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// Receive every event published from now on, until cancel is called
+func Subscribe() (events <-chan Event, cancel func()) {
+	c := make(chan Event, subscriberBuffer)
+
+	m.Lock()
+	subscribers[c] = true
+	m.Unlock()
+
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			m.Lock()
+			delete(subscribers, c)
+			m.Unlock()
+		})
+	}
+}
@@ -8,26 +8,62 @@ import (
 	"runtime"
 	"path"
 	"os"
+	"sync/atomic"
 )
 
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var level int32 = LevelDebug
+
+// Set the minimum level that gets logged. One of debug, info, warn, error.
+func SetLevel(name string) {
+	switch name {
+	case "debug":
+		atomic.StoreInt32(&level, LevelDebug)
+	case "info":
+		atomic.StoreInt32(&level, LevelInfo)
+	case "warn":
+		atomic.StoreInt32(&level, LevelWarn)
+	case "error":
+		atomic.StoreInt32(&level, LevelError)
+	}
+}
+
+func enabled(l int32) bool {
+	return atomic.LoadInt32(&level) <= l
+}
+
 func I(ft string, x ...interface{}) {
-	logw(fmt.Sprintf("[ INFO ] " + ft, x...))
+	if enabled(LevelInfo) {
+		logw(fmt.Sprintf("[ INFO ] " + ft, x...))
+	}
 }
 
 func W(ft string, x ...interface{}) {
-	logw(fmt.Sprintf("[ WARN ] " + ft, x...))
+	if enabled(LevelWarn) {
+		logw(fmt.Sprintf("[ WARN ] " + ft, x...))
+	}
 }
 
 func E(ft string, x ...interface{}) {
-	logw(fmt.Sprintf("[ ERROR ] " + ft, x...))
+	if enabled(LevelError) {
+		logw(fmt.Sprintf("[ ERROR ] " + ft, x...))
+	}
 }
 
 func D(ft string, x ...interface{}) {
-	logw(fmt.Sprintf("[ DEBUG ] " + ft, x...))
+	if enabled(LevelDebug) {
+		logw(fmt.Sprintf("[ DEBUG ] " + ft, x...))
+	}
 }
 
 func F(ft string, x ...interface{}) {
-	E(ft, x)
+	E(ft, x...)
 	os.Exit(1)
 }
 
@@ -35,4 +71,4 @@ func logw(x string) {
 	_, fp, ln, _ := runtime.Caller(2)
 	file := path.Base(fp)
 	stdlog.Println(fmt.Sprintf("%s:%d %s", file, ln, x))
-}
\ No newline at end of file
+}
@@ -2,120 +2,556 @@ package main
 
 import (
 	"cisco.com/comm/api"
-	"cisco.com/comm/socket"
+	"cisco.com/comm/audit"
+	"cisco.com/comm/common"
+	"cisco.com/comm/config"
 	"cisco.com/comm/log"
+	"cisco.com/comm/socket"
+	"cisco.com/comm/tracing"
+	"cisco.com/comm/tunnel"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
-var Options struct {
-	APIPort int
-	Server  string
-	Port    int
-	Mode    string
-	Output  string
-}
+var Options *config.Config
+
+// Told to peers in the handshake. Set at build time with
+// -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+// Set by setHandler if fragmented transfers are enabled
+var transfers *socket.Transfers
 
-func init() {
-	// Command-line options
-	what := flag.String(
+// Set by setHandler if the store-and-forward queue is enabled
+var queue *socket.Queue
+
+// Set by setHandler for the "api" handler
+var limiter *socket.Limiter
+
+// Set by setHandler for the "api" handler
+var acl *socket.ACL
+
+// Register the command-line options on fs, parse args and return the
+// effective configuration: defaults < config file < environment < flags.
+// Only flags that were actually given override the lower layers.
+func parseOptions(fs *flag.FlagSet, args []string) (*config.Config, error) {
+	path := fs.String(
+		"config",
+		os.Getenv("COMM_CONFIG"),
+		"Path to a JSON config file (or set COMM_CONFIG)")
+	what := fs.String(
 		"mode",
 		"server",
 		"Mode of operation ('client', 'server')")
-	output := flag.String(
+	output := fs.String(
 		"handler",
 		"api",
 		"Connection handling mode for socket server. You will never need to override this unless you know what you're doing")
-	port := flag.Int(
+	port := fs.Int(
 		"p",
 		0,
 		"Port to bind to (in server mode) or connect to (in client mode)")
-	apiport := flag.Int(
+	apiport := fs.Int(
 		"apiport",
 		0,
 		"Port that the API should listen on")
-	server := flag.String(
+	server := fs.String(
 		"s",
 		"localhost",
 		"Server to connect to (only valid in client mode)",
 	)
+	lan := fs.String(
+		"lan",
+		"",
+		"Address to listen on for LAN clients (host:port or unix:/path)")
 
-	flag.Parse()
-	Options.Mode = *what
-	Options.Port = *port
-	Options.Output = *output
-	Options.APIPort = *apiport
-	Options.Server = *server
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c, err := config.Load(*path)
+	if err != nil {
+		return nil, err
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "mode":
+			c.Mode = strings.ToLower(*what)
+		case "handler":
+			c.Handler = *output
+		case "p":
+			c.WAN.Port = *port
+		case "apiport":
+			c.API.Port = *apiport
+		case "s":
+			c.WAN.Server = *server
+		case "lan":
+			c.LAN.Listen = *lan
+		}
+	})
+
+	return c, nil
 }
 
 func main() {
-	log.I("Booting. Using configuration %v", Options)
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfig(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAudit(os.Args[2:]))
+	}
 
-	switch strings.ToLower(Options.Mode) {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "console" {
+		os.Exit(runConsole(os.Args[2:]))
+	}
+
+	c, err := parseOptions(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.F("Failed to load configuration: %v", err)
+	}
+
+	if err := c.Validate(); err != nil {
+		log.F("%v", err)
+	}
+
+	Options = c
+	log.SetLevel(Options.Log.Level)
+	log.I("Booting. Using configuration %+v", *Options.Redacted())
+
+	if Options.Audit.Path != "" {
+		err := audit.Open(audit.Options{
+			Path:      Options.Audit.Path,
+			MaxBytes:  Options.Audit.MaxBytes,
+			MaxAge:    time.Duration(Options.Audit.MaxAge),
+			HashChain: Options.Audit.HashChain,
+		})
+		if err != nil {
+			log.F("Failed to open the audit log: %v", err)
+		}
+	}
+
+	if Options.Tracing.Exporter != "" {
+		err := tracing.Setup(tracing.Options{
+			Exporter:    Options.Tracing.Exporter,
+			Endpoint:    Options.Tracing.Endpoint,
+			ServiceName: Options.Tracing.ServiceName,
+			SampleRatio: Options.Tracing.SampleRatio,
+		})
+		if err != nil {
+			log.F("Failed to set up tracing: %v", err)
+		}
+	}
+
+	switch Options.Mode {
 	case "server":
 		runServer()
 	case "client":
 		runClient()
 	default:
-		log.F("Unknown mode", Options.Mode)
+		log.F("Unknown mode %s", Options.Mode)
 	}
 }
 
-func getHandler() socket.ConnectionHandler {
-	switch Options.Output {
-	case "echo":
-		log.D("Using echo handler")
-		return &socket.EchoHandler{}
-	case "api":
-		log.D("Using API handler")
-		return socket.NewChannelHandler()
+// comm audit verify FILE...	Check the hash chain through audit log files,
+// given oldest first
+func runAudit(args []string) int {
+	if len(args) < 2 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: comm audit verify FILE...")
+		return 2
+	}
+
+	prev := ""
+	for _, name := range args[1:] {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		var n int
+		prev, n, err = audit.Verify(f, prev)
+		f.Close()
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			return 1
+		}
+		fmt.Printf("%s: %d records OK\n", name, n)
+	}
+	return 0
+}
+
+// comm config check [flags]	Print the effective configuration and validate it
+// comm config env				List the environment variables that override the config
+func runConfig(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: comm config check [flags] | comm config env")
+		return 2
+	}
+
+	switch args[0] {
+	case "check":
+		fs := flag.NewFlagSet("config check", flag.ContinueOnError)
+		c, err := parseOptions(fs, args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		out, _ := json.MarshalIndent(c.Redacted(), "", "  ")
+		fmt.Println(string(out))
+
+		if err := c.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+
+		fmt.Fprintln(os.Stderr, "configuration OK")
+		return 0
+	case "env":
+		for _, name := range config.EnvNames() {
+			fmt.Println(name)
+		}
+		return 0
 	default:
-		log.F("Unknown handler")
+		fmt.Fprintf(os.Stderr, "unknown config command %q\n", args[0])
+		return 2
+	}
+}
+
+// What the tunnel does with its sessions: forward HTTP for the "api" handler,
+// or hand them to another registered handler
+func setHandler(opts *tunnel.Options) {
+	chain := socket.NewChain()
+	chain.Use(socket.MetricsMiddleware())
+	opts.Chain = chain
+
+	if Options.Handler != "api" {
+		handler, err := socket.NewHandler(Options.Handler, socket.ForwarderOptions{Chain: chain})
+		if err != nil {
+			log.F("Unknown handler %q", Options.Handler)
+		}
+
+		opts.Handler = handler
+		return
+	}
+
+	log.D("Using API handler")
+	router = socket.NewRouter(Options.LAN.Origin, routes(Options))
+
+	if Options.Transfers.Dir != "" {
+		var err error
+		transfers, err = socket.NewTransfers(socket.TransferOptions{
+			Dir:       Options.Transfers.Dir,
+			ChunkSize: Options.Transfers.ChunkSize,
+			MaxSize:   Options.Transfers.MaxSize,
+		})
+		if err != nil {
+			log.F("Failed to set up transfers in %s: %v", Options.Transfers.Dir, err)
+		}
+	}
+
+	if Options.Queue.Dir != "" {
+		var err error
+		queue, err = socket.NewQueue(socket.QueueOptions{
+			Dir:             Options.Queue.Dir,
+			TTL:             time.Duration(Options.Queue.TTL),
+			MaxBytes:        Options.Queue.MaxBytes,
+			DeliveryTimeout: time.Duration(Options.Limits.RequestTimeout),
+		})
+		if err != nil {
+			log.F("Failed to set up the queue in %s: %v", Options.Queue.Dir, err)
+		}
+	}
+
+	// Validate has checked the limits
+	limiter, _ = socket.NewLimiter(Options.RateLimits)
+	acl, _ = socket.NewACL(aclRules(Options.ACL.Allow), aclRules(Options.ACL.Deny))
+
+	opts.Forwarder = &socket.ForwarderOptions{
+		Router:         router,
+		DialTimeout:    time.Duration(Options.Limits.DialTimeout),
+		LANAddr:        Options.LAN.Listen,
+		LANPorts:       Options.LAN.Ports,
+		RequestTimeout: time.Duration(Options.Limits.RequestTimeout),
+		Transfers:      transfers,
+		Queue:          queue,
+		Limiter:        limiter,
+		ACL:            acl,
+	}
+}
+
+// The tunnel's options for either mode. The TLS configuration is left to the
+// caller.
+func tunnelOptions() tunnel.Options {
+	opts := tunnel.Options{
+		Key:         Options.Auth.Key,
+		Keys:        Options.Auth.Keys,
+		Name:        Options.WAN.Name,
+		Labels:      labels(),
+		Info:        peerInfo(),
+		Compression: compression(),
+		Checksums:   Options.WAN.Checksums,
+		Heartbeat:   time.Duration(Options.WAN.Heartbeat),
+		Limits:      sizeLimits(),
+		DialTimeout: time.Duration(Options.Limits.DialTimeout),
+		Admission:   admission(Options),
+
+		// Nothing in here would serve them
+		NoStreams: true,
+	}
+
+	setHandler(&opts)
+	return opts
+}
+
+func routes(c *config.Config) []socket.Route {
+	res := make([]socket.Route, len(c.Routes))
+	for i, r := range c.Routes {
+		res[i] = socket.Route{Host: r.Host, Origin: r.Origin}
+	}
+	return res
+}
+
+func aclRules(rules []config.ACLRule) []socket.ACLRule {
+	res := make([]socket.ACLRule, len(rules))
+	for i, r := range rules {
+		res[i] = socket.ACLRule{Host: r.Host, Ports: r.Ports, Methods: r.Methods, Paths: r.Paths}
+	}
+	return res
+}
+
+// Validate has made sure the CIDR blocks parse
+func admission(c *config.Config) socket.AdmissionOptions {
+	res := socket.AdmissionOptions{
+		MaxTunnels:       c.Admission.MaxTunnels,
+		MaxPerIP:         c.Admission.MaxPerIP,
+		AcceptRate:       c.Admission.AcceptRate,
+		HandshakeTimeout: time.Duration(c.Admission.HandshakeTimeout),
+	}
+
+	for _, l := range c.Admission.CIDRLimits {
+		block, _ := common.ParseCIDR(l.CIDR)
+		res.CIDRLimits = append(res.CIDRLimits, socket.CIDRLimit{Block: block, Max: l.Max})
+	}
+
+	res.Allow, _ = common.ParseCIDRs(c.Admission.Allow)
+	res.Deny, _ = common.ParseCIDRs(c.Admission.Deny)
+	return res
+}
+
+func compression() socket.CompressionOptions {
+	return socket.CompressionOptions{
+		Codecs:  Options.Compression.Codecs,
+		MinSize: Options.Compression.MinSize,
+	}
+}
+
+func sizeLimits() socket.SizeLimits {
+	return socket.SizeLimits{
+		MaxInbound:  Options.Limits.MaxInboundSize,
+		MaxOutbound: Options.Limits.MaxOutboundSize,
+	}
+}
+
+// Validate has made sure the labels parse
+func labels() map[string]string {
+	res, _ := common.ParseLabels(Options.WAN.Labels)
+	return res
+}
+
+// What we tell peers about ourselves in the handshake
+func peerInfo() common.PeerInfo {
+	hostname, _ := os.Hostname()
+	metadata, _ := common.ParseMetadata(Options.WAN.Metadata)
+
+	var caps []string
+	for _, codec := range Options.Compression.Codecs {
+		caps = append(caps, "compression:"+codec)
+	}
+	if Options.WAN.Checksums {
+		caps = append(caps, "checksums")
+	}
+	if Options.Transfers.Dir != "" {
+		caps = append(caps, "transfers")
+	}
+	if Options.Queue.Dir != "" {
+		caps = append(caps, "queue")
+	}
+	if Options.Tracing.Exporter != "" {
+		caps = append(caps, "tracing")
+	}
+
+	return common.PeerInfo{
+		Hostname:     hostname,
+		Version:      version,
+		Capabilities: caps,
+		Metadata:     metadata,
+	}
+}
+
+// The API's view of transfers. A nil *socket.Transfers must not end up in a
+// non-nil interface.
+func transfersAPI() api.Transfers {
+	if transfers == nil {
+		return nil
+	}
+	return transfers
+}
+
+func queueAPI() api.Queue {
+	if queue == nil {
 		return nil
 	}
+	return queue
+}
+
+func limiterAPI() api.RateLimiter {
+	if limiter == nil {
+		return nil
+	}
+	return limiter
+}
+
+func routerAPI() api.Router {
+	if router == nil {
+		return nil
+	}
+	return router
+}
+
+// Ready once the WAN listener is bound
+func serverReady() error {
+	if wan.Addr() == nil {
+		return errors.New("the WAN listener is not bound")
+	}
+	return nil
+}
+
+// Ready once connected to the server, and as long as the server is heard
+// from: a heartbeat may go missing, but not three in a row
+func clientReady() error {
+	sessions := wan.Sessions()
+	if len(sessions) == 0 {
+		return errors.New("not connected to the server")
+	}
+
+	sess := sessions[0]
+	if d := sess.Heartbeat(); d > 0 {
+		if quiet := time.Since(sess.Connection().Stats().LastHeard); quiet > 3*d {
+			return fmt.Errorf("nothing heard from the server for %v", quiet.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+func debugState() interface{} {
+	return socket.State()
 }
 
 func runServer() {
 	errc := make(chan error)
-	handler := getHandler()
-	socketServer := socket.NewServer(Options.Port, handler)
-	apiServer := api.APIServer{Port: Options.APIPort, SocketServer: socketServer}
+	opts := tunnelOptions()
 
-	// Start servers and wait for termination
+	tlsConf, err := Options.TLS.ServerConfig()
+	if err != nil {
+		log.F("Failed to load TLS configuration %v", err)
+	}
+	opts.TLS = tlsConf
+
+	wan = tunnel.New(opts)
+	if err := wan.Listen(fmt.Sprintf(":%d", Options.WAN.Port)); err != nil {
+		log.F("Failed to start server daemons %v", err)
+	}
+
+	apiServer := api.APIServer{
+		Port:           Options.API.Port,
+		SocketServer:   wan,
+		Reload:         reload,
+		Transfers:      transfersAPI(),
+		Queue:          queueAPI(),
+		Limiter:        limiterAPI(),
+		Router:         routerAPI(),
+		RequestTimeout: time.Duration(Options.Limits.RequestTimeout),
+		MessageTTL:     time.Duration(Options.API.MessageTTL),
+		Ready:          serverReady,
+		State:          debugState,
+		Frames:         wan,
+		Token:          Options.API.Token,
+		DebugToken:     Options.API.DebugToken}
+	watchReloadSignal()
+
+	// Start the API and wait for termination
 	go func() {
 		errc <- apiServer.Listen()
 	}()
 
 	go func() {
-		errc <- socketServer.Listen()
+		errc <- wan.Wait()
 	}()
 
-	err := <-errc
+	err = <-errc
 	if err != nil {
 		log.F("Failed to start server daemons %v", err)
 	}
 }
 
 func runClient() {
-	log.I("Starting in CLIENT mode. Connecting to %s:%d", "localhost", Options.Port)
+	log.I("Starting in CLIENT mode. Connecting to %s:%d", Options.WAN.Server, Options.WAN.Port)
 	errc := make(chan error)
-	handler := getHandler()
-
-	if Options.Server == "" {
-		log.F("No server given")
-	}
-
-	cSocketServer, err := socket.NewClient(Options.Server, Options.Port, handler)
+	opts := tunnelOptions()
 
+	tlsConf, err := Options.TLS.ClientConfig(Options.WAN.Server)
 	if err != nil {
-		log.F("Failed to start client %v", err)
+		log.F("Failed to load TLS configuration %v", err)
 	}
+	opts.TLS = tlsConf
 
-	apiserver := api.APIServer{Port: Options.APIPort, SocketServer: cSocketServer}
+	wan = tunnel.New(opts)
+
+	apiserver := api.APIServer{
+		Port:           Options.API.Port,
+		SocketServer:   wan,
+		Reload:         reload,
+		Transfers:      transfersAPI(),
+		Queue:          queueAPI(),
+		Limiter:        limiterAPI(),
+		Router:         routerAPI(),
+		RequestTimeout: time.Duration(Options.Limits.RequestTimeout),
+		MessageTTL:     time.Duration(Options.API.MessageTTL),
+		Ready:          clientReady,
+		State:          debugState,
+		Frames:         wan,
+		Token:          Options.API.Token,
+		DebugToken:     Options.API.DebugToken}
+	watchReloadSignal()
 
 	// Start servers and wait for termination
 	go func() {
-		errc <- cSocketServer.Connect()
+		addr := net.JoinHostPort(Options.WAN.Server, strconv.Itoa(Options.WAN.Port))
+		sess, err := wan.Dial(context.Background(), addr)
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		sess.Wait()
+		log.I("Disconnected from %s, shutting down", addr)
+		errc <- nil
 	}()
 
 	go func() {
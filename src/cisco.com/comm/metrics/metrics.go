@@ -0,0 +1,158 @@
+// Process-wide counters, served in the Prometheus text format by the API's
+// GET /metrics.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A counter that only goes up
+type Counter struct {
+	v int64
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.v, n)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+// A family of counters told apart by the value of a single label
+type CounterVec struct {
+	name  string
+	help  string
+	label string
+
+	m        sync.Mutex
+	counters map[string]*Counter
+}
+
+var (
+	mregistry sync.Mutex
+	registry  []*CounterVec
+)
+
+// Create and register a counter family. Panics if name is taken, which is a
+// programming error.
+func NewCounterVec(name, help, label string) *CounterVec {
+	mregistry.Lock()
+	defer mregistry.Unlock()
+
+	for _, v := range registry {
+		if v.name == name {
+			panic("metrics: duplicate metric " + name)
+		}
+	}
+
+	v := &CounterVec{name: name, help: help, label: label, counters: make(map[string]*Counter)}
+	registry = append(registry, v)
+	return v
+}
+
+// The counter for the given label value, created on first use
+func (v *CounterVec) With(value string) *Counter {
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	c, ok := v.counters[value]
+	if !ok {
+		c = &Counter{}
+		v.counters[value] = c
+	}
+
+	return c
+}
+
+// Write every registered counter to w in the Prometheus text format
+func WriteText(w io.Writer) error {
+	mregistry.Lock()
+	vecs := append([]*CounterVec(nil), registry...)
+	mregistry.Unlock()
+
+	for _, v := range vecs {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name); err != nil {
+			return err
+		}
+
+		v.m.Lock()
+		values := make([]string, 0, len(v.counters))
+		for value := range v.counters {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+
+		for _, value := range values {
+			fmt.Fprintf(w, "%s{%s=%q} %d\n", v.name, v.label, value, v.counters[value].Value())
+		}
+		v.m.Unlock()
+	}
+
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// Counters
+//////////////////////////////////////////////////////////////////////////////////
+
+// Messages refused for exceeding the size limit, by direction ("inbound" for
+// messages the peer announced, "outbound" for messages we were asked to send)
+var OversizedMessages = NewCounterVec(
+	"comm_oversized_messages_total",
+	"Messages refused because they exceed the message size limit",
+	"direction")
+
+// What happened to messages in the store-and-forward queue: "enqueued",
+// "delivered", "expired", "deleted" (through the API) or "dropped" (given up
+// on after failed delivery attempts)
+var QueuedMessages = NewCounterVec(
+	"comm_queued_messages_total",
+	"Messages passing through the store-and-forward queue",
+	"event")
+
+// CONTROL and DATA messages (and those of types registered by embedders) sent
+// and received, by direction ("inbound" or "outbound"). Counted by
+// socket.MetricsMiddleware.
+var Messages = NewCounterVec(
+	"comm_messages_total",
+	"Messages sent and received over the WAN",
+	"direction")
+
+// Payload bytes of the messages counted in comm_messages_total, before
+// compression
+var MessageBytes = NewCounterVec(
+	"comm_message_bytes_total",
+	"Payload bytes of the messages sent and received over the WAN",
+	"direction")
+
+// Requests refused with ERR_RATE_LIMITED, by the scope whose request rate
+// they exceeded: "global", "connection" or "route"
+var RateLimited = NewCounterVec(
+	"comm_rate_limited_requests_total",
+	"Requests refused for exceeding a request rate limit",
+	"scope")
+
+// How long traffic was held up to fit the byte rate limits, by the scope that
+// held it up longest
+var RateLimitDelay = NewCounterVec(
+	"comm_rate_limit_delay_milliseconds_total",
+	"Time traffic was delayed to fit a byte rate limit",
+	"scope")
+
+// Connections the WAN server turned away, by reason: "denied" or
+// "not_allowed" (deny and allow lists), "max_tunnels", "max_per_ip",
+// "max_per_cidr", "accept_rate", "handshake_timeout", "handshake_failed" or
+// "auth"
+var RejectedConnections = NewCounterVec(
+	"comm_rejected_connections_total",
+	"Connections the WAN server turned away",
+	"reason")
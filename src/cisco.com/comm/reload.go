@@ -0,0 +1,118 @@
+package main
+
+import (
+	"cisco.com/comm/api"
+	"cisco.com/comm/config"
+	"cisco.com/comm/log"
+	"cisco.com/comm/socket"
+	"cisco.com/comm/tunnel"
+	"flag"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+)
+
+// State that reload() swaps in place. Set up by runServer/runClient.
+var (
+	mreload sync.Mutex
+	router  *socket.Router
+	wan     *tunnel.Tunnel
+)
+
+// Re-read the configuration from the same file, environment and flags we were
+// started with and apply the parts that can change without a restart: routes,
+// accepted client keys, rate limits, admission control, the ACL and the log
+// level. Established tunnels are kept unless the key they authenticated with
+// was removed.
+func reload() (*api.ReloadResult, error) {
+	mreload.Lock()
+	defer mreload.Unlock()
+
+	c, err := parseOptions(flag.NewFlagSet("reload", flag.ContinueOnError), os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	res := &api.ReloadResult{Revoked: []int{}, RestartRequired: restartRequired(Options, c)}
+
+	if router != nil {
+		router.Set(c.LAN.Origin, routes(c))
+	}
+
+	if wan != nil {
+		res.Revoked = wan.SetKeys(c.Auth.Keys)
+		wan.SetAdmission(admission(c))
+	}
+
+	if limiter != nil {
+		limiter.SetLimits(c.RateLimits)
+	}
+
+	if acl != nil {
+		acl.Set(aclRules(c.ACL.Allow), aclRules(c.ACL.Deny))
+	}
+
+	log.SetLevel(c.Log.Level)
+
+	next := *Options
+	next.LAN.Origin = c.LAN.Origin
+	next.Routes = c.Routes
+	next.Auth.Keys = c.Auth.Keys
+	next.Log = c.Log
+	next.RateLimits = c.RateLimits
+	next.Admission = c.Admission
+	next.ACL = c.ACL
+	Options = &next
+
+	log.I("Configuration reloaded. Revoked connections %v. Changes needing a restart %v",
+		res.Revoked, res.RestartRequired)
+	return res, nil
+}
+
+// Names of the config sections that differ between old and new but can't be
+// applied at runtime.
+func restartRequired(old, new *config.Config) []string {
+	var res []string
+	check := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			res = append(res, name)
+		}
+	}
+
+	check("mode", old.Mode, new.Mode)
+	check("handler", old.Handler, new.Handler)
+	check("api", old.API, new.API)
+	check("wan", old.WAN, new.WAN)
+	check("lan.listen", old.LAN.Listen, new.LAN.Listen)
+	check("lan.ports", old.LAN.Ports, new.LAN.Ports)
+	check("tls", old.TLS, new.TLS)
+	check("auth.key", old.Auth.Key, new.Auth.Key)
+	check("limits", old.Limits, new.Limits)
+	check("compression", old.Compression, new.Compression)
+	check("transfers", old.Transfers, new.Transfers)
+	check("queue", old.Queue, new.Queue)
+	check("audit", old.Audit, new.Audit)
+	check("tracing", old.Tracing, new.Tracing)
+	return res
+}
+
+// Reload the configuration whenever we get a SIGHUP.
+func watchReloadSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			log.I("Got SIGHUP. Reloading configuration")
+			if _, err := reload(); err != nil {
+				log.E("Reload failed, keeping the current configuration: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,237 @@
+package socket
+
+import (
+	"cisco.com/comm/common"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A request from the peer the ACL doesn't let through
+var ErrForbidden = errors.New("ERR_FORBIDDEN")
+
+// ErrForbidden, and why
+type aclError struct {
+	why string
+}
+
+func (e *aclError) Error() string {
+	return ErrForbidden.Error() + ": " + e.why
+}
+
+func (e *aclError) Unwrap() error {
+	return ErrForbidden
+}
+
+// Matches requests by where they go and what they ask for. Empty fields
+// match anything.
+type ACLRule struct {
+
+	// The destination: a host name, "*.example.com" for any subdomain, an
+	// address or a CIDR block. Names match the origin as routed, addresses
+	// and blocks the address actually dialed.
+	Host string
+
+	Ports   []int
+	Methods []string
+
+	// Prefixes of the request path, which is cleaned first so that "/a/../b"
+	// can't pass for "/a/"
+	Paths []string
+}
+
+func (r ACLRule) String() string {
+	return fmt.Sprintf("host=%q ports=%v methods=%v paths=%v", r.Host, r.Ports, r.Methods, r.Paths)
+}
+
+// Check a rule for values that can't work
+func (r ACLRule) Check() error {
+	if strings.Contains(r.Host, "/") {
+		if _, _, err := net.ParseCIDR(r.Host); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range r.Ports {
+		if p <= 0 || p > 65535 {
+			return fmt.Errorf("%d is not a valid TCP port", p)
+		}
+	}
+
+	for _, m := range r.Methods {
+		if m == "" || strings.ContainsAny(m, " \t\r\n") {
+			return fmt.Errorf("invalid method %q", m)
+		}
+	}
+
+	for _, p := range r.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("path %q must start with /", p)
+		}
+	}
+
+	return nil
+}
+
+// A request as far as the ACL is concerned
+type aclRequest struct {
+	method string
+	path   string
+
+	// The origin's host name and port as routed, and the address dialed
+	host string
+	port int
+	ip   net.IP
+}
+
+func (r ACLRule) matches(req aclRequest) bool {
+	if r.Host != "" && !matchHost(r.Host, req.host, req.ip) {
+		return false
+	}
+
+	if len(r.Ports) > 0 {
+		found := false
+		for _, p := range r.Ports {
+			found = found || p == req.port
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Methods) > 0 {
+		found := false
+		for _, m := range r.Methods {
+			found = found || strings.EqualFold(m, req.method)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Paths) > 0 {
+		found := false
+		for _, p := range r.Paths {
+			found = found || strings.HasPrefix(req.path, p)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchHost(pattern, host string, ip net.IP) bool {
+	if strings.Contains(pattern, "/") || net.ParseIP(pattern) != nil {
+		block, err := common.ParseCIDR(pattern)
+		return err == nil && ip != nil && block.Contains(ip)
+	}
+
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+// Which destinations the peer's requests may reach, checked right before an
+// origin is dialed. A request must match an Allow rule, unless there are
+// none, and no Deny rule. It is safe for concurrent use, and a nil ACL lets
+// everything through.
+type ACL struct {
+	m     sync.RWMutex
+	allow []ACLRule
+	deny  []ACLRule
+}
+
+func NewACL(allow, deny []ACLRule) (*ACL, error) {
+	a := &ACL{}
+	if err := a.Set(allow, deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Replace the rules
+func (a *ACL) Set(allow, deny []ACLRule) error {
+	for _, r := range append(append([]ACLRule(nil), allow...), deny...) {
+		if err := r.Check(); err != nil {
+			return fmt.Errorf("rule %v: %v", r, err)
+		}
+	}
+
+	a.m.Lock()
+	a.allow = allow
+	a.deny = deny
+	a.m.Unlock()
+	return nil
+}
+
+// Whether req may go through, and if not, why
+func (a *ACL) decide(req aclRequest) (bool, string) {
+	a.m.RLock()
+	defer a.m.RUnlock()
+
+	for _, r := range a.deny {
+		if r.matches(req) {
+			return false, "matches deny rule " + r.String()
+		}
+	}
+
+	if len(a.allow) == 0 {
+		return true, ""
+	}
+
+	for _, r := range a.allow {
+		if r.matches(req) {
+			return true, ""
+		}
+	}
+
+	return false, "matches no allow rule"
+}
+
+// A dialer hook that refuses connections the ACL doesn't let through. Only
+// once the dialer has resolved the origin do we know the address to check
+// address rules against. The dial then fails with an *aclError.
+func (a *ACL) control(method, requestURI, origin string) func(string, string, syscall.RawConn) error {
+	if a == nil {
+		return nil
+	}
+
+	req := aclRequest{method: method, path: "/"}
+	if u, err := url.ParseRequestURI(requestURI); err == nil && u.Path != "" {
+		req.path = path.Clean(u.Path)
+		if strings.HasSuffix(u.Path, "/") && req.path != "/" {
+			req.path += "/"
+		}
+	}
+
+	req.host, _, _ = net.SplitHostPort(origin)
+
+	return func(network, address string, _ syscall.RawConn) error {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+
+		// Called for every address the dialer tries, maybe at once
+		r := req
+		r.ip = net.ParseIP(host)
+		r.port, _ = strconv.Atoi(port)
+
+		if ok, why := a.decide(r); !ok {
+			return &aclError{why: why}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,55 @@
+package socket
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	acl, err := NewACL(
+		[]ACLRule{
+			{Host: "*.internal"},
+			{Host: "10.1.0.0/16", Methods: []string{"GET"}},
+		},
+		[]ACLRule{
+			{Host: "169.254.169.254"},
+			{Host: "*.internal", Paths: []string{"/admin/"}},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, uri string
+
+		// As routed, and the address dialed
+		origin, addr string
+
+		ok bool
+	}{
+		{"GET", "/", "db.internal:80", "192.0.2.1:80", true},
+
+		// Deny rules win over allow rules
+		{"GET", "/admin/users", "db.internal:80", "192.0.2.1:80", false},
+		{"GET", "/", "meta.internal:80", "169.254.169.254:80", false},
+
+		// Names match the origin as routed, blocks the address dialed
+		{"GET", "/", "elsewhere.example:80", "10.1.2.3:80", true},
+		{"POST", "/", "elsewhere.example:80", "10.1.2.3:80", false},
+		{"GET", "/", "elsewhere.example:80", "10.2.0.1:80", false},
+		{"GET", "/", "10.1.2.3:80", "192.0.2.1:80", false},
+
+		// Paths are cleaned before they're matched
+		{"GET", "/public/../admin/users", "db.internal:80", "192.0.2.1:80", false},
+		{"GET", "/./admin//users", "db.internal:80", "192.0.2.1:80", false},
+		{"GET", "/admin", "db.internal:80", "192.0.2.1:80", true},
+		{"GET", "/public/admin/", "db.internal:80", "192.0.2.1:80", true},
+	}
+
+	for _, test := range tests {
+		err := acl.control(test.method, test.uri, test.origin)("tcp", test.addr, nil)
+		if (err == nil) != test.ok || (err != nil && !errors.Is(err, ErrForbidden)) {
+			t.Errorf("%s %s to %s at %s: got %v, want it allowed: %v", test.method, test.uri, test.origin, test.addr, err, test.ok)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package socket
+
+import (
+	"cisco.com/comm/events"
+	"cisco.com/comm/log"
+	"cisco.com/comm/metrics"
+	"net"
+	"sync"
+	"time"
+)
+
+// Why the server turned a connection away, as reported in metrics and events
+const (
+	rejectDenied           = "denied"
+	rejectNotAllowed       = "not_allowed"
+	rejectMaxTunnels       = "max_tunnels"
+	rejectMaxPerIP         = "max_per_ip"
+	rejectMaxPerCIDR       = "max_per_cidr"
+	rejectAcceptRate       = "accept_rate"
+	rejectHandshakeTimeout = "handshake_timeout"
+	rejectHandshakeFailed  = "handshake_failed"
+	rejectAuth             = "auth"
+)
+
+// Caps how many clients sources may keep connected at once, together
+type CIDRLimit struct {
+	Block *net.IPNet
+	Max   int
+}
+
+// Which connections the server accepts. Zero values mean no limit.
+type AdmissionOptions struct {
+
+	// Connections open at once, counted from accepting the TCP connection
+	// until it closes, handshake included
+	MaxTunnels int
+
+	// Connections open at once from any single address
+	MaxPerIP int
+
+	// Connections open at once from all the addresses in a block. A source
+	// counts against every block it is in.
+	CIDRLimits []CIDRLimit
+
+	// New connections per second, with a burst of one second's worth
+	AcceptRate int64
+
+	// How long a client has to complete the handshake
+	HandshakeTimeout time.Duration
+
+	// If set, only sources in one of these blocks are accepted. Deny wins
+	// over Allow.
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// Counts what's connected for the server and decides on new connections. It
+// is safe for concurrent use.
+type admission struct {
+	m    sync.Mutex
+	opts AdmissionOptions
+
+	accepts *bucket
+
+	// Connections open, in total and by source address
+	open     int
+	bySource map[string]int
+
+	// The clock, time.Now but for tests
+	now func() time.Time
+}
+
+func newAdmission(opts AdmissionOptions) *admission {
+	a := &admission{bySource: make(map[string]int), now: time.Now}
+	a.set(opts)
+	return a
+}
+
+// Replace the options. Connections already open stay, even if they're over
+// the new limits.
+func (a *admission) set(opts AdmissionOptions) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	a.opts = opts
+	a.accepts = newBucket(opts.AcceptRate, a.now())
+}
+
+func (a *admission) handshakeTimeout() time.Duration {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.opts.HandshakeTimeout
+}
+
+// Decide on a new connection from addr. If it's admitted, release must be
+// called once it closes; otherwise reason says why it wasn't.
+func (a *admission) admit(addr net.Addr) (release func(), reason string) {
+	ip := addrIP(addr)
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if ip != nil {
+		if inAny(ip, a.opts.Deny) {
+			return nil, rejectDenied
+		}
+
+		if len(a.opts.Allow) > 0 && !inAny(ip, a.opts.Allow) {
+			return nil, rejectNotAllowed
+		}
+	}
+
+	if a.opts.MaxTunnels > 0 && a.open >= a.opts.MaxTunnels {
+		return nil, rejectMaxTunnels
+	}
+
+	source := ""
+	if ip != nil {
+		source = ip.String()
+
+		if a.opts.MaxPerIP > 0 && a.bySource[source] >= a.opts.MaxPerIP {
+			return nil, rejectMaxPerIP
+		}
+
+		for _, l := range a.opts.CIDRLimits {
+			if l.Block.Contains(ip) && a.countIn(l.Block) >= l.Max {
+				return nil, rejectMaxPerCIDR
+			}
+		}
+	}
+
+	// Checked last so that connections turned away anyway don't use up
+	// the rate
+	now := a.now()
+	if !a.accepts.available(now) {
+		return nil, rejectAcceptRate
+	}
+	a.accepts.take(1, now)
+
+	a.open++
+	a.bySource[source]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.m.Lock()
+			defer a.m.Unlock()
+
+			a.open--
+			if a.bySource[source]--; a.bySource[source] <= 0 {
+				delete(a.bySource, source)
+			}
+		})
+	}, ""
+}
+
+// Connections open from addresses in block. Call with a.m held.
+func (a *admission) countIn(block *net.IPNet) int {
+	n := 0
+	for source, count := range a.bySource {
+		if ip := net.ParseIP(source); ip != nil && block.Contains(ip) {
+			n += count
+		}
+	}
+	return n
+}
+
+func inAny(ip net.IP, blocks []*net.IPNet) bool {
+	for _, b := range blocks {
+		if b.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return net.ParseIP(host)
+	}
+}
+
+// Report a connection the server turned away
+func reject(addr net.Addr, reason string) {
+	log.W("Rejecting connection from %v: %s", addr, reason)
+	metrics.RejectedConnections.With(reason).Inc()
+	events.Publish(events.Event{Type: events.Rejected, Remote: addr.String(), Reason: reason})
+}
@@ -0,0 +1,157 @@
+package socket
+
+import (
+	"cisco.com/comm/events"
+	"net"
+	"testing"
+	"time"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func cidr(t *testing.T, s string) *net.IPNet {
+	_, block, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// Admit a connection from ip, or fail with the reason it was turned away
+func admitted(t *testing.T, a *admission, ip string) func() {
+	t.Helper()
+	release, reason := a.admit(tcpAddr(ip))
+	if release == nil {
+		t.Fatalf("%s turned away: %s", ip, reason)
+	}
+	return release
+}
+
+func rejected(t *testing.T, a *admission, ip, want string) {
+	t.Helper()
+	if release, reason := a.admit(tcpAddr(ip)); release != nil || reason != want {
+		t.Errorf("%s: got reason %q, want %q", ip, reason, want)
+	}
+}
+
+func TestAdmissionLimits(t *testing.T) {
+	a := newAdmission(AdmissionOptions{
+		MaxTunnels: 4,
+		MaxPerIP:   2,
+		CIDRLimits: []CIDRLimit{{Block: cidr(t, "10.1.0.0/16"), Max: 3}},
+	})
+
+	first := admitted(t, a, "10.1.0.1")
+	admitted(t, a, "10.1.0.1")
+	rejected(t, a, "10.1.0.1", rejectMaxPerIP)
+
+	// The block counts every address in it
+	admitted(t, a, "10.1.0.2")
+	rejected(t, a, "10.1.0.3", rejectMaxPerCIDR)
+
+	admitted(t, a, "192.168.0.1")
+	rejected(t, a, "192.168.0.2", rejectMaxTunnels)
+
+	// Releasing frees the slot everywhere it counted, once
+	first()
+	first()
+	admitted(t, a, "10.1.0.3")
+	rejected(t, a, "10.1.0.4", rejectMaxTunnels)
+}
+
+func TestAdmissionAcceptRate(t *testing.T) {
+	now := time.Unix(1000, 0)
+	a := newAdmission(AdmissionOptions{})
+	a.now = func() time.Time { return now }
+	a.set(AdmissionOptions{AcceptRate: 2})
+
+	admitted(t, a, "10.0.0.1")
+	admitted(t, a, "10.0.0.2")
+	rejected(t, a, "10.0.0.3", rejectAcceptRate)
+
+	now = now.Add(500 * time.Millisecond)
+	admitted(t, a, "10.0.0.3")
+	rejected(t, a, "10.0.0.4", rejectAcceptRate)
+
+	// Connections turned away for other reasons don't use up the rate
+	now = now.Add(time.Second)
+	a.set(AdmissionOptions{AcceptRate: 2, Deny: []*net.IPNet{cidr(t, "10.9.0.0/16")}})
+	rejected(t, a, "10.9.0.1", rejectDenied)
+	rejected(t, a, "10.9.0.2", rejectDenied)
+	admitted(t, a, "10.0.0.5")
+	admitted(t, a, "10.0.0.6")
+}
+
+func TestAdmissionAllowDeny(t *testing.T) {
+	a := newAdmission(AdmissionOptions{
+		Allow: []*net.IPNet{cidr(t, "10.0.0.0/8"), cidr(t, "2001:db8::/32")},
+		Deny:  []*net.IPNet{cidr(t, "10.66.0.0/16")},
+	})
+
+	admitted(t, a, "10.1.2.3")
+	admitted(t, a, "2001:db8::1")
+	rejected(t, a, "192.168.0.1", rejectNotAllowed)
+
+	// Deny wins over Allow
+	rejected(t, a, "10.66.0.1", rejectDenied)
+
+	// Sources without an address can't be told apart, so only the
+	// counting limits apply to them
+	if release, reason := a.admit(&net.UnixAddr{Name: "@", Net: "unix"}); release == nil {
+		t.Errorf("Unix socket peer turned away: %s", reason)
+	}
+}
+
+func TestAdmissionHandshakeTimeout(t *testing.T) {
+	srv := NewServer(0, NewChannelHandler(ForwarderOptions{NoLAN: true}), ServerOptions{
+		Admission: AdmissionOptions{HandshakeTimeout: 50 * time.Millisecond, MaxTunnels: 1},
+	})
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(lst)
+	defer srv.Close()
+
+	rejections, cancel := events.Subscribe()
+	defer cancel()
+
+	// A client that never says hello is hung up on
+	c, err := net.Dial("tcp", lst.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected the server to hang up")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("The server kept waiting for the handshake")
+	}
+
+	for rejected := false; !rejected; {
+		select {
+		case e := <-rejections:
+			if rejected = e.Type == events.Rejected; rejected && e.Reason != rejectHandshakeTimeout {
+				t.Errorf("Rejected for %q, want %q", e.Reason, rejectHandshakeTimeout)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No rejection reported")
+		}
+	}
+
+	// And its slot is freed, right after the rejection is reported
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		p, err := dialTestServer(t, lst.Addr().String(), "a")
+		if err == nil {
+			p.Close()
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("The slot of the timed out client is still taken: %v", err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package socket
+
+import (
+	"cisco.com/comm/audit"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Picks the status code out of an HTTP response as it goes by
+type statusSniffer struct {
+	buf  []byte
+	code int
+}
+
+func (s *statusSniffer) sniff(p []byte) {
+	const n = len("HTTP/1.1 200")
+	if s.code != 0 || len(s.buf) >= n {
+		return
+	}
+
+	if len(p) > n-len(s.buf) {
+		p = p[:n-len(s.buf)]
+	}
+	s.buf = append(s.buf, p...)
+	if len(s.buf) >= n && string(s.buf[:5]) == "HTTP/" {
+		s.code, _ = strconv.Atoi(string(s.buf[9:n]))
+	}
+}
+
+// A response to the peer's request on its way back. Once all N bytes have
+// been read, or it's closed or given up on, the request is recorded in the
+// audit log.
+type auditedResponse struct {
+	R     io.Reader
+	N     int64
+	entry audit.Entry
+	start time.Time
+
+	read   int64
+	status statusSniffer
+	once   sync.Once
+}
+
+func (r *auditedResponse) Read(p []byte) (int, error) {
+	n, err := r.R.Read(p)
+	r.read += int64(n)
+	r.status.sniff(p[:n])
+
+	if err != nil {
+		r.done(err)
+	} else if r.read >= r.N {
+		r.done(nil)
+	}
+	return n, err
+}
+
+func (r *auditedResponse) Close() error {
+	r.done(nil)
+	if c, ok := r.R.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (r *auditedResponse) done(err error) {
+	r.once.Do(func() {
+		e := r.entry
+		e.Status = r.status.code
+		e.BytesOut = r.read
+		e.Duration = milliseconds(time.Since(r.start))
+		if err != nil && err != io.EOF && e.Error == "" {
+			e.Error = err.Error()
+		}
+		audit.Record(e)
+	})
+}
+
+// A LAN client's connection, counting what's written back to it
+type auditedConn struct {
+	net.Conn
+	written int64
+	status  statusSniffer
+}
+
+func (c *auditedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written += int64(n)
+	c.status.sniff(p[:n])
+	return n, err
+}
+
+// The path of a request target, without the query, which may hold secrets
+func requestPath(requestURI string) string {
+	if u, err := url.ParseRequestURI(requestURI); err == nil {
+		return u.Path
+	}
+	return requestURI
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
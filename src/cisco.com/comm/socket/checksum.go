@@ -0,0 +1,62 @@
+package socket
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// When checksums are negotiated for a connection every message carries
+// FLAG_CHECKSUM, its header is followed by the CRC32C of the header bytes and
+// its payload (as sent on the wire, i.e. after compression) by the CRC32C of
+// the payload bytes.
+const CHECKSUM_LEN = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrChecksum = errors.New("ERR_CHECKSUM")
+
+func checksum(b []byte) []byte {
+	res := make([]byte, CHECKSUM_LEN)
+	binary.BigEndian.PutUint32(res, crc32.Checksum(b, castagnoli))
+	return res
+}
+
+// Read a checksum off r and compare it with sum
+func verifyChecksum(r io.Reader, sum uint32) error {
+	buf := make([]byte, CHECKSUM_LEN)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+
+	if binary.BigEndian.Uint32(buf) != sum {
+		return ErrChecksum
+	}
+
+	return nil
+}
+
+// An io.Writer that keeps a running CRC32C of what passes through it
+type crcWriter struct {
+	w   io.Writer
+	crc uint32
+}
+
+func (c *crcWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.crc = crc32.Update(c.crc, castagnoli, p[:n])
+	return n, err
+}
+
+// An io.Reader that keeps a running CRC32C of what passes through it
+type crcReader struct {
+	r   io.Reader
+	crc uint32
+}
+
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc = crc32.Update(c.crc, castagnoli, p[:n])
+	return n, err
+}
@@ -0,0 +1,73 @@
+package socket
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestChecksumMismatch(t *testing.T) {
+	payload := []byte("abc")
+	h := Header{Vendor: string(PREAMBLE), Type: MSG_TYPE_DATA, Flags: FLAG_CHECKSUM, Seq: 1, Length: uint64(len(payload))}
+	hb := h.ToBytes()
+
+	// A frame put together by hand, then broken by each test
+	frame := func(hb, hsum, psum []byte) []byte {
+		var b bytes.Buffer
+		b.Write(hb)
+		b.Write(hsum)
+		b.Write(payload)
+		b.Write(psum)
+		return b.Bytes()
+	}
+
+	// The length blown up in transit, past the limit
+	long := append([]byte(nil), hb...)
+	binary.BigEndian.PutUint64(long[LEN_OFF:], 1<<40)
+
+	unflagged := h
+	unflagged.Flags = 0
+	ub := unflagged.ToBytes()
+
+	tests := map[string][]byte{
+		"header":    frame(hb, []byte{0, 0, 0, 0}, checksum(payload)),
+		"length":    frame(long, checksum(hb), checksum(payload)),
+		"payload":   frame(hb, checksum(hb), []byte{0, 0, 0, 0}),
+		"unflagged": frame(ub, checksum(ub), checksum(payload)),
+	}
+
+	for name, raw := range tests {
+		t.Run(name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer b.Close()
+
+			server := newTestEnd(NewServerPipe(a), testOptions{pipe: func(p Pipe) {
+				p.SetChecksums(true)
+				p.SetLimits(SizeLimits{MaxInbound: 1024})
+			}})
+
+			peer := NewPipe(b)
+			peer.SetChecksums(true)
+			go b.Write(raw)
+
+			r, err := peer.NextMessage()
+			if err != nil {
+				t.Fatalf("Expected an error message, got %v", err)
+			}
+
+			msg, _ := ioutil.ReadAll(r)
+			if r.header.Type != MSG_TYPE_ERROR || string(msg) != ErrChecksum.Error() {
+				t.Errorf("Expected an error message about %v, got type %d: %q", ErrChecksum, r.header.Type, msg)
+			}
+
+			select {
+			case <-server.gone:
+			case <-time.After(5 * time.Second):
+				t.Error("Connection wasn't closed after a checksum mismatch")
+			}
+		})
+	}
+}
@@ -2,10 +2,12 @@ package socket
 
 import (
 	"cisco.com/comm/common"
+	"crypto/tls"
 	"fmt"
 	"cisco.com/comm/log"
 	"net"
 	"sync"
+	"time"
 )
 
 // The Client half of a client-server connection model. Note that since there's
@@ -14,6 +16,10 @@ import (
 // multiple goroutines concurrently might result in undefined behavior.
 type Client interface {
 	Connect() error
+
+	// Drop the connection, or give up connecting
+	Close() error
+
 	GetConnections() []common.Connection
 	GetConnection(int) common.Connection
 }
@@ -21,19 +27,56 @@ type Client interface {
 type client struct {
 	Handler     ConnectionHandler
 	Addr        *net.TCPAddr
-	conn        *net.TCPConn
+	Options     ClientOptions
 	mconnection sync.Mutex
+	conn        net.Conn
 	connection  *common.Connection
+	closed      bool
+}
+
+type ClientOptions struct {
+
+	// Connect over TLS instead of plain TCP if set
+	TLS *tls.Config
+
+	// Sent to the server in our Hello
+	Key string
+
+	// Codecs offered to the server
+	Compression CompressionOptions
+
+	// Ask for checksums on every message
+	Checksums bool
+
+	// How often to exchange heartbeats with the server. The server may
+	// pick a shorter interval. Zero for none.
+	Heartbeat time.Duration
+
+	// Message size limits. The server's own inbound limit lowers
+	// MaxOutbound.
+	Limits SizeLimits
+
+	// Our name, sent to the server in the handshake
+	Name string
+
+	// Our labels, sent to the server in the handshake
+	Labels map[string]string
+
+	// About us, sent to the server in the handshake
+	Info common.PeerInfo
+
+	// Give up connecting after this long. Zero means no timeout.
+	DialTimeout time.Duration
 }
 
-func NewClient(addr string, port int, h ConnectionHandler) (Client, error) {
+func NewClient(addr string, port int, h ConnectionHandler, opts ClientOptions) (Client, error) {
 	n, err := net.ResolveTCPAddr(proto, fmt.Sprintf("%s:%d", addr, port))
 
 	if err != nil {
 		return nil, err
 	}
 
-	c := &client{Handler: h, Addr: n}
+	c := &client{Handler: h, Addr: n, Options: opts}
 	return c, nil
 }
 
@@ -46,18 +89,41 @@ func (c *client) Connect() error {
 		return err
 	}
 
+	p := NewPipe(conn)
+
+	hello := Hello{
+		Key:         c.Options.Key,
+		Compression: c.Options.Compression.Codecs,
+		Checksums:   c.Options.Checksums,
+		Heartbeat:   int64(c.Options.Heartbeat / time.Millisecond),
+		Name:        c.Options.Name,
+		Labels:      c.Options.Labels,
+		Info:        c.Options.Info,
+	}
+
+	reply, err := clientHandshake(p, hello, c.Options.Compression.MinSize, c.Options.Limits)
+	if err != nil {
+		log.E("Server rejected handshake %v", err)
+		p.Close()
+		return err
+	}
+
 	OnTeardown := func(int) {
 		c.mconnection.Lock()
 		c.connection = nil
 		c.mconnection.Unlock()
 	}
 
-	c.connection = &common.Connection{
-		Remote: conn.RemoteAddr(),
-		Out:    make(chan common.EgressMessage),
-		In:     make(chan common.IngressMessage)}
+	connection := common.NewConnection(0, conn.RemoteAddr())
+	connection.Peer = reply.Name
+	connection.Info = reply.Info
+	connection.SetLabels(peerLabels(reply.Labels))
+	connection.SetLimits(p.Limits().MaxInbound, p.Limits().MaxOutbound)
+	c.mconnection.Lock()
+	c.connection = &connection
+	c.mconnection.Unlock()
 
-	c.Handler.OnConnect(NewPipe(conn), *c.connection, OnTeardown)
+	c.Handler.OnConnect(p, connection, OnTeardown)
 
 	log.I("client.Connect() shutting down")
 	return nil
@@ -68,31 +134,71 @@ func (c *client) Connect() error {
 func (c *client) GetConnections() []common.Connection {
 	defer c.mconnection.Unlock()
 	c.mconnection.Lock()
+
+	if c.connection == nil {
+		return []common.Connection{}
+	}
 	return []common.Connection{*c.connection}
 }
 
 // Get channel by its ID. Since the client can only be connected to one endpoint
-// currently, the id field is not used here.
+// currently, the id field is not used here. Returns the zero Connection if
+// we're not connected.
 func (c *client) GetConnection(id int) common.Connection {
 	defer c.mconnection.Unlock()
 	c.mconnection.Lock()
+
+	if c.connection == nil {
+		return common.Connection{}
+	}
 	return *c.connection
 }
 
 // Establish a connection to the server and cache the connection in
 // receiver.conn
-func (c *client) connect() (*net.TCPConn, error) {
-	if c.conn != nil {
-		return c.conn, nil
+func (c *client) connect() (net.Conn, error) {
+	c.mconnection.Lock()
+	conn := c.conn
+	c.mconnection.Unlock()
+
+	if conn != nil {
+		return conn, nil
 	}
 
-	conn, err := net.DialTCP(proto, nil, c.Addr)
+	var err error
+	dialer := &net.Dialer{Timeout: c.Options.DialTimeout}
+
+	if c.Options.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, proto, c.Addr.String(), c.Options.TLS)
+	} else {
+		conn, err = dialer.Dial(proto, c.Addr.String())
+	}
 
 	if err != nil {
 		log.E("ServerConnection failed to connect to server %v", err)
 		return nil, err
 	}
 
+	c.mconnection.Lock()
+	defer c.mconnection.Unlock()
+
+	// Closed while we were dialing
+	if c.closed {
+		conn.Close()
+		return nil, common.ErrClosed
+	}
+
 	c.conn = conn
 	return c.conn, nil
 }
+
+func (c *client) Close() error {
+	c.mconnection.Lock()
+	defer c.mconnection.Unlock()
+
+	c.closed = true
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
+}
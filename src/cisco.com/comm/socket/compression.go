@@ -0,0 +1,168 @@
+package socket
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// A compressed payload can't announce its length up front without being
+// buffered in full, so it is sent as a series of chunks instead, each
+// prefixed with its length as a 32 bit big endian integer. A zero length
+// chunk ends the payload.
+const maxChunkLen = 64 * 1024
+
+// Length of the chunk length prefix
+const CHUNK_LEN_LEN = 4
+
+// A compression algorithm that can be negotiated for a connection
+type Codec struct {
+	Name      string
+	NewWriter func(io.Writer) io.WriteCloser
+	NewReader func(io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]*Codec{
+	"gzip": {
+		Name:      "gzip",
+		NewWriter: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+
+	// Raw deflate at its fastest setting. Worse ratio than gzip but a lot
+	// cheaper on CPU.
+	"flate": {
+		Name: "flate",
+		NewWriter: func(w io.Writer) io.WriteCloser {
+			zw, _ := flate.NewWriter(w, flate.BestSpeed)
+			return zw
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil },
+	},
+
+	// LZ77 only, see lz.go. The cheapest on CPU.
+	"lz": {
+		Name:      "lz",
+		NewWriter: func(w io.Writer) io.WriteCloser { return newLZWriter(w) },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return newLZReader(r), nil },
+	},
+}
+
+// Look up a codec by name. Returns nil if there is no such codec.
+func CodecByName(name string) *Codec {
+	return codecs[name]
+}
+
+type CompressionOptions struct {
+
+	// Codecs we're willing to use, in order of preference. Empty disables
+	// compression.
+	Codecs []string
+
+	// Payloads smaller than this many bytes are sent uncompressed
+	MinSize int64
+}
+
+// Pick the codec for a connection: the first one the client offered that the
+// server supports too. Returns "" if there's none.
+func negotiateCodec(offered, supported []string) string {
+	for _, o := range offered {
+		for _, s := range supported {
+			if o == s && codecs[o] != nil {
+				return o
+			}
+		}
+	}
+	return ""
+}
+
+// Splits whatever is written to it into length-prefixed chunks
+type chunkWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+
+	for len(c.buf) >= maxChunkLen {
+		if err := c.flush(maxChunkLen); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (c *chunkWriter) flush(n int) error {
+	prefix := make([]byte, CHUNK_LEN_LEN)
+	binary.BigEndian.PutUint32(prefix, uint32(n))
+
+	if _, err := c.w.Write(append(prefix, c.buf[:n]...)); err != nil {
+		return err
+	}
+
+	c.buf = c.buf[n:]
+	return nil
+}
+
+// Write out what's left followed by the terminating empty chunk
+func (c *chunkWriter) Close() error {
+	if len(c.buf) > 0 {
+		if err := c.flush(len(c.buf)); err != nil {
+			return err
+		}
+	}
+
+	_, err := c.w.Write(make([]byte, CHUNK_LEN_LEN))
+	return err
+}
+
+var ErrChunkTooLong = errors.New("ERR_CHUNK_TOO_LONG")
+
+// Reads the chunks written by a chunkWriter back as one stream. Returns EOF
+// after the terminating chunk without reading past it.
+type chunkReader struct {
+	r    io.Reader
+	left uint32
+	eof  bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.eof {
+		return 0, io.EOF
+	}
+
+	if c.left == 0 {
+		prefix := make([]byte, CHUNK_LEN_LEN)
+		if _, err := io.ReadFull(c.r, prefix); err != nil {
+			return 0, err
+		}
+
+		c.left = binary.BigEndian.Uint32(prefix)
+
+		if c.left == 0 {
+			c.eof = true
+			return 0, io.EOF
+		}
+
+		if c.left > maxChunkLen {
+			return 0, ErrChunkTooLong
+		}
+	}
+
+	if uint32(len(p)) > c.left {
+		p = p[:c.left]
+	}
+
+	n, err := c.r.Read(p)
+	c.left -= uint32(n)
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
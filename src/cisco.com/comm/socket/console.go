@@ -0,0 +1,629 @@
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"cisco.com/comm/common"
+	"cisco.com/comm/log"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The debug console sends frames exactly as they are typed in, or read from a
+// script, and shows every frame that goes by. Commands, one per line:
+//
+//	send TYPE [seq=N] [response] [timeout=MS] [PAYLOAD]
+//	expect [TYPE] [seq=N|seq=last] [response|request] [within=DURATION] [PAYLOAD]
+//	sleep DURATION
+//	help
+//	quit
+//
+// TYPE is a name such as control, data or cancel, or a number. A request sent
+// without a seq gets a fresh one from our half of the ID space; seq=last
+// stands for the seq of the last frame sent. PAYLOAD is text, a "quoted
+// string" with Go escapes, hex:0a0b... or @file. expect waits (5s by default)
+// for the next frame from the peer that matches, skipping others; a payload
+// given to it must appear in the first few KiB of the frame's. Heartbeats are
+// neither shown nor matched. Blank lines and lines starting with # are
+// skipped.
+const consoleHelp = `send TYPE [seq=N] [response] [timeout=MS] [PAYLOAD]
+expect [TYPE] [seq=N|seq=last] [response|request] [within=DURATION] [PAYLOAD]
+sleep DURATION
+quit
+
+TYPE: control, data, cancel, error, ... or a number
+PAYLOAD: text, "quoted text", hex:0a0b... or @file`
+
+var (
+	ErrNoSession = errors.New("ERR_NO_SESSION")
+	ErrExpect    = errors.New("ERR_EXPECT_TIMEOUT")
+)
+
+var errQuit = errors.New("quit")
+
+// Frames the console can send and show
+type ConsoleLink interface {
+
+	// Send f to the peer as it is. A request with a zero Seq gets a fresh
+	// one. Returns the Seq sent.
+	Send(f common.Frame) (uint64, error)
+
+	// Frames sent and received, as they go by. Closed once the connection
+	// is gone.
+	Frames() <-chan common.Frame
+}
+
+type ConsoleOptions struct {
+
+	// Commands, one per line
+	In io.Reader
+
+	// Where frames and results are shown
+	Out io.Writer
+
+	// Run In as a script: no prompt, and the first step that fails ends it
+	Script bool
+
+	// How long expect waits unless told otherwise. Defaults to 5s.
+	Timeout time.Duration
+}
+
+var frameTypeNames = map[byte]string{
+	MSG_TYPE_CONTROL:         "control",
+	MSG_TYPE_DATA:            "data",
+	MSG_TYPE_HELLO:           "hello",
+	MSG_TYPE_CANCEL:          "cancel",
+	MSG_TYPE_ERROR:           "error",
+	MSG_TYPE_TRANSFER_OPEN:   "transfer_open",
+	MSG_TYPE_TRANSFER_ACK:    "transfer_ack",
+	MSG_TYPE_TRANSFER_CHUNK:  "transfer_chunk",
+	MSG_TYPE_TRANSFER_COMMIT: "transfer_commit",
+	MSG_TYPE_STREAM_OPEN:     "stream_open",
+	MSG_TYPE_STREAM_DATA:     "stream_data",
+	MSG_TYPE_STREAM_WINDOW:   "stream_window",
+	MSG_TYPE_STREAM_CLOSE:    "stream_close",
+	MSG_TYPE_HEARTBEAT:       "heartbeat",
+}
+
+// The name of a frame type, or its number if it has none
+func FrameTypeName(t byte) string {
+	if name, ok := frameTypeNames[t]; ok {
+		return name
+	}
+	return strconv.Itoa(int(t))
+}
+
+// A frame type by name or number
+func ParseFrameType(s string) (byte, error) {
+	for t, name := range frameTypeNames {
+		if strings.EqualFold(s, name) {
+			return t, nil
+		}
+	}
+
+	t, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown frame type %q", s)
+	}
+	return byte(t), nil
+}
+
+// Queue a frame on the connection c exactly as given, next to its other
+// traffic. It bypasses the middleware and isn't tracked as a request: a
+// response to it is only seen by taps. A request with a zero Seq gets a
+// fresh one. Returns the Seq sent.
+func SendFrame(c common.Connection, f common.Frame) (uint64, error) {
+	s := findSession(c)
+	if s == nil {
+		return 0, ErrNoSession
+	}
+
+	if err := c.CheckOutbound(int64(len(f.Payload))); err != nil {
+		return 0, err
+	}
+
+	flags := f.Flags & FLAG_RESPONSE
+	if f.Seq == 0 && flags == 0 {
+		f.Seq = s.nextSeq()
+	}
+
+	return f.Seq, s.sendControl(controlMessage{t: f.Type, flags: flags, seq: f.Seq, timeout: f.Timeout, payload: f.Payload})
+}
+
+// Run the commands in opts.In against l until they run out, quit or, for a
+// script, one fails
+func RunConsole(l ConsoleLink, opts ConsoleOptions) error {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+
+	c := &console{
+		link:  l,
+		opts:  opts,
+		inbox: make(chan common.Frame, 1024),
+		gone:  make(chan struct{}),
+	}
+	go c.watch()
+
+	scanner := bufio.NewScanner(opts.In)
+	for n := 1; ; n++ {
+		if !opts.Script {
+			c.printf("> ")
+		}
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		err := c.exec(line)
+		if err == errQuit {
+			return nil
+		}
+
+		if err != nil {
+			if opts.Script {
+				return fmt.Errorf("line %d: %s: %v", n, line, err)
+			}
+			c.printf("error: %v\n", err)
+		}
+	}
+}
+
+type console struct {
+	link ConsoleLink
+	opts ConsoleOptions
+
+	// Serializes output
+	m sync.Mutex
+
+	// Frames from the peer, for expect
+	inbox chan common.Frame
+
+	// Closed once the link's frames run out
+	gone chan struct{}
+
+	lastSeq uint64
+}
+
+func (c *console) printf(format string, a ...interface{}) {
+	c.m.Lock()
+	fmt.Fprintf(c.opts.Out, format, a...)
+	c.m.Unlock()
+}
+
+// Show frames as they go by and keep those from the peer for expect
+func (c *console) watch() {
+	defer close(c.gone)
+
+	for f := range c.link.Frames() {
+		if f.Type == MSG_TYPE_HEARTBEAT {
+			continue
+		}
+
+		c.m.Lock()
+		printFrame(c.opts.Out, f)
+		c.m.Unlock()
+
+		if f.Direction != common.FrameIn {
+			continue
+		}
+
+		// Nobody may be expecting anything; make room by forgetting the
+		// oldest
+		for {
+			select {
+			case c.inbox <- f:
+			default:
+				select {
+				case <-c.inbox:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+func (c *console) exec(line string) error {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	args, err := splitArgs(line)
+	if err != nil {
+		return err
+	}
+
+	switch args[0].text {
+	case "send":
+		return c.send(args[1:])
+	case "expect":
+		return c.expect(args[1:])
+	case "sleep":
+		if len(args) != 2 {
+			return errors.New("sleep needs a duration")
+		}
+		d, err := time.ParseDuration(args[1].text)
+		if err != nil {
+			return err
+		}
+		time.Sleep(d)
+		return nil
+	case "help":
+		c.printf("%s\n", consoleHelp)
+		return nil
+	case "quit", "exit":
+		return errQuit
+	}
+	return fmt.Errorf("unknown command %q, try help", args[0].text)
+}
+
+func (c *console) send(args []consoleArg) error {
+	if len(args) == 0 {
+		return errors.New("send needs a frame type")
+	}
+
+	t, err := ParseFrameType(args[0].text)
+	if err != nil {
+		return err
+	}
+	f := common.Frame{Type: t}
+
+	rest := args[1:]
+options:
+	for len(rest) > 0 && !rest[0].quoted {
+		k, v := rest[0].option()
+		switch {
+		case k == "seq":
+			if f.Seq, err = c.parseSeq(v); err != nil {
+				return err
+			}
+		case k == "timeout":
+			ms, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return fmt.Errorf("bad timeout %q", v)
+			}
+			f.Timeout = uint32(ms)
+		case rest[0].text == "response":
+			f.Flags |= FLAG_RESPONSE
+		default:
+			break options
+		}
+		rest = rest[1:]
+	}
+
+	if f.Payload, err = parsePayload(rest); err != nil {
+		return err
+	}
+
+	seq, err := c.link.Send(f)
+	if err != nil {
+		return err
+	}
+	c.lastSeq = seq
+	return nil
+}
+
+func (c *console) expect(args []consoleArg) error {
+	var (
+		t         *byte
+		seq       *uint64
+		response  *bool
+		within    = c.opts.Timeout
+		yes, no   = true, false
+		err       error
+		rest      = args
+		wantBytes []byte
+	)
+
+options:
+	for len(rest) > 0 && !rest[0].quoted {
+		k, v := rest[0].option()
+		switch {
+		case k == "seq":
+			s, err := c.parseSeq(v)
+			if err != nil {
+				return err
+			}
+			seq = &s
+		case k == "within":
+			if within, err = time.ParseDuration(v); err != nil {
+				return err
+			}
+		case rest[0].text == "response":
+			response = &yes
+		case rest[0].text == "request":
+			response = &no
+		case t == nil && k == "":
+			typ, err := ParseFrameType(rest[0].text)
+			if err != nil {
+				break options
+			}
+			t = &typ
+		default:
+			break options
+		}
+		rest = rest[1:]
+	}
+
+	if wantBytes, err = parsePayload(rest); err != nil {
+		return err
+	}
+
+	matches := func(f common.Frame) bool {
+		return (t == nil || f.Type == *t) &&
+			(seq == nil || f.Seq == *seq) &&
+			(response == nil || (f.Flags&FLAG_RESPONSE != 0) == *response) &&
+			bytes.Contains(f.Payload, wantBytes)
+	}
+
+	deadline := time.NewTimer(within)
+	defer deadline.Stop()
+
+	for {
+		select {
+		case f := <-c.inbox:
+			if matches(f) {
+				return nil
+			}
+		case <-deadline.C:
+			return ErrExpect
+		case <-c.gone:
+			// What arrived before the end may still match
+			for {
+				select {
+				case f := <-c.inbox:
+					if matches(f) {
+						return nil
+					}
+				default:
+					return common.ErrClosed
+				}
+			}
+		}
+	}
+}
+
+// A seq given as a number, or as "last" for the last one sent
+func (c *console) parseSeq(v string) (uint64, error) {
+	if v == "last" {
+		return c.lastSeq, nil
+	}
+
+	seq, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad seq %q", v)
+	}
+	return seq, nil
+}
+
+// A word of a console command. Quoted strings are unquoted.
+type consoleArg struct {
+	text   string
+	quoted bool
+}
+
+// The key and value of a key=value word, empty if it isn't one
+func (a consoleArg) option() (string, string) {
+	if a.quoted {
+		return "", ""
+	}
+	if i := strings.Index(a.text, "="); i > 0 {
+		return a.text[:i], a.text[i+1:]
+	}
+	return "", ""
+}
+
+// Split a command into words at spaces, keeping "quoted strings" together
+func splitArgs(line string) ([]consoleArg, error) {
+	var args []consoleArg
+
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			args = append(args, consoleArg{text: line[:end]})
+			line = line[end:]
+			continue
+		}
+
+		quoted, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("unterminated string")
+		}
+
+		text, _ := strconv.Unquote(quoted)
+		args = append(args, consoleArg{text: text, quoted: true})
+		line = line[len(quoted):]
+	}
+
+	return args, nil
+}
+
+// The payload given by the rest of a command: nothing, hex:..., @file, or
+// else the words themselves
+func parsePayload(args []consoleArg) ([]byte, error) {
+	if len(args) == 1 && !args[0].quoted {
+		switch a := args[0].text; {
+		case strings.HasPrefix(a, "hex:"):
+			return hex.DecodeString(a[len("hex:"):])
+		case strings.HasPrefix(a, "@"):
+			return ioutil.ReadFile(a[1:])
+		}
+	}
+
+	words := make([]string, len(args))
+	for i, a := range args {
+		words[i] = a.text
+	}
+	if len(words) == 0 {
+		return nil, nil
+	}
+	return []byte(strings.Join(words, " ")), nil
+}
+
+var flagNames = []struct {
+	flag byte
+	name string
+}{
+	{FLAG_COMPRESSED, "compressed"},
+	{FLAG_CHECKSUM, "checksum"},
+	{FLAG_RESPONSE, "response"},
+	{FLAG_TRACE, "trace"},
+}
+
+// Write a frame's header on one line and its payload as a hex dump
+func printFrame(w io.Writer, f common.Frame) {
+	arrow := "<-"
+	if f.Direction == common.FrameOut {
+		arrow = "->"
+	}
+
+	line := fmt.Sprintf("%s %s %s seq=%d len=%d", arrow, f.Time.Format("15:04:05.000"), FrameTypeName(f.Type), f.Seq, f.Length)
+
+	var flags []string
+	for _, fl := range flagNames {
+		if f.Flags&fl.flag != 0 {
+			flags = append(flags, fl.name)
+		}
+	}
+	if len(flags) > 0 {
+		line += " flags=" + strings.Join(flags, ",")
+	}
+	if f.Timeout > 0 {
+		line += fmt.Sprintf(" timeout=%dms", f.Timeout)
+	}
+	fmt.Fprintln(w, line)
+
+	if len(f.Payload) > 0 {
+		fmt.Fprint(w, hex.Dump(f.Payload))
+	}
+	if more := int64(f.Length) - int64(len(f.Payload)); more > 0 {
+		fmt.Fprintf(w, "... %d more bytes\n", more)
+	}
+}
+
+// A console on a pipe of its own, for the console handler
+type pipeLink struct {
+	p      Pipe
+	frames chan common.Frame
+	untap  func()
+
+	// Guards writes and lastSeq
+	mwrite  sync.Mutex
+	lastSeq uint64
+
+	// Guards frames once it may be closed
+	m      sync.Mutex
+	closed bool
+}
+
+func newPipeLink(p Pipe) *pipeLink {
+	l := &pipeLink{p: p, frames: make(chan common.Frame, 1024)}
+	l.untap = p.Tap(l.publish)
+	go l.read()
+	return l
+}
+
+func (l *pipeLink) publish(f common.Frame) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.closed {
+		return
+	}
+
+	select {
+	case l.frames <- f:
+	default:
+		log.W("Console is falling behind, dropping a %s frame", FrameTypeName(f.Type))
+	}
+}
+
+// Read frames off the pipe so that the tap shows them, until it fails
+func (l *pipeLink) read() {
+	for {
+		r, err := l.p.NextMessage()
+		if err != nil {
+			log.I("Console connection closed: %v", err)
+			break
+		}
+		io.Copy(ioutil.Discard, r)
+	}
+
+	l.untap()
+	l.m.Lock()
+	l.closed = true
+	close(l.frames)
+	l.m.Unlock()
+}
+
+func (l *pipeLink) Send(f common.Frame) (uint64, error) {
+	l.mwrite.Lock()
+	defer l.mwrite.Unlock()
+
+	flags := f.Flags & FLAG_RESPONSE
+	if f.Seq == 0 && flags == 0 {
+		l.lastSeq++
+		f.Seq = l.lastSeq
+		if l.p.IsServer() {
+			f.Seq |= SEQ_SERVER_BIT
+		}
+	}
+
+	h := Header{Vendor: string(PREAMBLE), Type: f.Type, Flags: flags, Seq: f.Seq, Length: uint64(len(f.Payload)), Timeout: f.Timeout}
+	_, err := writeFrame(l.p, h, bytes.NewReader(f.Payload))
+	return f.Seq, err
+}
+
+func (l *pipeLink) Frames() <-chan common.Frame {
+	return l.frames
+}
+
+// Serves a connection with the debug console (see RunConsole) reading
+// commands from In, instead of forwarding anything. One connection at a time
+// gets the console; others wait their turn.
+type ConsoleHandler struct {
+	In     io.Reader
+	Out    io.Writer
+	Script bool
+}
+
+var consoleBusy sync.Mutex
+
+func (h *ConsoleHandler) OnConnect(p Pipe, c common.Connection, OnTeardown func(int)) {
+	consoleBusy.Lock()
+	defer consoleBusy.Unlock()
+
+	log.I("Console attached to connection %d (%s)", c.Id, c.Peer)
+	l := newPipeLink(p)
+
+	if err := RunConsole(l, ConsoleOptions{In: h.In, Out: h.Out, Script: h.Script}); err != nil {
+		log.E("Console on connection %d failed: %v", c.Id, err)
+	}
+
+	p.Close()
+	c.Close()
+	OnTeardown(c.Id)
+}
+
+// The console handler on stdin and stdout. Unless stdin is a terminal it's
+// run as a script.
+func newConsoleHandler(ForwarderOptions) ConnectionHandler {
+	script := true
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		script = false
+	}
+	return &ConsoleHandler{In: os.Stdin, Out: os.Stdout, Script: script}
+}
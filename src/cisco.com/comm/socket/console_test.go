@@ -0,0 +1,37 @@
+package socket
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestConsoleScript(t *testing.T) {
+	a, b := net.Pipe()
+	server := newTestEnd(NewServerPipe(a), testOptions{})
+	defer server.close()
+
+	p := NewPipe(b)
+	l := newPipeLink(p)
+	defer p.Close()
+
+	var out bytes.Buffer
+	script := `# the server answers with its name, in DATA
+send control "ping"
+expect data seq=last response "server:ping"
+send data seq=7 hex:706f6e67
+expect data seq=7 response within=2s pong
+expect within=100ms nothing
+`
+	err := RunConsole(l, ConsoleOptions{In: strings.NewReader(script), Out: &out, Script: true})
+	if err == nil || !strings.HasPrefix(err.Error(), "line 6:") || !strings.Contains(err.Error(), ErrExpect.Error()) {
+		t.Fatalf("Script ended with %v, want the expect on line 6 to time out\n%s", err, out.String())
+	}
+
+	for _, want := range []string{"-> ", "<- ", "control seq=1 len=4", "data seq=7 len=11 flags=response", "|server:pong|"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -1,13 +1,18 @@
 package socket
 
 import (
-	"bufio"
+	"bytes"
 	"cisco.com/comm/common"
 	"cisco.com/comm/log"
-	"fmt"
+	"cisco.com/comm/tracing"
+	"context"
+	"errors"
 	"io"
 	"io/ioutil"
-	"os"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Respond to events emitted from the socket server
@@ -17,148 +22,664 @@ type ConnectionHandler interface {
 	OnConnect(Pipe, common.Connection, func(int))
 }
 
-// ConnectionHandler that echoes back what it receives to the remote endpoint.
-// This is only really useful in development as it bypasses normal message
-// processing that would otherwise happen in higher levels. Use --handler echo.
-type EchoHandler struct {
+type ChannelHandler interface {
+	OnConnect(Pipe, common.Connection, func(int))
+}
+
+// Handler that will pass messages to and from the In and Out channels in
+// the Connection object.
+type channelHandler struct {
+	options ForwarderOptions
 }
 
-func (e *EchoHandler) OnConnect(p Pipe, c common.Connection, OnTeardown func(int)) {
-	log.I("Connected to server")
+func NewChannelHandler(opts ForwarderOptions) *channelHandler {
+	return &channelHandler{options: opts}
+}
 
-	reader := bufio.NewReader(os.Stdin)
+// Set in the Seq of every request originated by the server end of a
+// connection. Both ends originate and serve requests at the same time, each
+// allocating IDs for its own requests only; this keeps the two ID spaces
+// apart. Whether a message is a request or a response is told by
+// FLAG_RESPONSE, and a message whose Seq is from the wrong half for what it
+// claims to be is a protocol error.
+const SEQ_SERVER_BIT = 1 << 63
 
-	// REPL
-	for {
-		fmt.Print(" [x] Enter message to send (or <Enter> to receive a message or Ctrl-C to exit) => ")
+// The channelHandler's state for a single connection
+type session struct {
+	wan  Pipe
+	conn common.Connection
 
-		// Get next message to send from stdin (newline delim)
-		msg, _ := reader.ReadString('\n')
+	// SEQ_SERVER_BIT if we're the server end, 0 otherwise
+	origin uint64
 
-		h := Header{Vendor: string(PREAMBLE), Type: MSG_TYPE_CONTROL, Length: uint64(len(msg))}
-		msgbytes := append(h.ToBytes(), []byte(msg)...)
-		p.Write(msgbytes)
+	// Last request ID we allocated. Accessed atomically.
+	lastSeq uint64
 
-		log.D("Message sent. Waiting for reply...")
+	m sync.Mutex
 
-		r, err := p.NextMessage()
+	// Requests we sent and are waiting on a response for, by Seq
+	inflight map[uint64]*pendingRequest
+
+	// Requests the peer sent that we're still serving, by Seq
+	serving map[uint64]context.CancelFunc
+
+	// Control messages waiting to be written by writeToWAN
+	control chan controlMessage
+
+	// Fragmented transfers, nil if they're disabled
+	transfers *Transfers
+
+	streams *Streams
+
+	// Rate limits, nil for none
+	limiter *Limiter
+
+	// Middleware and message types, nil if there are none, and the send and
+	// receive steps wrapped in its middleware
+	chain   *Chain
+	send    SendFunc
+	receive ReceiveFunc
+}
+
+type controlMessage struct {
+	t       byte
+	flags   byte
+	seq     uint64
+	timeout uint32
+	payload []byte
+
+	// Closed once the message was written (or failed to), if set
+	sent chan struct{}
+}
+
+type pendingRequest struct {
+	response chan common.IngressMessage
+
+	// Closed once the response (or an error) was handed to response
+	done chan struct{}
+}
+
+func newSession(wan Pipe, c common.Connection, transfers *Transfers, chain *Chain) *session {
+	var origin uint64
+	if wan.IsServer() {
+		origin = SEQ_SERVER_BIT
+	}
+
+	s := &session{
+		wan:       wan,
+		conn:      c,
+		origin:    origin,
+		inflight:  make(map[uint64]*pendingRequest),
+		serving:   make(map[uint64]context.CancelFunc),
+		control:   make(chan controlMessage, 64),
+		transfers: transfers,
+		chain:     chain}
+
+	s.streams = newStreams(s)
+
+	s.send, s.receive = chain.wrap(
+		func(_ common.Connection, m common.EgressMessage) error {
+			s.write(m)
+			return nil
+		},
+		s.deliver)
+
+	return s
+}
+
+func (e *channelHandler) OnConnect(wan Pipe, c common.Connection, OnTeardown func(int)) {
+	log.I("connected. Got channel %v", wan)
+
+	if err := e.options.Chain.connect(c); err != nil {
+		log.E("Middleware refused connection %d, dropping it: %v", c.Id, err)
+		c.Close()
+		wan.Close()
+		OnTeardown(c.Id)
+		return
+	}
+
+	var lst net.Listener
+	if !e.options.NoLAN {
+		var err error
+		lst, err = listenLAN(e.options.LANAddr, e.options.LANPorts, c)
 
 		if err != nil {
-			log.I("Client got error in reply %v", err)
-			p.Close()
+			log.E("ERR_LISTEN Can't listen for LAN clients of connection %d on %q, dropping the connection: %v",
+				c.Id, e.options.LANAddr, err)
+			c.Close()
+			wan.Close()
 			OnTeardown(c.Id)
 			return
 		}
 
-		message, err := ioutil.ReadAll(r)
-		echoMessage(r, err, string(message))
+		c.SetLAN(lst.Addr())
+	}
+
+	s := newSession(wan, c, e.options.Transfers, e.options.Chain)
+	s.streams.accepting = e.options.Streams != nil
+	s.limiter = e.options.Limiter
+
+	if s.transfers != nil {
+		if err := s.transfers.attach(s); err != nil {
+			log.W("Not sending transfers to %q over connection %d: %v", c.Peer, c.Id, err)
+		}
+	}
+
+	register(s)
+	go s.readFromWAN(OnTeardown)
+	go s.writeToWAN()
+
+	if lst != nil {
+		go listenForLANData(lst, c, e.options)
+	}
+
+	if e.options.Queue != nil {
+		go e.options.Queue.deliver(c)
+	}
+
+	if e.options.Streams != nil {
+		e.options.Streams(c, s.streams)
+	}
+
+	// Run this synchronously until it dies (which means the WAN has disconnected).
+	listenForWANData(c, e.options)
+
+	if lst != nil {
+		lst.Close()
+	}
+}
+
+func (s *session) writeToWAN() {
+	var heartbeat <-chan time.Time
+	if d := s.wan.Heartbeat(); d > 0 {
+		t := time.NewTicker(d)
+		defer t.Stop()
+		heartbeat = t.C
 	}
 
-	log.I("common.Connection closed")
-	OnTeardown(c.Id)
-	p.Close()
+	for {
+		select {
+		case m := <-s.conn.Out:
+			s.dispatch(m)
+		case c := <-s.control:
+			log.D("Writing control message type %d seq %d", c.t, c.seq)
+			s.limiter.waitConn(s.conn.Id, int64(len(c.payload)), s.conn.Done())
+			h := Header{Vendor: string(PREAMBLE), Type: c.t, Flags: c.flags, Length: uint64(len(c.payload)), Seq: c.seq, Timeout: c.timeout}
+			if _, err := writeFrame(s.wan, h, bytes.NewReader(c.payload)); err != nil {
+				log.E("ERROR writing control message %v", err)
+			} else {
+				s.conn.CountOut(int64(len(c.payload)))
+			}
+			if c.sent != nil {
+				close(c.sent)
+			}
+		case <-heartbeat:
+			h := Header{Vendor: string(PREAMBLE), Type: MSG_TYPE_HEARTBEAT}
+			if _, err := writeFrame(s.wan, h, bytes.NewReader(nil)); err != nil {
+				log.W("Failed to send a heartbeat on connection %d: %v", s.conn.Id, err)
+			}
+		case <-s.conn.Done():
+			log.I("Shutting down. Channel closed. Channel %v", s.conn)
+			return
+		}
+	}
 }
 
-func echoMessage(reader *payloadReader, err error, text string) {
-	var t string
+// Pass a message from conn.Out through the middleware on to write
+func (s *session) dispatch(m common.EgressMessage) {
+	if m.ResponseChan != nil {
+		// This is a new request. Whatever Seq the sender put in is replaced.
+		m.Seq = s.nextSeq()
+	}
 
-	if reader.header.Type == MSG_TYPE_DATA {
-		t = "DATA Message"
-	} else if reader.header.Type == MSG_TYPE_CONTROL {
-		t = "CONTROL Message"
+	err := ErrReservedMessageType
+	if m.Type == 0 || m.Type >= MSG_TYPE_USER {
+		err = s.send(s.conn, m)
 	}
 
-	fmt.Println(
-		"\n ######################################################################\n",
-		"# Message RECV\n # Type:", t, ".",
-		"Length:", reader.header.Length, "\n # Payload:", text, err,
-		"\n ######################################################################\n")
+	if err != nil {
+		log.W("Not sending message %d on connection %d: %v", m.Seq, s.conn.Id, err)
+		if m.ResponseChan != nil {
+			m.ResponseChan <- common.IngressMessage{Seq: m.Seq, Err: err}
+		}
+		if c, ok := m.R.(io.Closer); ok {
+			c.Close()
+		}
+	}
 }
 
-type ChannelHandler interface {
-	OnConnect(Pipe, common.Connection, func(int))
+func (s *session) write(m common.EgressMessage) {
+	var t byte
+	if m.Binary {
+		t = MSG_TYPE_DATA
+	} else {
+		t = MSG_TYPE_CONTROL
+	}
+
+	if m.Type != 0 {
+		t = m.Type
+	}
+
+	var timeout uint32
+	var flags byte
+
+	// Normally caught by whoever queued the message, this is the last line of
+	// defence. A request fails right away; a response can't be replaced by
+	// anything meaningful here, so the peer is left to time out.
+	if err := s.conn.CheckOutbound(m.N); err != nil {
+		log.E("ERROR message of %d bytes exceeds the outbound size limit, not sending it", m.N)
+		if m.ResponseChan != nil {
+			m.ResponseChan <- common.IngressMessage{Err: err}
+		}
+		if c, ok := m.R.(io.Closer); ok {
+			c.Close()
+		}
+		return
+	}
+
+	if m.ResponseChan != nil {
+		// This is a new request, numbered by dispatch
+		var err error
+		if timeout, err = s.track(m); err != nil {
+			return
+		}
+	} else {
+		// This is our response to a request the peer sent
+		flags = FLAG_RESPONSE
+
+		s.m.Lock()
+		if cancel, ok := s.serving[m.Seq]; ok {
+			delete(s.serving, m.Seq)
+			cancel()
+		}
+		s.m.Unlock()
+	}
+
+	// Only messages that are part of a trace are traced
+	var span *tracing.Span
+	if parent := tracing.FromContext(m.Ctx); parent.IsValid() {
+		span = tracing.StartWithParent(parent, "comm.wan.write", tracing.KindProducer)
+		span.SetAttribute("comm.connection", s.conn.Id)
+		span.SetAttribute("comm.seq", m.Seq)
+		span.SetAttribute("comm.bytes", m.N)
+		span.SetAttribute("comm.response", flags&FLAG_RESPONSE != 0)
+		defer span.Finish()
+	}
+
+	log.I("Got message to write to WAN: %v", m)
+	h := Header{Seq: m.Seq, Vendor: string(PREAMBLE), Type: t, Flags: flags, Length: uint64(m.N), Timeout: timeout, Trace: span.SpanContext()}
+	n, err := writeFrame(s.wan, h, s.limiter.shapeConn(m.R, s.conn.Id, s.conn.Done()))
+	span.SetError(err)
+
+	if err != nil {
+		// A frame broken off halfway leaves the peer waiting for bytes that
+		// won't come. There's no way to recover from that, so drop the
+		// connection; readFromWAN cleans up.
+		log.E("ERROR writing message %d, closing the connection: %v", m.Seq, err)
+		s.wan.Close()
+		if m.ResponseChan != nil {
+			s.finish(m.Seq, common.IngressMessage{Seq: m.Seq, Err: err})
+		}
+	}
+
+	if err == nil {
+		s.conn.CountOut(m.N)
+	}
+
+	log.D("Wrote %d bytes. Err: %v", n, err)
 }
 
-// Handler that will pass messages to and from the In and Out channels in
-// the Connection object.
-type channelHandler struct {
-	inflight map[uint64]chan common.IngressMessage
+// Allocate an ID for a request we originate
+func (s *session) nextSeq() uint64 {
+	return (atomic.AddUint64(&s.lastSeq, 1) &^ SEQ_SERVER_BIT) | s.origin
 }
 
-func NewChannelHandler() *channelHandler {
-	return &channelHandler{inflight: make(map[uint64]chan common.IngressMessage)}
+// Whether seq belongs to a request we originated
+func (s *session) ours(seq uint64) bool {
+	return seq&SEQ_SERVER_BIT == s.origin
 }
 
-func (e *channelHandler) OnConnect(wan Pipe, c common.Connection, OnTeardown func(int)) {
-	log.I("connected. Got channel %v", wan)
+// Register a request we're about to send in the inflight table and start
+// watching its context. Returns the timeout to send along in the header, or an
+// error (already delivered to the requester) if the request expired before it
+// was even sent. The entry is registered before the request is written so a
+// quick response can't beat us to it.
+func (s *session) track(m common.EgressMessage) (uint32, error) {
+	req := &pendingRequest{response: m.ResponseChan, done: make(chan struct{})}
+	ctx := m.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
 
-	go e.readFromWAN(wan, c, OnTeardown)
-	go e.writeToWAN(wan, c)
-	go listenForLANData(c)
+	var timeout uint32
+	if deadline, ok := ctx.Deadline(); ok {
+		left := time.Until(deadline)
+		if left <= 0 {
+			m.ResponseChan <- common.IngressMessage{Seq: m.Seq, Err: context.DeadlineExceeded}
+			return 0, context.DeadlineExceeded
+		}
+		timeout = uint32((left + time.Millisecond - 1) / time.Millisecond)
+	}
 
-	// Run this synchronously until it dies (which means the WAN has disconnected).
-	listenForWANData(c)
+	s.m.Lock()
+	s.inflight[m.Seq] = req
+	s.m.Unlock()
+
+	go s.watch(m.Seq, ctx, req)
+	return timeout, nil
 }
 
-func (e *channelHandler) writeToWAN(p Pipe, c common.Connection) {
-	for m := range c.Out {
-		var t byte
-		if m.Binary {
-			t = MSG_TYPE_DATA
-		} else {
-			t = MSG_TYPE_CONTROL
+// Abandon the request once its context is done, unless it was answered first.
+func (s *session) watch(seq uint64, ctx context.Context, req *pendingRequest) {
+	select {
+	case <-req.done:
+		return
+	case <-s.conn.Done():
+		return
+	case <-ctx.Done():
+	}
+
+	s.m.Lock()
+	current, ok := s.inflight[seq]
+	if !ok || current != req {
+		s.m.Unlock()
+		return
+	}
+
+	// Should the response still show up, readFromWAN recognizes it as ours
+	// by its Seq and throws it away.
+	delete(s.inflight, seq)
+	close(req.done)
+	s.m.Unlock()
+
+	log.I("Request %d abandoned: %v", seq, ctx.Err())
+	req.response <- common.IngressMessage{Seq: seq, Err: ctx.Err()}
+
+	select {
+	case s.control <- controlMessage{t: MSG_TYPE_CANCEL, seq: seq}:
+	case <-s.conn.Done():
+	}
+}
+
+// Hand a response (or error) for request seq to whoever is waiting for it.
+// A response nobody is waiting for anymore is discarded.
+func (s *session) finish(seq uint64, ing common.IngressMessage) {
+	s.m.Lock()
+	req, ok := s.inflight[seq]
+
+	if !ok {
+		s.m.Unlock()
+		log.D("Discarding late response to abandoned request %d", seq)
+		if ing.R != nil {
+			io.Copy(ioutil.Discard, ing.R)
 		}
+		return
+	}
 
-		log.I("Got message to write to WAN: %v", m)
-		h := Header{Seq: m.Seq, Vendor: string(PREAMBLE), Type: t, Length: uint64(m.N)}
-		mr := &PrependHeaderReader{Header: h, InnerReader: m.R}
-		n, err := io.Copy(p, mr)
+	delete(s.inflight, seq)
+	close(req.done)
+	s.m.Unlock()
 
+	req.response <- ing
+}
+
+// Stop serving request seq on behalf of the peer
+func (s *session) cancelServing(seq uint64) {
+	s.m.Lock()
+	cancel, ok := s.serving[seq]
+	delete(s.serving, seq)
+	s.m.Unlock()
+
+	if ok {
+		log.I("Peer cancelled request %d", seq)
+		cancel()
+	}
+}
+
+// Queue a control message for writeToWAN. Fails once the connection is closed.
+func (s *session) sendControl(c controlMessage) error {
+	select {
+	case s.control <- c:
+		return nil
+	case <-s.conn.Done():
+		return common.ErrClosed
+	}
+}
+
+// Send a request of type t with an in-memory payload and wait for the
+// response. Like requests through conn.Out, it is bounded by ctx and fails
+// with common.ErrClosed if the connection goes away first.
+func (s *session) request(ctx context.Context, t byte, payload []byte) common.IngressMessage {
+	return s.requestAs(ctx, s.nextSeq(), t, payload)
+}
+
+// Same as request, for a Seq the caller allocated with nextSeq
+func (s *session) requestAs(ctx context.Context, seq uint64, t byte, payload []byte) common.IngressMessage {
+	res := make(chan common.IngressMessage, 1)
+	m := common.EgressMessage{Seq: seq, ResponseChan: res, Ctx: ctx}
+
+	timeout, err := s.track(m)
+	if err == nil {
+		err = s.sendControl(controlMessage{t: t, seq: m.Seq, timeout: timeout, payload: payload})
 		if err != nil {
-			log.E("ERROR copying %v", err)
-			c.In <- common.IngressMessage{Err: err}
+			s.finish(m.Seq, common.IngressMessage{Seq: m.Seq, Err: err})
 		}
+	}
 
-		e.inflight[m.Seq] = m.ResponseChan
-		log.D("Wrote %d bytes. Err: %v", n, err)
+	select {
+	case ing := <-res:
+		return ing
+	case <-s.conn.Done():
+		return common.IngressMessage{Seq: m.Seq, Err: common.ErrClosed}
 	}
+}
 
-	log.I("Shutting down. Channel closed. Channel %v", c)
+// Hand a new request from the peer to whoever serves this connection. It is
+// cancelled once the sender's timeout (in milliseconds, zero for none) passes,
+// the peer cancels it or we respond.
+func (s *session) serve(ing common.IngressMessage, timeout uint32) {
+	parent := ing.Ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ing.Ctx, cancel = context.WithTimeout(parent, time.Duration(timeout)*time.Millisecond)
+	} else {
+		ing.Ctx, cancel = context.WithCancel(parent)
+	}
+
+	s.m.Lock()
+	s.serving[ing.Seq] = cancel
+	s.m.Unlock()
+
+	if err := s.receive(s.conn, ing); err != nil {
+		log.W("Dropping request %d on connection %d: %v", ing.Seq, s.conn.Id, err)
+		if ing.R != nil {
+			io.Copy(ioutil.Discard, ing.R)
+		}
+
+		s.m.Lock()
+		delete(s.serving, ing.Seq)
+		s.m.Unlock()
+		cancel()
+	}
+}
+
+// The last step of receiving a message, after the middleware: a response goes
+// to its requester, a request of a registered type to its handler and any
+// other request to the In channel
+func (s *session) deliver(_ common.Connection, ing common.IngressMessage) error {
+	if s.ours(ing.Seq) {
+		s.finish(ing.Seq, ing)
+		return nil
+	}
+
+	if ing.Type != 0 {
+		h := s.chain.handler(ing.Type)
+		if h == nil {
+			return ErrUnknownMessageType
+		}
+
+		go h(s.conn, ing)
+		return nil
+	}
+
+	log.I("RECV done. Got NEW message. Sending on IN channel. Seq %d", ing.Seq)
+	s.conn.In <- ing
+	return nil
+}
+
+// Tell the peer why we're about to hang up. Gives up after a second, the
+// connection is going away either way.
+func (s *session) sendError(err error) {
+	sent := make(chan struct{})
+
+	select {
+	case s.control <- controlMessage{t: MSG_TYPE_ERROR, payload: []byte(err.Error()), sent: sent}:
+	case <-time.After(time.Second):
+		return
+	}
+
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+	}
+}
+
+// Fail everything still in flight once the WAN is gone
+func (s *session) teardown() {
+	s.m.Lock()
+	inflight := s.inflight
+	serving := s.serving
+	s.inflight = make(map[uint64]*pendingRequest)
+	s.serving = make(map[uint64]context.CancelFunc)
+	s.m.Unlock()
+
+	for seq, req := range inflight {
+		close(req.done)
+		req.response <- common.IngressMessage{Seq: seq, Err: common.ErrClosed}
+	}
+
+	for _, cancel := range serving {
+		cancel()
+	}
 }
 
-func (e *channelHandler) readFromWAN(p Pipe, conn common.Connection, OnTeardown func(int)) {
+func (s *session) readFromWAN(OnTeardown func(int)) {
+	p := s.wan
+	conn := s.conn
+
 	for {
 		log.D("READing WAN for NextMessage()")
 		r, err := p.NextMessage()
 		if err != nil {
 			log.I("Got err on p.NextMessage() so closing connection %v", err)
+
+			if isProtocolError(err) {
+				log.E("Protocol error on connection %d: %v", conn.Id, err)
+				s.sendError(err)
+			}
+
 			conn.Close()
 			p.Close()
+			s.teardown()
+			unregister(s)
+			s.chain.disconnect(conn)
+			s.limiter.forget(conn.Id)
+			if s.transfers != nil {
+				s.transfers.detach(s)
+			}
 			OnTeardown(conn.Id)
 			return
 		}
 
+		// Heartbeats only show the peer is there; they aren't traffic
+		if r.header.Type == MSG_TYPE_HEARTBEAT {
+			io.Copy(ioutil.Discard, r)
+			conn.Heard()
+			continue
+		}
+
 		log.I("RECV new ingress message from WAN. Header: %v", r.header)
+		conn.CountIn(int64(r.header.Length))
+
+		switch r.header.Type {
+		case MSG_TYPE_CANCEL:
+			io.Copy(ioutil.Discard, r)
+			s.cancelServing(r.header.Seq)
+			continue
+		case MSG_TYPE_ERROR:
+			msg, _ := ioutil.ReadAll(io.LimitReader(r, maxHelloLen))
+			io.Copy(ioutil.Discard, r)
+			log.E("Peer reported a protocol error on connection %d, closing: %s", conn.Id, msg)
+			p.Fail(errors.New("ERR_PEER_PROTOCOL_ERROR"))
+			continue
+		case MSG_TYPE_TRANSFER_OPEN, MSG_TYPE_TRANSFER_ACK, MSG_TYPE_TRANSFER_CHUNK, MSG_TYPE_TRANSFER_COMMIT:
+			s.limiter.waitConn(conn.Id, int64(r.header.Length), conn.Done())
+			s.transfers.handle(s, r)
+			continue
+		case MSG_TYPE_STREAM_OPEN, MSG_TYPE_STREAM_DATA, MSG_TYPE_STREAM_WINDOW, MSG_TYPE_STREAM_CLOSE:
+			s.limiter.waitConn(conn.Id, int64(r.header.Length), conn.Done())
+			s.streams.handle(r)
+			continue
+		}
 
+		// Whoever reads the payload is paced to the byte rates, and the
+		// next message isn't read before it's done
 		ing := common.IngressMessage{
 			Seq:    r.header.Seq,
 			N:      int64(r.header.Length),
-			R:      r,
+			R:      s.limiter.shapeConn(r, conn.Id, conn.Done()),
 			Binary: r.header.Type == MSG_TYPE_DATA,
 		}
 
-		c, ok := e.inflight[ing.Seq]
+		if r.header.Type != MSG_TYPE_CONTROL && r.header.Type != MSG_TYPE_DATA {
+			ing.Type = r.header.Type
+		}
 
-		if !ok {
-			// This is a new message
-			log.I("RECV done. Got NEW message. Sending on IN channel. Header %v", r.header)
-			conn.In <- ing
-		} else {
-			// This is a response to a previous outbound message
-			log.I("RECV done. Got RESPONSE message. Seq %d. Sending on channel %v", ing.Seq, c)
+		response := r.header.Flags&FLAG_RESPONSE != 0
+
+		// Receiving the payload is traced if the peer sent the trace along.
+		// What a request leads to is traced as part of it.
+		if r.header.Flags&FLAG_TRACE != 0 {
+			span := tracing.StartWithParent(r.header.Trace, "comm.wan.read", tracing.KindConsumer)
+			span.SetAttribute("comm.connection", conn.Id)
+			span.SetAttribute("comm.seq", ing.Seq)
+			span.SetAttribute("comm.bytes", ing.N)
+			span.SetAttribute("comm.response", response)
+			ing.R = &tracedReader{R: ing.R, N: ing.N, span: span}
+			if ing.N == 0 {
+				span.Finish()
+			}
+
+			if !response {
+				ing.Ctx = tracing.ContextWithSpan(context.Background(), span)
+			}
+		}
+
+		// A response must answer one of our requests and a request must
+		// carry one of the peer's IDs
+		if response != s.ours(ing.Seq) {
+			log.E("Got a misdirected message on connection %d (response: %t, seq %d)", conn.Id, response, ing.Seq)
+			io.Copy(ioutil.Discard, r)
+			p.Fail(ErrMisdirected)
+			continue
+		}
 
-			// Send the response to the channel waiting for it.
-			c <- ing
+		// This is a response to a previous outbound message
+		if response {
+			log.I("RECV done. Got RESPONSE message. Seq %d", ing.Seq)
+			if err := s.receive(conn, ing); err != nil {
+				log.W("Failing request %d on connection %d: %v", ing.Seq, conn.Id, err)
+				io.Copy(ioutil.Discard, r)
+				s.finish(ing.Seq, common.IngressMessage{Seq: ing.Seq, Err: err})
+			}
+			continue
 		}
+
+		// This is a new message
+		s.serve(ing, r.header.Timeout)
 	}
 }
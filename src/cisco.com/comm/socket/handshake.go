@@ -0,0 +1,271 @@
+package socket
+
+import (
+	"cisco.com/comm/common"
+	"cisco.com/comm/log"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"time"
+)
+
+// Upper bound on the size of a HELLO payload. Anything bigger is not a HELLO.
+const maxHelloLen = 64 * 1024
+
+// Sent by the client as the first message on a new connection.
+type Hello struct {
+
+	// PROTOCOL_VERSION of the client
+	Version int `json:"version"`
+
+	// Credential checked against the server's accepted keys
+	Key string `json:"key,omitempty"`
+
+	// Compression codecs the client supports, in order of preference
+	Compression []string `json:"compression,omitempty"`
+
+	// The client wants checksums on every message
+	Checksums bool `json:"checksums,omitempty"`
+
+	// The client understands trace context in headers
+	Tracing bool `json:"tracing,omitempty"`
+
+	// How often the client would like heartbeats, in milliseconds. Zero if
+	// it doesn't send or expect any.
+	Heartbeat int64 `json:"heartbeat_ms,omitempty"`
+
+	// Largest message the client accepts, zero for no limit
+	MaxMessageSize int64 `json:"max_message_size,omitempty"`
+
+	// Name of the client. Unlike the connection ID it stays the same when
+	// the client reconnects.
+	Name string `json:"name,omitempty"`
+
+	// Labels the server can pick the connection by
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// About the client, for the server's connection registry
+	Info common.PeerInfo `json:"info"`
+}
+
+// The server's answer to a Hello. An empty Error means the connection was
+// accepted.
+type HelloReply struct {
+	Error string `json:"error,omitempty"`
+
+	// PROTOCOL_VERSION of the server
+	Version int `json:"version"`
+
+	// Codec picked from Hello.Compression, empty for none
+	Compression string `json:"compression,omitempty"`
+
+	// Checksums are on, because either end asked for them
+	Checksums bool `json:"checksums,omitempty"`
+
+	// The server understands trace context in headers too
+	Tracing bool `json:"tracing,omitempty"`
+
+	// How often both ends send heartbeats, in milliseconds. Zero for never.
+	Heartbeat int64 `json:"heartbeat_ms,omitempty"`
+
+	// Largest message the server accepts, zero for no limit
+	MaxMessageSize int64 `json:"max_message_size,omitempty"`
+
+	// Name of the server
+	Name string `json:"name,omitempty"`
+
+	// Labels of the server
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// About the server
+	Info common.PeerInfo `json:"info"`
+}
+
+var ErrAuth = errors.New("ERR_AUTH")
+
+// Read the next message from the pipe, which must be of type t, and decode
+// its JSON payload into v.
+func readJSONMessage(p Pipe, t byte, v interface{}) error {
+	r, err := p.NextMessage()
+	if err != nil {
+		return err
+	}
+
+	if r.header.Type != t || r.header.Length > maxHelloLen {
+		p.Done()
+		return errors.New("ERR_HANDSHAKE_UNEXPECTED_MESSAGE")
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func writeJSONMessage(p Pipe, t byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return writeMessage(p, t, 0, data)
+}
+
+// Introduce ourselves to the server and wait for it to accept us. Sets up
+// the compression the server picked and the size limits on p.
+func clientHandshake(p Pipe, hello Hello, minSize int64, limits SizeLimits) (*HelloReply, error) {
+	hello.Version = PROTOCOL_VERSION
+	hello.MaxMessageSize = limits.MaxInbound
+	hello.Tracing = true
+
+	if hello.Heartbeat < 0 {
+		hello.Heartbeat = 0
+	}
+
+	if err := writeJSONMessage(p, MSG_TYPE_HELLO, hello); err != nil {
+		return nil, err
+	}
+
+	var reply HelloReply
+	if err := readJSONMessage(p, MSG_TYPE_HELLO, &reply); err != nil {
+		return nil, err
+	}
+
+	if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+
+	if reply.Version != PROTOCOL_VERSION {
+		log.W("Server speaks protocol version %d, we speak %d", reply.Version, PROTOCOL_VERSION)
+		return nil, ErrProtocolVersion
+	}
+
+	if reply.Compression != "" {
+		codec := CodecByName(reply.Compression)
+		if codec == nil {
+			return nil, errors.New("ERR_HANDSHAKE_UNKNOWN_CODEC")
+		}
+		log.I("Compressing payloads with %s", codec.Name)
+		p.SetCompression(codec, minSize)
+	}
+
+	p.SetChecksums(reply.Checksums)
+	p.SetTracing(reply.Tracing)
+	p.SetHeartbeat(negotiateHeartbeat(hello.Heartbeat, reply.Heartbeat))
+	p.SetLimits(SizeLimits{
+		MaxInbound:  limits.MaxInbound,
+		MaxOutbound: lowerLimit(limits.MaxOutbound, reply.MaxMessageSize),
+	})
+	return &reply, nil
+}
+
+// Wait for the client's Hello and check its key against keys, the ones
+// accepted right now rather than opts.Keys. If keys is empty any client is
+// accepted. On failure the client is told why before the error is returned;
+// closing the pipe is left to the caller. On success the compression and size
+// limits agreed on are set up on p.
+func serverHandshake(p Pipe, keys []string, opts ServerOptions) (*Hello, error) {
+	var hello Hello
+	if err := readJSONMessage(p, MSG_TYPE_HELLO, &hello); err != nil {
+		return nil, err
+	}
+
+	if hello.Version != PROTOCOL_VERSION {
+		log.W("Rejecting client speaking protocol version %d, we speak %d", hello.Version, PROTOCOL_VERSION)
+		writeJSONMessage(p, MSG_TYPE_HELLO, HelloReply{Error: ErrProtocolVersion.Error(), Version: PROTOCOL_VERSION})
+		return nil, ErrProtocolVersion
+	}
+
+	if !keyAccepted(hello.Key, keys) {
+		log.W("Rejecting client with invalid key")
+		writeJSONMessage(p, MSG_TYPE_HELLO, HelloReply{Error: ErrAuth.Error(), Version: PROTOCOL_VERSION})
+		return nil, ErrAuth
+	}
+
+	reply := HelloReply{
+		Version:     PROTOCOL_VERSION,
+		Compression: negotiateCodec(hello.Compression, opts.Compression.Codecs),
+		Checksums:   hello.Checksums || opts.Checksums,
+		Tracing:     hello.Tracing,
+		Heartbeat:   int64(negotiateHeartbeat(hello.Heartbeat, int64(opts.Heartbeat/time.Millisecond)) / time.Millisecond),
+
+		MaxMessageSize: opts.Limits.MaxInbound,
+		Name:           opts.Name,
+		Labels:         opts.Labels,
+		Info:           opts.Info,
+	}
+
+	if err := writeJSONMessage(p, MSG_TYPE_HELLO, reply); err != nil {
+		return nil, err
+	}
+
+	if reply.Compression != "" {
+		p.SetCompression(CodecByName(reply.Compression), opts.Compression.MinSize)
+	}
+
+	p.SetChecksums(reply.Checksums)
+	p.SetTracing(reply.Tracing)
+	p.SetHeartbeat(time.Duration(reply.Heartbeat) * time.Millisecond)
+	p.SetLimits(SizeLimits{
+		MaxInbound:  opts.Limits.MaxInbound,
+		MaxOutbound: lowerLimit(opts.Limits.MaxOutbound, hello.MaxMessageSize),
+	})
+
+	return &hello, nil
+}
+
+// The heartbeat interval for two ends asking for a and b milliseconds: the
+// shorter one, or none if either end doesn't do heartbeats
+func negotiateHeartbeat(a, b int64) time.Duration {
+	if a <= 0 || b <= 0 {
+		return 0
+	}
+	if b < a {
+		a = b
+	}
+	return time.Duration(a) * time.Millisecond
+}
+
+// The labels the peer sent, less any that couldn't be used in a selector
+func peerLabels(labels map[string]string) map[string]string {
+	res := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if err := common.CheckLabel(k, v); err != nil {
+			log.W("Ignoring label from peer: %v", err)
+			continue
+		}
+		res[k] = v
+	}
+
+	return res
+}
+
+func keyAccepted(key string, keys []string) bool {
+	if len(keys) == 0 {
+		return true
+	}
+
+	ok := 0
+	for _, k := range keys {
+		ok |= subtle.ConstantTimeCompare([]byte(key), []byte(k))
+	}
+
+	return ok == 1
+}
+
+// What a client authenticated with key is known as once connected (see
+// Connection.Identity): a digest of the key, so the key itself isn't kept
+// around. Empty if keys accepts any client.
+func keyIdentity(key string, keys []string) string {
+	if len(keys) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,40 @@
+package socket
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProtocolVersion(t *testing.T) {
+	h := Header{Vendor: string(PREAMBLE), Type: MSG_TYPE_DATA, Length: 3, Seq: 1}
+	if got, err := NewHeader(bytes.NewReader(h.ToBytes()), 0); err != nil || got.Seq != 1 {
+		t.Fatalf("Reading our own header failed: %v", err)
+	}
+
+	// A peer from before versioning
+	old := h.ToBytes()
+	copy(old, "cisco")
+	if _, err := NewHeader(bytes.NewReader(old), 0); err != ErrProtocolVersion {
+		t.Errorf("Old header: got %v, want %v", err, ErrProtocolVersion)
+	}
+
+	// Not ours at all
+	copy(old, "hello")
+	if _, err := NewHeader(bytes.NewReader(old), 0); err != ErrBadPreamble {
+		t.Errorf("Foreign header: got %v, want %v", err, ErrBadPreamble)
+	}
+
+	// A client of another version is refused in the handshake
+	a, b := net.Pipe()
+	server, client := NewServerPipe(a), NewPipe(b)
+	defer server.Close()
+	defer client.Close()
+
+	go writeJSONMessage(client, MSG_TYPE_HELLO, Hello{Version: PROTOCOL_VERSION + 1})
+	go readJSONMessage(client, MSG_TYPE_HELLO, &HelloReply{})
+
+	if _, err := serverHandshake(server, nil, ServerOptions{}); err != ErrProtocolVersion {
+		t.Errorf("Handshake: got %v, want %v", err, ErrProtocolVersion)
+	}
+}
@@ -1,7 +1,10 @@
 package socket
 
 import (
+	"cisco.com/comm/common"
 	"cisco.com/comm/log"
+	"cisco.com/comm/metrics"
+	"cisco.com/comm/tracing"
 	"bytes"
 	"encoding/binary"
 	"errors"
@@ -12,52 +15,144 @@ import (
 // Header constants. All lengths are in bytes
 //////////////////////////////////////////////////////////////////////////////////
 
-// 'cisco'
-var PREAMBLE = []byte{0x63, 0x69, 0x73, 0x63, 0x6f}
+// Version of the wire protocol. It is the last byte of the preamble, so a
+// peer speaking another version fails on the very first header instead of
+// reading frames at the wrong offsets; the original protocol had 'o' there
+// ('cisco'). Bump it whenever the header layout changes. Changes that both
+// ends negotiate in the handshake don't need a new version.
+const PROTOCOL_VERSION = 2
+
+// 'cisc' and the protocol version
+var MAGIC = []byte{0x63, 0x69, 0x73, 0x63}
+var PREAMBLE = append(append([]byte{}, MAGIC...), PROTOCOL_VERSION)
 
 // Length of the message type field
 const TYPE_LEN = 1
 
+// Length of the flags field
+const FLAGS_LEN = 1
+
 // Length of the payload length field
 const LEN_LEN = 8
 
 // Length of sequence identifier field
 const SEQ_LEN = 8
 
+// Length of the request timeout field
+const TIMEOUT_LEN = 4
+
 // Total length of the header
-var HEADER_LEN = len(PREAMBLE) + TYPE_LEN + LEN_LEN + SEQ_LEN
+var HEADER_LEN = len(PREAMBLE) + TYPE_LEN + FLAGS_LEN + LEN_LEN + SEQ_LEN + TIMEOUT_LEN
+
+// Offset into header before flags field
+var FLAGS_OFF = len(PREAMBLE) + TYPE_LEN
 
 // Offset into header before length field
-var LEN_OFF = len(PREAMBLE) + TYPE_LEN
+var LEN_OFF = FLAGS_OFF + FLAGS_LEN
 
 // Offset into header before sequence field
 var SEQ_OFF = LEN_OFF + LEN_LEN
 
+// Offset into header before timeout field
+var TIMEOUT_OFF = SEQ_OFF + SEQ_LEN
+
+// Length of the trace context that follows the header if FLAG_TRACE is set
+const TRACE_LEN = tracing.BinaryLen
+
 const (
 	MSG_TYPE_CONTROL = iota
 	MSG_TYPE_DATA
+
+	// Exchanged once when a connection is established. See handshake.go.
+	MSG_TYPE_HELLO
+
+	// Tells the peer to abandon the request with the same Seq. No payload.
+	MSG_TYPE_CANCEL
+
+	// Sent right before closing the connection because of a protocol
+	// violation such as a checksum mismatch. The payload says what happened.
+	MSG_TYPE_ERROR
+
+	// Fragmented transfers, see transfer.go
+	MSG_TYPE_TRANSFER_OPEN
+	MSG_TYPE_TRANSFER_ACK
+	MSG_TYPE_TRANSFER_CHUNK
+	MSG_TYPE_TRANSFER_COMMIT
+
+	// Streams, see stream.go
+	MSG_TYPE_STREAM_OPEN
+	MSG_TYPE_STREAM_DATA
+	MSG_TYPE_STREAM_WINDOW
+	MSG_TYPE_STREAM_CLOSE
+
+	// Sent every so often to show the connection is alive, if both ends
+	// agreed to in the handshake. No payload.
+	MSG_TYPE_HEARTBEAT
 )
 
+// Types from this one up are left to applications. See Chain.Handle.
+const MSG_TYPE_USER = 64
+
+// Header flags
+const (
+	// The payload is compressed with the codec negotiated for the connection
+	// and sent as a series of chunks (see compression.go). Length is the
+	// uncompressed length.
+	FLAG_COMPRESSED = 1 << iota
+
+	// The header and payload are followed by checksums (see checksum.go)
+	FLAG_CHECKSUM
+
+	// The message is the response to the peer's request with the same Seq.
+	// Without it a CONTROL or DATA message is a new request.
+	FLAG_RESPONSE
+
+	// The header is followed by TRACE_LEN bytes of trace context: the trace
+	// ID, the ID of the sender's span and the trace flags. Only sent to
+	// peers that said they understand it in the handshake.
+	FLAG_TRACE
+)
+
+var ErrBadPreamble = errors.New("ERR_EQUALITY")
+
+// The peer speaks another version of the protocol
+var ErrProtocolVersion = errors.New("ERR_PROTOCOL_VERSION")
+
 type Header struct {
 	Vendor string
 	Type   byte
+	Flags  byte
 	Length uint64
 	Seq    uint64
+
+	// Milliseconds the sender is still willing to wait for a response to
+	// this request. Zero means no limit.
+	Timeout uint32
+
+	// The span that sent the message, if FLAG_TRACE is set
+	Trace tracing.SpanContext
 }
 
 func (h *Header) ToBytes() []byte {
 	lenbytes := make([]byte, LEN_LEN)
 	seqbytes := make([]byte, SEQ_LEN)
+	timeoutbytes := make([]byte, TIMEOUT_LEN)
 	binary.BigEndian.PutUint64(lenbytes, h.Length)
 	binary.BigEndian.PutUint64(seqbytes, h.Seq)
-	res := append(append(append([]byte(h.Vendor), h.Type), lenbytes...), seqbytes...)
+	binary.BigEndian.PutUint32(timeoutbytes, h.Timeout)
+	res := append(append(append(append([]byte(h.Vendor), h.Type, h.Flags), lenbytes...), seqbytes...), timeoutbytes...)
+	if h.Flags&FLAG_TRACE != 0 {
+		res = h.Trace.AppendBinary(res)
+	}
 	log.D("Writing header %v to bytes %v", h, res)
 	return res
 }
 
 // Construct a new header from a connection by reading the first
-// HEADER_LEN bytes from the connection stream.
-func NewHeader(conn io.Reader) (*Header, error) {
+// HEADER_LEN bytes from the connection stream. A header announcing a payload
+// longer than maxLen is refused with common.ErrMessageTooLarge, unless maxLen
+// is zero.
+func NewHeader(conn io.Reader, maxLen int64) (*Header, error) {
 	header := make([]byte, HEADER_LEN)
 	read := 0
 
@@ -77,16 +172,58 @@ func NewHeader(conn io.Reader) (*Header, error) {
 		}
 	}
 
+	if bytes.Equal(header[:len(MAGIC)], MAGIC) && header[len(MAGIC)] != PROTOCOL_VERSION {
+		log.W("ERROR: Peer speaks protocol version %d, we speak %d", version(header[len(MAGIC)]), PROTOCOL_VERSION)
+		return nil, ErrProtocolVersion
+	}
+
 	if !bytes.Equal(header[:len(PREAMBLE)], PREAMBLE) {
 		log.W("ERROR: Malformed header. Wrong preamble %v", header[:HEADER_LEN])
-		return nil, errors.New("ERR_EQUALITY")
+		return nil, ErrBadPreamble
 	}
 
 	h := &Header{
 		Vendor: string(header[:len(PREAMBLE)]),
 		Type:   header[len(PREAMBLE)],
+		Flags:  header[FLAGS_OFF],
 		Length: binary.BigEndian.Uint64(header[LEN_OFF : LEN_OFF+LEN_LEN]),
 		Seq:    binary.BigEndian.Uint64(header[SEQ_OFF : SEQ_OFF+SEQ_LEN]),
+
+		Timeout: binary.BigEndian.Uint32(header[TIMEOUT_OFF : TIMEOUT_OFF+TIMEOUT_LEN]),
 	}
+
+	if h.Flags&FLAG_TRACE != 0 {
+		trace := make([]byte, TRACE_LEN)
+		if _, err := io.ReadFull(conn, trace); err != nil {
+			log.W("Incomplete trace context received")
+			return nil, err
+		}
+		h.Trace = tracing.FromBinary(trace)
+	}
+
+	if err := h.checkLength(maxLen); err != nil {
+		return nil, err
+	}
+
 	return h, nil
 }
+
+// Refuse a message announcing more than maxLen bytes. Zero means no limit.
+func (h *Header) checkLength(maxLen int64) error {
+	if maxLen > 0 && h.Length > uint64(maxLen) {
+		log.W("ERROR: Message %d announces %d bytes, more than the limit of %d", h.Seq, h.Length, maxLen)
+		metrics.OversizedMessages.With("inbound").Inc()
+		return common.ErrMessageTooLarge
+	}
+
+	return nil
+}
+
+// The protocol version a preamble's version byte stands for. Peers predating
+// versioning sent 'o' and speak version 1.
+func version(b byte) int {
+	if b == 'o' {
+		return 1
+	}
+	return int(b)
+}
@@ -2,16 +2,70 @@ package socket
 
 import (
 	"bufio"
+	"bytes"
+	"cisco.com/comm/audit"
 	"cisco.com/comm/common"
 	"cisco.com/comm/log"
+	"cisco.com/comm/tracing"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httputil"
 	"net/textproto"
-	"regexp"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Settings for the HTTP forwarder that sits on both ends of the tunnel
+type ForwarderOptions struct {
+
+	// Picks the LAN origin for requests received over the WAN
+	Router *Router
+
+	// Timeout for dialing LAN origins. Zero means no timeout.
+	DialTimeout time.Duration
+
+	// Where to listen for LAN clients, and fixed ports by peer name. See
+	// listenLAN.
+	LANAddr  string
+	LANPorts map[string]int
+
+	// How long a LAN client's request may take end to end before it gets a
+	// 504. Zero means no limit.
+	RequestTimeout time.Duration
+
+	// Sends and receives fragmented transfers. Nil disables them.
+	Transfers *Transfers
+
+	// Delivers messages queued for a peer whenever it is connected. Nil
+	// disables the store-and-forward queue.
+	Queue *Queue
+
+	// Middleware wrapped around every connection's messages and handlers
+	// for custom message types. Nil for none.
+	Chain *Chain
+
+	// Request and byte rate limits. Nil for none.
+	Limiter *Limiter
+
+	// Which origins requests from the peer may reach. Nil for any.
+	ACL *ACL
+
+	// Don't listen for LAN clients at all, e.g. when the connection is only
+	// used for streams
+	NoLAN bool
+
+	// Called with the streams of every connection once it's up. The peer
+	// may only open streams if this is set. It shouldn't block.
+	Streams func(common.Connection, *Streams)
+}
+
 type RespondableMessage struct {
 	Seq             int
 	R               io.Reader
@@ -25,6 +79,9 @@ type proxyRequest struct {
 	dest routeKey
 }
 
+// A request from the peer whose body can't be told apart from what follows it
+var ErrBadRequest = errors.New("ERR_BAD_REQUEST")
+
 func parseRequestLine(line string) (method, requestURI, proto string, ok bool) {
 	s1 := strings.Index(line, " ")
 	s2 := strings.Index(line[s1+1:], " ")
@@ -35,19 +92,30 @@ func parseRequestLine(line string) (method, requestURI, proto string, ok bool) {
 	return line[:s1], line[s1+1 : s2], line[s2+1:], true
 }
 
-func getRequestLength(conn io.Reader) (int64, io.Reader) {
-	rd := bufio.NewReader(conn)
-	line, hdr := parseHeader(rd)
-	headerstring := writeHeaderToString(line, hdr)
+// Put a message back together for the WAN, which needs its total length up
+// front. A body whose length isn't known until it ends (blen < 0) is read in
+// full first, though no further than the outbound size limit of wan lets it be
+// sent anyway. One that ran up to the end of the connection gets its length
+// set in the header.
+func joinMessage(line string, hdr *textproto.MIMEHeader, body io.Reader, blen int64, wan common.Connection) (int64, io.Reader, error) {
+	if blen < 0 {
+		if _, out := wan.Limits(); out > 0 {
+			body = io.LimitReader(body, out+1)
+		}
 
-	blen, _ := strconv.ParseInt(hdr.Get("content-length"), 10, 64)
-	totallen := int64(len(headerstring)) + blen
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(body); err != nil {
+			return 0, nil, err
+		}
 
-	r1 := strings.NewReader(headerstring)
-	r2 := &io.LimitedReader{N: blen, R: rd}
-	r3 := io.MultiReader(r1, r2)
+		if hdr.Get("Transfer-Encoding") == "" {
+			hdr.Set("Content-Length", strconv.Itoa(buf.Len()))
+		}
+		body, blen = &buf, int64(buf.Len())
+	}
 
-	return totallen, r3
+	headerstring := writeHeaderToString(line, hdr)
+	return int64(len(headerstring)) + blen, io.MultiReader(strings.NewReader(headerstring), body), nil
 }
 
 // Encode a MIMEHeader to its HTTP 1.1 text form
@@ -82,33 +150,295 @@ func parseHeader(rd *bufio.Reader) (string, *textproto.MIMEHeader) {
 	return line, &hdr
 }
 
-func onNewWANRequest(conn common.IngressMessage) (*common.EgressMessage, error) {
-	egress, err := net.Dial("tcp", "localhost:8080")
+// Forward a request received over the WAN to its LAN origin and return the
+// origin's response. The request context bounds dialing the origin and
+// waiting for the response header (and the body, if it has to be read in full
+// to learn its length); once the response starts streaming back it is left
+// alone, since cutting it short would corrupt the tunnel framing.
+// wan is the connection the request came in on. What the request asked for
+// is filled in on e for the audit log.
+func onNewWANRequest(conn common.IngressMessage, opts ForwarderOptions, wan common.Connection, e *audit.Entry) (res *common.EgressMessage, err error) {
+	ctx := conn.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	rd := bufio.NewReader(conn.R)
+	line, hdr := parseHeader(rd)
+
+	if hdr == nil {
+		io.Copy(ioutil.Discard, rd)
+		return nil, errors.New("ERR_HEADER_PARSE")
+	}
+
+	host := hdr.Get("Host")
+	method, uri, _, _ := parseRequestLine(line)
+	e.Method, e.Host, e.Path = method, host, requestPath(uri)
+
+	// The peer may not have sent the trace along with the frame
+	parent := tracing.FromContext(ctx)
+	if !parent.IsValid() {
+		parent, _ = tracing.ParseTraceparent(hdr.Get("Traceparent"))
+	}
+
+	span := tracing.StartWithParent(parent, "comm.origin.request", tracing.KindClient)
+	setHTTPAttributes(span, wan, method, host, uri)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
+	if sc := span.SpanContext(); sc.IsValid() {
+		hdr.Set("Traceparent", sc.Traceparent())
+	}
+
+	// Only the body goes to the origin, which mustn't wait for another
+	// request on the connection either
+	body, _, err := requestBody(hdr, rd)
+	if err != nil {
+		log.W("Refusing request %d on connection %d: %v", conn.Seq, wan.Id, err)
+		io.Copy(ioutil.Discard, rd)
+		return nil, ErrBadRequest
+	}
+	hdr.Set("Connection", "close")
+
+	if err := opts.Limiter.allow(wan.Id, host); err != nil {
+		io.Copy(ioutil.Discard, rd)
+		return nil, err
+	}
+
+	origin := opts.Router.Lookup(host)
+	log.D("Routing request for host %q to %s", host, origin)
+
+	span.SetAttribute("server.address", origin)
+	dialer := &net.Dialer{Timeout: opts.DialTimeout, Control: opts.ACL.control(method, uri, origin)}
+	egress, err := dialer.DialContext(ctx, "tcp", origin)
+
+	var denied *aclError
+	if errors.As(err, &denied) {
+		log.W("ACL denied request %d on connection %d (peer %q): %s %s for host %q to %s, %s",
+			conn.Seq, wan.Id, wan.Peer, method, uri, host, origin, denied.why)
+		io.Copy(ioutil.Discard, rd)
+		return nil, ErrForbidden
+	}
 
 	if err != nil {
 		log.E("ERR_CON_OPEN %v", err)
+		io.Copy(ioutil.Discard, rd)
 		return nil, err
 	}
 
+	// Abort the exchange with the origin if the request is cancelled before
+	// the response header arrives.
+	headerDone := make(chan struct{})
+	aborted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			egress.Close()
+			aborted <- true
+		case <-headerDone:
+			aborted <- false
+		}
+	}()
+
 	// Write to the LAN connection
-	io.Copy(egress, conn.R)
+	io.Copy(egress, io.MultiReader(strings.NewReader(writeHeaderToString(line, hdr)), opts.Limiter.shapeRoute(body, host)))
+	if n, _ := io.Copy(ioutil.Discard, rd); n > 0 {
+		log.W("Dropped %d bytes after the body of request %d on connection %d", n, conn.Seq, wan.Id)
+	}
 	log.D("Wrote message to LAN client")
 
 	// Read the response
-	tlen, r := getRequestLength(egress)
+	var tlen int64
+	var r io.Reader
+	var rerr error
+	erd := bufio.NewReader(egress)
+	if status, rhdr := parseHeader(erd); rhdr != nil {
+		span.SetAttribute("http.response.status_code", statusCode(status))
+
+		var body io.Reader
+		var blen int64
+		if body, blen, rerr = responseBody(method, status, rhdr, erd); rerr == nil {
+			tlen, r, rerr = joinMessage(status, rhdr, body, blen, wan)
+		}
+	}
+	close(headerDone)
 	log.D("Request body total length %d", tlen)
 
-	res := &common.EgressMessage{
+	if <-aborted {
+		return nil, ctx.Err()
+	}
+
+	if rerr != nil {
+		log.W("Bad response to %d from %s: %v", conn.Seq, origin, rerr)
+		egress.Close()
+		return nil, errors.New("ERR_ORIGIN_BAD_RESPONSE")
+	}
+
+	if tlen == 0 {
+		egress.Close()
+		return nil, errors.New("ERR_ORIGIN_NO_RESPONSE")
+	}
+
+	res = &common.EgressMessage{
 		Seq: conn.Seq,
 		N:   tlen,
-		R:   r,
+		R:   opts.Limiter.shapeRoute(&closingReader{R: r, C: egress}, host),
+	}
+
+	if err := wan.CheckOutbound(tlen); err != nil {
+		log.E("Response to %d from %s is %d bytes, over the size limit", conn.Seq, origin, tlen)
+		egress.Close()
+		return nil, err
 	}
 
 	// Send response back to caller
 	return res, nil
 }
 
-func listenForWANData(conn common.Connection) {
+// The body of a request, as its header frames it: Content-Length bytes, or
+// chunks up to the last one. Whatever follows is left in rd. Requests framed
+// ambiguously are refused, and hdr is set to frame the body exactly as
+// returned. The length is -1 for a chunked body.
+func requestBody(hdr *textproto.MIMEHeader, rd *bufio.Reader) (io.Reader, int64, error) {
+	lengths := hdr.Values("Content-Length")
+
+	if te := hdr.Values("Transfer-Encoding"); len(te) > 0 {
+		if len(te) > 1 || !strings.EqualFold(strings.TrimSpace(te[0]), "chunked") {
+			return nil, 0, fmt.Errorf("unsupported transfer encoding %q", strings.Join(te, ", "))
+		}
+		if len(lengths) > 0 {
+			return nil, 0, errors.New("both a transfer encoding and a content length")
+		}
+		return &chunkedBody{rd: rd, cr: httputil.NewChunkedReader(rd)}, -1, nil
+	}
+
+	if len(lengths) == 0 {
+		return strings.NewReader(""), 0, nil
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(lengths[0]), 10, 63)
+	for _, l := range lengths[1:] {
+		if err == nil && strings.TrimSpace(l) != strings.TrimSpace(lengths[0]) {
+			err = errors.New("conflicting values")
+		}
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("bad content length %q: %v", strings.Join(lengths, ", "), err)
+	}
+
+	hdr.Set("Content-Length", strconv.FormatUint(n, 10))
+	return io.LimitReader(rd, int64(n)), int64(n), nil
+}
+
+// The body of the response to a method request. Responses to HEAD and 1xx,
+// 204 and 304 responses have none. Others are framed like requests, except
+// that one without a length runs up to the end of the connection (length -1).
+func responseBody(method, status string, hdr *textproto.MIMEHeader, rd *bufio.Reader) (io.Reader, int64, error) {
+	if code := statusCode(status); method == http.MethodHead || code/100 == 1 || code == 204 || code == 304 {
+		return strings.NewReader(""), 0, nil
+	}
+
+	if len(hdr.Values("Transfer-Encoding")) == 0 && len(hdr.Values("Content-Length")) == 0 {
+		return rd, -1, nil
+	}
+
+	return requestBody(hdr, rd)
+}
+
+// A chunked body chunked anew as it's decoded, so that it ends for the origin
+// exactly where it ended for us. Trailers are dropped.
+type chunkedBody struct {
+	rd      *bufio.Reader
+	cr      io.Reader
+	buf     []byte
+	pending []byte
+	done    bool
+}
+
+func (c *chunkedBody) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+
+		if c.buf == nil {
+			c.buf = make([]byte, shapeChunk)
+		}
+
+		n, err := c.cr.Read(c.buf)
+		if n > 0 {
+			c.pending = strconv.AppendInt(c.pending[:0], int64(n), 16)
+			c.pending = append(c.pending, "\r\n"...)
+			c.pending = append(c.pending, c.buf[:n]...)
+			c.pending = append(c.pending, "\r\n"...)
+		}
+
+		if err == io.EOF {
+			// The trailers, up to the empty line that ends the body
+			if _, err := textproto.NewReader(c.rd).ReadMIMEHeader(); err != nil {
+				return 0, err
+			}
+			c.pending = append(c.pending, "0\r\n\r\n"...)
+			c.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Serve a single request from the WAN and send the response back. Every
+// request gets exactly one response, an HTTP error if nothing better.
+func serveWANRequest(conn common.Connection, in common.IngressMessage, opts ForwarderOptions) {
+	start := time.Now()
+	e := audit.Entry{
+		Type:       audit.Request,
+		Direction:  audit.Inbound,
+		Connection: conn.Id,
+		Peer:       conn.Peer,
+		BytesIn:    in.N,
+	}
+
+	res, err := onNewWANRequest(in, opts, conn, &e)
+
+	if err != nil {
+		log.E("ERROR handling new WAN request %d: %v", in.Seq, err)
+		e.Error = err.Error()
+
+		status := http.StatusBadGateway
+		if err == context.DeadlineExceeded || err == context.Canceled {
+			status = http.StatusGatewayTimeout
+		} else if err == ErrRateLimited {
+			status = http.StatusTooManyRequests
+		} else if err == ErrForbidden {
+			status = http.StatusForbidden
+		} else if err == ErrBadRequest {
+			status = http.StatusBadRequest
+		}
+
+		n, r := httpError(status, err.Error())
+		res = &common.EgressMessage{Seq: in.Seq, N: n, R: r}
+	}
+
+	audited := &auditedResponse{R: res.R, N: res.N, entry: e, start: start}
+	res.R = audited
+
+	// Traces the response's way back as part of the request
+	res.Ctx = in.Ctx
+
+	log.D("Sending response back to WAN")
+	if err := conn.Send(*res); err != nil {
+		log.W("Dropping response to %d: %v", in.Seq, err)
+		audited.done(err)
+	}
+}
+
+func listenForWANData(conn common.Connection, opts ForwarderOptions) {
 	for {
 		log.I("Client waiting for new data from WAN")
 		in := <-conn.In
@@ -119,39 +449,126 @@ func listenForWANData(conn common.Connection) {
 		}
 
 		log.D("Got new data from WAN. Opening channel to LAN client. In message:", in)
-		res, err := onNewWANRequest(in)
+		go serveWANRequest(conn, in, opts)
+	}
+}
+
+// Called when a LAN client connects to this server to send a new message.
+func onLANRead(lan net.Conn, wan common.Connection, opts ForwarderOptions) {
+	defer lan.Close()
+
+	start := time.Now()
+	e := audit.Entry{
+		Type:       audit.Request,
+		Direction:  audit.Outbound,
+		Connection: wan.Id,
+		Peer:       wan.Peer,
+		Client:     lan.RemoteAddr().String(),
+	}
+
+	// Whatever happens, the client gets exactly one response through here
+	audited := &auditedConn{Conn: lan}
+	lan = audited
+
+	var span *tracing.Span
+	defer func() {
+		e.Status, e.BytesOut = audited.status.code, audited.written
+		e.Duration = milliseconds(time.Since(start))
+		audit.Record(e)
+
+		span.SetAttribute("http.response.status_code", e.Status)
+		if e.Error != "" {
+			span.SetError(errors.New(e.Error))
+		}
+		span.Finish()
+	}()
 
+	ctx, cancel := context.WithCancel(context.Background())
+	if opts.RequestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), opts.RequestTimeout)
+	}
+	defer cancel()
+
+	var tlen int64
+	var r io.Reader
+
+	rd := bufio.NewReader(lan)
+	if line, hdr := parseHeader(rd); hdr != nil {
+		method, uri, _, _ := parseRequestLine(line)
+		e.Method, e.Host, e.Path = method, hdr.Get("Host"), requestPath(uri)
+
+		// Carry on the client's trace, and tell the other side about our span
+		parent, _ := tracing.ParseTraceparent(hdr.Get("Traceparent"))
+		span = tracing.StartWithParent(parent, "comm.lan.request", tracing.KindServer)
+		setHTTPAttributes(span, wan, method, e.Host, uri)
+		if sc := span.SpanContext(); sc.IsValid() {
+			hdr.Set("Traceparent", sc.Traceparent())
+		}
+
+		body, blen, err := requestBody(hdr, rd)
+		if err == nil {
+			tlen, r, err = joinMessage(line, hdr, body, blen, wan)
+		}
 		if err != nil {
-			log.E("ERROR handling new WAN request. Aborting %v", err)
+			log.W("Refusing LAN request: %v", err)
+			writeHTTPError(lan, http.StatusBadRequest, err.Error())
 			return
 		}
+		e.BytesIn = tlen
+	}
 
-		log.D("Sending response back to WAN")
-		conn.Out <- *res
+	if tlen == 0 {
+		writeHTTPError(lan, http.StatusBadRequest, "malformed request")
+		return
 	}
-}
 
-// Return the sequence number from the net.Conn
-func seqFromConn(c net.Conn) uint64 {
-	r := regexp.MustCompile("([0-9])+$")
-	str := r.FindString(c.RemoteAddr().String())
-	id, _ := strconv.ParseInt(str, 10, 32)
-	log.D("Generated sequence %v from connection %s", id, c.RemoteAddr().String())
-	return uint64(id)
-}
+	if err := wan.CheckOutbound(tlen); err != nil {
+		log.W("Refusing LAN request of %d bytes: %v", tlen, err)
+		writeHTTPError(lan, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+
+	if err := opts.Limiter.allow(wan.Id, ""); err != nil {
+		writeHTTPError(lan, http.StatusTooManyRequests, err.Error())
+		return
+	}
+
+	ctx = tracing.ContextWithSpan(ctx, span)
 
-// Called when a LAN client connects to this server to send a new message.
-func onLANRead(lan net.Conn, wan common.Connection) {
-	tlen, r := getRequestLength(lan)
 	log.D("Sending request with total length %d", tlen)
 	c := make(chan common.IngressMessage)
+	body := &eofNotifier{R: r, EOF: make(chan struct{})}
+
+	// Once the request is sent, a read on the LAN connection only fails if
+	// the client's connection does, and then there's no one left to answer.
+	// A clean EOF may just be the client half-closing, and data a request it
+	// shouldn't have sent yet; neither stops the wait.
+	go func() {
+		select {
+		case <-body.EOF:
+		case <-ctx.Done():
+			return
+		}
+
+		if _, err := lan.Read(make([]byte, 1)); err != nil && err != io.EOF && ctx.Err() == nil {
+			log.I("LAN client connection failed: %v", err)
+			cancel()
+		}
+	}()
 
 	// Send the message
-	wan.Out <- common.EgressMessage{
-		Seq:          seqFromConn(lan),
+	err := wan.Send(common.EgressMessage{
 		N:            tlen,
-		R:            r,
-		ResponseChan: c}
+		R:            body,
+		ResponseChan: c,
+		Ctx:          ctx})
+
+	if err != nil {
+		log.E("Can't send LAN request: %v", err)
+		e.Error = err.Error()
+		writeHTTPError(lan, http.StatusBadGateway, err.Error())
+		return
+	}
 
 	// Wait for the response
 	res := <-c
@@ -159,24 +576,93 @@ func onLANRead(lan net.Conn, wan common.Connection) {
 	log.D("Got response message %v", res)
 	log.I("Closing LAN connection")
 
-	// Send the response back to the caller
-	io.Copy(lan, res.R)
+	if res.Err != nil {
+		e.Error = res.Err.Error()
+	}
 
-	lan.Close()
+	switch {
+	case res.Err == context.DeadlineExceeded:
+		writeHTTPError(lan, http.StatusGatewayTimeout, "no response from the remote end in time")
+	case res.Err == context.Canceled:
+		log.I("LAN client hung up before the response arrived")
+	case res.Err != nil:
+		writeHTTPError(lan, http.StatusBadGateway, res.Err.Error())
+	default:
+		// Send the response back to the caller. Drain whatever the caller
+		// didn't take so the WAN can move on to the next message.
+		io.Copy(lan, res.R)
+		io.Copy(ioutil.Discard, res.R)
+	}
 }
 
-// Respond to TCP connections from the LAN side (sending new messages out).
-func listenForLANData(wan common.Connection) {
-	lst, err := net.Listen("tcp", ":0")
+// Open the LAN listener for connection c. addr is host:port for TCP or
+// unix:/path for a Unix domain socket, and defaults to an ephemeral TCP port.
+// A peer named in ports listens on its port there instead, so that it keeps
+// it across reconnects. "{peer}" in a socket path is replaced by the peer's
+// name and "{id}" by the connection ID.
+func listenLAN(addr string, ports map[string]int, c common.Connection) (net.Listener, error) {
+	if addr == "" {
+		addr = ":0"
+	}
+
+	if strings.HasPrefix(addr, "unix:") {
+		path := addr[len("unix:"):]
+		if strings.Contains(path, "{peer}") {
+			if !safePeerName(c.Peer) {
+				return nil, fmt.Errorf("peer name %q can't be used in a socket path", c.Peer)
+			}
+			path = strings.Replace(path, "{peer}", c.Peer, -1)
+		}
+		path = strings.Replace(path, "{id}", strconv.Itoa(c.Id), -1)
+
+		// Clean up a socket left behind by a previous run
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+
+		return net.Listen("unix", path)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		log.E("ERR_LISTEN %v", err)
+		return nil, err
+	}
+
+	if p, ok := ports[c.Peer]; ok && c.Peer != "" {
+		port = strconv.Itoa(p)
+	}
+
+	return net.Listen("tcp", net.JoinHostPort(host, port))
+}
+
+// Whether a peer name is safe to put in a file name
+func safePeerName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
 	}
 
-	log.I("Listening for LAN connections on TCP %v", lst.Addr())
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// Respond to connections from the LAN side (sending new messages out).
+// Returns once the listener is closed.
+func listenForLANData(lst net.Listener, wan common.Connection, opts ForwarderOptions) {
+	log.I("Listening for LAN connections on %s %v", lst.Addr().Network(), lst.Addr())
 
 	for {
-		lan, _ := lst.Accept()
+		lan, err := lst.Accept()
+
+		if err != nil {
+			log.I("Stopped listening for LAN connections on %v: %v", lst.Addr(), err)
+			return
+		}
+
 		log.I("Got new LAN connection %v", lan.RemoteAddr())
-		go onLANRead(lan, wan)
+		go onLANRead(lan, wan, opts)
 	}
 }
@@ -0,0 +1,280 @@
+package socket
+
+import (
+	"bufio"
+	"bytes"
+	"cisco.com/comm/audit"
+	"cisco.com/comm/common"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An origin that answers one request and reports it, along with whatever
+// else it got before the connection was closed or went quiet
+func newTestOrigin(t *testing.T) (string, chan string) {
+	return newTestOriginResponding(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+}
+
+// Like newTestOrigin, with response as the answer, sent as is
+func newTestOriginResponding(t *testing.T, response string) (string, chan string) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan string, 1)
+	go func() {
+		defer lst.Close()
+
+		c, err := lst.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		rd := bufio.NewReader(c)
+		req, err := http.ReadRequest(rd)
+		if err != nil {
+			got <- "ERROR " + err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		io.WriteString(c, response)
+
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		rest, _ := ioutil.ReadAll(rd)
+		got <- fmt.Sprintf("%s %s connection=%s body=%q rest=%q", req.Method, req.URL.Path, req.Header.Get("Connection"), body, rest)
+	}()
+
+	return lst.Addr().String(), got
+}
+
+func TestForwardedRequestFraming(t *testing.T) {
+	tests := []struct {
+		req  string
+		want string
+	}{
+		{"POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc",
+			`POST /a connection=close body="abc" rest=""`},
+
+		// A second request smuggled after the body
+		{"POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabcGET /admin HTTP/1.1\r\nHost: x\r\n\r\n",
+			`POST /a connection=close body="abc" rest=""`},
+		{"POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\nX-Trailer: 1\r\n\r\nGET /admin HTTP/1.1\r\nHost: x\r\n\r\n",
+			`POST /a connection=close body="abc" rest=""`},
+		{"GET /a HTTP/1.1\r\nHost: x\r\nConnection: keep-alive\r\n\r\nGET /admin HTTP/1.1\r\nHost: x\r\n\r\n",
+			`GET /a connection=close body="" rest=""`},
+		{"POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nContent-Length: 3\r\n\r\nabc",
+			`POST /a connection=close body="abc" rest=""`},
+
+		// Framed ambiguously
+		{"POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n", ""},
+		{"POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nContent-Length: 30\r\n\r\nabc", ""},
+		{"POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: +3\r\n\r\nabc", ""},
+		{"POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: gzip\r\n\r\nabc", ""},
+	}
+
+	for _, test := range tests {
+		addr, got := newTestOrigin(t)
+		opts := ForwarderOptions{Router: NewRouter(addr, nil)}
+
+		in := common.IngressMessage{Seq: 1, N: int64(len(test.req)), R: strings.NewReader(test.req)}
+		res, err := onNewWANRequest(in, opts, common.NewConnection(1, nil), &audit.Entry{})
+
+		if test.want == "" {
+			if err != ErrBadRequest {
+				t.Errorf("%q: got %v, want %v", test.req, err, ErrBadRequest)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", test.req, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(res.R)
+		if !strings.HasSuffix(string(body), "\r\n\r\nok") {
+			t.Errorf("%q: got response %q", test.req, body)
+		}
+
+		if origin := <-got; origin != test.want {
+			t.Errorf("%q: origin got %s, want %s", test.req, origin, test.want)
+		}
+	}
+}
+
+func TestOriginResponseFraming(t *testing.T) {
+	tests := []struct {
+		method string
+		res    string
+
+		// The body the response is forwarded with, or "" if it's refused
+		want string
+	}{
+		{"GET", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nokjunk", "ok"},
+		{"GET", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\nX-Trailer: 1\r\n\r\njunk", "ok"},
+
+		// Up to the end of the connection
+		{"GET", "HTTP/1.1 200 OK\r\n\r\nall of it", "all of it"},
+
+		// No body whatever the header says
+		{"HEAD", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", "-"},
+		{"GET", "HTTP/1.1 304 Not Modified\r\nContent-Length: 2\r\n\r\nok", "-"},
+
+		// Framed ambiguously
+		{"GET", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n", ""},
+		{"GET", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nContent-Length: 20\r\n\r\nok", ""},
+	}
+
+	for _, test := range tests {
+		addr, got := newTestOriginResponding(t, test.res)
+		opts := ForwarderOptions{Router: NewRouter(addr, nil)}
+
+		req := test.method + " /a HTTP/1.1\r\nHost: x\r\n\r\n"
+		in := common.IngressMessage{Seq: 1, N: int64(len(req)), R: strings.NewReader(req)}
+		res, err := onNewWANRequest(in, opts, common.NewConnection(1, nil), &audit.Entry{})
+		<-got
+
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%q: expected the response to be refused", test.res)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", test.res, err)
+			continue
+		}
+
+		// Exactly the message announced, which a client reads in full
+		msg, _ := ioutil.ReadAll(res.R)
+		if int64(len(msg)) != res.N {
+			t.Errorf("%q: forwarded %d bytes, announced %d", test.res, len(msg), res.N)
+		}
+
+		rd := bufio.NewReader(bytes.NewReader(msg))
+		hr, err := http.ReadResponse(rd, &http.Request{Method: test.method})
+		if err != nil {
+			t.Errorf("%q: forwarded %q: %v", test.res, msg, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(hr.Body)
+		if test.want == "-" {
+			test.want = ""
+		}
+		if string(body) != test.want || rd.Buffered() > 0 {
+			t.Errorf("%q: forwarded %q, want body %q", test.res, msg, test.want)
+		}
+	}
+}
+
+// Connect a client end to a server end that forwards the requests it gets
+// to origin
+func newForwardingEnds(origin string) (*testEnd, *testEnd) {
+	server, client := newTestEnds(testOptions{quiet: true})
+	go listenForWANData(server.conn, ForwarderOptions{Router: NewRouter(origin, nil)})
+	return server, client
+}
+
+// Send req as a LAN client of e. Returns the status and body of the response
+// the LAN client got.
+func sendLAN(t *testing.T, e *testEnd, opts ForwarderOptions, req string) (int, string) {
+	lan, peer := net.Pipe()
+	defer peer.Close()
+	go onLANRead(lan, e.conn, opts)
+
+	go io.WriteString(peer, req)
+	res, err := http.ReadResponse(bufio.NewReader(peer), nil)
+	if err != nil {
+		t.Fatalf("%q: %v", req, err)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Errorf("%q: reading the response: %v", req, err)
+	}
+	return res.StatusCode, string(body)
+}
+
+// Send req as a LAN client of the client end, which the server end forwards
+// to origin. Returns the status and body of the response the LAN client got.
+func lanRequest(t *testing.T, origin, req string) (int, string) {
+	server, client := newForwardingEnds(origin)
+	defer server.close()
+	return sendLAN(t, client, ForwarderOptions{}, req)
+}
+
+func TestLANRequestFraming(t *testing.T) {
+	addr, got := newTestOrigin(t)
+	status, body := lanRequest(t, addr, "POST /a HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n2\r\nde\r\n0\r\n\r\n")
+	if status != http.StatusOK || body != "ok" {
+		t.Errorf("Got response %d %q to a chunked request", status, body)
+	}
+	if origin, want := <-got, `POST /a connection=close body="abcde" rest=""`; origin != want {
+		t.Errorf("Origin got %s, want %s", origin, want)
+	}
+
+	// Refused before it gets anywhere
+	for _, req := range []string{
+		"POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+		"POST /a HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nContent-Length: 4\r\n\r\nabc",
+	} {
+		if status, _ := lanRequest(t, "127.0.0.1:1", req); status != http.StatusBadRequest {
+			t.Errorf("%q: got status %d, want %d", req, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestChunkedOriginResponse(t *testing.T) {
+	addr, got := newTestOriginResponding(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n2\r\nde\r\n0\r\n\r\n")
+	status, body := lanRequest(t, addr, "GET /a HTTP/1.1\r\nHost: x\r\n\r\n")
+	<-got
+
+	if status != http.StatusOK || body != "abcde" {
+		t.Errorf("Got response %d %q from a chunked origin response", status, body)
+	}
+}
+
+func TestLANRequestTimeout(t *testing.T) {
+	// An origin that never answers, and tells when it's hung up on
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+
+	aborted := make(chan struct{})
+	go func() {
+		c, err := lst.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(ioutil.Discard, c)
+		close(aborted)
+	}()
+
+	server, client := newForwardingEnds(lst.Addr().String())
+	defer server.close()
+
+	status, _ := sendLAN(t, client, ForwarderOptions{RequestTimeout: 100 * time.Millisecond}, "GET /a HTTP/1.1\r\nHost: x\r\n\r\n")
+	if status != http.StatusGatewayTimeout {
+		t.Errorf("Got status %d for a request the origin never answered, want %d", status, http.StatusGatewayTimeout)
+	}
+
+	// The cancel makes it to the server end, which gives up on the origin
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The server end kept waiting on the origin")
+	}
+
+	waitIdle(t, server, client)
+}
@@ -0,0 +1,117 @@
+package socket
+
+import (
+	"bytes"
+	"cisco.com/comm/common"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLowerLimit(t *testing.T) {
+	for _, test := range [][3]int64{{0, 0, 0}, {0, 5, 5}, {5, 0, 5}, {5, 3, 3}, {3, 5, 3}} {
+		if got := lowerLimit(test[0], test[1]); got != test[2] {
+			t.Errorf("lowerLimit(%d, %d) = %d, want %d", test[0], test[1], got, test[2])
+		}
+	}
+}
+
+func TestHeaderLimit(t *testing.T) {
+	for _, test := range []struct {
+		length uint64
+		max    int64
+		err    error
+	}{
+		{1024, 1024, nil},
+		{1025, 1024, common.ErrMessageTooLarge},
+		{1 << 40, 0, nil},
+	} {
+		h := Header{Vendor: string(PREAMBLE), Type: MSG_TYPE_DATA, Length: test.length, Seq: 1}
+		if _, err := NewHeader(bytes.NewReader(h.ToBytes()), test.max); err != test.err {
+			t.Errorf("%d bytes with a limit of %d: got %v, want %v", test.length, test.max, err, test.err)
+		}
+	}
+}
+
+// Each end sends no more than the other accepts, nor more than it was told to
+func TestHandshakeLimits(t *testing.T) {
+	tests := []struct {
+		server, client         SizeLimits
+		wantServer, wantClient SizeLimits
+	}{
+		{SizeLimits{1000, 5000}, SizeLimits{2000, 500}, SizeLimits{1000, 2000}, SizeLimits{2000, 500}},
+
+		// Unlimited on one side takes the other's limit
+		{SizeLimits{1000, 0}, SizeLimits{2000, 0}, SizeLimits{1000, 2000}, SizeLimits{2000, 1000}},
+		{SizeLimits{0, 5000}, SizeLimits{0, 500}, SizeLimits{0, 5000}, SizeLimits{0, 500}},
+		{SizeLimits{}, SizeLimits{}, SizeLimits{}, SizeLimits{}},
+	}
+
+	for _, test := range tests {
+		a, b := net.Pipe()
+		server, client := NewServerPipe(a), NewPipe(b)
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := serverHandshake(server, nil, ServerOptions{Limits: test.server})
+			done <- err
+		}()
+
+		if _, err := clientHandshake(client, Hello{}, 0, test.client); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+
+		if got := server.Limits(); got != test.wantServer {
+			t.Errorf("Server %+v, client %+v: server got %+v, want %+v", test.server, test.client, got, test.wantServer)
+		}
+		if got := client.Limits(); got != test.wantClient {
+			t.Errorf("Server %+v, client %+v: client got %+v, want %+v", test.server, test.client, got, test.wantClient)
+		}
+
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestOutboundLimit(t *testing.T) {
+	server, client := newTestEnds(testOptions{})
+	defer server.close()
+	client.conn.SetLimits(0, 10)
+
+	// Refused before it goes anywhere, the connection carries on
+	if _, err := client.request(strings.Repeat("x", 11)); err != common.ErrMessageTooLarge {
+		t.Errorf("Request over the outbound limit: got %v, want %v", err, common.ErrMessageTooLarge)
+	}
+
+	if res, err := client.request(strings.Repeat("x", 10)); err != nil || res != "server:xxxxxxxxxx" {
+		t.Errorf("Request at the outbound limit: got %q, %v", res, err)
+	}
+}
+
+func TestInboundLimit(t *testing.T) {
+	server, client := newTestEnds(testOptions{pipe: func(p Pipe) {
+		if p.IsServer() {
+			p.SetLimits(SizeLimits{MaxInbound: 10})
+		}
+	}})
+	defer server.close()
+
+	if res, err := client.request(strings.Repeat("x", 10)); err != nil || res != "server:xxxxxxxxxx" {
+		t.Errorf("Request at the inbound limit: got %q, %v", res, err)
+	}
+
+	// A peer that ignores our limit is hung up on
+	if _, err := client.request(strings.Repeat("x", 11)); err == nil {
+		t.Error("Expected a request over the inbound limit to fail")
+	}
+
+	select {
+	case <-server.gone:
+	case <-time.After(5 * time.Second):
+		t.Error("Connection wasn't closed after a message over the inbound limit")
+	}
+}
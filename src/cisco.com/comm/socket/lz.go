@@ -0,0 +1,329 @@
+package socket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The "lz" codec: LZ77 without entropy coding, in the block format of Snappy.
+// It compresses JSON and logs less than gzip does but at a fraction of the
+// CPU cost, in both directions.
+//
+// The stream is a series of blocks of at most lzBlockLen bytes of payload,
+// each a kind byte (lzStored or lzCompressed), the length of the data as a
+// uvarint and the data. A compressed block is a Snappy block: the decoded
+// length as a uvarint, then literals and back references.
+
+// Most payload bytes in a block
+const lzBlockLen = 64 * 1024
+
+// Longest a block's data may be on the wire. Blocks that don't compress are
+// stored, so this is only lzBlockLen plus Snappy's worst case overhead.
+const lzMaxData = lzBlockLen + lzBlockLen/6 + 32
+
+const (
+	lzStored     = 0
+	lzCompressed = 1
+)
+
+// Snappy element tags, in the low two bits
+const (
+	lzTagLiteral = 0
+	lzTagCopy1   = 1
+	lzTagCopy2   = 2
+	lzTagCopy4   = 3
+)
+
+const lzHashBits = 14
+
+var ErrCorruptLZ = errors.New("ERR_CORRUPT_LZ")
+
+// Compresses into blocks of lzBlockLen
+type lzWriter struct {
+	w     io.Writer
+	buf   []byte
+	out   []byte
+	table [1 << lzHashBits]int32
+}
+
+func newLZWriter(w io.Writer) *lzWriter {
+	return &lzWriter{w: w, buf: make([]byte, 0, lzBlockLen)}
+}
+
+func (z *lzWriter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		room := lzBlockLen - len(z.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		z.buf = append(z.buf, p[:room]...)
+		p = p[room:]
+
+		if len(z.buf) == lzBlockLen {
+			if err := z.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+func (z *lzWriter) flush() error {
+	z.out = lzEncode(z.out[:0], z.buf, &z.table)
+
+	kind, data := byte(lzCompressed), z.out
+	if len(z.out) >= len(z.buf) {
+		kind, data = lzStored, z.buf
+	}
+
+	head := make([]byte, 1, 1+binary.MaxVarintLen64)
+	head[0] = kind
+	head = appendUvarint(head, uint64(len(data)))
+
+	if _, err := z.w.Write(append(head, data...)); err != nil {
+		return err
+	}
+
+	z.buf = z.buf[:0]
+	return nil
+}
+
+// Write out the last block. The underlying writer is left open.
+func (z *lzWriter) Close() error {
+	if len(z.buf) == 0 {
+		return nil
+	}
+	return z.flush()
+}
+
+// Decompresses what an lzWriter wrote
+type lzReader struct {
+	r       *bufio.Reader
+	data    []byte
+	decoded []byte
+	left    []byte
+}
+
+func newLZReader(r io.Reader) *lzReader {
+	return &lzReader{r: bufio.NewReader(r), data: make([]byte, lzMaxData)}
+}
+
+func (z *lzReader) Read(p []byte) (int, error) {
+	for len(z.left) == 0 {
+		if err := z.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, z.left)
+	z.left = z.left[n:]
+	return n, nil
+}
+
+// Read and decode the next block
+func (z *lzReader) next() error {
+	kind, err := z.r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	n, err := binary.ReadUvarint(z.r)
+	if err != nil || n > lzMaxData || (kind == lzStored && n > lzBlockLen) {
+		return ErrCorruptLZ
+	}
+
+	data := z.data[:n]
+	if _, err := io.ReadFull(z.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	switch kind {
+	case lzStored:
+		z.left = data
+	case lzCompressed:
+		if z.decoded, err = lzDecode(z.decoded[:0], data); err != nil {
+			return err
+		}
+		z.left = z.decoded
+	default:
+		return ErrCorruptLZ
+	}
+
+	return nil
+}
+
+func (z *lzReader) Close() error {
+	return nil
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(dst, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func lzLoad32(b []byte, i int) uint32 {
+	return binary.LittleEndian.Uint32(b[i:])
+}
+
+func lzHash(v uint32) uint32 {
+	return (v * 0x1e35a7bd) >> (32 - lzHashBits)
+}
+
+// Append src, at most lzBlockLen bytes, to dst as a Snappy block. Matches are
+// found through a hash table of the last position of every 4 byte sequence;
+// table is scratch space.
+func lzEncode(dst, src []byte, table *[1 << lzHashBits]int32) []byte {
+	dst = appendUvarint(dst, uint64(len(src)))
+
+	for i := range table {
+		table[i] = -1
+	}
+
+	lit, s := 0, 0
+	for s+4 <= len(src) {
+		v := lzLoad32(src, s)
+		h := lzHash(v)
+		cand := int(table[h])
+		table[h] = int32(s)
+
+		if cand < 0 || lzLoad32(src, cand) != v {
+			// Skip ahead faster the longer nothing matched, so that
+			// incompressible data goes through quickly
+			s += 1 + (s-lit)>>5
+			continue
+		}
+
+		l := 4
+		for s+l < len(src) && src[cand+l] == src[s+l] {
+			l++
+		}
+
+		dst = lzLiteral(dst, src[lit:s])
+		dst = lzCopy(dst, s-cand, l)
+		s += l
+		lit = s
+	}
+
+	return lzLiteral(dst, src[lit:])
+}
+
+func lzLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+
+	switch n := len(lit) - 1; {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|lzTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|lzTagLiteral, byte(n))
+	default:
+		dst = append(dst, 61<<2|lzTagLiteral, byte(n), byte(n>>8))
+	}
+
+	return append(dst, lit...)
+}
+
+func lzCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		if offset < 2048 && length >= 4 && length <= 11 {
+			return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|lzTagCopy1, byte(offset))
+		}
+
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte(n-1)<<2|lzTagCopy2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
+
+// Decode the Snappy block src, appending to dst. Refuses blocks that decode
+// to more than lzBlockLen.
+func lzDecode(dst, src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 || n > lzBlockLen {
+		return nil, ErrCorruptLZ
+	}
+
+	end := len(dst) + int(n)
+	start := len(dst)
+
+	for i := k; i < len(src); {
+		var length, offset int
+
+		switch tag := src[i]; tag & 3 {
+		case lzTagLiteral:
+			length = int(tag >> 2)
+			i++
+
+			if length >= 60 {
+				extra := length - 59
+				if extra > 4 || i+extra > len(src) {
+					return nil, ErrCorruptLZ
+				}
+				length = 0
+				for j := extra - 1; j >= 0; j-- {
+					length = length<<8 | int(src[i+j])
+				}
+				i += extra
+			}
+			length++
+
+			if length <= 0 || length > len(src)-i || length > end-len(dst) {
+				return nil, ErrCorruptLZ
+			}
+			dst = append(dst, src[i:i+length]...)
+			i += length
+			continue
+
+		case lzTagCopy1:
+			if i+2 > len(src) {
+				return nil, ErrCorruptLZ
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag>>5)<<8 | int(src[i+1])
+			i += 2
+
+		case lzTagCopy2:
+			if i+3 > len(src) {
+				return nil, ErrCorruptLZ
+			}
+			length = 1 + int(tag>>2)
+			offset = int(src[i+1]) | int(src[i+2])<<8
+			i += 3
+
+		case lzTagCopy4:
+			if i+5 > len(src) {
+				return nil, ErrCorruptLZ
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[i+1:]))
+			i += 5
+		}
+
+		if offset <= 0 || offset > len(dst)-start || length > end-len(dst) {
+			return nil, ErrCorruptLZ
+		}
+
+		// Byte by byte, since the source may overlap what's being written
+		for j := 0; j < length; j++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+
+	if len(dst) != end {
+		return nil, ErrCorruptLZ
+	}
+	return dst, nil
+}
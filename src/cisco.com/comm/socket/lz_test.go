@@ -0,0 +1,70 @@
+package socket
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestLZ(t *testing.T) {
+	random := make([]byte, 200*1024)
+	var x uint32 = 1
+	for i := range random {
+		x = x*1664525 + 1013904223
+		random[i] = byte(x >> 24)
+	}
+
+	var js bytes.Buffer
+	for i := 0; js.Len() < 300*1024; i++ {
+		fmt.Fprintf(&js, `{"id":%d,"level":"info","msg":"request served","path":"/api/v1/items/%d"}`+"\n", i, i%97)
+	}
+
+	for name, payload := range map[string][]byte{
+		"empty":  {},
+		"short":  []byte("abc"),
+		"run":    bytes.Repeat([]byte{'a'}, 100000),
+		"json":   js.Bytes(),
+		"random": random,
+	} {
+		var wire bytes.Buffer
+		w := newLZWriter(&wire)
+
+		// Written in odd sizes, to cross block boundaries mid-write
+		for p := payload; len(p) > 0; {
+			n := 7777
+			if n > len(p) {
+				n = len(p)
+			}
+			w.Write(p[:n])
+			p = p[n:]
+		}
+		w.Close()
+
+		got, err := ioutil.ReadAll(newLZReader(&wire))
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Errorf("%s: round trip failed: %v", name, err)
+		}
+
+		if name == "json" && wire.Len() > len(payload)/3 {
+			t.Errorf("json: compressed %d bytes to %d", len(payload), wire.Len())
+		}
+		if name == "random" && wire.Len() > len(payload)+len(payload)/1000 {
+			t.Errorf("random: grew %d bytes to %d", len(payload), wire.Len())
+		}
+	}
+
+	// Corrupt blocks fail cleanly
+	for _, wire := range [][]byte{
+		{lzCompressed, 3, 5, 1 << 2, 'a'},           // copy before any output
+		{lzCompressed, 4, 2, 0, 'a', 0},             // decodes to less than announced
+		{lzCompressed, 3, 0xff, 0xff, 0xff},         // absurd length
+		{lzStored, 10, 'a'},                         // truncated
+		{7, 1, 0},                                   // unknown kind
+		{lzCompressed, 4, 9, 2 << 2, 'a', 'b', 'c'}, // literal past the end
+	} {
+		if _, err := ioutil.ReadAll(newLZReader(bytes.NewReader(wire))); err == nil {
+			t.Errorf("Decoding % x succeeded", wire)
+		}
+	}
+}
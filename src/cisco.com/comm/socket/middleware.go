@@ -0,0 +1,219 @@
+package socket
+
+import (
+	"cisco.com/comm/common"
+	"cisco.com/comm/metrics"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrUnknownHandler = errors.New("ERR_UNKNOWN_HANDLER")
+
+	// A request of a type nobody registered a handler for
+	ErrUnknownMessageType = errors.New("ERR_UNKNOWN_MESSAGE_TYPE")
+
+	// An outbound message of one of the types the protocol itself uses
+	ErrReservedMessageType = errors.New("ERR_RESERVED_MESSAGE_TYPE")
+)
+
+// Passes an outbound message on towards the WAN
+type SendFunc func(c common.Connection, m common.EgressMessage) error
+
+// Passes an inbound message on to whoever handles it: the requester waiting
+// on a response, the handler registered for its type or the connection's In
+// channel.
+type ReceiveFunc func(c common.Connection, m common.IngressMessage) error
+
+// Behavior wrapped around the messages of every connection a channelHandler
+// serves, such as auth, logging or metrics. Every field is optional.
+//
+// Send and Receive get the next step of the chain and return their own. They
+// may inspect or replace the message before passing it on, or return an
+// error instead: an outbound request then fails with that error, an inbound
+// response fails its request and an inbound request is dropped (answer it
+// first if the peer shouldn't wait out its timeout). Whoever stops a message
+// needn't drain its body; the session does.
+//
+// Send runs on the connection's writer and Receive on its reader, so either
+// blocking holds up every message behind it.
+type Middleware struct {
+
+	// Shown in logs
+	Name string
+
+	// Called once a connection is established, before any message goes over
+	// it. An error drops the connection.
+	Connect func(common.Connection) error
+
+	// Called once a connection is gone
+	Disconnect func(common.Connection)
+
+	Send    func(next SendFunc) SendFunc
+	Receive func(next ReceiveFunc) ReceiveFunc
+}
+
+// Handles requests of a message type registered with Chain.Handle. It must
+// read the payload in full and answers, if at all, by sending a response
+// with m's Seq on c.
+type TypeHandler func(c common.Connection, m common.IngressMessage)
+
+// The middleware and message types a channelHandler applies to its
+// connections. Set it up before the handler starts serving connections.
+type Chain struct {
+	middleware []Middleware
+	types      map[byte]TypeHandler
+}
+
+func NewChain() *Chain {
+	return &Chain{types: make(map[byte]TypeHandler)}
+}
+
+// Add middleware to the chain. Whatever is added first runs outermost: first
+// on the way out and first on the way in.
+func (c *Chain) Use(mw ...Middleware) {
+	c.middleware = append(c.middleware, mw...)
+}
+
+// Serve requests of message type t, which must be at least MSG_TYPE_USER.
+// They go through the middleware like any other message, then to h instead of
+// the connection's In channel. Send them with EgressMessage.Type.
+func (c *Chain) Handle(t byte, h TypeHandler) error {
+	if t < MSG_TYPE_USER {
+		return fmt.Errorf("message type %d is reserved", t)
+	}
+
+	c.types[t] = h
+	return nil
+}
+
+// The handler for message type t, nil if there's none. A nil chain has
+// nothing.
+func (c *Chain) handler(t byte) TypeHandler {
+	if c == nil {
+		return nil
+	}
+	return c.types[t]
+}
+
+// Wrap the final steps of sending and receiving in the middleware
+func (c *Chain) wrap(send SendFunc, receive ReceiveFunc) (SendFunc, ReceiveFunc) {
+	if c == nil {
+		return send, receive
+	}
+
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		mw := c.middleware[i]
+		if mw.Send != nil {
+			send = mw.Send(send)
+		}
+		if mw.Receive != nil {
+			receive = mw.Receive(receive)
+		}
+	}
+
+	return send, receive
+}
+
+// Run the Connect hooks in order. If one fails, those that succeeded are
+// told the connection is gone.
+func (c *Chain) connect(conn common.Connection) error {
+	if c == nil {
+		return nil
+	}
+
+	for i, mw := range c.middleware {
+		if mw.Connect == nil {
+			continue
+		}
+
+		if err := mw.Connect(conn); err != nil {
+			unwind(conn, c.middleware[:i])
+			return fmt.Errorf("%s: %v", mw.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Run the Disconnect hooks, last middleware first
+func (c *Chain) disconnect(conn common.Connection) {
+	if c != nil {
+		unwind(conn, c.middleware)
+	}
+}
+
+func unwind(conn common.Connection, middleware []Middleware) {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		if middleware[i].Disconnect != nil {
+			middleware[i].Disconnect(conn)
+		}
+	}
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// Connection handlers
+//////////////////////////////////////////////////////////////////////////////////
+
+var (
+	mhandlers sync.Mutex
+	handlers  = map[string]func(ForwarderOptions) ConnectionHandler{
+		"api":     func(o ForwarderOptions) ConnectionHandler { return NewChannelHandler(o) },
+		"console": newConsoleHandler,
+		"echo":    newConsoleHandler,
+	}
+)
+
+// Make a connection handler available to NewHandler under name, replacing
+// any handler registered under it before
+func RegisterHandler(name string, f func(ForwarderOptions) ConnectionHandler) {
+	mhandlers.Lock()
+	defer mhandlers.Unlock()
+
+	handlers[name] = f
+}
+
+// Create the connection handler registered under name: "api" (the HTTP
+// forwarder), "console" (the debug console on stdin; "echo" is an older
+// name for it) or one added with RegisterHandler
+func NewHandler(name string, opts ForwarderOptions) (ConnectionHandler, error) {
+	mhandlers.Lock()
+	f, ok := handlers[name]
+	mhandlers.Unlock()
+
+	if !ok {
+		return nil, ErrUnknownHandler
+	}
+
+	return f(opts), nil
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// Built-in middleware
+//////////////////////////////////////////////////////////////////////////////////
+
+// Counts the CONTROL and DATA messages (and those of registered types) that
+// pass through the chain, and their bytes
+func MetricsMiddleware() Middleware {
+	return Middleware{
+		Name: "metrics",
+		Send: func(next SendFunc) SendFunc {
+			return func(c common.Connection, m common.EgressMessage) error {
+				err := next(c, m)
+				if err == nil {
+					metrics.Messages.With("outbound").Inc()
+					metrics.MessageBytes.With("outbound").Add(m.N)
+				}
+				return err
+			}
+		},
+		Receive: func(next ReceiveFunc) ReceiveFunc {
+			return func(c common.Connection, m common.IngressMessage) error {
+				metrics.Messages.With("inbound").Inc()
+				metrics.MessageBytes.With("inbound").Add(m.N)
+				return next(c, m)
+			}
+		},
+	}
+}
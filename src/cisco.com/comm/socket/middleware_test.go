@@ -0,0 +1,66 @@
+package socket
+
+import (
+	"bytes"
+	"cisco.com/comm/common"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestMiddlewareAndMessageTypes(t *testing.T) {
+	ErrForbidden := errors.New("ERR_FORBIDDEN")
+
+	chain := NewChain()
+	chain.Use(Middleware{
+		Name: "upper",
+		Receive: func(next ReceiveFunc) ReceiveFunc {
+			return func(c common.Connection, m common.IngressMessage) error {
+				body, _ := ioutil.ReadAll(m.R)
+				m.R = strings.NewReader(strings.ToUpper(string(body)))
+				return next(c, m)
+			}
+		},
+	}, Middleware{
+		Name: "deny",
+		Send: func(next SendFunc) SendFunc {
+			return func(c common.Connection, m common.EgressMessage) error {
+				if m.Type == MSG_TYPE_USER+1 {
+					return ErrForbidden
+				}
+				return next(c, m)
+			}
+		},
+	})
+
+	chain.Handle(MSG_TYPE_USER, func(c common.Connection, m common.IngressMessage) {
+		body, _ := ioutil.ReadAll(m.R)
+		res := []byte("type:" + string(body))
+		c.Send(common.EgressMessage{Seq: m.Seq, N: int64(len(res)), R: bytes.NewReader(res), Type: MSG_TYPE_USER})
+	})
+
+	if err := chain.Handle(MSG_TYPE_DATA, nil); err == nil {
+		t.Error("Expected built-in message types to be reserved")
+	}
+
+	server, client := newTestEnds(testOptions{chain: chain})
+	defer server.close()
+
+	// Requests, responses and both ends' payloads pass through the middleware
+	if res, err := client.request("hi"); err != nil || res != "SERVER:HI" {
+		t.Errorf("Got response %q (%v), want %q", res, err, "SERVER:HI")
+	}
+
+	if res, err := client.requestType(MSG_TYPE_USER, "ping"); err != nil || res != "TYPE:PING" {
+		t.Errorf("Got response %q (%v), want %q", res, err, "TYPE:PING")
+	}
+
+	if _, err := client.requestType(MSG_TYPE_USER+1, "x"); err != ErrForbidden {
+		t.Errorf("Got %v for a message stopped by middleware, want %v", err, ErrForbidden)
+	}
+
+	if _, err := client.requestType(MSG_TYPE_HELLO, "x"); err != ErrReservedMessageType {
+		t.Errorf("Got %v for a message of a reserved type, want %v", err, ErrReservedMessageType)
+	}
+}
@@ -1,9 +1,11 @@
 package socket
 
 import (
+	"cisco.com/comm/common"
 	"errors"
 	log "github.com/Sirupsen/logrus"
 	"io"
+	"io/ioutil"
 	"sync"
 )
 
@@ -21,6 +23,19 @@ type payloadReader struct {
 	progress   uint64
 	closed     bool
 	mlock      sync.Mutex
+
+	// Where the payload is read from: the pipe itself, or crc if the
+	// payload has a checksum
+	src io.Reader
+	crc *crcReader
+
+	// Set for compressed payloads: the raw chunks off the wire and the
+	// decompressed stream read from them
+	chunks  *chunkReader
+	decoded io.ReadCloser
+
+	// Shown the payload as it's read if the pipe is tapped, nil otherwise
+	tap *tappedFrame
 }
 
 // Close the PayloadReader. This will NOT close the underlying io.Reader. It
@@ -30,6 +45,7 @@ type payloadReader struct {
 // once it is closed. Close() will be called automatically from Read() upon
 // exhaustion of the reader so there's little reason to invoke it directly.
 func (p *payloadReader) Close() {
+	p.tap.show()
 	p.closed = true
 	p.connection.Done()
 }
@@ -43,15 +59,28 @@ func (p *payloadReader) Read(output []byte) (int, error) {
 		return 0, errors.New("ERR_SOCKET_RE_READ")
 	}
 
+	if p.decoded != nil {
+		return p.readDecoded(output)
+	}
+
 	h := p.header
-	conn := p.connection
 
 	buf := make([]byte, Min(int64(len(output)), int64(h.Length-p.progress)))
 
-	n, err := conn.Read(buf)
+	// Leave the connection alone once the payload is complete: a zero byte
+	// read may block until the peer sends more (in-memory pipes do)
+	var n int
+	var err error
+	if p.progress < h.Length {
+		n, err = p.src.Read(buf)
+	}
 	log.Debug("[socket.payloadreader] Read ", n, " bytes")
 
 	if n <= 0 {
+		if err := p.verify(); err != nil {
+			return 0, err
+		}
+
 		log.Info("[socket.payloadreader] PayloadReader depleted. Message has been consumed.", n)
 		p.Close()
 		return n, io.EOF
@@ -59,6 +88,7 @@ func (p *payloadReader) Read(output []byte) (int, error) {
 
 	p.progress += uint64(n)
 	copy(output, buf)
+	p.tap.collect(buf[:n])
 
 	if err != nil {
 		log.Debug("Connection Closed")
@@ -68,3 +98,62 @@ func (p *payloadReader) Read(output []byte) (int, error) {
 
 	return n, nil
 }
+
+func (p *payloadReader) readDecoded(output []byte) (int, error) {
+	n, err := p.decoded.Read(output)
+	p.progress += uint64(n)
+	p.tap.collect(output[:n])
+
+	// Don't let a payload that decompresses to more than its header said
+	// sneak past the size limit
+	if p.progress > p.header.Length {
+		log.Warn("[socket.payloadreader] Compressed message expands past its length of ", p.header.Length)
+		p.connection.Fail(common.ErrMessageTooLarge)
+		p.Close()
+		return 0, common.ErrMessageTooLarge
+	}
+
+	if err == io.EOF {
+		// The decompressor may stop short of the terminating chunk
+		if _, err := io.Copy(ioutil.Discard, p.chunks); err != nil {
+			log.Info("[socket.payloadreader] Failed to read the end of a compressed message ", err)
+			p.connection.Fail(err)
+			p.Close()
+			return n, err
+		}
+
+		if err := p.verify(); err != nil {
+			return n, err
+		}
+
+		log.Info("[socket.payloadreader] PayloadReader depleted. Message has been consumed.", n)
+		p.Close()
+		return n, io.EOF
+	}
+
+	if err != nil {
+		log.Info("[socket.payloadreader] Failed to decompress message ", err)
+		p.connection.Fail(err)
+		p.Close()
+		return n, err
+	}
+
+	return n, nil
+}
+
+// Check the payload against its checksum trailer, if it has one. On a
+// mismatch the pipe is failed, since whatever follows can't be trusted either.
+func (p *payloadReader) verify() error {
+	if p.crc == nil {
+		return nil
+	}
+
+	if err := verifyChecksum(p.connection, p.crc.crc); err != nil {
+		log.Warn("[socket.payloadreader] Payload checksum mismatch. Header ", p.header, " ", err)
+		p.connection.Fail(ErrChecksum)
+		p.Close()
+		return ErrChecksum
+	}
+
+	return nil
+}
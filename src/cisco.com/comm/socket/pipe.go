@@ -1,9 +1,18 @@
 package socket
 
 import (
+	"bytes"
+	"cisco.com/comm/common"
 	"cisco.com/comm/log"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
 	"net"
 	"sync"
+	"time"
 )
 
 // A bi-directional connection between two endpoints. Implements the
@@ -15,10 +24,77 @@ type Pipe interface {
 	Read([]byte) (int, error)
 	Done()
 	NextMessage() (*payloadReader, error)
+
+	// Whether this is the server (accepting) end of the connection
+	IsServer() bool
+
+	// The codec negotiated for this pipe (nil if none) and the smallest
+	// payload worth compressing with it
+	Compression() (*Codec, int64)
+	SetCompression(*Codec, int64)
+
+	// Whether every message carries checksums (see checksum.go)
+	Checksums() bool
+	SetChecksums(bool)
+
+	// Whether the peer accepts trace context in headers (FLAG_TRACE)
+	Tracing() bool
+	SetTracing(bool)
+
+	// How often each end sends a heartbeat, zero for never
+	Heartbeat() time.Duration
+	SetHeartbeat(time.Duration)
+
+	// Show fn every frame read from or written to the pipe from now on, as
+	// it goes by. fn must not block. Returns a function that stops it.
+	Tap(fn func(common.Frame)) func()
+
+	// Mark the stream as unusable, e.g. after a corrupt payload. The next
+	// NextMessage returns err instead of reading on.
+	Fail(err error)
+
+	// Message size limits agreed on in the handshake
+	Limits() SizeLimits
+	SetLimits(SizeLimits)
+}
+
+// Message size limits in bytes. Zero means no limit.
+type SizeLimits struct {
+
+	// Largest message accepted from the peer. NextMessage refuses to read
+	// anything bigger.
+	MaxInbound int64
+
+	// Largest message that may be sent to the peer
+	MaxOutbound int64
+}
+
+// The stricter of two limits, either of which may be zero for no limit
+func lowerLimit(a, b int64) int64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
 }
 
 type pipe struct {
 	net.Conn
+	server bool
+
+	// Set once during the handshake, before any payload is exchanged
+	codec     *Codec
+	minSize   int64
+	checksums bool
+	tracing   bool
+	heartbeat time.Duration
+	limits    SizeLimits
+
+	// Set by Fail from whichever goroutine found the stream broken
+	mfailed sync.Mutex
+	failed  error
+
+	mtaps sync.Mutex
+	taps  taps
 
 	mbody sync.Mutex
 	body  *payloadReader
@@ -30,6 +106,63 @@ func NewPipe(c net.Conn) Pipe {
 	return &pipe{Conn: c}
 }
 
+// Same as NewPipe, for connections accepted by a server.
+func NewServerPipe(c net.Conn) Pipe {
+	return &pipe{Conn: c, server: true}
+}
+
+func (s *pipe) IsServer() bool {
+	return s.server
+}
+
+func (s *pipe) Compression() (*Codec, int64) {
+	return s.codec, s.minSize
+}
+
+func (s *pipe) SetCompression(c *Codec, minSize int64) {
+	s.codec = c
+	s.minSize = minSize
+}
+
+func (s *pipe) Checksums() bool {
+	return s.checksums
+}
+
+func (s *pipe) SetChecksums(on bool) {
+	s.checksums = on
+}
+
+func (s *pipe) Tracing() bool {
+	return s.tracing
+}
+
+func (s *pipe) SetTracing(on bool) {
+	s.tracing = on
+}
+
+func (s *pipe) Heartbeat() time.Duration {
+	return s.heartbeat
+}
+
+func (s *pipe) SetHeartbeat(d time.Duration) {
+	s.heartbeat = d
+}
+
+func (s *pipe) Limits() SizeLimits {
+	return s.limits
+}
+
+func (s *pipe) SetLimits(l SizeLimits) {
+	s.limits = l
+}
+
+// Safe to call from any goroutine, with or without a message being read
+func (s *pipe) Fail(err error) {
+	s.mfailed.Lock()
+	s.failed = err
+	s.mfailed.Unlock()
+}
+
 func (s *pipe) Done() {
 	s.mbody.Unlock()
 }
@@ -40,14 +173,167 @@ func (s *pipe) Done() {
 func (s *pipe) NextMessage() (*payloadReader, error) {
 	s.mbody.Lock()
 
-	header, err := NewHeader(s)
+	s.mfailed.Lock()
+	failed := s.failed
+	s.mfailed.Unlock()
+
+	if failed != nil {
+		return nil, failed
+	}
+
+	// The length is only checked against the limit once the checksum showed
+	// it's what the peer sent
+	header, err := NewHeader(s, 0)
 
 	if err != nil {
 		log.W("Error parsing header %v", err)
 		return nil, err
 	}
 
+	if s.checksums {
+		if header.Flags&FLAG_CHECKSUM == 0 {
+			log.W("Got a message without checksum %v", header)
+			return nil, ErrChecksum
+		}
+
+		if err := verifyChecksum(s, crc32.Checksum(header.ToBytes(), castagnoli)); err != nil {
+			log.W("Header checksum mismatch %v: %v", header, err)
+			return nil, err
+		}
+	}
+
+	if err := header.checkLength(s.limits.MaxInbound); err != nil {
+		return nil, err
+	}
+
 	log.D("Constructed new message. Using header %v", header)
-	pr := &payloadReader{header: *header, connection: s}
+	pr := &payloadReader{header: *header, connection: s, src: s}
+	pr.tap = newTappedFrame(s.tapped(), common.FrameIn, *header)
+
+	if s.checksums {
+		pr.crc = &crcReader{r: s}
+		pr.src = pr.crc
+	}
+
+	if header.Flags&FLAG_COMPRESSED != 0 {
+		if s.codec == nil {
+			log.W("Got a compressed message but no codec was negotiated")
+			return nil, ErrUnexpectedCompression
+		}
+
+		pr.chunks = &chunkReader{r: pr.src}
+		if pr.decoded, err = s.codec.NewReader(pr.chunks); err != nil {
+			log.W("Can't decompress message %v", err)
+			return nil, err
+		}
+	}
+
 	return pr, nil
 }
+
+// Write a complete message with an in-memory payload to the pipe.
+func writeMessage(p Pipe, t byte, seq uint64, payload []byte) error {
+	h := Header{Vendor: string(PREAMBLE), Type: t, Length: uint64(len(payload)), Seq: seq}
+	_, err := writeFrame(p, h, bytes.NewReader(payload))
+	return err
+}
+
+var (
+	ErrShortPayload          = errors.New("ERR_SHORT_PAYLOAD")
+	ErrUnexpectedCompression = errors.New("ERR_UNEXPECTED_COMPRESSION")
+
+	// A response with an ID from the peer's half of the ID space, or a
+	// request with one from ours
+	ErrMisdirected = errors.New("ERR_MISDIRECTED_MESSAGE")
+)
+
+// Whether err means the peer broke the protocol (as opposed to the
+// connection simply going away). Such connections are closed with a
+// MSG_TYPE_ERROR message telling the peer why.
+func isProtocolError(err error) bool {
+	switch err {
+	case ErrBadPreamble, ErrProtocolVersion, ErrChecksum, ErrChunkTooLong, ErrUnexpectedCompression, ErrMisdirected, ErrStreamWindow,
+		ErrCorruptLZ, common.ErrMessageTooLarge, gzip.ErrHeader, gzip.ErrChecksum:
+		return true
+	}
+
+	_, corrupt := err.(flate.CorruptInputError)
+	return corrupt
+}
+
+// Write a message to the pipe, compressing its payload if compression was
+// negotiated for the pipe and the payload is big enough to be worth it, and
+// adding checksums if those were negotiated. The payload is streamed, never
+// held in memory in full.
+//
+// Once the header is out, the peer expects exactly h.Length bytes and the
+// trailer. If r fails or runs dry before that the frame can't be completed:
+// ErrShortPayload is returned and the pipe must not be used again.
+func writeFrame(p Pipe, h Header, r io.Reader) (int64, error) {
+	codec, minSize := p.Compression()
+	compress := codec != nil && h.Length > 0 && int64(h.Length) >= minSize
+
+	if compress {
+		h.Flags |= FLAG_COMPRESSED
+	}
+
+	if p.Checksums() {
+		h.Flags |= FLAG_CHECKSUM
+	}
+
+	if p.Tracing() && h.Trace.IsValid() {
+		h.Flags |= FLAG_TRACE
+	}
+
+	var tap *tappedFrame
+	if tp, ok := p.(*pipe); ok {
+		if tap = newTappedFrame(tp.tapped(), common.FrameOut, h); tap != nil {
+			r = &tapReader{r: r, frame: tap}
+		}
+	}
+
+	hb := h.ToBytes()
+	if p.Checksums() {
+		hb = append(hb, checksum(hb)...)
+	}
+
+	if _, err := p.Write(hb); err != nil {
+		return 0, err
+	}
+
+	cw := &crcWriter{w: p}
+	var n int64
+	var err error
+
+	if compress {
+		chunks := &chunkWriter{w: cw}
+		zw := codec.NewWriter(chunks)
+		n, err = io.Copy(zw, io.LimitReader(r, int64(h.Length)))
+
+		// Flush what was compressed and end the chunks
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+		if cerr := chunks.Close(); err == nil {
+			err = cerr
+		}
+	} else {
+		n, err = io.Copy(cw, io.LimitReader(r, int64(h.Length)))
+	}
+
+	if err != nil || uint64(n) < h.Length {
+		log.W("Message %d broken off after %d of %d bytes: %v", h.Seq, n, h.Length, err)
+		return n, ErrShortPayload
+	}
+
+	if p.Checksums() {
+		sum := make([]byte, CHECKSUM_LEN)
+		binary.BigEndian.PutUint32(sum, cw.crc)
+		_, err = p.Write(sum)
+	}
+
+	if err == nil {
+		tap.show()
+	}
+	return n, err
+}
@@ -0,0 +1,762 @@
+package socket
+
+import (
+	"cisco.com/comm/common"
+	"cisco.com/comm/log"
+	"cisco.com/comm/metrics"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Store-and-forward queue. Messages for a peer are stored on disk and sent,
+// oldest first, whenever the peer is connected, so work for intermittently
+// connected sites can be handed over while they're away. Like transfers, the
+// queue belongs to the peer's name (see Hello) since connection IDs don't
+// survive reconnects.
+//
+// Every peer gets a directory holding append-only segment files, named after
+// the ID of their first message, and a log of the IDs of messages that are
+// done with (delivered, expired or deleted). A segment is a series of records:
+//
+//	meta length (4 bytes, big endian) | meta (JSON QueuedMessage) | payload
+//
+// A segment is removed once every message in it is done with, and the whole
+// directory once the peer's queue runs empty. The done log is rewritten
+// whenever a segment goes, keeping only the IDs of the segments left and the
+// highest ID done, so IDs aren't handed out again after a restart. Delivery is at least once: a
+// message is only done with once the peer responded to it.
+
+// Start a new segment once the current one is this big
+const queueSegmentSize = 64 << 20
+
+// Drop a message after this many failed delivery attempts
+const queueMaxAttempts = 3
+
+var (
+	ErrQueueBadPeer = errors.New("ERR_QUEUE_BAD_PEER")
+	ErrQueueFull    = errors.New("ERR_QUEUE_FULL")
+	ErrQueueUnknown = errors.New("ERR_QUEUE_MESSAGE_UNKNOWN")
+)
+
+type QueueOptions struct {
+
+	// Where queued messages are stored
+	Dir string
+
+	// How long a message is kept if whoever queued it doesn't say
+	TTL time.Duration
+
+	// Most payload bytes queued per peer. Zero means no limit.
+	MaxBytes int64
+
+	// How long the peer has to respond to a delivered message. Zero means
+	// no limit.
+	DeliveryTimeout time.Duration
+}
+
+// The store-and-forward queue of a client or server, for all its peers
+type Queue struct {
+	opts QueueOptions
+
+	m      sync.Mutex
+	peers  map[string]*peerQueue
+	lastID uint64
+}
+
+type peerQueue struct {
+	name string
+	dir  string
+
+	// Serializes appends, which stream the payload to disk without holding
+	// Queue.m. Everything below is guarded by Queue.m.
+	w sync.Mutex
+
+	// Set while an append is in progress, which keeps the directory from
+	// being reset under it
+	appending bool
+
+	msgs  []*queuedMessage
+	bytes int64
+
+	// Number of messages not yet done with, by segment name
+	live map[string]int
+
+	// The segment being appended to, if any
+	seg     *os.File
+	segName string
+	segSize int64
+
+	// The done log, and the IDs in it by segment for rewriting it
+	done     *os.File
+	doneIDs  map[string][]uint64
+	lastDone uint64
+
+	// Bumped by every connection that starts delivering. An older delivery
+	// loop that sees it changed stops.
+	gen       int
+	connected bool
+
+	// Poked when a message is queued
+	wake chan struct{}
+}
+
+type queuedMessage struct {
+	common.QueuedMessage
+
+	// Segment name and offset of the payload in it
+	seg string
+	off int64
+}
+
+// Set up the queue directory and load whatever a previous run left in it
+func NewQueue(opts QueueOptions) (*Queue, error) {
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{opts: opts, peers: make(map[string]*peerQueue)}
+
+	dirs, err := ioutil.ReadDir(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fi := range dirs {
+		name, err := url.PathUnescape(fi.Name())
+		if !fi.IsDir() || err != nil || validPeerName(name) != nil {
+			log.W("Ignoring %s in the queue directory", fi.Name())
+			continue
+		}
+
+		pq := q.peer(name)
+		if err := q.load(pq); err != nil {
+			return nil, fmt.Errorf("loading the queue for %s: %v", name, err)
+		}
+
+		log.I("Queue for %s holds %d messages (%d bytes)", name, len(pq.msgs), pq.bytes)
+	}
+
+	return q, nil
+}
+
+func validPeerName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return ErrQueueBadPeer
+	}
+	return nil
+}
+
+// The queue for a peer, created if need be. Call with q.m held or before the
+// queue is shared.
+func (q *Queue) peer(name string) *peerQueue {
+	pq, ok := q.peers[name]
+	if !ok {
+		pq = &peerQueue{
+			name:    name,
+			dir:     filepath.Join(q.opts.Dir, url.PathEscape(name)),
+			live:    make(map[string]int),
+			doneIDs: make(map[string][]uint64),
+			wake:    make(chan struct{}, 1),
+		}
+		q.peers[name] = pq
+	}
+
+	return pq
+}
+
+func (pq *peerQueue) poke() {
+	select {
+	case pq.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) load(pq *peerQueue) error {
+	done := make(map[uint64]bool)
+	if b, err := ioutil.ReadFile(filepath.Join(pq.dir, "done")); err == nil {
+		for i := 0; i+8 <= len(b); i += 8 {
+			id := binary.BigEndian.Uint64(b[i:])
+			done[id] = true
+			if id > pq.lastDone {
+				pq.lastDone = id
+			}
+		}
+	}
+
+	// The segments of messages done with may be gone already
+	if pq.lastDone > q.lastID {
+		q.lastID = pq.lastDone
+	}
+
+	// Names are zero-padded IDs, so this is the order they were written in
+	segs, _ := filepath.Glob(filepath.Join(pq.dir, "*.seg"))
+	sort.Strings(segs)
+	now := time.Now()
+
+	for _, path := range segs {
+		msgs, err := readSegment(path)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Base(path)
+		for _, m := range msgs {
+			if m.ID > q.lastID {
+				q.lastID = m.ID
+			}
+
+			if done[m.ID] {
+				pq.doneIDs[name] = append(pq.doneIDs[name], m.ID)
+				continue
+			}
+
+			if now.After(m.Expires) {
+				continue
+			}
+
+			m.Peer = pq.name
+			m.seg = name
+			pq.msgs = append(pq.msgs, m)
+			pq.bytes += m.Size
+			pq.live[name]++
+		}
+
+		if pq.live[name] == 0 {
+			os.Remove(path)
+			delete(pq.doneIDs, name)
+		}
+	}
+
+	if len(pq.msgs) == 0 {
+		q.reset(pq)
+		return nil
+	}
+
+	return q.compact(pq)
+}
+
+// Rewrite the done log of a peer with only the IDs of segments still on disk
+// and the highest ID done. Call with q.m held or before the queue is shared.
+func (q *Queue) compact(pq *peerQueue) error {
+	var b []byte
+	last := false
+	for _, ids := range pq.doneIDs {
+		for _, id := range ids {
+			b = appendID(b, id)
+			last = last || id == pq.lastDone
+		}
+	}
+	if !last && pq.lastDone != 0 {
+		b = appendID(b, pq.lastDone)
+	}
+
+	if pq.done != nil {
+		pq.done.Close()
+		pq.done = nil
+	}
+
+	path := filepath.Join(pq.dir, "done")
+	if err := ioutil.WriteFile(path+".new", b, 0600); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path + ".new")
+	if err == nil {
+		err = f.Sync()
+		f.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".new", path)
+}
+
+func appendID(b []byte, id uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], id)
+	return append(b, buf[:]...)
+}
+
+// Read the index of a segment. A record cut short, which is what a crash
+// in the middle of an append leaves behind, is cut off.
+func readSegment(path string) ([]*queuedMessage, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*queuedMessage
+	var off int64
+	hdr := make([]byte, 4)
+
+	for off < fi.Size() {
+		m := &queuedMessage{}
+
+		ok := false
+		if _, err := f.ReadAt(hdr, off); err == nil {
+			meta := make([]byte, binary.BigEndian.Uint32(hdr))
+			if _, err := f.ReadAt(meta, off+4); err == nil && json.Unmarshal(meta, &m.QueuedMessage) == nil {
+				m.off = off + 4 + int64(len(meta))
+				ok = m.Size >= 0 && m.off+m.Size <= fi.Size()
+			}
+		}
+
+		if !ok {
+			log.W("Cutting off the partial record at %d in %s", off, path)
+			return res, f.Truncate(off)
+		}
+
+		res = append(res, m)
+		off = m.off + m.Size
+	}
+
+	return res, nil
+}
+
+// Forget everything queued for a peer and remove its directory. Call with
+// q.m held.
+func (q *Queue) reset(pq *peerQueue) {
+	if pq.seg != nil {
+		pq.seg.Close()
+	}
+	if pq.done != nil {
+		pq.done.Close()
+	}
+
+	pq.seg, pq.segName, pq.segSize, pq.done = nil, "", 0, nil
+	pq.msgs, pq.bytes = nil, 0
+	pq.live = make(map[string]int)
+	pq.doneIDs, pq.lastDone = make(map[string][]uint64), 0
+	os.RemoveAll(pq.dir)
+}
+
+// Queue size bytes from r for peer, to be dropped if they can't be delivered
+// within ttl (or the default TTL if that's zero). Returns once the message is
+// safely on disk.
+func (q *Queue) Enqueue(peer string, size int64, r io.Reader, ttl time.Duration) (common.QueuedMessage, error) {
+	if err := validPeerName(peer); err != nil {
+		return common.QueuedMessage{}, err
+	}
+
+	if ttl <= 0 {
+		ttl = q.opts.TTL
+	}
+
+	q.m.Lock()
+	pq := q.peer(peer)
+	q.m.Unlock()
+
+	pq.w.Lock()
+	defer pq.w.Unlock()
+
+	q.m.Lock()
+	q.expire(pq)
+
+	if q.opts.MaxBytes > 0 && pq.bytes+size > q.opts.MaxBytes {
+		q.m.Unlock()
+		return common.QueuedMessage{}, ErrQueueFull
+	}
+
+	q.lastID++
+	now := time.Now()
+	m := &queuedMessage{QueuedMessage: common.QueuedMessage{
+		ID:       q.lastID,
+		Peer:     peer,
+		Size:     size,
+		Enqueued: now,
+		Expires:  now.Add(ttl),
+	}}
+
+	f, err := q.segment(pq, m.ID)
+	start := pq.segSize
+	pq.appending = err == nil
+	q.m.Unlock()
+
+	if err != nil {
+		return common.QueuedMessage{}, err
+	}
+
+	m.seg = pq.segName
+	err = appendRecord(f, m, r)
+
+	q.m.Lock()
+	defer q.m.Unlock()
+	pq.appending = false
+
+	if err != nil {
+		f.Truncate(start)
+		if len(pq.msgs) == 0 {
+			q.reset(pq)
+		}
+		return common.QueuedMessage{}, err
+	}
+
+	pq.segSize = m.off + m.Size
+	pq.msgs = append(pq.msgs, m)
+	pq.bytes += m.Size
+	pq.live[m.seg]++
+	pq.poke()
+
+	metrics.QueuedMessages.With("enqueued").Inc()
+	log.I("Queued message %d of %d bytes for %s", m.ID, size, peer)
+	return m.QueuedMessage, nil
+}
+
+// The segment to append message id to, starting a new one if there is none
+// or the current one is full. Call with q.m held.
+func (q *Queue) segment(pq *peerQueue, id uint64) (*os.File, error) {
+	if pq.seg != nil && pq.segSize < queueSegmentSize {
+		return pq.seg, nil
+	}
+
+	if err := os.MkdirAll(pq.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%020d.seg", id)
+	f, err := os.OpenFile(filepath.Join(pq.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if pq.seg != nil {
+		pq.seg.Close()
+		if pq.live[pq.segName] == 0 {
+			q.removeSegment(pq, pq.segName)
+		}
+	}
+
+	pq.seg, pq.segName, pq.segSize = f, name, 0
+	return f, nil
+}
+
+// Write m and its payload from r to the end of f and flush it to disk. Sets
+// m.off.
+func appendRecord(f *os.File, m *queuedMessage, r io.Reader) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	meta, err := json.Marshal(m.QueuedMessage)
+	if err != nil {
+		return err
+	}
+
+	hdr := make([]byte, 4)
+	binary.BigEndian.PutUint32(hdr, uint32(len(meta)))
+
+	if _, err := f.Write(append(hdr, meta...)); err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(f, r, m.Size); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	m.off = fi.Size() + int64(len(hdr)+len(meta))
+	return f.Sync()
+}
+
+// Be done with a message: take it out of the queue and note so on disk.
+// event says why, for the metrics. Call with q.m held.
+func (q *Queue) finish(pq *peerQueue, m *queuedMessage, event string) bool {
+	i := 0
+	for i < len(pq.msgs) && pq.msgs[i] != m {
+		i++
+	}
+
+	if i == len(pq.msgs) {
+		return false
+	}
+
+	pq.msgs = append(pq.msgs[:i], pq.msgs[i+1:]...)
+	pq.bytes -= m.Size
+	pq.live[m.seg]--
+	metrics.QueuedMessages.With(event).Inc()
+
+	if len(pq.msgs) == 0 && !pq.appending {
+		q.reset(pq)
+		return true
+	}
+
+	if pq.done == nil {
+		f, err := os.OpenFile(filepath.Join(pq.dir, "done"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.E("Can't record that queued message %d is done, it will be delivered again after a restart: %v", m.ID, err)
+			return true
+		}
+		pq.done = f
+	}
+
+	pq.done.Write(appendID(nil, m.ID))
+	pq.doneIDs[m.seg] = append(pq.doneIDs[m.seg], m.ID)
+	if m.ID > pq.lastDone {
+		pq.lastDone = m.ID
+	}
+
+	if pq.live[m.seg] == 0 && m.seg != pq.segName {
+		q.removeSegment(pq, m.seg)
+	}
+
+	return true
+}
+
+// Remove a segment nothing in is live anymore, and its IDs from the done
+// log. Call with q.m held.
+func (q *Queue) removeSegment(pq *peerQueue, name string) {
+	os.Remove(filepath.Join(pq.dir, name))
+	delete(pq.live, name)
+	delete(pq.doneIDs, name)
+
+	if err := q.compact(pq); err != nil {
+		log.W("Can't compact the done log of the queue for %s: %v", pq.name, err)
+	}
+}
+
+// Drop the messages of a peer that expired. Call with q.m held.
+func (q *Queue) expire(pq *peerQueue) {
+	now := time.Now()
+	for _, m := range append([]*queuedMessage(nil), pq.msgs...) {
+		if now.After(m.Expires) {
+			log.W("Queued message %d for %s expired undelivered", m.ID, pq.name)
+			q.finish(pq, m, "expired")
+		}
+	}
+}
+
+// What is queued for every peer that has messages queued or is connected
+func (q *Queue) Peers() []common.QueueSummary {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	res := []common.QueueSummary{}
+	for _, pq := range q.peers {
+		q.expire(pq)
+		if len(pq.msgs) == 0 && !pq.connected {
+			continue
+		}
+
+		res = append(res, common.QueueSummary{
+			Peer:      pq.name,
+			Messages:  len(pq.msgs),
+			Bytes:     pq.bytes,
+			Connected: pq.connected,
+		})
+	}
+
+	return res
+}
+
+// The messages queued for peer, oldest first
+func (q *Queue) List(peer string) []common.QueuedMessage {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	res := []common.QueuedMessage{}
+	pq, ok := q.peers[peer]
+	if !ok {
+		return res
+	}
+
+	q.expire(pq)
+	for _, m := range pq.msgs {
+		res = append(res, m.QueuedMessage)
+	}
+
+	return res
+}
+
+// Remove a single message from the queue of peer
+func (q *Queue) Delete(peer string, id uint64) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if pq, ok := q.peers[peer]; ok {
+		for _, m := range pq.msgs {
+			if m.ID == id && q.finish(pq, m, "deleted") {
+				log.I("Deleted queued message %d for %s", id, peer)
+				return nil
+			}
+		}
+	}
+
+	return ErrQueueUnknown
+}
+
+// Remove everything queued for peer. Returns the number of messages removed.
+func (q *Queue) Purge(peer string) int {
+	q.m.Lock()
+	pq, ok := q.peers[peer]
+	q.m.Unlock()
+
+	if !ok {
+		return 0
+	}
+
+	// Let an append in progress finish so it isn't cut off
+	pq.w.Lock()
+	defer pq.w.Unlock()
+
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	n := len(pq.msgs)
+	metrics.QueuedMessages.With("deleted").Add(int64(n))
+	q.reset(pq)
+
+	log.I("Purged %d queued messages for %s", n, peer)
+	return n
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// Delivery
+//////////////////////////////////////////////////////////////////////////////////
+
+// Deliver the peer's queued messages over c until c closes, including any
+// queued in the meantime. A newer connection of the same peer takes over.
+func (q *Queue) deliver(c common.Connection) {
+	if validPeerName(c.Peer) != nil {
+		return
+	}
+
+	q.m.Lock()
+	pq := q.peer(c.Peer)
+	pq.gen++
+	gen := pq.gen
+	pq.connected = true
+	q.m.Unlock()
+
+	defer func() {
+		q.m.Lock()
+		if pq.gen == gen {
+			pq.connected = false
+		}
+		q.m.Unlock()
+	}()
+
+	log.D("Delivering queued messages for %s over connection %d", c.Peer, c.Id)
+
+	for {
+		q.m.Lock()
+		var m *queuedMessage
+		current := pq.gen == gen
+		if current {
+			q.expire(pq)
+			if len(pq.msgs) > 0 {
+				m = pq.msgs[0]
+			}
+		}
+		q.m.Unlock()
+
+		if !current {
+			// In case we took a poke meant for the new loop
+			pq.poke()
+			return
+		}
+
+		if m == nil {
+			select {
+			case <-pq.wake:
+				continue
+			case <-c.Done():
+				return
+			}
+		}
+
+		if err := q.send(c, pq, m); err == common.ErrClosed {
+			return
+		}
+	}
+}
+
+// Send a queued message as a request and wait for the response, which is
+// discarded. The message is done with once the peer responded.
+func (q *Queue) send(c common.Connection, pq *peerQueue, m *queuedMessage) error {
+	if err := c.CheckOutbound(m.Size); err != nil {
+		log.E("Dropping queued message %d for %s: %d bytes is over the size limit of connection %d",
+			m.ID, pq.name, m.Size, c.Id)
+		q.drop(pq, m)
+		return err
+	}
+
+	f, err := os.Open(filepath.Join(pq.dir, m.seg))
+	if err != nil {
+		log.E("Dropping queued message %d for %s: %v", m.ID, pq.name, err)
+		q.drop(pq, m)
+		return err
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if q.opts.DeliveryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), q.opts.DeliveryTimeout)
+	}
+	defer cancel()
+
+	res := make(chan common.IngressMessage, 1)
+	err = c.Send(common.EgressMessage{
+		N:            m.Size,
+		R:            io.NewSectionReader(f, m.off, m.Size),
+		Binary:       true,
+		ResponseChan: res,
+		Ctx:          ctx})
+
+	if err != nil {
+		return err
+	}
+
+	r := <-res
+	if r.Err == common.ErrClosed {
+		return r.Err
+	}
+
+	if r.Err != nil {
+		q.m.Lock()
+		m.Attempts++
+		attempts := m.Attempts
+		q.m.Unlock()
+
+		log.W("Delivering queued message %d to %s failed (attempt %d): %v", m.ID, pq.name, attempts, r.Err)
+		if attempts >= queueMaxAttempts {
+			log.E("Giving up on queued message %d for %s", m.ID, pq.name)
+			q.drop(pq, m)
+		}
+		return r.Err
+	}
+
+	n, _ := io.Copy(ioutil.Discard, r.R)
+	log.I("Delivered queued message %d to %s over connection %d, %d byte response", m.ID, pq.name, c.Id, n)
+
+	q.m.Lock()
+	q.finish(pq, m, "delivered")
+	q.m.Unlock()
+	return nil
+}
+
+func (q *Queue) drop(pq *peerQueue, m *queuedMessage) {
+	q.m.Lock()
+	q.finish(pq, m, "dropped")
+	q.m.Unlock()
+}
@@ -0,0 +1,85 @@
+package socket
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueRestart(t *testing.T) {
+	dir := t.TempDir()
+	opts := QueueOptions{Dir: dir, TTL: time.Hour}
+
+	restart := func() *Queue {
+		q, err := NewQueue(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+
+	enqueue := func(q *Queue, payload string) uint64 {
+		m, err := q.Enqueue("site", int64(len(payload)), strings.NewReader(payload), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.ID
+	}
+
+	ids := func(q *Queue) []uint64 {
+		var res []uint64
+		for _, m := range q.List("site") {
+			res = append(res, m.ID)
+		}
+		return res
+	}
+
+	doneLen := func() int64 {
+		fi, err := os.Stat(filepath.Join(dir, "site", "done"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+
+	// Every run starts a segment of its own
+	q := restart()
+	first := enqueue(q, "one")
+
+	q = restart()
+	second := enqueue(q, "two")
+	if err := q.Delete("site", second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The segment of the second message goes, but not its ID
+	q = restart()
+	q = restart()
+	third := enqueue(q, "three")
+	if third <= second {
+		t.Errorf("Got ID %d again after it was done with", third)
+	}
+
+	q = restart()
+	if got := ids(q); len(got) != 2 || got[0] != first || got[1] != third {
+		t.Fatalf("After a restart the queue holds %v, want [%d %d]", got, first, third)
+	}
+
+	// Removing the first segment leaves only the highest ID in the done log
+	if err := q.Delete("site", first); err != nil {
+		t.Fatal(err)
+	}
+	if n := doneLen(); n != 8 {
+		t.Errorf("The done log is %d bytes, want 8", n)
+	}
+
+	q = restart()
+	if got := ids(q); len(got) != 1 || got[0] != third {
+		t.Fatalf("After a restart the queue holds %v, want [%d]", got, third)
+	}
+	if next := enqueue(q, "four"); next <= third {
+		t.Errorf("Got ID %d after %d", next, third)
+	}
+}
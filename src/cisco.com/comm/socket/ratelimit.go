@@ -0,0 +1,324 @@
+package socket
+
+import (
+	"cisco.com/comm/common"
+	"cisco.com/comm/log"
+	"cisco.com/comm/metrics"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("ERR_RATE_LIMITED")
+
+// Largest read a shaped reader passes through at once, so a single read
+// doesn't run up a debt of many seconds
+const shapeChunk = 32 << 10
+
+// A token bucket filling up with rate tokens a second, to at most one
+// second's worth. Bytes may take it into debt, which whoever took them then
+// waits out; requests need a whole token. A nil bucket has no limit.
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64, now time.Time) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// Take n tokens and return how long to wait until the bucket is out of debt
+func (b *bucket) take(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.refill(now)
+	b.tokens -= n
+
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *bucket) available(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.refill(now)
+	return b.tokens >= 1
+}
+
+// The request and byte buckets of one scope
+type limit struct {
+	scope    string
+	requests *bucket
+	bytes    *bucket
+}
+
+func newLimit(scope string, r common.Rate, now time.Time) *limit {
+	return &limit{scope: scope, requests: newBucket(r.Requests, now), bytes: newBucket(r.Bytes, now)}
+}
+
+// Enforces common.RateLimits: refuses requests over the request rates and
+// delays traffic over the byte rates. It is safe for concurrent use, and a
+// nil Limiter limits nothing.
+type Limiter struct {
+	m      sync.Mutex
+	limits common.RateLimits
+
+	global *limit
+
+	// By connection ID, created as connections first show up
+	conns map[int]*limit
+
+	// By route host, and the table that matches request hosts to them
+	routes map[string]*limit
+	hosts  *Router
+
+	// The clock, time.Now but for tests
+	now func() time.Time
+}
+
+func NewLimiter(limits common.RateLimits) (*Limiter, error) {
+	l := &Limiter{now: time.Now}
+	if err := l.SetLimits(limits); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Limiter) Limits() common.RateLimits {
+	l.m.Lock()
+	res := l.limits
+	l.m.Unlock()
+
+	if res.Connections == nil {
+		res.Connections = []common.ConnectionRate{}
+	}
+	if res.Routes == nil {
+		res.Routes = []common.RouteRate{}
+	}
+	return res
+}
+
+// Replace the limits. Every bucket starts out full again.
+func (l *Limiter) SetLimits(limits common.RateLimits) error {
+	if errs := limits.Check(); len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	now := l.now()
+	routes := make(map[string]*limit)
+	var table []Route
+
+	for _, r := range limits.Routes {
+		host := strings.ToLower(r.Host)
+		routes[host] = newLimit("route", r.Rate, now)
+		table = append(table, Route{Host: host, Origin: host})
+	}
+
+	l.m.Lock()
+	l.limits = limits
+	l.global = newLimit("global", limits.Global, now)
+	l.conns = make(map[int]*limit)
+	l.routes = routes
+	l.hosts = NewRouter("", table)
+	l.m.Unlock()
+
+	log.I("Rate limits are now %+v", limits)
+	return nil
+}
+
+// The limit of connection id. Call with l.m held.
+func (l *Limiter) conn(id int) *limit {
+	if c, ok := l.conns[id]; ok {
+		return c
+	}
+
+	rate := l.limits.Connection
+	for _, c := range l.limits.Connections {
+		if c.Connection == id {
+			rate = c.Rate
+		}
+	}
+
+	c := newLimit("connection", rate, l.now())
+	l.conns[id] = c
+	return c
+}
+
+// The limit of the route host matches, nil if it matches none. Call with l.m
+// held.
+func (l *Limiter) route(host string) *limit {
+	if host == "" {
+		return nil
+	}
+	return l.routes[l.hosts.Lookup(host)]
+}
+
+// Drop what we know about connection id once it's gone
+func (l *Limiter) forget(id int) {
+	if l == nil {
+		return
+	}
+
+	l.m.Lock()
+	delete(l.conns, id)
+	l.m.Unlock()
+}
+
+// Take a request token from the global limit, connection id's and that of
+// the route host matches (if any), or fail with ErrRateLimited if one of
+// them has none left
+func (l *Limiter) allow(id int, host string) error {
+	if l == nil {
+		return nil
+	}
+
+	now := l.now()
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	scopes := []*limit{l.global, l.conn(id)}
+	if r := l.route(host); r != nil {
+		scopes = append(scopes, r)
+	}
+
+	for _, s := range scopes {
+		if !s.requests.available(now) {
+			metrics.RateLimited.With(s.scope).Inc()
+			log.W("Refusing request on connection %d (host %q): over the %s request rate", id, host, s.scope)
+			return ErrRateLimited
+		}
+	}
+
+	for _, s := range scopes {
+		s.requests.take(1, now)
+	}
+
+	return nil
+}
+
+// Take n bytes from the given limits and wait until they are out of debt, or
+// done is closed
+func (l *Limiter) wait(scopes []*limit, n int64, done <-chan struct{}) {
+	now := l.now()
+	var delay time.Duration
+	var scope string
+
+	l.m.Lock()
+	for _, s := range scopes {
+		if s == nil {
+			continue
+		}
+
+		if d := s.bytes.take(float64(n), now); d > delay {
+			delay, scope = d, s.scope
+		}
+	}
+	l.m.Unlock()
+
+	if delay <= 0 {
+		return
+	}
+
+	metrics.RateLimitDelay.With(scope).Add(int64(delay / time.Millisecond))
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-done:
+	}
+}
+
+// Hold the caller up until n more bytes over connection id fit the global
+// and connection byte rates
+func (l *Limiter) waitConn(id int, n int64, done <-chan struct{}) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.m.Lock()
+	scopes := []*limit{l.global, l.conn(id)}
+	l.m.Unlock()
+
+	l.wait(scopes, n, done)
+}
+
+// Pace reads from r to the global and connection byte rates
+func (l *Limiter) shapeConn(r io.Reader, id int, done <-chan struct{}) io.Reader {
+	if l == nil || r == nil {
+		return r
+	}
+
+	l.m.Lock()
+	unlimited := l.global.bytes == nil && l.conn(id).bytes == nil
+	l.m.Unlock()
+
+	if unlimited {
+		return r
+	}
+	return &shapedReader{R: r, wait: func(n int64) { l.waitConn(id, n, done) }}
+}
+
+// Pace reads from r to the byte rate of the route host matches, if any
+func (l *Limiter) shapeRoute(r io.Reader, host string) io.Reader {
+	if l == nil || r == nil {
+		return r
+	}
+
+	l.m.Lock()
+	route := l.route(host)
+	l.m.Unlock()
+
+	if route == nil || route.bytes == nil {
+		return r
+	}
+	return &shapedReader{R: r, wait: func(n int64) { l.wait([]*limit{route}, n, nil) }}
+}
+
+// Waits after every read until its bytes fit the rate
+type shapedReader struct {
+	R    io.Reader
+	wait func(int64)
+}
+
+func (s *shapedReader) Read(p []byte) (int, error) {
+	if len(p) > shapeChunk {
+		p = p[:shapeChunk]
+	}
+
+	n, err := s.R.Read(p)
+	if n > 0 {
+		s.wait(int64(n))
+	}
+	return n, err
+}
+
+// Whoever closes the original reader should be able to close this one
+func (s *shapedReader) Close() error {
+	if c, ok := s.R.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
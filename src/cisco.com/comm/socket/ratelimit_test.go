@@ -0,0 +1,118 @@
+package socket
+
+import (
+	"cisco.com/comm/common"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	start := time.Unix(1000, 0)
+	b := newBucket(10, start)
+
+	if d := b.take(10, start); d != 0 {
+		t.Errorf("Taking a full bucket: wait %v, want 0", d)
+	}
+	if b.available(start) {
+		t.Error("An empty bucket has a token")
+	}
+	if !b.available(start.Add(100 * time.Millisecond)) {
+		t.Error("No token 100ms later")
+	}
+
+	// Into debt by a second's worth
+	if d := b.take(11, start.Add(100*time.Millisecond)); d != time.Second {
+		t.Errorf("Taking 11 of 1: wait %v, want 1s", d)
+	}
+	if b.available(start.Add(time.Second)) {
+		t.Error("A token while still in debt")
+	}
+
+	// Never more than a second's worth, however long it sat
+	later := start.Add(time.Hour)
+	if d := b.take(10, later); d != 0 {
+		t.Errorf("Taking a refilled bucket: wait %v, want 0", d)
+	}
+	if d := b.take(1, later); d != 100*time.Millisecond {
+		t.Errorf("Taking one past a refilled bucket: wait %v, want 100ms", d)
+	}
+
+	// No limit
+	none := newBucket(0, start)
+	if none != nil || none.take(1e9, start) != 0 || !none.available(start) {
+		t.Error("A bucket without a rate limits")
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l, _ := NewLimiter(common.RateLimits{})
+	l.now = func() time.Time { return now }
+
+	err := l.SetLimits(common.RateLimits{
+		Global:      common.Rate{Requests: 10},
+		Connection:  common.Rate{Requests: 2},
+		Connections: []common.ConnectionRate{{Connection: 7, Rate: common.Rate{Requests: 4}}},
+		Routes:      []common.RouteRate{{Host: "*.example.com", Rate: common.Rate{Requests: 1}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		conn int
+		host string
+		ok   bool
+	}{
+		// Per connection
+		{1, "", true},
+		{1, "", true},
+		{1, "", false},
+		{2, "", true},
+
+		// The override
+		{7, "", true},
+		{7, "", true},
+		{7, "", true},
+		{7, "", true},
+		{7, "", false},
+
+		// Per route, shared by every connection. A refused request
+		// takes no tokens.
+		{3, "a.example.com", true},
+		{4, "b.example.com:80", false},
+		{4, "other.org", true},
+		{4, "", true},
+
+		// Global: 10 requests went through by now
+		{5, "", false},
+	}
+
+	for i, step := range steps {
+		err := l.allow(step.conn, step.host)
+		if (err == nil) != step.ok {
+			t.Errorf("Step %d, connection %d, host %q: got %v, want it allowed: %v", i, step.conn, step.host, err, step.ok)
+		}
+	}
+
+	// A second later every bucket is full again
+	now = now.Add(time.Second)
+	for _, id := range []int{1, 1, 7, 7, 7, 7} {
+		if err := l.allow(id, ""); err != nil {
+			t.Errorf("Connection %d a second later: %v", id, err)
+		}
+	}
+	if err := l.allow(3, "a.example.com"); err != nil {
+		t.Errorf("Route a second later: %v", err)
+	}
+
+	// A connection that's gone starts over
+	now = now.Add(100 * time.Millisecond)
+	if err := l.allow(1, ""); err != ErrRateLimited {
+		t.Errorf("Connection 1 over its rate: got %v", err)
+	}
+	l.forget(1)
+	if err := l.allow(1, ""); err != nil {
+		t.Errorf("Connection 1 after forget: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package socket
+
+import (
+	"cisco.com/comm/common"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Maps the Host header of a proxied request to the LAN origin (host:port) it
+// should be sent to.
+type Route struct {
+	Host   string
+	Origin string
+}
+
+// A Router is a table of Routes plus a fallback origin for requests that
+// don't match any of them. It is safe for concurrent use.
+type Router struct {
+	m        sync.RWMutex
+	fallback string
+	exact    map[string]string
+	wildcard []Route
+
+	// As given to Set
+	routes []Route
+}
+
+func NewRouter(fallback string, routes []Route) *Router {
+	r := &Router{}
+	r.Set(fallback, routes)
+	return r
+}
+
+// Replace the routing table.
+func (r *Router) Set(fallback string, routes []Route) {
+	exact := make(map[string]string)
+	var wildcard []Route
+
+	for _, rt := range routes {
+		host := strings.ToLower(rt.Host)
+		if strings.HasPrefix(host, "*.") {
+			wildcard = append(wildcard, Route{Host: host[1:], Origin: rt.Origin})
+		} else {
+			exact[host] = rt.Origin
+		}
+	}
+
+	r.m.Lock()
+	r.fallback = fallback
+	r.exact = exact
+	r.wildcard = wildcard
+	r.routes = append([]Route(nil), routes...)
+	r.m.Unlock()
+}
+
+// The routing table, for the API
+func (r *Router) Table() common.RouteTable {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	t := common.RouteTable{Default: r.fallback, Routes: make([]common.Route, len(r.routes))}
+	for i, rt := range r.routes {
+		t.Routes[i] = common.Route{Host: rt.Host, Origin: rt.Origin}
+	}
+	return t
+}
+
+// Find the origin for a Host header. Exact matches win over wildcards, and a
+// host with a port is tried with the port first and without it second. A nil
+// Router has no origins.
+func (r *Router) Lookup(host string) string {
+	if r == nil {
+		return ""
+	}
+
+	host = strings.ToLower(host)
+	candidates := []string{host}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		candidates = append(candidates, h)
+	}
+
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	for _, h := range candidates {
+		if origin, ok := r.exact[h]; ok {
+			return origin
+		}
+	}
+
+	for _, h := range candidates {
+		for _, rt := range r.wildcard {
+			if strings.HasSuffix(h, rt.Host) {
+				return rt.Origin
+			}
+		}
+	}
+
+	return r.fallback
+}
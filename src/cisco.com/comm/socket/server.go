@@ -2,16 +2,41 @@ package socket
 
 import (
 	"cisco.com/comm/common"
+	"cisco.com/comm/events"
 	"cisco.com/comm/log"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"time"
 )
 
+// Returned by Listen and Serve once the server was closed
+var ErrServerClosed = errors.New("ERR_SERVER_CLOSED")
+
 type Server interface {
 	Listen() error
+
+	// Like Listen, on a listener of the caller's
+	Serve(net.Listener) error
+
+	// Stop listening and drop every connection
+	Close() error
+
+	// Where the server listens, nil until it does
+	Addr() net.Addr
+
 	GetConnection(int) common.Connection
 	GetConnections() []common.Connection
+
+	// Replace the keys accepted from clients. Connected clients that
+	// authenticated with a key that is no longer accepted are disconnected.
+	// Returns the IDs of those connections.
+	SetKeys([]string) []int
+
+	// Replace the admission options. Connections already open stay.
+	SetAdmission(AdmissionOptions)
 }
 
 // A Server represents a listen-able endpoint. This is the endpoint that
@@ -20,53 +45,232 @@ type Server interface {
 type server struct {
 	Port     int
 	Handler  ConnectionHandler
+	Options  ServerOptions
 	m        sync.Mutex
 	channels map[int]common.Connection
+	peers    map[int]peer
+	keys     []string
 	i        int
+	lst      net.Listener
+	closed   bool
+	admit    *admission
 }
 
-func NewServer(port int, handler ConnectionHandler) Server {
-	return &server{Port: port, Handler: handler, channels: make(map[int]common.Connection)}
+// What the server remembers about each authenticated client
+type peer struct {
+	pipe Pipe
+	key  string
+}
+
+type ServerOptions struct {
+
+	// Serve TLS instead of plain TCP if set
+	TLS *tls.Config
+
+	// Keys accepted in the client's Hello. Empty accepts any client.
+	Keys []string
+
+	// Codecs offered to clients
+	Compression CompressionOptions
+
+	// Require checksums on every message, even if the client didn't ask
+	Checksums bool
+
+	// How often to exchange heartbeats with clients. A client may pick a
+	// shorter interval. Zero for none.
+	Heartbeat time.Duration
+
+	// Message size limits. The client's own inbound limit lowers
+	// MaxOutbound per connection.
+	Limits SizeLimits
+
+	// Our name, sent to clients in the handshake
+	Name string
+
+	// Our labels, sent to clients in the handshake
+	Labels map[string]string
+
+	// About us, sent to clients in the handshake
+	Info common.PeerInfo
+
+	// Which connections to accept
+	Admission AdmissionOptions
+}
+
+func NewServer(port int, handler ConnectionHandler, opts ServerOptions) Server {
+	return &server{
+		Port:     port,
+		Handler:  handler,
+		Options:  opts,
+		channels: make(map[int]common.Connection),
+		peers:    make(map[int]peer),
+		keys:     opts.Keys,
+		admit:    newAdmission(opts.Admission)}
 }
 
 // Start the server. This call will block until the server shuts down.
 func (s *server) Listen() error {
+	lst, err := net.Listen(proto, fmt.Sprintf(":%d", s.Port))
+
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(lst)
+}
+
+// Accept connections on lst until it fails or the server is closed
+func (s *server) Serve(lst net.Listener) error {
 
 	// Called by the handler when connection is closed
 	teardown := func(i int) {
 		s.m.Lock()
 		delete(s.channels, i)
+		delete(s.peers, i)
 		s.m.Unlock()
 	}
 
-	lst, err := net.Listen(proto, fmt.Sprintf(":%d", s.Port))
-	log.I("WAN server listening on %s", lst.Addr())
+	if s.Options.TLS != nil {
+		lst = tls.NewListener(lst, s.Options.TLS)
+	}
 
-	if err != nil {
-		return err
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		lst.Close()
+		return ErrServerClosed
 	}
+	s.lst = lst
+	s.m.Unlock()
+
+	log.I("WAN server listening on %s (TLS: %t)", lst.Addr(), s.Options.TLS != nil)
 
 	for {
 		wan, err := lst.Accept()
 
 		if err != nil {
+			s.m.Lock()
+			if s.closed {
+				err = ErrServerClosed
+			}
+			s.m.Unlock()
 			return err
 		}
 
-		s.m.Lock()
-		s.i = (s.i + 1) % 65536
+		release, reason := s.admit.admit(wan.RemoteAddr())
+		if release == nil {
+			reject(wan.RemoteAddr(), reason)
+			wan.Close()
+			continue
+		}
 
-		s.channels[s.i] = common.Connection{
-			Id:     s.i,
-			Remote: wan.RemoteAddr(),
-			Out:    make(chan (common.EgressMessage)),
-			In:     make(chan common.IngressMessage)}
+		go s.accept(wan, func(id int) {
+			teardown(id)
+			release()
+		}, release)
+	}
+}
 
-		c := s.channels[s.i]
+func (s *server) Addr() net.Addr {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.lst == nil {
+		return nil
+	}
+	return s.lst.Addr()
+}
+
+func (s *server) Close() error {
+	s.m.Lock()
+	s.closed = true
+	lst := s.lst
+
+	// Closing the pipes makes the handler tear the connections down
+	for _, p := range s.peers {
+		p.pipe.Close()
+	}
+	s.m.Unlock()
+
+	if lst != nil {
+		return lst.Close()
+	}
+	return nil
+}
+
+// Authenticate a freshly accepted connection and hand it to the handler.
+// teardown is passed on to the handler; release frees the connection's
+// admission slot if it never gets that far.
+func (s *server) accept(wan net.Conn, teardown func(int), release func()) {
+	p := NewServerPipe(wan)
+
+	s.m.Lock()
+	keys := s.keys
+	s.m.Unlock()
+
+	// Clients that connect and never speak would hold their slot forever
+	if timeout := s.admit.handshakeTimeout(); timeout > 0 {
+		wan.SetDeadline(time.Now().Add(timeout))
+	}
+
+	hello, err := serverHandshake(p, keys, s.Options)
+	if err != nil {
+		reason := rejectHandshakeFailed
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			reason = rejectHandshakeTimeout
+		} else if err == ErrAuth {
+			reason = rejectAuth
+		}
+
+		log.W("Handshake with %v failed, closing: %v", wan.RemoteAddr(), err)
+		reject(wan.RemoteAddr(), reason)
+		p.Close()
+		release()
+		return
+	}
+
+	wan.SetDeadline(time.Time{})
+
+	s.m.Lock()
+
+	if s.closed {
 		s.m.Unlock()
+		p.Close()
+		release()
+		return
+	}
 
-		go s.Handler.OnConnect(NewPipe(wan), c, teardown)
+	// The keys may have been reloaded while we were shaking hands
+	if !keyAccepted(hello.Key, s.keys) {
+		s.m.Unlock()
+		log.W("Key of %v was revoked during the handshake, closing", wan.RemoteAddr())
+		reject(wan.RemoteAddr(), rejectAuth)
+		p.Close()
+		release()
+		return
 	}
+
+	s.i = (s.i + 1) % 65536
+
+	conn := common.NewConnection(s.i, wan.RemoteAddr())
+	conn.Peer = hello.Name
+	conn.SetIdentity(keyIdentity(hello.Key, s.keys))
+	conn.Info = hello.Info
+	conn.SetLabels(peerLabels(hello.Labels))
+	conn.SetLimits(p.Limits().MaxInbound, p.Limits().MaxOutbound)
+	s.channels[s.i] = conn
+
+	s.peers[s.i] = peer{pipe: p, key: hello.Key}
+
+	c := s.channels[s.i]
+	s.m.Unlock()
+
+	events.Publish(events.Event{Type: events.Connected, Connection: c.Id, Peer: c.Peer, Remote: wan.RemoteAddr().String()})
+
+	s.Handler.OnConnect(p, c, func(id int) {
+		teardown(id)
+		events.Publish(events.Event{Type: events.Disconnected, Connection: c.Id, Peer: c.Peer, Remote: wan.RemoteAddr().String()})
+	})
 }
 
 func (s *server) GetConnections() []common.Connection {
@@ -88,3 +292,30 @@ func (s *server) GetConnection(idx int) common.Connection {
 	s.m.Lock()
 	return s.channels[idx]
 }
+
+func (s *server) SetAdmission(opts AdmissionOptions) {
+	s.admit.set(opts)
+}
+
+func (s *server) SetKeys(keys []string) []int {
+	var revoked []int
+
+	s.m.Lock()
+	s.keys = keys
+
+	for id, p := range s.peers {
+		if !keyAccepted(p.key, keys) {
+			revoked = append(revoked, id)
+			p.pipe.Close()
+		}
+	}
+	s.m.Unlock()
+
+	// Closing the pipe makes the handler tear the connection down, which
+	// removes it from the registry.
+	for _, id := range revoked {
+		log.I("Disconnected connection %d. Its key is no longer accepted", id)
+	}
+
+	return revoked
+}
@@ -0,0 +1,81 @@
+package socket
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Connect to addr and shake hands with key
+func dialTestServer(t *testing.T, addr, key string) (Pipe, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPipe(c)
+	if _, err := clientHandshake(p, Hello{Key: key, Name: key}, 0, SizeLimits{}); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func TestSetKeysRevokes(t *testing.T) {
+	srv := NewServer(0, NewChannelHandler(ForwarderOptions{NoLAN: true}), ServerOptions{Keys: []string{"a", "b"}})
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(lst)
+	defer srv.Close()
+
+	revoked, err := dialTestServer(t, lst.Addr().String(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer revoked.Close()
+
+	kept, err := dialTestServer(t, lst.Addr().String(), "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kept.Close()
+
+	waitConnections := func(n int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for len(srv.GetConnections()) != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("The server has %d connections, want %d", len(srv.GetConnections()), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitConnections(2)
+
+	if ids := srv.SetKeys([]string{"b"}); len(ids) != 1 {
+		t.Fatalf("Revoked connections %v, want one", ids)
+	}
+
+	// The server hangs up on the client whose key went
+	revoked.(*pipe).SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := revoked.NextMessage(); err == nil {
+		t.Error("The revoked client's connection is still open")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("The revoked client's connection wasn't closed")
+	}
+	waitConnections(1)
+
+	// and leaves the other alone
+	kept.(*pipe).SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := kept.NextMessage(); err == nil {
+		t.Error("The kept client got a message")
+	} else if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("The kept client's connection broke: %v", err)
+	}
+
+	// The old key is refused from now on
+	if _, err := dialTestServer(t, lst.Addr().String(), "a"); err == nil || err.Error() != ErrAuth.Error() {
+		t.Errorf("Connecting with the revoked key: got %v, want %v", err, ErrAuth)
+	}
+}
@@ -0,0 +1,305 @@
+package socket
+
+import (
+	"bytes"
+	"cisco.com/comm/common"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// One end of an in-memory connection, running the same session loops as a
+// real one
+type testEnd struct {
+	name string
+	conn common.Connection
+	wan  Pipe
+	s    *session
+
+	// Closed once the session is torn down
+	gone chan struct{}
+}
+
+// How newTestEnds sets up its ends. The zero value gives plain sessions that
+// answer every request.
+type testOptions struct {
+	chain *Chain
+
+	// Transfers of the server end and of the client end
+	transfers [2]*Transfers
+
+	// Whether the ends accept streams
+	streams bool
+
+	// Called with each pipe before its session starts, to set up what a
+	// handshake would have
+	pipe func(Pipe)
+
+	// Leave requests in conn.In for the test instead of answering them
+	quiet bool
+}
+
+// Connect a server and a client session through net.Pipe, as peers named
+// "server" and "client". Unless opts.quiet, each end answers every request
+// with its name and the request's payload.
+func newTestEnds(opts testOptions) (*testEnd, *testEnd) {
+	a, b := net.Pipe()
+	return newTestEnd(NewServerPipe(a), opts), newTestEnd(NewPipe(b), opts)
+}
+
+// Run a session over one end of a pipe, for tests that play the peer
+// themselves
+func newTestEnd(p Pipe, opts testOptions) *testEnd {
+	e := &testEnd{name: "server", conn: common.NewConnection(1, nil), wan: p, gone: make(chan struct{})}
+	e.conn.Peer = "client"
+	transfers := opts.transfers[0]
+	if !p.IsServer() {
+		e.name, e.conn.Peer, transfers = "client", "server", opts.transfers[1]
+	}
+
+	if opts.pipe != nil {
+		opts.pipe(p)
+	}
+
+	e.s = newSession(p, e.conn, transfers, opts.chain)
+	e.s.streams.accepting = opts.streams
+	if transfers != nil {
+		transfers.attach(e.s)
+	}
+
+	go e.s.readFromWAN(func(int) { close(e.gone) })
+	go e.s.writeToWAN()
+	if !opts.quiet {
+		go e.answer()
+	}
+
+	return e
+}
+
+func (e *testEnd) answer() {
+	for in := range e.conn.In {
+		body, err := ioutil.ReadAll(in.R)
+		if err != nil {
+			continue
+		}
+
+		// Answer from a goroutine of its own, so requests are served
+		// concurrently
+		go func(in common.IngressMessage, body []byte) {
+			res := []byte(e.name + ":" + string(body))
+			e.conn.Send(common.EgressMessage{Seq: in.Seq, N: int64(len(res)), R: bytes.NewReader(res), Binary: true})
+		}(in, body)
+	}
+}
+
+// Whether the session has no requests in flight or being served
+func (e *testEnd) idle() bool {
+	e.s.m.Lock()
+	defer e.s.m.Unlock()
+	return len(e.s.inflight) == 0 && len(e.s.serving) == 0
+}
+
+// Wait for the sessions of ends to forget about every request
+func waitIdle(t *testing.T, ends ...*testEnd) {
+	for _, e := range ends {
+		for start := time.Now(); !e.idle(); time.Sleep(10 * time.Millisecond) {
+			if time.Since(start) > 5*time.Second {
+				t.Errorf("The %s end still tracks requests", e.name)
+				break
+			}
+		}
+	}
+}
+
+func (e *testEnd) close() {
+	e.wan.Close()
+}
+
+// Send a request and wait for its response
+func (e *testEnd) request(payload string) (string, error) {
+	return e.requestType(0, payload)
+}
+
+func (e *testEnd) requestType(t byte, payload string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res := make(chan common.IngressMessage, 1)
+	err := e.conn.Send(common.EgressMessage{
+		N:            int64(len(payload)),
+		R:            bytes.NewReader([]byte(payload)),
+		Binary:       true,
+		Type:         t,
+		ResponseChan: res,
+		Ctx:          ctx})
+	if err != nil {
+		return "", err
+	}
+
+	in := <-res
+	if in.Err != nil {
+		return "", in.Err
+	}
+
+	body, err := ioutil.ReadAll(in.R)
+	return string(body), err
+}
+
+func TestBidirectionalRequests(t *testing.T) {
+	server, client := newTestEnds(testOptions{})
+	defer server.close()
+
+	const n = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+
+	for i := 0; i < n; i++ {
+		for _, pair := range [][2]*testEnd{{server, client}, {client, server}} {
+			wg.Add(1)
+			go func(from, to *testEnd, i int) {
+				defer wg.Done()
+
+				req := fmt.Sprintf("%s-%d", from.name, i)
+				res, err := from.request(req)
+				if err != nil {
+					errs <- fmt.Errorf("%s: %v", req, err)
+					return
+				}
+
+				if want := to.name + ":" + req; res != want {
+					errs <- fmt.Errorf("%s: got response %q, want %q", req, res, want)
+				}
+			}(pair[0], pair[1], i)
+		}
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestMisdirectedResponse(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	server := newTestEnd(NewServerPipe(a), testOptions{quiet: true})
+
+	// A response numbered from the client's half, which the server can't
+	// have sent a request with
+	peer := NewPipe(b)
+	payload := []byte("stray")
+	h := Header{Vendor: string(PREAMBLE), Type: MSG_TYPE_DATA, Flags: FLAG_RESPONSE, Seq: 7, Length: uint64(len(payload))}
+	go writeFrame(peer, h, bytes.NewReader(payload))
+
+	r, err := peer.NextMessage()
+	if err != nil {
+		t.Fatalf("Expected an error message, got %v", err)
+	}
+
+	msg, _ := ioutil.ReadAll(r)
+	if r.header.Type != MSG_TYPE_ERROR || string(msg) != ErrMisdirected.Error() {
+		t.Errorf("Expected an error message about %v, got type %d: %q", ErrMisdirected, r.header.Type, msg)
+	}
+
+	select {
+	case <-server.gone:
+	case <-time.After(5 * time.Second):
+		t.Error("Connection wasn't closed after a misdirected response")
+	}
+}
+
+// Gives a few bytes, then fails
+type failingReader struct {
+	n int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, errors.New("source failed")
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.n -= len(p)
+	return len(p), nil
+}
+
+func TestBrokenOffPayload(t *testing.T) {
+	for name, setup := range map[string]func(Pipe){
+		"plain": nil,
+		"compressed": func(p Pipe) {
+			p.SetCompression(CodecByName("gzip"), 0)
+			p.SetChecksums(true)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server, client := newTestEnds(testOptions{pipe: setup})
+			defer server.close()
+
+			// The header announces 100 bytes, the source fails after 10
+			res := make(chan common.IngressMessage, 1)
+			client.conn.Send(common.EgressMessage{N: 100, R: &failingReader{n: 10}, Binary: true, ResponseChan: res})
+
+			select {
+			case in := <-res:
+				if in.Err != ErrShortPayload {
+					t.Errorf("Expected %v for the broken off request, got %v", ErrShortPayload, in.Err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("The broken off request never failed")
+			}
+
+			for _, e := range []*testEnd{client, server} {
+				select {
+				case <-e.gone:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("The %s end wasn't torn down", e.name)
+				}
+			}
+
+			// Nothing more goes out on the broken pipe
+			if _, err := client.request("again"); err == nil {
+				t.Error("Expected a request after the broken off one to fail")
+			}
+		})
+	}
+}
+
+func TestRequestCancel(t *testing.T) {
+	server, client := newTestEnds(testOptions{quiet: true})
+	defer server.close()
+
+	// No deadline, so only a cancel ends the request on the server end
+	ctx, cancel := context.WithCancel(context.Background())
+	res := make(chan common.IngressMessage, 1)
+	client.conn.Send(common.EgressMessage{N: 3, R: bytes.NewReader([]byte("abc")), Binary: true, ResponseChan: res, Ctx: ctx})
+
+	in := <-server.conn.In
+	ioutil.ReadAll(in.R)
+	cancel()
+
+	if got := <-res; got.Err != context.Canceled {
+		t.Errorf("Expected the request to fail with %v, got %v", context.Canceled, got.Err)
+	}
+
+	select {
+	case <-in.Ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("The cancel never reached the server end")
+	}
+
+	// Answering it anyway is fine, the client throws the late response away
+	server.conn.Send(common.EgressMessage{Seq: in.Seq, N: 2, R: bytes.NewReader([]byte("ok")), Binary: true})
+	waitIdle(t, server, client)
+}
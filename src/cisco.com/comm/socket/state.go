@@ -0,0 +1,158 @@
+package socket
+
+import (
+	"cisco.com/comm/common"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What a connection's goroutines are holding on to, for debugging
+type SessionState struct {
+	Connection int    `json:"connection"`
+	Peer       string `json:"peer,omitempty"`
+	Server     bool   `json:"server"`
+
+	// Heartbeat interval agreed on in the handshake, zero for none, and
+	// when the peer was last heard from
+	Heartbeat float64   `json:"heartbeat_ms"`
+	LastHeard time.Time `json:"last_heard"`
+
+	// Last request ID we allocated, zero if none yet
+	LastSeq uint64 `json:"last_seq"`
+
+	// Requests we sent and wait on, and requests of the peer we serve
+	Inflight []uint64 `json:"inflight"`
+	Serving  []uint64 `json:"serving"`
+
+	// Control messages waiting for writeToWAN, and how many fit
+	ControlQueue    int `json:"control_queue"`
+	ControlCapacity int `json:"control_capacity"`
+
+	Streams []StreamState `json:"streams"`
+}
+
+type StreamState struct {
+	ID uint64 `json:"id"`
+
+	// Received and not read yet
+	Buffered int `json:"buffered"`
+
+	// How much more we may send
+	Window int `json:"window"`
+
+	Closed       bool `json:"closed,omitempty"`
+	RemoteClosed bool `json:"remote_closed,omitempty"`
+}
+
+// The sessions of every connection in the process
+var live = struct {
+	m        sync.Mutex
+	sessions map[*session]struct{}
+}{sessions: make(map[*session]struct{})}
+
+func register(s *session) {
+	live.m.Lock()
+	live.sessions[s] = struct{}{}
+	live.m.Unlock()
+}
+
+func unregister(s *session) {
+	live.m.Lock()
+	delete(live.sessions, s)
+	live.m.Unlock()
+}
+
+// The session serving c, nil if there's none
+func findSession(c common.Connection) *session {
+	live.m.Lock()
+	defer live.m.Unlock()
+
+	for s := range live.sessions {
+		if s.conn.Done() == c.Done() {
+			return s
+		}
+	}
+	return nil
+}
+
+// A snapshot of the state of every connection served by a channel handler,
+// by connection ID
+func State() []SessionState {
+	live.m.Lock()
+	sessions := make([]*session, 0, len(live.sessions))
+	for s := range live.sessions {
+		sessions = append(sessions, s)
+	}
+	live.m.Unlock()
+
+	res := make([]SessionState, 0, len(sessions))
+	for _, s := range sessions {
+		res = append(res, s.state())
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Connection < res[j].Connection })
+	return res
+}
+
+func (s *session) state() SessionState {
+	st := SessionState{
+		Connection:      s.conn.Id,
+		Peer:            s.conn.Peer,
+		Server:          s.wan.IsServer(),
+		Heartbeat:       milliseconds(s.wan.Heartbeat()),
+		LastHeard:       s.conn.Stats().LastHeard,
+		Inflight:        []uint64{},
+		Serving:         []uint64{},
+		ControlQueue:    len(s.control),
+		ControlCapacity: cap(s.control),
+		Streams:         s.streams.state(),
+	}
+
+	if seq := atomic.LoadUint64(&s.lastSeq); seq != 0 {
+		st.LastSeq = (seq &^ SEQ_SERVER_BIT) | s.origin
+	}
+
+	s.m.Lock()
+	for seq := range s.inflight {
+		st.Inflight = append(st.Inflight, seq)
+	}
+	for seq := range s.serving {
+		st.Serving = append(st.Serving, seq)
+	}
+	s.m.Unlock()
+
+	sortSeqs(st.Inflight)
+	sortSeqs(st.Serving)
+	return st
+}
+
+func (x *Streams) state() []StreamState {
+	x.m.Lock()
+	streams := make([]*Stream, 0, len(x.streams))
+	for _, st := range x.streams {
+		streams = append(streams, st)
+	}
+	x.m.Unlock()
+
+	res := make([]StreamState, 0, len(streams))
+	for _, st := range streams {
+		st.m.Lock()
+		res = append(res, StreamState{
+			ID:           st.id,
+			Buffered:     st.buf.Len(),
+			Window:       st.window,
+			Closed:       st.closed,
+			RemoteClosed: st.remoteClosed,
+		})
+		st.m.Unlock()
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+func sortSeqs(seqs []uint64) {
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+}
@@ -0,0 +1,470 @@
+package socket
+
+import (
+	"bytes"
+	"cisco.com/comm/common"
+	"cisco.com/comm/log"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+// Streams are byte streams multiplexed over a connection, next to its
+// messages. Either end opens one with a MSG_TYPE_STREAM_OPEN request whose Seq
+// becomes the stream's ID; the other end answers with a MSG_TYPE_STREAM_OPEN
+// carrying FLAG_RESPONSE and an empty payload if it accepted the stream, or
+// the reason it didn't. Then:
+//
+//	MSG_TYPE_STREAM_DATA	the next bytes of the stream
+//	MSG_TYPE_STREAM_WINDOW	4 bytes, big endian: how many more bytes the
+//				receiver of this frame may send
+//	MSG_TYPE_STREAM_CLOSE	the sender closed its end, no payload
+//
+// Each end starts out allowed to send streamWindow bytes and grants more as
+// its reader consumes them, so a stream nobody reads never holds up the rest
+// of the connection. Stream frames bypass the middleware.
+
+// Bytes either end may send before the other grants more
+const streamWindow = 256 << 10
+
+// Largest payload of a single MSG_TYPE_STREAM_DATA frame
+const streamChunk = 32 << 10
+
+// Opened streams waiting for Accept. More are refused.
+const streamBacklog = 16
+
+var (
+	// The peer doesn't accept streams, or not that many at once
+	ErrStreamsDisabled = errors.New("ERR_STREAMS_DISABLED")
+	ErrStreamBacklog   = errors.New("ERR_STREAM_BACKLOG")
+
+	// The peer sent more than it was granted
+	ErrStreamWindow = errors.New("ERR_STREAM_WINDOW")
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Returned by Stream reads and writes that hit their deadline. It is a
+// net.Error whose Timeout is true.
+var ErrStreamTimeout error = timeoutError{}
+
+// The streams of one connection
+type Streams struct {
+	s *session
+
+	// Whether the peer may open streams. Set before the session starts.
+	accepting bool
+
+	m       sync.Mutex
+	streams map[uint64]*Stream
+
+	accept chan *Stream
+}
+
+func newStreams(s *session) *Streams {
+	return &Streams{s: s, streams: make(map[uint64]*Stream), accept: make(chan *Stream, streamBacklog)}
+}
+
+// Open a stream to the peer. Fails if the peer refuses it, ctx is done first
+// or the connection goes away.
+func (x *Streams) Open(ctx context.Context) (*Stream, error) {
+	id := x.s.nextSeq()
+
+	// Registered up front so data the peer sends right after accepting
+	// isn't taken for a stray
+	st := x.add(id)
+
+	ing := x.s.requestAs(ctx, id, MSG_TYPE_STREAM_OPEN, nil)
+	if ing.Err == nil {
+		reason, _ := ioutil.ReadAll(ing.R)
+		if len(reason) > 0 {
+			ing.Err = errors.New(string(reason))
+		}
+	}
+
+	if ing.Err != nil {
+		x.remove(id)
+		return nil, ing.Err
+	}
+
+	return st, nil
+}
+
+// Wait for the peer to open a stream
+func (x *Streams) Accept(ctx context.Context) (*Stream, error) {
+	select {
+	case st := <-x.accept:
+		return st, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-x.s.conn.Done():
+		return nil, common.ErrClosed
+	}
+}
+
+func (x *Streams) add(id uint64) *Stream {
+	st := &Stream{
+		x:        x,
+		id:       id,
+		window:   streamWindow,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1)}
+
+	x.m.Lock()
+	x.streams[id] = st
+	x.m.Unlock()
+
+	return st
+}
+
+func (x *Streams) get(id uint64) *Stream {
+	x.m.Lock()
+	defer x.m.Unlock()
+	return x.streams[id]
+}
+
+func (x *Streams) remove(id uint64) {
+	x.m.Lock()
+	delete(x.streams, id)
+	x.m.Unlock()
+}
+
+// Handle a stream frame read by readFromWAN
+func (x *Streams) handle(r *payloadReader) {
+	var err error
+	seq := r.header.Seq
+
+	switch r.header.Type {
+	case MSG_TYPE_STREAM_OPEN:
+		err = x.onOpen(r)
+	case MSG_TYPE_STREAM_DATA:
+		if st := x.get(seq); st != nil {
+			err = st.push(r)
+		} else {
+			// The stream was closed or abandoned while this was on its way
+			log.D("Data for unknown stream %d, closing it", seq)
+			x.s.sendControl(controlMessage{t: MSG_TYPE_STREAM_CLOSE, seq: seq})
+		}
+	case MSG_TYPE_STREAM_WINDOW:
+		var n uint32
+		if err = binary.Read(r, binary.BigEndian, &n); err == nil {
+			if st := x.get(seq); st != nil {
+				st.grant(int(n))
+			}
+		}
+	case MSG_TYPE_STREAM_CLOSE:
+		if st := x.get(seq); st != nil {
+			st.closeRemote()
+		}
+	}
+
+	if !r.closed {
+		io.Copy(ioutil.Discard, r)
+	}
+
+	if err == ErrMisdirected || err == ErrStreamWindow {
+		log.E("Stream protocol error on connection %d: %v", x.s.conn.Id, err)
+		x.s.wan.Fail(err)
+	} else if err != nil {
+		log.W("Stream message %v failed: %v", r.header, err)
+	}
+}
+
+func (x *Streams) onOpen(r *payloadReader) error {
+	seq := r.header.Seq
+
+	if r.header.Flags&FLAG_RESPONSE != 0 {
+		if !x.s.ours(seq) {
+			return ErrMisdirected
+		}
+
+		reason, err := ioutil.ReadAll(io.LimitReader(r, maxHelloLen))
+		if err != nil {
+			return err
+		}
+
+		x.s.finish(seq, common.IngressMessage{Seq: seq, N: int64(len(reason)), R: bytes.NewReader(reason)})
+		return nil
+	}
+
+	if x.s.ours(seq) {
+		return ErrMisdirected
+	}
+
+	refuse := ErrStreamsDisabled
+	if x.accepting {
+		st := x.add(seq)
+		select {
+		case x.accept <- st:
+			refuse = nil
+		default:
+			x.remove(seq)
+			refuse = ErrStreamBacklog
+		}
+	}
+
+	var reason []byte
+	if refuse != nil {
+		log.W("Refusing stream %d on connection %d: %v", seq, x.s.conn.Id, refuse)
+		reason = []byte(refuse.Error())
+	}
+
+	return x.s.sendControl(controlMessage{t: MSG_TYPE_STREAM_OPEN, flags: FLAG_RESPONSE, seq: seq, payload: reason})
+}
+
+// One end of a stream. It implements net.Conn.
+type Stream struct {
+	x  *Streams
+	id uint64
+
+	m sync.Mutex
+
+	// Received and not read yet, and how much of what was read the peer
+	// hasn't been granted again
+	buf      bytes.Buffer
+	consumed int
+
+	// How much more we may send
+	window int
+
+	closed       bool
+	remoteClosed bool
+
+	rdeadline time.Time
+	wdeadline time.Time
+
+	// Poked whenever there may be something new to read, or room to write
+	readable chan struct{}
+	writable chan struct{}
+}
+
+// Where a stream runs: the connection, the peer's name (for the remote end)
+// and the stream's ID
+type StreamAddr struct {
+	Connection int
+	Peer       string
+	Stream     uint64
+}
+
+func (a StreamAddr) Network() string {
+	return "comm"
+}
+
+func (a StreamAddr) String() string {
+	if a.Peer != "" {
+		return fmt.Sprintf("%s/%d/%d", a.Peer, a.Connection, a.Stream)
+	}
+	return fmt.Sprintf("%d/%d", a.Connection, a.Stream)
+}
+
+func poke(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Buffer a data frame. Called by readFromWAN only.
+func (st *Stream) push(r io.Reader) error {
+	st.m.Lock()
+	defer st.m.Unlock()
+
+	if st.closed {
+		return nil
+	}
+
+	n, err := st.buf.ReadFrom(io.LimitReader(r, int64(streamWindow-st.buf.Len()+1)))
+	if err != nil {
+		return err
+	}
+
+	if st.buf.Len() > streamWindow {
+		return ErrStreamWindow
+	}
+
+	if n > 0 {
+		poke(st.readable)
+	}
+	return nil
+}
+
+func (st *Stream) grant(n int) {
+	st.m.Lock()
+	st.window += n
+	st.m.Unlock()
+	poke(st.writable)
+}
+
+func (st *Stream) closeRemote() {
+	st.m.Lock()
+	st.remoteClosed = true
+	st.m.Unlock()
+	poke(st.readable)
+	poke(st.writable)
+}
+
+// Block until c is poked, the deadline passes or the connection goes away
+func (st *Stream) wait(c chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return ErrStreamTimeout
+		}
+
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case <-c:
+		return nil
+	case <-timeout:
+		return ErrStreamTimeout
+	case <-st.x.s.conn.Done():
+		return common.ErrClosed
+	}
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.m.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(b)
+			st.consumed += n
+
+			// Grant in batches rather than for every read
+			var grant int
+			if st.consumed >= streamWindow/2 && !st.remoteClosed {
+				grant, st.consumed = st.consumed, 0
+			}
+			st.m.Unlock()
+
+			if grant > 0 {
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint32(payload, uint32(grant))
+				st.x.s.sendControl(controlMessage{t: MSG_TYPE_STREAM_WINDOW, seq: st.id, payload: payload})
+			}
+
+			return n, nil
+		}
+
+		if st.closed {
+			st.m.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+
+		if st.remoteClosed {
+			st.m.Unlock()
+			return 0, io.EOF
+		}
+
+		deadline := st.rdeadline
+		st.m.Unlock()
+
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	written := 0
+
+	for len(b) > 0 {
+		st.m.Lock()
+		if st.closed || st.remoteClosed {
+			st.m.Unlock()
+			return written, io.ErrClosedPipe
+		}
+
+		if st.window == 0 {
+			deadline := st.wdeadline
+			st.m.Unlock()
+
+			if err := st.wait(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		n := len(b)
+		if n > st.window {
+			n = st.window
+		}
+		if n > streamChunk {
+			n = streamChunk
+		}
+		st.window -= n
+		st.m.Unlock()
+
+		payload := append([]byte(nil), b[:n]...)
+		if err := st.x.s.sendControl(controlMessage{t: MSG_TYPE_STREAM_DATA, seq: st.id, payload: payload}); err != nil {
+			return written, err
+		}
+
+		written += n
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// Close the stream. The peer reads what was written before and then EOF;
+// whatever it sends from now on is dropped.
+func (st *Stream) Close() error {
+	st.m.Lock()
+	if st.closed {
+		st.m.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.m.Unlock()
+
+	poke(st.readable)
+	poke(st.writable)
+
+	st.x.remove(st.id)
+	st.x.s.sendControl(controlMessage{t: MSG_TYPE_STREAM_CLOSE, seq: st.id})
+	return nil
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return StreamAddr{Connection: st.x.s.conn.Id, Stream: st.id}
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return StreamAddr{Connection: st.x.s.conn.Id, Peer: st.x.s.conn.Peer, Stream: st.id}
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.m.Lock()
+	st.rdeadline = t
+	st.m.Unlock()
+	poke(st.readable)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.m.Lock()
+	st.wdeadline = t
+	st.m.Unlock()
+	poke(st.writable)
+	return nil
+}
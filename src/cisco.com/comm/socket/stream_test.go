@@ -0,0 +1,77 @@
+package socket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStreams(t *testing.T) {
+	server, client := newTestEnds(testOptions{streams: true, quiet: true})
+	defer server.close()
+	ends := []*session{server.s, client.s}
+
+	// Several times the window each way, so the senders have to wait for
+	// grants
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 4*streamWindow/16+3)
+
+	var wg sync.WaitGroup
+	for i, end := range ends {
+		peer := ends[1-i]
+
+		// The peer echoes whatever it's sent
+		go func() {
+			st, err := peer.streams.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			defer st.Close()
+
+			buf := make([]byte, 1000)
+			for {
+				n, err := st.Read(buf)
+				if err != nil {
+					return
+				}
+				st.Write(buf[:n])
+			}
+		}()
+
+		wg.Add(1)
+		go func(end *session) {
+			defer wg.Done()
+
+			st, err := end.streams.Open(context.Background())
+			if err != nil {
+				t.Errorf("Can't open stream: %v", err)
+				return
+			}
+
+			go func() {
+				st.Write(payload)
+			}()
+
+			got := make([]byte, len(payload))
+			st.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if _, err := io.ReadFull(st, got); err != nil {
+				t.Errorf("Reading the echo failed: %v", err)
+			} else if !bytes.Equal(got, payload) {
+				t.Error("Echo differs from what was sent")
+			}
+
+			st.Close()
+		}(end)
+	}
+
+	wg.Wait()
+
+	server, client = newTestEnds(testOptions{quiet: true})
+	defer server.close()
+
+	if _, err := client.s.streams.Open(context.Background()); err == nil || err.Error() != ErrStreamsDisabled.Error() {
+		t.Errorf("Got %v opening a stream the peer doesn't accept, want %v", err, ErrStreamsDisabled)
+	}
+}
@@ -0,0 +1,110 @@
+package socket
+
+import (
+	"cisco.com/comm/common"
+	"io"
+	"time"
+)
+
+// How much of each payload a tap gets to see
+const tapPayloadLen = 4096
+
+// Frames shown to the taps of a pipe
+type taps struct {
+	last int
+	fns  map[int]func(common.Frame)
+}
+
+func (s *pipe) Tap(fn func(common.Frame)) func() {
+	s.mtaps.Lock()
+	defer s.mtaps.Unlock()
+
+	if s.taps.fns == nil {
+		s.taps.fns = make(map[int]func(common.Frame))
+	}
+	s.taps.last++
+	id := s.taps.last
+	s.taps.fns[id] = fn
+
+	return func() {
+		s.mtaps.Lock()
+		delete(s.taps.fns, id)
+		s.mtaps.Unlock()
+	}
+}
+
+// The taps to show a frame to, nil if there are none
+func (s *pipe) tapped() []func(common.Frame) {
+	s.mtaps.Lock()
+	defer s.mtaps.Unlock()
+
+	if len(s.taps.fns) == 0 {
+		return nil
+	}
+
+	fns := make([]func(common.Frame), 0, len(s.taps.fns))
+	for _, fn := range s.taps.fns {
+		fns = append(fns, fn)
+	}
+	return fns
+}
+
+// A frame on its way past the taps. The start of the payload is collected as
+// it's read or written, and the frame is shown once that's over.
+type tappedFrame struct {
+	frame common.Frame
+	fns   []func(common.Frame)
+	done  bool
+}
+
+func newTappedFrame(fns []func(common.Frame), direction string, h Header) *tappedFrame {
+	if fns == nil {
+		return nil
+	}
+
+	return &tappedFrame{fns: fns, frame: common.Frame{
+		Time:      time.Now(),
+		Direction: direction,
+		Type:      h.Type,
+		Flags:     h.Flags,
+		Seq:       h.Seq,
+		Length:    h.Length,
+		Timeout:   h.Timeout,
+	}}
+}
+
+func (t *tappedFrame) collect(p []byte) {
+	if t == nil {
+		return
+	}
+
+	if room := tapPayloadLen - len(t.frame.Payload); room > 0 {
+		if len(p) > room {
+			p = p[:room]
+		}
+		t.frame.Payload = append(t.frame.Payload, p...)
+	}
+}
+
+func (t *tappedFrame) show() {
+	if t == nil || t.done {
+		return
+	}
+
+	t.done = true
+	for _, fn := range t.fns {
+		fn(t.frame)
+	}
+}
+
+// Collects what's read through it into a tapped frame
+type tapReader struct {
+	r     io.Reader
+	frame *tappedFrame
+}
+
+func (r *tapReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.frame.collect(p[:n])
+	return n, err
+}
@@ -0,0 +1,57 @@
+package socket
+
+import (
+	"cisco.com/comm/common"
+	"cisco.com/comm/tracing"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Describe a proxied request on span
+func setHTTPAttributes(span *tracing.Span, wan common.Connection, method, host, requestURI string) {
+	span.SetAttribute("comm.connection", wan.Id)
+	span.SetAttribute("comm.peer", wan.Peer)
+	span.SetAttribute("http.request.method", method)
+	span.SetAttribute("http.host", host)
+	span.SetAttribute("url.path", requestPath(requestURI))
+}
+
+// The status code in an HTTP status line, zero if there is none
+func statusCode(line string) int {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 {
+		return 0
+	}
+	code, _ := strconv.Atoi(parts[1])
+	return code
+}
+
+// A payload being received under span, which ends once all N bytes have been
+// read or reading fails
+type tracedReader struct {
+	R    io.Reader
+	N    int64
+	span *tracing.Span
+
+	read int64
+	done bool
+}
+
+func (r *tracedReader) Read(p []byte) (int, error) {
+	n, err := r.R.Read(p)
+	r.read += int64(n)
+
+	if r.done {
+		return n, err
+	}
+
+	if err != nil && err != io.EOF {
+		r.span.SetError(err)
+	}
+	if err != nil || r.read >= r.N {
+		r.done = true
+		r.span.Finish()
+	}
+	return n, err
+}
@@ -0,0 +1,43 @@
+package socket
+
+import (
+	"cisco.com/comm/common"
+	"cisco.com/comm/tracing"
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestTracePropagation(t *testing.T) {
+	// Spans are made, though none is sampled and exported
+	if err := tracing.Setup(tracing.Options{Exporter: tracing.Stdout, SampleRatio: 0}); err != nil {
+		t.Fatal(err)
+	}
+	defer tracing.Shutdown()
+
+	server, client := newTestEnds(testOptions{quiet: true, pipe: func(p Pipe) { p.SetTracing(true) }})
+	defer server.close()
+
+	parent := tracing.SpanContext{TraceID: tracing.TraceID{1}, SpanID: tracing.SpanID{2}}
+	ctx := tracing.ContextWithRemote(context.Background(), parent)
+
+	res := make(chan common.IngressMessage, 1)
+	client.conn.Send(common.EgressMessage{N: 4, R: strings.NewReader("ping"), ResponseChan: res, Ctx: ctx})
+
+	in := <-server.conn.In
+	ioutil.ReadAll(in.R)
+
+	got := tracing.FromContext(in.Ctx)
+	if got.TraceID != parent.TraceID {
+		t.Errorf("request arrived in trace %s, want %s", got.TraceID, parent.TraceID)
+	}
+	if got.SpanID == parent.SpanID || !got.IsValid() {
+		t.Errorf("request arrived with span %s, want a span of its own", got.SpanID)
+	}
+
+	server.conn.Send(common.EgressMessage{Seq: in.Seq, N: 4, R: strings.NewReader("pong")})
+	if out := <-res; out.Err != nil {
+		t.Fatal(out.Err)
+	}
+}
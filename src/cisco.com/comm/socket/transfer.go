@@ -0,0 +1,874 @@
+package socket
+
+import (
+	"cisco.com/comm/common"
+	"cisco.com/comm/log"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Fragmented transfers. A payload too big to send in one message, or to start
+// over whenever the WAN blips, is spooled to disk and sent as a series of
+// chunks the receiver acknowledges as it writes them to disk:
+//
+//	sender                                  receiver
+//	TRANSFER_OPEN {id, size}           ->
+//	                                   <-   TRANSFER_ACK {id, offset}
+//	TRANSFER_CHUNK id|offset|data      ->
+//	                                   <-   TRANSFER_ACK {id, offset}
+//	...
+//	TRANSFER_COMMIT id (a request)     ->   the reassembled payload is served
+//	                                   <-   like any other request
+//
+// The receiver answers TRANSFER_OPEN with how much of the transfer it already
+// has. A transfer belongs to the peer's name (see Hello) rather than to a
+// connection, so when the connection drops the sender waits for the peer to
+// come back and carries on from the last acknowledged offset. Since anyone can
+// claim a name, the name is bound to the identity the peer authenticated with
+// (see Connection.Identity) for as long as it has a connection or transfers.
+
+// Length of a transfer ID in bytes. IDs are written in hex everywhere but in
+// the chunk prefix.
+const TRANSFER_ID_LEN = 16
+
+// Length of the prefix of a TRANSFER_CHUNK payload: transfer ID and offset
+const CHUNK_PREFIX_LEN = TRANSFER_ID_LEN + 8
+
+// How much the sender may get ahead of the receiver's acknowledgements, in
+// chunks
+const transferWindow = 4
+
+// Give up on a connection if the receiver doesn't acknowledge anything for
+// this long. The transfer resumes once the peer reconnects.
+const transferAckTimeout = time.Minute
+
+// Partially received transfers nobody resumed for this long are deleted
+const transferTTL = 24 * time.Hour
+
+var (
+	ErrTransfersDisabled   = errors.New("ERR_TRANSFERS_DISABLED")
+	ErrTransferUnknown     = errors.New("ERR_TRANSFER_UNKNOWN")
+	ErrTransferIncomplete  = errors.New("ERR_TRANSFER_INCOMPLETE")
+	ErrTransferCommitted   = errors.New("ERR_TRANSFER_COMMITTED")
+	ErrTransferNoPeer      = errors.New("ERR_TRANSFER_PEER_UNNAMED")
+	ErrTransferStalled     = errors.New("ERR_TRANSFER_STALLED")
+	ErrTransferLimit       = errors.New("ERR_TRANSFER_LIMIT_TOO_SMALL")
+	ErrTransferTooLarge    = errors.New("ERR_TRANSFER_TOO_LARGE")
+	ErrTransferPeerClaimed = errors.New("ERR_TRANSFER_PEER_CLAIMED")
+	errTransferMalformedID = errors.New("ERR_TRANSFER_MALFORMED_ID")
+)
+
+type transferOpen struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
+}
+
+// Acknowledges everything up to Offset. Sent with the Seq of a commit it
+// reports why the commit failed instead.
+type transferAck struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Error  string `json:"error,omitempty"`
+}
+
+type TransferOptions struct {
+
+	// Where outgoing transfers are spooled and incoming ones assembled
+	Dir string
+
+	// Payload bytes per chunk. Lowered to fit the peer's message size limit.
+	ChunkSize int64
+
+	// Largest transfer accepted from the peer, in bytes. Zero means no
+	// limit. Transfers aren't subject to the message size limits.
+	MaxSize int64
+}
+
+// Sends and receives fragmented transfers for every connection of a client
+// or server.
+type Transfers struct {
+	opts TransferOptions
+
+	m        sync.Mutex
+	outgoing map[string]*outgoingTransfer
+	incoming map[string]*incomingTransfer
+
+	// Connected peers by name
+	peers map[string]*session
+
+	// The identity each peer name was last attached with
+	owners map[string]string
+
+	// Closed and replaced whenever a peer connects
+	connected chan struct{}
+}
+
+type outgoingTransfer struct {
+	status common.TransferStatus
+	path   string
+
+	// Set once the receiver acknowledged our TRANSFER_OPEN on the current
+	// connection
+	opened bool
+
+	// Error the receiver reported, if any
+	ackErr error
+
+	// Poked whenever an acknowledgement arrives
+	acked chan struct{}
+
+	// Acknowledgements received so far, to tell one that didn't move the
+	// offset from none at all
+	acks uint64
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type incomingTransfer struct {
+	size int64
+	path string
+
+	// Who opened it. Only they may send its chunks and commit it.
+	peer     string
+	identity string
+}
+
+// Set up the spool directory. Outgoing transfers left behind by a previous
+// run are removed since nothing knows about them anymore; incoming ones are
+// kept for their senders to resume unless they expired.
+func NewTransfers(opts TransferOptions) (*Transfers, error) {
+	for _, dir := range []string{"out", "in"} {
+		if err := os.MkdirAll(filepath.Join(opts.Dir, dir), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	old, _ := filepath.Glob(filepath.Join(opts.Dir, "out", "*"))
+	for _, path := range old {
+		os.Remove(path)
+	}
+
+	old, _ = filepath.Glob(filepath.Join(opts.Dir, "in", "*"))
+	for _, path := range old {
+		if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) > transferTTL {
+			log.I("Removing expired transfer %s", path)
+			os.Remove(path)
+		}
+	}
+
+	return &Transfers{
+		opts:      opts,
+		outgoing:  make(map[string]*outgoingTransfer),
+		incoming:  make(map[string]*incomingTransfer),
+		peers:     make(map[string]*session),
+		owners:    make(map[string]string),
+		connected: make(chan struct{})}, nil
+}
+
+// Make s the session transfers to its peer go over. A peer that authenticated
+// differently than the one holding the name can't take it over.
+func (t *Transfers) attach(s *session) error {
+	if s.conn.Peer == "" {
+		return nil
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if owner, ok := t.owners[s.conn.Peer]; ok && owner != s.conn.Identity() && t.claimed(s.conn.Peer) {
+		return ErrTransferPeerClaimed
+	}
+
+	t.owners[s.conn.Peer] = s.conn.Identity()
+	t.peers[s.conn.Peer] = s
+	close(t.connected)
+	t.connected = make(chan struct{})
+	return nil
+}
+
+// Whether peer is connected or has transfers under way. Called with t.m
+// held.
+func (t *Transfers) claimed(peer string) bool {
+	if s := t.peers[peer]; s != nil {
+		select {
+		case <-s.conn.Done():
+		default:
+			return true
+		}
+	}
+
+	for _, ot := range t.outgoing {
+		if ot.status.Peer == peer && ot.status.State != common.TransferDone &&
+			ot.status.State != common.TransferFailed && ot.status.State != common.TransferCancelled {
+			return true
+		}
+	}
+
+	for _, in := range t.incoming {
+		if in.peer == peer {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *Transfers) detach(s *session) {
+	t.m.Lock()
+	if t.peers[s.conn.Peer] == s {
+		delete(t.peers, s.conn.Peer)
+	}
+	t.m.Unlock()
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// Sending
+//////////////////////////////////////////////////////////////////////////////////
+
+// Spool size bytes from r and start sending them to peer. Returns as soon as
+// the payload is on disk; the transfer goes on in the background.
+func (t *Transfers) Start(peer string, size int64, r io.Reader) (common.TransferStatus, error) {
+	if peer == "" {
+		return common.TransferStatus{}, ErrTransferNoPeer
+	}
+
+	id := newTransferID()
+	path := filepath.Join(t.opts.Dir, "out", id)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return common.TransferStatus{}, err
+	}
+
+	n, err := io.Copy(f, io.LimitReader(r, size))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		os.Remove(path)
+		return common.TransferStatus{}, err
+	}
+
+	now := time.Now()
+	ot := &outgoingTransfer{
+		status: common.TransferStatus{
+			ID:      id,
+			Peer:    peer,
+			Size:    size,
+			State:   common.TransferWaiting,
+			Started: now,
+			Updated: now,
+		},
+		path:  path,
+		acked: make(chan struct{}, 1),
+	}
+	ot.ctx, ot.cancel = context.WithCancel(context.Background())
+
+	t.m.Lock()
+	t.outgoing[id] = ot
+	t.m.Unlock()
+
+	status := ot.status
+	log.I("Spooled transfer %s of %d bytes for %s", id, size, peer)
+	go t.run(ot)
+	return status, nil
+}
+
+// Every transfer we're sending or have sent since we started
+func (t *Transfers) List() []common.TransferStatus {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	res := make([]common.TransferStatus, 0, len(t.outgoing))
+	for _, ot := range t.outgoing {
+		res = append(res, ot.status)
+	}
+
+	return res
+}
+
+func (t *Transfers) Get(id string) (common.TransferStatus, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	ot, ok := t.outgoing[id]
+	if !ok {
+		return common.TransferStatus{}, false
+	}
+
+	return ot.status, true
+}
+
+// The peer's response to a transfer that is done
+func (t *Transfers) Response(id string) (io.ReadCloser, error) {
+	status, ok := t.Get(id)
+	if !ok {
+		return nil, ErrTransferUnknown
+	}
+
+	if status.State != common.TransferDone {
+		return nil, ErrTransferIncomplete
+	}
+
+	return os.Open(filepath.Join(t.opts.Dir, "out", id+".response"))
+}
+
+// Stop sending a transfer, or forget a finished one, and delete its files
+func (t *Transfers) Cancel(id string) error {
+	t.m.Lock()
+	ot, ok := t.outgoing[id]
+	delete(t.outgoing, id)
+	t.m.Unlock()
+
+	if !ok {
+		return ErrTransferUnknown
+	}
+
+	ot.cancel()
+	t.update(ot, func(st *common.TransferStatus) {
+		if st.State != common.TransferDone && st.State != common.TransferFailed {
+			st.State = common.TransferCancelled
+		}
+	})
+
+	os.Remove(ot.path)
+	os.Remove(ot.path + ".response")
+	return nil
+}
+
+func (t *Transfers) update(ot *outgoingTransfer, f func(*common.TransferStatus)) {
+	t.m.Lock()
+	f(&ot.status)
+	ot.status.Updated = time.Now()
+	t.m.Unlock()
+}
+
+func (t *Transfers) fail(ot *outgoingTransfer, err error) {
+	log.E("Transfer %s failed: %v", ot.status.ID, err)
+	t.update(ot, func(st *common.TransferStatus) {
+		st.State = common.TransferFailed
+		st.Error = err.Error()
+	})
+	os.Remove(ot.path)
+}
+
+// Send the transfer over whatever connection its peer has, waiting for the
+// peer to reconnect whenever the connection goes away.
+func (t *Transfers) run(ot *outgoingTransfer) {
+	for {
+		s := t.waitPeer(ot)
+		if s == nil {
+			return
+		}
+
+		err := t.send(ot, s)
+
+		switch {
+		case err == nil:
+			return
+		case ot.ctx.Err() != nil:
+			log.I("Transfer %s cancelled", ot.status.ID)
+			return
+		case err == ErrTransferCommitted || err == ErrTransfersDisabled ||
+			err == ErrTransferUnknown || err == ErrTransferIncomplete || err == ErrTransferTooLarge:
+			// The receiver won't ever take it
+			t.fail(ot, err)
+			return
+		}
+
+		log.W("Transfer %s interrupted, waiting for %s to reconnect: %v", ot.status.ID, ot.status.Peer, err)
+		t.update(ot, func(st *common.TransferStatus) {
+			st.State = common.TransferWaiting
+			st.Error = err.Error()
+		})
+
+		// Don't spin if the peer is connected but keeps failing us
+		select {
+		case <-time.After(time.Second):
+		case <-ot.ctx.Done():
+			return
+		}
+	}
+}
+
+// The session of the transfer's peer, once it has one. Nil if the transfer
+// was cancelled first.
+func (t *Transfers) waitPeer(ot *outgoingTransfer) *session {
+	for {
+		t.m.Lock()
+		s := t.peers[ot.status.Peer]
+		connected := t.connected
+		t.m.Unlock()
+
+		if s != nil {
+			select {
+			case <-s.conn.Done():
+			default:
+				return s
+			}
+		}
+
+		select {
+		case <-connected:
+		case <-time.After(time.Second):
+		case <-ot.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Send the rest of the transfer over s and commit it. Returns nil once the
+// transfer is done (or failed for good).
+func (t *Transfers) send(ot *outgoingTransfer, s *session) error {
+	id := ot.status.ID
+	size := ot.status.Size
+
+	t.m.Lock()
+	ot.opened = false
+	ot.ackErr = nil
+	t.m.Unlock()
+
+	open, _ := json.Marshal(transferOpen{ID: id, Size: size})
+	if err := s.sendControl(controlMessage{t: MSG_TYPE_TRANSFER_OPEN, payload: open}); err != nil {
+		return err
+	}
+
+	acked, err := t.waitAck(ot, s, func() bool { return ot.opened })
+	if err != nil {
+		return err
+	}
+
+	log.I("Transfer %s: %s has %d of %d bytes", id, ot.status.Peer, acked, size)
+	t.update(ot, func(st *common.TransferStatus) {
+		st.State = common.TransferSending
+		st.Error = ""
+	})
+
+	f, err := os.Open(ot.path)
+	if err != nil {
+		t.fail(ot, err)
+		return nil
+	}
+	defer f.Close()
+
+	chunk := t.opts.ChunkSize
+	if _, max := s.conn.Limits(); max > 0 && chunk > max-CHUNK_PREFIX_LEN {
+		chunk = max - CHUNK_PREFIX_LEN
+	}
+
+	// The peer's limit leaves no room for data
+	if chunk <= 0 {
+		t.fail(ot, ErrTransferLimit)
+		return nil
+	}
+
+	rawID, _ := hex.DecodeString(id)
+	sent := acked
+
+	for acked < size {
+		t.m.Lock()
+		acks, last := ot.acks, ot.status.Acked
+		t.m.Unlock()
+
+		for sent < size && sent-acked < transferWindow*chunk {
+			n := Min(chunk, size-sent)
+			buf := make([]byte, CHUNK_PREFIX_LEN+n)
+			copy(buf, rawID)
+			binary.BigEndian.PutUint64(buf[TRANSFER_ID_LEN:], uint64(sent))
+
+			if _, err := f.ReadAt(buf[CHUNK_PREFIX_LEN:], sent); err != nil {
+				t.fail(ot, err)
+				return nil
+			}
+
+			if err := s.sendControl(controlMessage{t: MSG_TYPE_TRANSFER_CHUNK, payload: buf}); err != nil {
+				return err
+			}
+
+			sent += n
+		}
+
+		if acked, err = t.waitAck(ot, s, func() bool { return ot.acks > acks }); err != nil {
+			return err
+		}
+
+		// An acknowledgement that doesn't move the offset means the
+		// receiver ignored a chunk past a gap; resend from where it is
+		// rather than wait for the rest of the window to time out
+		if acked <= last && acked < sent {
+			sent = acked
+		}
+	}
+
+	t.update(ot, func(st *common.TransferStatus) { st.State = common.TransferCommitting })
+
+	res := s.request(ot.ctx, MSG_TYPE_TRANSFER_COMMIT, rawID)
+
+	switch {
+	case res.Err == common.ErrClosed || ot.ctx.Err() != nil:
+		return res.Err
+	case res.Err != nil:
+		// The receiver refused the commit
+		t.fail(ot, res.Err)
+		return nil
+	}
+
+	// Keep the response around for GET /transfers/{id}/response
+	out, err := os.Create(ot.path + ".response")
+	if err == nil {
+		_, err = io.Copy(out, res.R)
+		out.Close()
+	}
+	io.Copy(ioutil.Discard, res.R)
+
+	if err != nil {
+		t.fail(ot, err)
+		return nil
+	}
+
+	log.I("Transfer %s of %d bytes to %s done", id, size, ot.status.Peer)
+	t.update(ot, func(st *common.TransferStatus) { st.State = common.TransferDone })
+	os.Remove(ot.path)
+	return nil
+}
+
+// Wait for acknowledgements until done says so. Returns the acknowledged
+// offset.
+func (t *Transfers) waitAck(ot *outgoingTransfer, s *session, done func() bool) (int64, error) {
+	for {
+		t.m.Lock()
+		ok, acked, err := done(), ot.status.Acked, ot.ackErr
+		t.m.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+
+		if ok {
+			return acked, nil
+		}
+
+		select {
+		case <-ot.acked:
+		case <-s.conn.Done():
+			return 0, common.ErrClosed
+		case <-ot.ctx.Done():
+			return 0, ot.ctx.Err()
+		case <-time.After(transferAckTimeout):
+			return 0, ErrTransferStalled
+		}
+	}
+}
+
+func (t *Transfers) onAck(ack transferAck) {
+	t.m.Lock()
+	ot, ok := t.outgoing[ack.ID]
+	if ok {
+		if ack.Error != "" {
+			ot.ackErr = transferError(ack.Error)
+		} else {
+			ot.opened = true
+			ot.acks++
+			ot.status.Acked = ack.Offset
+			ot.status.Updated = time.Now()
+		}
+	}
+	t.m.Unlock()
+
+	if !ok {
+		log.D("Acknowledgement for unknown transfer %s", ack.ID)
+		return
+	}
+
+	select {
+	case ot.acked <- struct{}{}:
+	default:
+	}
+}
+
+// Turn an error reported by the receiver back into one of ours so run() can
+// tell the permanent ones apart
+func transferError(msg string) error {
+	for _, err := range []error{ErrTransfersDisabled, ErrTransferUnknown, ErrTransferIncomplete, ErrTransferCommitted, ErrTransferTooLarge} {
+		if err.Error() == msg {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+// Receiving
+//////////////////////////////////////////////////////////////////////////////////
+
+// Handle a transfer message read off s. t may be nil if transfers are
+// disabled, in which case the sender is told so.
+func (t *Transfers) handle(s *session, r *payloadReader) {
+	var err error
+
+	switch r.header.Type {
+	case MSG_TYPE_TRANSFER_OPEN:
+		err = t.onOpen(s, r)
+	case MSG_TYPE_TRANSFER_CHUNK:
+		err = t.onChunk(s, r)
+	case MSG_TYPE_TRANSFER_COMMIT:
+		err = t.onCommit(s, r)
+		if err != nil {
+			// A commit is a request, and requests get exactly one response
+			log.W("Refusing to commit transfer: %v", err)
+			payload, _ := json.Marshal(transferAck{Error: err.Error()})
+			s.sendControl(controlMessage{t: MSG_TYPE_TRANSFER_ACK, flags: FLAG_RESPONSE, seq: r.header.Seq, payload: payload})
+			err = nil
+		}
+	case MSG_TYPE_TRANSFER_ACK:
+		err = t.onAckMessage(s, r)
+	}
+
+	if !r.closed {
+		io.Copy(ioutil.Discard, r)
+	}
+
+	if err != nil {
+		log.W("Transfer message %v failed: %v", r.header, err)
+	}
+}
+
+func (t *Transfers) ack(s *session, ack transferAck) error {
+	payload, _ := json.Marshal(ack)
+	return s.sendControl(controlMessage{t: MSG_TYPE_TRANSFER_ACK, payload: payload})
+}
+
+func (t *Transfers) onAckMessage(s *session, r *payloadReader) error {
+	var ack transferAck
+	if err := json.NewDecoder(io.LimitReader(r, maxHelloLen)).Decode(&ack); err != nil {
+		return err
+	}
+
+	// The answer to a commit we sent
+	if r.header.Flags&FLAG_RESPONSE != 0 {
+		if !s.ours(r.header.Seq) {
+			return ErrMisdirected
+		}
+		s.finish(r.header.Seq, common.IngressMessage{Seq: r.header.Seq, Err: transferError(ack.Error)})
+		return nil
+	}
+
+	if t != nil {
+		t.onAck(ack)
+	}
+	return nil
+}
+
+// Where an incoming transfer is assembled, and the marker left behind once it
+// was committed
+func (t *Transfers) incomingPath(id string) (part, committed string, err error) {
+	if b, err := hex.DecodeString(id); err != nil || len(b) != TRANSFER_ID_LEN {
+		return "", "", errTransferMalformedID
+	}
+
+	base := filepath.Join(t.opts.Dir, "in", id)
+	return base + ".part", base + ".committed", nil
+}
+
+func (t *Transfers) onOpen(s *session, r *payloadReader) error {
+	var open transferOpen
+	if err := json.NewDecoder(io.LimitReader(r, maxHelloLen)).Decode(&open); err != nil {
+		return err
+	}
+
+	if t == nil {
+		return t.ack(s, transferAck{ID: open.ID, Error: ErrTransfersDisabled.Error()})
+	}
+
+	// Transfers are spooled to disk, out of reach of the message size limits
+	if open.Size < 0 || (t.opts.MaxSize > 0 && open.Size > t.opts.MaxSize) {
+		log.W("Refusing transfer %s of %d bytes from %s", open.ID, open.Size, s.conn.Peer)
+		return t.ack(s, transferAck{ID: open.ID, Error: ErrTransferTooLarge.Error()})
+	}
+
+	part, committed, err := t.incomingPath(open.ID)
+	if err != nil {
+		return t.ack(s, transferAck{ID: open.ID, Error: err.Error()})
+	}
+
+	t.m.Lock()
+	in, ok := t.incoming[open.ID]
+	t.m.Unlock()
+	if ok && !in.openedBy(s) {
+		return t.ack(s, transferAck{ID: open.ID, Error: ErrTransferUnknown.Error()})
+	}
+
+	if _, err := os.Stat(committed); err == nil {
+		return t.ack(s, transferAck{ID: open.ID, Error: ErrTransferCommitted.Error()})
+	}
+
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err == nil && offset > open.Size {
+		log.W("Transfer %s has more bytes on disk than announced, starting over", open.ID)
+		offset, err = 0, f.Truncate(0)
+	}
+	f.Close()
+
+	if err != nil {
+		return err
+	}
+
+	t.m.Lock()
+	t.incoming[open.ID] = &incomingTransfer{size: open.Size, path: part, peer: s.conn.Peer, identity: s.conn.Identity()}
+	t.m.Unlock()
+
+	log.I("Receiving transfer %s of %d bytes from %s, resuming at %d", open.ID, open.Size, s.conn.Peer, offset)
+	return t.ack(s, transferAck{ID: open.ID, Offset: offset})
+}
+
+func (t *Transfers) onChunk(s *session, r *payloadReader) error {
+	prefix := make([]byte, CHUNK_PREFIX_LEN)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return err
+	}
+
+	id := hex.EncodeToString(prefix[:TRANSFER_ID_LEN])
+	offset := int64(binary.BigEndian.Uint64(prefix[TRANSFER_ID_LEN:]))
+
+	if t == nil {
+		return ErrTransfersDisabled
+	}
+
+	t.m.Lock()
+	in, ok := t.incoming[id]
+	t.m.Unlock()
+
+	if !ok || !in.openedBy(s) {
+		return t.ack(s, transferAck{ID: id, Error: ErrTransferUnknown.Error()})
+	}
+
+	f, err := os.OpenFile(in.path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	// A chunk we already have, or one past a gap. Either way the sender
+	// learns where we really are from the acknowledgement.
+	if offset != end {
+		log.D("Transfer %s: ignoring chunk at %d, have %d bytes", id, offset, end)
+		return t.ack(s, transferAck{ID: id, Offset: end})
+	}
+
+	n, err := io.Copy(f, io.LimitReader(r, in.size-end))
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return t.ack(s, transferAck{ID: id, Offset: end + n})
+}
+
+// Serve a completely received transfer as a regular request
+func (t *Transfers) onCommit(s *session, r *payloadReader) error {
+	rawID, err := ioutil.ReadAll(io.LimitReader(r, TRANSFER_ID_LEN))
+	if err != nil {
+		return err
+	}
+
+	if t == nil {
+		return ErrTransfersDisabled
+	}
+
+	id := hex.EncodeToString(rawID)
+
+	t.m.Lock()
+	in, ok := t.incoming[id]
+	if ok && in.openedBy(s) {
+		delete(t.incoming, id)
+	}
+	t.m.Unlock()
+
+	if !ok || !in.openedBy(s) {
+		return ErrTransferUnknown
+	}
+
+	part, committed, err := t.incomingPath(id)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(part)
+	if err != nil {
+		log.E("Can't open transfer %s: %v", id, err)
+		return ErrTransferIncomplete
+	}
+
+	if fi, err := f.Stat(); err != nil || fi.Size() != in.size {
+		f.Close()
+		return ErrTransferIncomplete
+	}
+
+	// Remember the commit, so a sender that missed our response doesn't
+	// deliver the transfer twice
+	if err := ioutil.WriteFile(committed, nil, 0600); err != nil {
+		f.Close()
+		return err
+	}
+
+	log.I("Transfer %s of %d bytes from %s complete", id, in.size, s.conn.Peer)
+
+	s.serve(common.IngressMessage{
+		Seq:    r.header.Seq,
+		N:      in.size,
+		R:      &closingReader{R: f, C: removingCloser{f}},
+		Binary: true,
+	}, r.header.Timeout)
+
+	return nil
+}
+
+// Whether s is from the peer that opened the transfer
+func (in *incomingTransfer) openedBy(s *session) bool {
+	return in.peer == s.conn.Peer && in.identity == s.conn.Identity()
+}
+
+// Closes a file and deletes it
+type removingCloser struct {
+	f *os.File
+}
+
+func (c removingCloser) Close() error {
+	c.f.Close()
+	return os.Remove(c.f.Name())
+}
+
+func newTransferID() string {
+	b := make([]byte, TRANSFER_ID_LEN)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,219 @@
+package socket
+
+import (
+	"bytes"
+	"cisco.com/comm/common"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The offset of a chunk the receiver got
+func chunkOffset(f common.Frame) (int64, bool) {
+	if f.Direction != common.FrameIn || f.Type != MSG_TYPE_TRANSFER_CHUNK || len(f.Payload) < CHUNK_PREFIX_LEN {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(f.Payload[TRANSFER_ID_LEN:])), true
+}
+
+func TestTransferResume(t *testing.T) {
+	sender, err := NewTransfers(TransferOptions{Dir: t.TempDir(), ChunkSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := NewTransfers(TransferOptions{Dir: t.TempDir(), ChunkSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := make([]byte, 64*1024)
+	for i := range payload {
+		payload[i] = byte(i * 7)
+	}
+
+	// Drop the connection once a quarter of the payload went through
+	ends := testOptions{transfers: [2]*Transfers{receiver, sender}}
+	server, _ := newTestEnds(ends)
+	var once sync.Once
+	server.wan.Tap(func(f common.Frame) {
+		if offset, ok := chunkOffset(f); ok && offset >= int64(len(payload)/4) {
+			once.Do(func() { go server.close() })
+		}
+	})
+
+	status, err := sender.Start("server", int64(len(payload)), bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-server.gone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The connection wasn't dropped")
+	}
+
+	part, _, _ := receiver.incomingPath(status.ID)
+	fi, err := os.Stat(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := fi.Size()
+	if have < int64(len(payload)/4) || have >= int64(len(payload)) {
+		t.Fatalf("The receiver has %d of %d bytes after the drop", have, len(payload))
+	}
+
+	// The transfer picks up where the receiver left off
+	server, _ = newTestEnds(ends)
+	defer server.close()
+
+	first := make(chan int64, 1)
+	server.wan.Tap(func(f common.Frame) {
+		if offset, ok := chunkOffset(f); ok {
+			select {
+			case first <- offset:
+			default:
+			}
+		}
+	})
+
+	if status = waitTransfer(t, sender, status.ID); status.State != common.TransferDone {
+		t.Fatalf("Transfer ended up %s: %s", status.State, status.Error)
+	}
+
+	if offset := <-first; offset != have {
+		t.Errorf("Resumed at %d, want %d", offset, have)
+	}
+
+	r, err := sender.Response(status.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// The test ends answer with their name and what they got
+	res, _ := ioutil.ReadAll(r)
+	if want := "server:" + string(payload); string(res) != want {
+		t.Errorf("Committed payload differs: got %d bytes, want %d", len(res), len(want))
+	}
+}
+
+// Wait for the transfer to be done or failed
+func waitTransfer(t *testing.T, sender *Transfers, id string) common.TransferStatus {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status, _ := sender.Get(id)
+		if status.State == common.TransferDone || status.State == common.TransferFailed {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Transfer still %s", status.State)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransferTooLarge(t *testing.T) {
+	sender, err := NewTransfers(TransferOptions{Dir: t.TempDir(), ChunkSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := NewTransfers(TransferOptions{Dir: t.TempDir(), ChunkSize: 1024, MaxSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, _ := newTestEnds(testOptions{transfers: [2]*Transfers{receiver, sender}})
+	defer server.close()
+
+	status, err := sender.Start("server", 4097, bytes.NewReader(make([]byte, 4097)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status = waitTransfer(t, sender, status.ID)
+	if status.State != common.TransferFailed || status.Error != ErrTransferTooLarge.Error() {
+		t.Errorf("Transfer over the limit ended up %s: %s", status.State, status.Error)
+	}
+
+	if part, _, _ := receiver.incomingPath(status.ID); fileExists(part) {
+		t.Error("The receiver made room for a transfer over the limit")
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestTransferCommitRefused(t *testing.T) {
+	receiver, err := NewTransfers(TransferOptions{Dir: t.TempDir(), ChunkSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, client := newTestEnds(testOptions{transfers: [2]*Transfers{receiver, nil}})
+	defer server.close()
+
+	// The refusal answers the commit, like any response would; anything else
+	// leaves the request to time out
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res := client.s.request(ctx, MSG_TYPE_TRANSFER_COMMIT, make([]byte, TRANSFER_ID_LEN))
+	if res.Err != ErrTransferUnknown {
+		t.Errorf("Expected the commit of an unknown transfer to fail with %v, got %v", ErrTransferUnknown, res.Err)
+	}
+}
+
+func TestTransferPeerClaimed(t *testing.T) {
+	transfers, err := NewTransfers(TransferOptions{Dir: t.TempDir(), ChunkSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connect := func(identity string) *session {
+		a, _ := net.Pipe()
+		conn := common.NewConnection(1, nil)
+		conn.Peer = "edge"
+		conn.SetIdentity(identity)
+		return newSession(NewServerPipe(a), conn, transfers, nil)
+	}
+
+	first := connect("a")
+	if err := transfers.attach(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else claiming the name gets nothing meant for it
+	if err := transfers.attach(connect("b")); err != ErrTransferPeerClaimed {
+		t.Errorf("Expected %v attaching another identity, got %v", ErrTransferPeerClaimed, err)
+	}
+
+	// The same peer reconnecting takes over
+	second := connect("a")
+	if err := transfers.attach(second); err != nil {
+		t.Errorf("Expected the same identity to reconnect, got %v", err)
+	}
+	first.conn.Close()
+
+	// So long as something is waiting for the peer, the name stays taken
+	status, err := transfers.Start("edge", 3, bytes.NewReader([]byte("abc")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.conn.Close()
+	transfers.detach(second)
+
+	if err := transfers.attach(connect("b")); err != ErrTransferPeerClaimed {
+		t.Errorf("Expected %v while a transfer waits, got %v", ErrTransferPeerClaimed, err)
+	}
+
+	transfers.Cancel(status.ID)
+	if err := transfers.attach(connect("b")); err != nil {
+		t.Errorf("Expected the name to be free once nothing uses it, got %v", err)
+	}
+}
@@ -1,5 +1,12 @@
 package socket
 
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
 func Min(x, y int64) int64 {
 	if x < y {
 		return x
@@ -7,3 +14,53 @@ func Min(x, y int64) int64 {
 		return y
 	}
 }
+
+// An io.Reader that closes EOF once the underlying reader is exhausted
+type eofNotifier struct {
+	R   io.Reader
+	EOF chan struct{}
+	eof bool
+}
+
+func (r *eofNotifier) Read(p []byte) (int, error) {
+	n, err := r.R.Read(p)
+	if err == io.EOF && !r.eof {
+		r.eof = true
+		close(r.EOF)
+	}
+	return n, err
+}
+
+// An io.Reader that closes C once R is exhausted or fails
+type closingReader struct {
+	R io.Reader
+	C io.Closer
+}
+
+func (r *closingReader) Read(p []byte) (int, error) {
+	n, err := r.R.Read(p)
+	if err != nil {
+		r.C.Close()
+	}
+	return n, err
+}
+
+// For when the reader is abandoned before reaching its end
+func (r *closingReader) Close() error {
+	return r.C.Close()
+}
+
+// Build a minimal HTTP response with a plain text body. Returns its length
+// and a reader for it.
+func httpError(status int, msg string) (int64, io.Reader) {
+	body := msg + "\n"
+	res := fmt.Sprintf(
+		"HTTP/1.1 %d %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), len(body), body)
+	return int64(len(res)), strings.NewReader(res)
+}
+
+func writeHTTPError(w io.Writer, status int, msg string) {
+	_, r := httpError(status, msg)
+	io.Copy(w, r)
+}
@@ -0,0 +1,364 @@
+package tracing
+
+import (
+	"bytes"
+	"cisco.com/comm/log"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Exporters
+const (
+	Stdout = "stdout"
+	OTLP   = "otlp"
+)
+
+// Spans sent in one go, at most
+const batchSize = 512
+
+// How long a finished span may wait for its batch to fill up
+const batchDelay = time.Second
+
+// Finished spans waiting to be exported. Beyond that they're dropped.
+const queueLen = 4096
+
+type Options struct {
+
+	// Stdout writes every span as a line of JSON, OTLP posts them to
+	// Endpoint in the OTLP/HTTP JSON encoding
+	Exporter string
+
+	// The collector's traces URL, e.g. http://localhost:4318/v1/traces
+	Endpoint string
+
+	// Reported as service.name
+	ServiceName string
+
+	// The share of new traces that is recorded, from 0 to 1. Traces started
+	// elsewhere follow the sampled flag they come with.
+	SampleRatio float64
+}
+
+type exporter interface {
+	export(spans []*Span) error
+}
+
+type pipeline struct {
+	opts     Options
+	exporter exporter
+	queue    chan *Span
+	flush    chan chan struct{}
+	stopped  chan struct{}
+}
+
+var (
+	m       sync.RWMutex
+	current *pipeline
+)
+
+// Start tracing. Any previous setup is shut down first.
+func Setup(opts Options) error {
+	var e exporter
+	switch opts.Exporter {
+	case Stdout:
+		e = &jsonExporter{w: os.Stdout, service: opts.ServiceName}
+	case OTLP:
+		if opts.Endpoint == "" {
+			return fmt.Errorf("the OTLP exporter needs an endpoint")
+		}
+		e = &otlpExporter{
+			endpoint: opts.Endpoint,
+			service:  opts.ServiceName,
+			client:   &http.Client{Timeout: 10 * time.Second},
+		}
+	default:
+		return fmt.Errorf("unknown exporter %q", opts.Exporter)
+	}
+
+	p := &pipeline{
+		opts:     opts,
+		exporter: e,
+		queue:    make(chan *Span, queueLen),
+		flush:    make(chan chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go p.run()
+
+	Shutdown()
+	m.Lock()
+	current = p
+	m.Unlock()
+	return nil
+}
+
+// Export the spans still waiting and stop tracing
+func Shutdown() {
+	m.Lock()
+	p := current
+	current = nil
+	m.Unlock()
+
+	if p != nil {
+		done := make(chan struct{})
+		p.flush <- done
+		<-done
+		close(p.stopped)
+	}
+}
+
+func enabled() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return current != nil
+}
+
+// Whether to record a new trace, decided by its ID so that it's the same
+// everywhere
+func sample(id TraceID) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	if current == nil {
+		return false
+	}
+
+	ratio := current.opts.SampleRatio
+	if ratio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(id[8:])) < ratio*(1<<64)
+}
+
+func export(s *Span) {
+	m.RLock()
+	p := current
+	m.RUnlock()
+
+	if p == nil {
+		return
+	}
+
+	select {
+	case p.queue <- s:
+	default:
+		log.W("Dropping span %s: the export queue is full", s.Name)
+	}
+}
+
+func (p *pipeline) run() {
+	var batch []*Span
+	tick := time.NewTicker(batchDelay)
+	defer tick.Stop()
+
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := p.exporter.export(batch); err != nil {
+			log.W("Failed to export %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case s := <-p.queue:
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				send()
+			}
+		case <-tick.C:
+			send()
+		case done := <-p.flush:
+			for len(p.queue) > 0 {
+				batch = append(batch, <-p.queue)
+			}
+			send()
+			close(done)
+		case <-p.stopped:
+			return
+		}
+	}
+}
+
+// A span as written by the stdout exporter
+type spanJSON struct {
+	Service    string                 `json:"service,omitempty"`
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	Parent     string                 `json:"parent_span_id,omitempty"`
+	Name       string                 `json:"name"`
+	Kind       int                    `json:"kind"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Duration   float64                `json:"duration_ms"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+}
+
+type jsonExporter struct {
+	w       io.Writer
+	service string
+}
+
+func (e *jsonExporter) export(spans []*Span) error {
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		s.m.Lock()
+		j := spanJSON{
+			Service:    e.service,
+			TraceID:    s.Context.TraceID.String(),
+			SpanID:     s.Context.SpanID.String(),
+			Name:       s.Name,
+			Kind:       s.Kind,
+			Start:      s.Start,
+			End:        s.End,
+			Duration:   float64(s.End.Sub(s.Start)) / float64(time.Millisecond),
+			Attributes: s.Attributes,
+			Error:      s.Error,
+		}
+		if s.Parent != (SpanID{}) {
+			j.Parent = s.Parent.String()
+		}
+		err := enc.Encode(j)
+		s.m.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Posts spans to an OTLP/HTTP collector, JSON encoded
+type otlpExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Flags        uint32          `json:"flags,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+// OTLP status code for a failed span. Others are left unset.
+const otlpStatusError = 2
+
+func otlpAttr(key string, v interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch x := v.(type) {
+	case string:
+		a.Value.StringValue = &x
+	case bool:
+		a.Value.BoolValue = &x
+	case int:
+		s := strconv.FormatInt(int64(x), 10)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		a.Value.IntValue = &s
+	case uint64:
+		s := strconv.FormatUint(x, 10)
+		a.Value.IntValue = &s
+	case float64:
+		a.Value.DoubleValue = &x
+	default:
+		s := fmt.Sprint(x)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+func (e *otlpExporter) export(spans []*Span) error {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.m.Lock()
+		o := otlpSpan{
+			TraceID: s.Context.TraceID.String(),
+			SpanID:  s.Context.SpanID.String(),
+			Flags:   uint32(s.Context.Flags),
+			Name:    s.Name,
+			Kind:    s.Kind,
+			Start:   strconv.FormatInt(s.Start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.Parent != (SpanID{}) {
+			o.ParentSpanID = s.Parent.String()
+		}
+		for k, v := range s.Attributes {
+			o.Attributes = append(o.Attributes, otlpAttr(k, v))
+		}
+		if s.Error != "" {
+			o.Status = otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+		s.m.Unlock()
+		out = append(out, o)
+	}
+
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{otlpAttr("service.name", e.service)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "cisco.com/comm"},
+						"spans": out,
+					},
+				},
+			},
+		},
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector replied %s", res.Status)
+	}
+	return nil
+}
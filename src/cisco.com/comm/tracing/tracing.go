@@ -0,0 +1,249 @@
+// Spans in the style of OpenTelemetry for following a request across hops:
+// from the LAN client, over the tunnel, to the origin and back. Span contexts
+// travel in W3C traceparent headers and in tunnel frame headers.
+//
+// Until Setup is called nothing is traced: Start returns a nil *Span, on which
+// every method does nothing.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// Trace flags
+const FlagSampled = 1
+
+// Where a span sits in its trace, as passed from hop to hop
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+// Length of a SpanContext in binary form: trace ID, span ID and flags
+const BinaryLen = 16 + 8 + 1
+
+var ErrBadTraceparent = errors.New("ERR_BAD_TRACEPARENT")
+
+// Neither ID may be all zeroes
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+func (c SpanContext) Sampled() bool {
+	return c.Flags&FlagSampled != 0
+}
+
+// The traceparent header value, version 00
+func (c SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", c.TraceID, c.SpanID, c.Flags)
+}
+
+// Parse a traceparent header value. Versions after 00 are read as far as 00
+// goes, as the specification asks.
+func ParseTraceparent(s string) (SpanContext, error) {
+	var c SpanContext
+	s = strings.TrimSpace(s)
+
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return c, ErrBadTraceparent
+	}
+
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 || strings.ToLower(s) != s {
+		return c, ErrBadTraceparent
+	}
+
+	var flags [1]byte
+	if _, err := hex.Decode(c.TraceID[:], []byte(parts[1])); err != nil {
+		return c, ErrBadTraceparent
+	}
+	if _, err := hex.Decode(c.SpanID[:], []byte(parts[2])); err != nil {
+		return c, ErrBadTraceparent
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return c, ErrBadTraceparent
+	}
+	c.Flags = flags[0]
+
+	if !c.IsValid() {
+		return c, ErrBadTraceparent
+	}
+	return c, nil
+}
+
+// Append the binary form of c to b
+func (c SpanContext) AppendBinary(b []byte) []byte {
+	b = append(b, c.TraceID[:]...)
+	b = append(b, c.SpanID[:]...)
+	return append(b, c.Flags)
+}
+
+// Read a SpanContext from the first BinaryLen bytes of b
+func FromBinary(b []byte) SpanContext {
+	var c SpanContext
+	copy(c.TraceID[:], b[:16])
+	copy(c.SpanID[:], b[16:24])
+	c.Flags = b[24]
+	return c
+}
+
+// Span kinds, numbered as in OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+	KindProducer = 4
+	KindConsumer = 5
+)
+
+// A timed operation. Safe for concurrent use.
+type Span struct {
+	m sync.Mutex
+
+	Name    string
+	Kind    int
+	Context SpanContext
+	Parent  SpanID
+	Start   time.Time
+	End     time.Time
+
+	Attributes map[string]interface{}
+
+	// Set if the operation failed
+	Error string
+
+	ended bool
+}
+
+// Set an attribute. Values should be strings, numbers or booleans.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.Attributes[key] = value
+}
+
+// Mark the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.Error = err.Error()
+}
+
+// The context to pass on to the next hop. Invalid for a nil span.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.Context
+}
+
+// End the span and hand it to the exporter if it's sampled. Only the first
+// call counts.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+
+	s.m.Lock()
+	if s.ended {
+		s.m.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.m.Unlock()
+
+	if s.Context.Sampled() {
+		export(s)
+	}
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// A context carrying s as the parent of spans started from it
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// A context carrying a span context received from elsewhere as the parent of
+// spans started from it
+func ContextWithRemote(ctx context.Context, c SpanContext) context.Context {
+	if !c.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, c)
+}
+
+// The parent for spans started from ctx: the span in it, or else the remote
+// span context in it. Invalid if there's neither.
+func FromContext(ctx context.Context) SpanContext {
+	if ctx == nil {
+		return SpanContext{}
+	}
+	if s, ok := ctx.Value(spanKey{}).(*Span); ok {
+		return s.Context
+	}
+	c, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return c
+}
+
+// Start a span as a child of the span in ctx, or a new trace if there is none.
+// Returns nil if tracing isn't set up.
+func Start(ctx context.Context, name string, kind int) *Span {
+	return StartWithParent(FromContext(ctx), name, kind)
+}
+
+// Start a span as a child of parent, or a new trace if parent is invalid.
+// Returns nil if tracing isn't set up.
+func StartWithParent(parent SpanContext, name string, kind int) *Span {
+	if !enabled() {
+		return nil
+	}
+
+	s := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]interface{}),
+	}
+
+	if parent.IsValid() {
+		s.Context.TraceID = parent.TraceID
+		s.Context.Flags = parent.Flags
+		s.Parent = parent.SpanID
+	} else {
+		rand.Read(s.Context.TraceID[:])
+		if sample(s.Context.TraceID) {
+			s.Context.Flags = FlagSampled
+		}
+	}
+
+	rand.Read(s.Context.SpanID[:])
+	return s
+}
@@ -0,0 +1,152 @@
+package tunnel
+
+import (
+	"cisco.com/comm/socket"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+)
+
+var (
+	ErrListenerClosed = errors.New("ERR_LISTENER_CLOSED")
+
+	// No session to the peer named in the address passed to DialContext
+	ErrNoSession = errors.New("ERR_NO_SESSION")
+)
+
+// A net.Listener whose connections are the streams peers open, so that an
+// http.Server or a gRPC server can be served through the tunnel:
+//
+//	go http.Serve(sess.Listener(), mux)
+//
+// Closing it stops Accept only, the sessions stay up.
+type Listener struct {
+	accept func(ctx context.Context) (net.Conn, error)
+	addr   net.Addr
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newListener(addr net.Addr, accept func(ctx context.Context) (net.Conn, error)) *Listener {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Listener{accept: accept, addr: addr, ctx: ctx, cancel: cancel}
+}
+
+// Wait for the next stream. Fails once the listener is closed or whatever it
+// listens on ends.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.accept(l.ctx)
+	if err != nil && l.ctx.Err() != nil {
+		return nil, ErrListenerClosed
+	}
+	return c, err
+}
+
+func (l *Listener) Close() error {
+	l.cancel()
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// Listen for the streams the peer opens on this session. They are taken from
+// AcceptStream, so use one or the other.
+func (s *Session) Listener() *Listener {
+	return newListener(socket.StreamAddr{Connection: s.ID(), Peer: s.conn.Peer}, s.AcceptStream)
+}
+
+// Open a stream to the peer, whatever network and address say. Fits
+// http.Transport.DialContext for a client that only talks to this peer.
+func (s *Session) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return s.OpenStream(ctx)
+}
+
+// Listen for the streams peers open on every session, present and future.
+// Once it was called, streams go to the tunnel's listeners instead of
+// Session.AcceptStream, even after they are closed.
+func (t *Tunnel) Listener() *Listener {
+	t.m.Lock()
+	var sessions []*Session
+	if !t.pumping {
+		t.pumping = true
+		sessions = append(sessions, t.sessions...)
+	}
+	addr := t.addr
+	t.m.Unlock()
+
+	for _, sess := range sessions {
+		go t.pump(sess)
+	}
+
+	if addr == nil {
+		addr = socket.StreamAddr{}
+	}
+
+	return newListener(addr, func(ctx context.Context) (net.Conn, error) {
+		select {
+		case c := <-t.incoming:
+			return c, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-t.done:
+			return nil, ErrClosed
+		}
+	})
+}
+
+// Hand the streams opened on sess to the tunnel's listeners
+func (t *Tunnel) pump(sess *Session) {
+	for {
+		st, err := sess.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		select {
+		case t.incoming <- st:
+		case <-sess.Done():
+			st.Close()
+			return
+		case <-t.done:
+			st.Close()
+			return
+		}
+	}
+}
+
+// Open a stream to the peer addr names, so that
+//
+//	client := &http.Client{Transport: &http.Transport{DialContext: t.DialContext}}
+//	client.Get("http://site1/status")
+//
+// reaches whatever serves HTTP on the streams of the peer named site1. The
+// host is a peer name, or a connection ID; the port and network are ignored.
+// If several sessions go to the same peer, the oldest is used.
+func (t *Tunnel) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	sess := t.find(host)
+	if sess == nil {
+		return nil, ErrNoSession
+	}
+	return sess.OpenStream(ctx)
+}
+
+// The session to the peer named host, or with host as its connection ID
+func (t *Tunnel) find(host string) *Session {
+	id, err := strconv.Atoi(host)
+
+	for _, sess := range t.Sessions() {
+		if sess.conn.Peer == host || (err == nil && sess.ID() == id) {
+			return sess
+		}
+	}
+	return nil
+}
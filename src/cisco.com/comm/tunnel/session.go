@@ -0,0 +1,122 @@
+package tunnel
+
+import (
+	"cisco.com/comm/common"
+	"cisco.com/comm/socket"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// The session was served by Options.Handler, or with Options.NoStreams
+var ErrNoStreams = errors.New("ERR_NO_STREAMS")
+
+// A connection to a peer. It is safe for concurrent use.
+type Session struct {
+	pipe socket.Pipe
+	conn common.Connection
+
+	// Closed once streams is set, or it's clear it never will be
+	ready   chan struct{}
+	streams *socket.Streams
+
+	done chan struct{}
+	once sync.Once
+}
+
+func newSession(p socket.Pipe, c common.Connection) *Session {
+	return &Session{pipe: p, conn: c, ready: make(chan struct{}), done: make(chan struct{})}
+}
+
+// The connection ID, as used by the API
+func (s *Session) ID() int {
+	return s.conn.Id
+}
+
+// The peer's name, labels and details, and the connection's traffic
+func (s *Session) Connection() common.Connection {
+	return s.conn
+}
+
+// How often the ends exchange heartbeats, zero if they don't
+func (s *Session) Heartbeat() time.Duration {
+	return s.pipe.Heartbeat()
+}
+
+// Call fn with every frame sent or received from now on, with the start of
+// its payload, until the returned func is called
+func (s *Session) Tap(fn func(common.Frame)) func() {
+	return s.pipe.Tap(fn)
+}
+
+// Send f to the peer as it is, for debugging. See socket.SendFrame.
+func (s *Session) SendFrame(f common.Frame) (uint64, error) {
+	return socket.SendFrame(s.conn, f)
+}
+
+// Wait until the session's streams are set up
+func (s *Session) waitStreams(ctx context.Context) (*socket.Streams, error) {
+	select {
+	case <-s.ready:
+	case <-s.done:
+		return nil, common.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if s.streams == nil {
+		return nil, ErrNoStreams
+	}
+	return s.streams, nil
+}
+
+// Open a stream to the peer. Fails if the peer doesn't accept streams, ctx
+// is done first or the session ends.
+func (s *Session) OpenStream(ctx context.Context) (net.Conn, error) {
+	streams, err := s.waitStreams(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := streams.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Wait for the peer to open a stream. Streams the peer opens while nobody
+// waits here are held, up to a point; beyond that they're refused.
+func (s *Session) AcceptStream(ctx context.Context) (net.Conn, error) {
+	streams, err := s.waitStreams(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := streams.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Close the connection to the peer, and every stream with it
+func (s *Session) Close() error {
+	return s.pipe.Close()
+}
+
+// Closed once the session ended
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Block until the session ends
+func (s *Session) Wait() {
+	<-s.done
+}
+
+func (s *Session) stop() {
+	s.once.Do(func() { close(s.done) })
+}
@@ -0,0 +1,468 @@
+// Package tunnel embeds comm's WAN tunnel in Go programs.
+//
+// A Tunnel listens for peers, dials them or both. Every connection to a peer
+// is a Session, over which either end can open byte streams (net.Conns), on
+// top of the messages and HTTP forwarding the comm binary uses:
+//
+//	t := tunnel.New(tunnel.Options{Key: "secret"})
+//	sess, err := t.Dial(ctx, "hub.example.com:3501")
+//	...
+//	conn, err := sess.OpenStream(ctx)
+//
+// and on the other end
+//
+//	t := tunnel.New(tunnel.Options{Keys: []string{"secret"}})
+//	err := t.Listen(":3501")
+//	sess, err := t.Accept(ctx)
+//	conn, err := sess.AcceptStream(ctx)
+package tunnel
+
+import (
+	"cisco.com/comm/common"
+	"cisco.com/comm/socket"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClosed    = errors.New("ERR_TUNNEL_CLOSED")
+	ErrListening = errors.New("ERR_TUNNEL_LISTENING")
+)
+
+// Sessions from Listen waiting for Accept. Any more are served all the same,
+// they just aren't handed to Accept.
+const acceptBacklog = 64
+
+type Options struct {
+
+	// Listen or dial over TLS instead of plain TCP if set
+	TLS *tls.Config
+
+	// Sent to the server when dialing
+	Key string
+
+	// Accepted from clients when listening. Empty accepts any client.
+	Keys []string
+
+	// Our name, labels and details, sent to peers in the handshake
+	Name   string
+	Labels map[string]string
+	Info   common.PeerInfo
+
+	Compression socket.CompressionOptions
+
+	// Ask for (when dialing) or require (when listening) checksums on every
+	// message
+	Checksums bool
+
+	// How often to exchange heartbeats with peers that do them too, the
+	// shorter interval of the two ends winning. Zero for none.
+	Heartbeat time.Duration
+
+	Limits socket.SizeLimits
+
+	// Give up dialing after this long. Zero means no timeout.
+	DialTimeout time.Duration
+
+	// Forward HTTP between LAN clients and LAN origins like the comm binary
+	// does. Nil leaves sessions to streams and whatever Chain handles:
+	// nothing listens for LAN clients and plain requests from the peer get a
+	// 502.
+	Forwarder *socket.ForwarderOptions
+
+	// Middleware and custom message types. Overrides Forwarder.Chain.
+	Chain *socket.Chain
+
+	// Serves every session instead of the built-in handler, e.g. one from
+	// socket.NewHandler. Sessions served by it have no streams.
+	Handler socket.ConnectionHandler
+
+	// Don't offer streams at all. Peers can't open any, nor can we.
+	NoStreams bool
+
+	// Which peers Listen lets connect
+	Admission socket.AdmissionOptions
+}
+
+// A Tunnel keeps track of the sessions it accepted and dialed. It is safe
+// for concurrent use.
+type Tunnel struct {
+	opts Options
+
+	m        sync.Mutex
+	server   socket.Server
+	addr     net.Addr
+	clients  []socket.Client
+	sessions []*Session
+	closed   bool
+
+	accept chan *Session
+
+	// Streams for the tunnel's listeners, once Listener was called
+	incoming chan net.Conn
+	pumping  bool
+
+	// Closed once the tunnel is closed or stops listening, err says why
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func New(opts Options) *Tunnel {
+	return &Tunnel{
+		opts:     opts,
+		accept:   make(chan *Session, acceptBacklog),
+		incoming: make(chan net.Conn),
+		done:     make(chan struct{})}
+}
+
+// Start listening for peers on addr (host:port). Returns once the listener
+// is up; sessions are then served in the background and handed to Accept. A
+// Tunnel listens on one address at most.
+func (t *Tunnel) Listen(addr string) error {
+	lst, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	t.m.Lock()
+	if t.closed || t.server != nil {
+		err := ErrListening
+		if t.closed {
+			err = ErrClosed
+		}
+		t.m.Unlock()
+		lst.Close()
+		return err
+	}
+
+	t.server = socket.NewServer(0, &handler{t: t, sessions: t.accept}, socket.ServerOptions{
+		TLS:         t.opts.TLS,
+		Keys:        t.opts.Keys,
+		Compression: t.opts.Compression,
+		Checksums:   t.opts.Checksums,
+		Heartbeat:   t.opts.Heartbeat,
+		Limits:      t.opts.Limits,
+		Name:        t.opts.Name,
+		Labels:      t.opts.Labels,
+		Info:        t.opts.Info,
+		Admission:   t.opts.Admission,
+	})
+	server := t.server
+	t.addr = lst.Addr()
+	t.m.Unlock()
+
+	go func() {
+		err := server.Serve(lst)
+		if err == socket.ErrServerClosed {
+			err = nil
+		}
+		t.stop(err)
+	}()
+
+	return nil
+}
+
+// The address Listen listens on, nil if it doesn't
+func (t *Tunnel) Addr() net.Addr {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.addr
+}
+
+// Connect to the peer listening on addr (host:port). Returns once the
+// handshake is done; the session is then served in the background.
+func (t *Tunnel) Dial(ctx context.Context, addr string) (*Session, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make(chan *Session, 1)
+	client, err := socket.NewClient(host, p, &handler{t: t, sessions: sessions}, socket.ClientOptions{
+		TLS:         t.opts.TLS,
+		Key:         t.opts.Key,
+		Compression: t.opts.Compression,
+		Checksums:   t.opts.Checksums,
+		Heartbeat:   t.opts.Heartbeat,
+		Limits:      t.opts.Limits,
+		Name:        t.opts.Name,
+		Labels:      t.opts.Labels,
+		Info:        t.opts.Info,
+		DialTimeout: t.opts.DialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t.m.Lock()
+	if t.closed {
+		t.m.Unlock()
+		return nil, ErrClosed
+	}
+	t.clients = append(t.clients, client)
+	t.m.Unlock()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.Connect()
+		t.removeClient(client)
+	}()
+
+	select {
+	case sess := <-sessions:
+		return sess, nil
+	case err := <-errc:
+		if err == nil {
+			err = common.ErrClosed
+		}
+		return nil, err
+	case <-ctx.Done():
+		client.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func (t *Tunnel) removeClient(c socket.Client) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for i, have := range t.clients {
+		if have == c {
+			t.clients = append(t.clients[:i], t.clients[i+1:]...)
+			return
+		}
+	}
+}
+
+// Wait for a peer to connect to the listener
+func (t *Tunnel) Accept(ctx context.Context) (*Session, error) {
+	select {
+	case sess := <-t.accept:
+		return sess, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.done:
+		return nil, ErrClosed
+	}
+}
+
+// The sessions that are up, by connection ID
+func (t *Tunnel) Sessions() []*Session {
+	t.m.Lock()
+	res := append([]*Session(nil), t.sessions...)
+	t.m.Unlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].ID() < res[j].ID() })
+	return res
+}
+
+// The session with connection ID id, nil if there's none
+func (t *Tunnel) Session(id int) *Session {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for _, sess := range t.sessions {
+		if sess.ID() == id {
+			return sess
+		}
+	}
+	return nil
+}
+
+// Same as Session, for the API. Returns the zero Connection if there's no
+// such session.
+func (t *Tunnel) GetConnection(id int) common.Connection {
+	if sess := t.Session(id); sess != nil {
+		return sess.conn
+	}
+	return common.Connection{}
+}
+
+func (t *Tunnel) GetConnections() []common.Connection {
+	res := []common.Connection{}
+	for _, sess := range t.Sessions() {
+		res = append(res, sess.conn)
+	}
+	return res
+}
+
+// Close the session with connection ID id, for the API. False if there's no
+// such session.
+func (t *Tunnel) CloseConnection(id int) bool {
+	sess := t.Session(id)
+	if sess == nil {
+		return false
+	}
+	sess.Close()
+	return true
+}
+
+// Same as Session.Tap, for the API
+func (t *Tunnel) Tap(id int, fn func(common.Frame)) (func(), error) {
+	sess := t.Session(id)
+	if sess == nil {
+		return nil, ErrNoSession
+	}
+	return sess.Tap(fn), nil
+}
+
+// Same as Session.SendFrame, for the API
+func (t *Tunnel) SendFrame(id int, f common.Frame) (uint64, error) {
+	sess := t.Session(id)
+	if sess == nil {
+		return 0, ErrNoSession
+	}
+	return sess.SendFrame(f)
+}
+
+// Replace the keys accepted from clients. Sessions that authenticated with a
+// key that is no longer accepted are closed; their IDs are returned.
+func (t *Tunnel) SetKeys(keys []string) []int {
+	t.m.Lock()
+	t.opts.Keys = keys
+	server := t.server
+	t.m.Unlock()
+
+	if server == nil {
+		return []int{}
+	}
+	return server.SetKeys(keys)
+}
+
+// Replace the admission options of the listener. Sessions already up stay.
+func (t *Tunnel) SetAdmission(opts socket.AdmissionOptions) {
+	t.m.Lock()
+	t.opts.Admission = opts
+	server := t.server
+	t.m.Unlock()
+
+	if server != nil {
+		server.SetAdmission(opts)
+	}
+}
+
+// Stop listening and close every session
+func (t *Tunnel) Close() error {
+	t.m.Lock()
+	t.closed = true
+	server := t.server
+	clients := append([]socket.Client(nil), t.clients...)
+	t.m.Unlock()
+
+	if server != nil {
+		server.Close()
+	}
+
+	for _, c := range clients {
+		c.Close()
+	}
+
+	t.stop(nil)
+	return nil
+}
+
+// Closed once the tunnel is closed or its listener failed
+func (t *Tunnel) Done() <-chan struct{} {
+	return t.done
+}
+
+// Block until the tunnel is closed or its listener failed. Returns why the
+// listener failed, nil if the tunnel was closed.
+func (t *Tunnel) Wait() error {
+	<-t.done
+	return t.err
+}
+
+func (t *Tunnel) stop(err error) {
+	t.once.Do(func() {
+		t.err = err
+		close(t.done)
+	})
+}
+
+func (t *Tunnel) add(sess *Session) {
+	t.m.Lock()
+	t.sessions = append(t.sessions, sess)
+	pumping := t.pumping
+	t.m.Unlock()
+
+	if pumping {
+		go t.pump(sess)
+	}
+}
+
+func (t *Tunnel) remove(sess *Session) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for i, have := range t.sessions {
+		if have == sess {
+			t.sessions = append(t.sessions[:i], t.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Turns the connections of the socket server and clients into sessions
+type handler struct {
+	t *Tunnel
+
+	// Where new sessions are announced
+	sessions chan *Session
+}
+
+func (h *handler) OnConnect(p socket.Pipe, c common.Connection, teardown func(int)) {
+	t := h.t
+	sess := newSession(p, c)
+	t.add(sess)
+
+	inner := t.opts.Handler
+	if inner == nil {
+		var fwd socket.ForwarderOptions
+		if t.opts.Forwarder != nil {
+			fwd = *t.opts.Forwarder
+		} else {
+			fwd.NoLAN = true
+		}
+
+		if t.opts.Chain != nil {
+			fwd.Chain = t.opts.Chain
+		}
+
+		if t.opts.NoStreams {
+			close(sess.ready)
+		} else {
+			fwd.Streams = func(_ common.Connection, streams *socket.Streams) {
+				sess.streams = streams
+				close(sess.ready)
+			}
+		}
+
+		inner = socket.NewChannelHandler(fwd)
+	} else {
+		close(sess.ready)
+	}
+
+	select {
+	case h.sessions <- sess:
+	default:
+	}
+
+	inner.OnConnect(p, c, func(id int) {
+		teardown(id)
+		t.remove(sess)
+		sess.stop()
+	})
+}
@@ -0,0 +1,193 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDialAndStreams(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	hub := New(Options{Keys: []string{"secret"}, Name: "hub"})
+	if err := hub.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	defer hub.Close()
+
+	site := New(Options{Key: "secret", Name: "site"})
+	defer site.Close()
+
+	dialed, err := site.Dial(ctx, hub.Addr().String())
+	if err != nil {
+		t.Fatalf("Can't dial: %v", err)
+	}
+
+	accepted, err := hub.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Can't accept: %v", err)
+	}
+
+	if got := accepted.Connection().Peer; got != "site" {
+		t.Errorf("Hub sees peer %q, want %q", got, "site")
+	}
+
+	// The hub echoes one stream back
+	go func() {
+		st, err := accepted.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		defer st.Close()
+		io.Copy(st, st)
+	}()
+
+	st, err := dialed.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("Can't open stream: %v", err)
+	}
+
+	payload := []byte("hello over the tunnel")
+	if _, err := st.Write(payload); err != nil {
+		t.Fatalf("Can't write: %v", err)
+	}
+
+	got := make([]byte, len(payload))
+	st.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(st, got); err != nil {
+		t.Fatalf("Reading the echo failed: %v", err)
+	} else if !bytes.Equal(got, payload) {
+		t.Errorf("Got echo %q, want %q", got, payload)
+	}
+	st.Close()
+
+	// Closing the dialed session ends it on both sides
+	dialed.Close()
+	select {
+	case <-accepted.Done():
+	case <-ctx.Done():
+		t.Fatal("Hub's session didn't end")
+	}
+
+	hub.Close()
+	if err := hub.Wait(); err != nil {
+		t.Errorf("Wait returned %v after Close, want nil", err)
+	}
+	if _, err := hub.Accept(ctx); err != ErrClosed {
+		t.Errorf("Accept returned %v after Close, want %v", err, ErrClosed)
+	}
+}
+
+func TestHTTPOverStreams(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	hub := New(Options{})
+	if err := hub.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	defer hub.Close()
+
+	// The site serves HTTP on the streams the hub opens, with no TCP
+	// listener of its own
+	site := New(Options{Name: "site1"})
+	defer site.Close()
+
+	sess, err := site.Dial(ctx, hub.Addr().String())
+	if err != nil {
+		t.Fatalf("Can't dial: %v", err)
+	}
+
+	lst := sess.Listener()
+	defer lst.Close()
+
+	go http.Serve(lst, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from " + r.URL.Path))
+	}))
+
+	if _, err := hub.Accept(ctx); err != nil {
+		t.Fatalf("Can't accept: %v", err)
+	}
+
+	client := &http.Client{Transport: &http.Transport{DialContext: hub.DialContext}}
+	res, err := client.Get("http://site1/status")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if string(body) != "hello from /status" {
+		t.Errorf("Got %q", body)
+	}
+
+	if _, err := client.Get("http://nobody/"); err == nil {
+		t.Error("Request to an unknown peer succeeded")
+	}
+
+	lst.Close()
+	if _, err := lst.Accept(); err != ErrListenerClosed {
+		t.Errorf("Accept returned %v after Close, want %v", err, ErrListenerClosed)
+	}
+}
+
+func TestHeartbeats(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	hub := New(Options{Heartbeat: 50 * time.Millisecond})
+	if err := hub.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	defer hub.Close()
+
+	site := New(Options{Heartbeat: 20 * time.Millisecond})
+	defer site.Close()
+
+	dialed, err := site.Dial(ctx, hub.Addr().String())
+	if err != nil {
+		t.Fatalf("Can't dial: %v", err)
+	}
+
+	accepted, err := hub.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Can't accept: %v", err)
+	}
+
+	// The shorter interval wins
+	for _, sess := range []*Session{dialed, accepted} {
+		if got := sess.Heartbeat(); got != 20*time.Millisecond {
+			t.Errorf("Heartbeat is %v, want 20ms", got)
+		}
+	}
+
+	start := time.Now()
+	time.Sleep(100 * time.Millisecond)
+
+	for _, sess := range []*Session{dialed, accepted} {
+		stats := sess.Connection().Stats()
+		if !stats.LastHeard.After(start) {
+			t.Errorf("Connection %d heard nothing since %v", sess.ID(), start)
+		}
+		if stats.MessagesIn != 0 {
+			t.Errorf("Heartbeats counted as %d messages", stats.MessagesIn)
+		}
+	}
+
+	// Either end turning them off turns them off
+	quiet := New(Options{})
+	defer quiet.Close()
+
+	sess, err := quiet.Dial(ctx, hub.Addr().String())
+	if err != nil {
+		t.Fatalf("Can't dial: %v", err)
+	}
+	if got := sess.Heartbeat(); got != 0 {
+		t.Errorf("Heartbeat is %v without heartbeats on one end, want 0", got)
+	}
+}